@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestBasicAuthFlag(t *testing.T) {
+	t.Setenv("TUNNELR_BASIC_AUTH", "")
+	_, opts, err := parseConnectArgs([]string{"3000", "--basic-auth", "alice:pa:ss"})
+	if err != nil || opts.basicAuth != "alice:pa:ss" {
+		t.Errorf("got %q, %v", opts.basicAuth, err)
+	}
+
+	t.Setenv("TUNNELR_BASIC_AUTH", "bob:from-env")
+	if _, opts, _ := parseConnectArgs([]string{"3000"}); opts.basicAuth != "bob:from-env" {
+		t.Errorf("TUNNELR_BASIC_AUTH: got %q", opts.basicAuth)
+	}
+
+	// A bad value is refused without echoing the password
+	_, _, err = parseConnectArgs([]string{"3000", "--basic-auth", ":hunter2"})
+	if err == nil {
+		t.Fatal("accepted credentials without a user")
+	}
+	if strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("error %q shows the password", err)
+	}
+}
+
+func TestBasicAuthNeedsServerSupport(t *testing.T) {
+	// An older server: it assigns the tunnel without agreeing to basic_auth,
+	// so it would leave the app open
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+		reply, _ := tunnel.Encode(tunnel.TypeTunnelAssigned, tunnel.TunnelAssigned{
+			TunnelID:        "old516",
+			Capabilities:    []string{tunnel.CapStreaming},
+			ProtocolVersion: tunnel.ProtocolVersion,
+		})
+		conn.WriteMessage(websocket.TextMessage, reply)
+		conn.ReadMessage()
+	}))
+	defer srv.Close()
+
+	_, _, err := connectTunnel(context.Background(), websocket.DefaultDialer,
+		"ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", tunnel.TunnelRegister{LocalPort: 3000, BasicAuth: "alice:secret"})
+	var connErr *connectError
+	if !errors.As(err, &connErr) || !connErr.permanent {
+		t.Fatalf("got %v, want a permanent connectError", err)
+	}
+	if !strings.Contains(connErr.msg, "--basic-auth") {
+		t.Errorf("error %q doesn't say why", connErr.msg)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestImageResponseInBinaryFrame(t *testing.T) {
+	img := make([]byte, 200<<10)
+	rand.Read(img)
+	copy(img, "\x89PNG\r\n\x1a\n")
+	addr := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(img)
+	})
+	caps := []string{tunnel.CapBinary, tunnel.CapGzip}
+	_, server := startSession(t, []string{addr}, caps)
+	sendMessage(t, server, tunnel.NewCodec(caps), tunnel.TypeHTTPRequest, tunnel.HTTPRequest{ID: "img", Method: http.MethodGet, Path: "/logo.png"})
+
+	server.SetReadDeadline(time.Now().Add(10 * time.Second))
+	frameType, data, err := server.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frameType != websocket.BinaryMessage {
+		t.Errorf("response sent as WebSocket message type %d, want binary", frameType)
+	}
+	if overhead := len(data) - len(img); overhead < 0 || overhead > 1024 {
+		t.Errorf("%d bytes on the wire for a %d byte image, want no base64", len(data), len(img))
+	}
+
+	msg, err := tunnel.DecodeMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.Decompress(); err != nil {
+		t.Fatal(err)
+	}
+	var resp tunnel.HTTPResponse
+	if err := msg.Unmarshal(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Headers.Get("Content-Type") != "image/png" {
+		t.Errorf("got %d %s", resp.StatusCode, resp.Headers.Get("Content-Type"))
+	}
+	if !bytes.Equal(resp.Body, img) {
+		t.Errorf("image changed on the way: %d bytes back, want %d identical", len(resp.Body), len(img))
+	}
+}
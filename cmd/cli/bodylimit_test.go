@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	valid := map[string]int64{
+		"":       0,
+		"0":      0,
+		"1500":   1500,
+		"64B":    64,
+		"500KB":  500 << 10,
+		"500 kb": 500 << 10,
+		"100MB":  100 << 20,
+		"1.5MB":  3 << 19,
+		"2GB":    2 << 30,
+		" 10MB ": 10 << 20,
+	}
+	for text, want := range valid {
+		if got, err := parseSize(text); err != nil || got != want {
+			t.Errorf("parseSize(%q) = %d, %v; want %d", text, got, err, want)
+		}
+	}
+	for _, text := range []string{"big", "-5MB", "10TB", "MB", "1,000"} {
+		if _, err := parseSize(text); err == nil {
+			t.Errorf("parseSize(%q) accepted", text)
+		}
+	}
+}
+
+func TestMaxBodySizeFlag(t *testing.T) {
+	t.Setenv("TUNNELR_MAX_BODY_SIZE", "")
+	_, opts, err := parseConnectArgs([]string{"3000", "--max-body-size", "100MB"})
+	if err != nil || opts.maxBodySize != "100MB" {
+		t.Errorf("got %q, %v", opts.maxBodySize, err)
+	}
+	if _, _, err := parseConnectArgs([]string{"3000", "--max-body-size", "lots"}); err == nil {
+		t.Error("accepted an invalid --max-body-size")
+	}
+
+	t.Setenv("TUNNELR_MAX_BODY_SIZE", "64KB")
+	if _, opts, _ := parseConnectArgs([]string{"3000"}); opts.maxBodySize != "64KB" {
+		t.Errorf("TUNNELR_MAX_BODY_SIZE ignored: %q", opts.maxBodySize)
+	}
+}
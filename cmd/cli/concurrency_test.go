@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestConcurrentRequestsFromOneSession(t *testing.T) {
+	addr := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "answer for %s", r.URL.Path)
+	})
+	_, server := startSession(t, []string{addr}, nil)
+
+	// 100 requests in flight at once, each answered by its own goroutine
+	// writing to the shared connection
+	const requests = 100
+	for i := 0; i < requests; i++ {
+		sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{
+			ID: fmt.Sprintf("req-%d", i), Method: http.MethodGet, Path: fmt.Sprintf("/%d", i), Headers: http.Header{},
+		})
+	}
+
+	seen := make(map[string]bool)
+	for len(seen) < requests {
+		resp := readResponse(t, server)
+		var i int
+		if _, err := fmt.Sscanf(resp.ID, "req-%d", &i); err != nil {
+			t.Fatalf("response with unknown ID %q", resp.ID)
+		}
+		if want := fmt.Sprintf("answer for /%d", i); resp.StatusCode != http.StatusOK || string(resp.Body) != want {
+			t.Errorf("%s: got %d %q, want %q", resp.ID, resp.StatusCode, resp.Body, want)
+		}
+		if seen[resp.ID] {
+			t.Errorf("%s answered twice", resp.ID)
+		}
+		seen[resp.ID] = true
+	}
+}
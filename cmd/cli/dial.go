@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// How the CLI reaches the server
+//
+// TUNNELR_HANDSHAKE_TIMEOUT (or --handshake-timeout) bounds the whole
+// connect + TLS + WebSocket upgrade, so an unreachable server fails fast.
+// Proxies come from HTTPS_PROXY / HTTP_PROXY as usual, or TUNNELR_PROXY to use
+// a specific one. TUNNELR_CA_CERT adds a CA (PEM file) for servers with a
+// private or self-signed certificate.
+
+// defaultHandshakeTimeout is used when neither the flag nor the env var is set
+var defaultHandshakeTimeout = getEnvDuration("TUNNELR_HANDSHAKE_TIMEOUT", 15*time.Second)
+
+// newDialer builds the WebSocket dialer for the tunnel server
+func newDialer(handshakeTimeout time.Duration) (*websocket.Dialer, error) {
+	// Start from the default so we keep its proxy-from-environment behavior
+	dialer := *websocket.DefaultDialer
+	dialer.HandshakeTimeout = handshakeTimeout
+	dialer.EnableCompression = wsCompression.Enabled
+
+	if proxy := getEnv("TUNNELR_PROXY", ""); proxy != "" {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TUNNELR_PROXY: %v", err)
+		}
+		dialer.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	dialer.TLSClientConfig = tlsConfig
+
+	return &dialer, nil
+}
+
+// httpClientFor returns an HTTP client that reaches the server the same way
+// the dialer does (proxy, TLS, timeout)
+func httpClientFor(dialer *websocket.Dialer) *http.Client {
+	return &http.Client{
+		Timeout: dialer.HandshakeTimeout,
+		Transport: &http.Transport{
+			Proxy:           dialer.Proxy,
+			TLSClientConfig: dialer.TLSClientConfig,
+		},
+	}
+}
+
+// loadTLSConfig trusts TUNNELR_CA_CERT on top of the system CAs
+// Returns nil (Go's defaults) when it isn't set
+func loadTLSConfig() (*tls.Config, error) {
+	caFile := getEnv("TUNNELR_CA_CERT", "")
+	if caFile == "" {
+		return nil, nil
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading TUNNELR_CA_CERT: %v", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("TUNNELR_CA_CERT %s contains no PEM certificates", caFile)
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
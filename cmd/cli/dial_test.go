@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestHandshakeTimeoutIsHonored(t *testing.T) {
+	// Accepts connections and never says anything
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	dialer, err := newDialer(300 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, _, err = connectTunnel(context.Background(), dialer, "ws://"+ln.Addr().String()+"/ws", tunnel.TunnelRegister{LocalPort: 3000})
+	took := time.Since(start)
+
+	if err == nil {
+		t.Fatal("connected to a server that never answers")
+	}
+	if took < 300*time.Millisecond || took > 2*time.Second {
+		t.Errorf("gave up after %s with a 300ms handshake timeout", took)
+	}
+}
+
+func TestHandshakeTimeoutFlag(t *testing.T) {
+	_, opts, err := parseConnectArgs([]string{"3000", "--handshake-timeout", "2s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.handshakeTimeout != 2*time.Second {
+		t.Errorf("handshakeTimeout = %s, want 2s", opts.handshakeTimeout)
+	}
+}
+
+func TestDialerProxy(t *testing.T) {
+	t.Setenv("TUNNELR_PROXY", "http://proxy.internal:3128")
+	dialer, err := newDialer(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://tunnel.example.com/ws", nil)
+	proxyURL, err := dialer.Proxy(req)
+	if err != nil || proxyURL == nil || proxyURL.Host != "proxy.internal:3128" {
+		t.Errorf("proxy = %v, %v; want proxy.internal:3128", proxyURL, err)
+	}
+
+	t.Setenv("TUNNELR_PROXY", "://nope")
+	if _, err := newDialer(time.Second); err == nil || !strings.Contains(err.Error(), "TUNNELR_PROXY") {
+		t.Errorf("invalid proxy: got %v", err)
+	}
+}
+
+func TestDialerTrustsCACert(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer srv.Close()
+	wsURL := "wss" + strings.TrimPrefix(srv.URL, "https")
+
+	// A self-signed server isn't trusted out of the box
+	t.Setenv("TUNNELR_CA_CERT", "")
+	dialer, err := newDialer(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn, _, err := dialer.Dial(wsURL, nil); err == nil {
+		conn.Close()
+		t.Error("connected to an untrusted certificate")
+	}
+
+	// It is with its certificate in TUNNELR_CA_CERT
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TUNNELR_CA_CERT", caFile)
+	dialer, err = newDialer(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, _, err := dialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("with TUNNELR_CA_CERT: %v", err)
+	}
+	conn.Close()
+
+	// A file without certificates is an error, not silently ignored
+	os.WriteFile(caFile, []byte("not a certificate"), 0o600)
+	if _, err := newDialer(time.Second); err == nil {
+		t.Error("accepted a CA file without certificates")
+	}
+}
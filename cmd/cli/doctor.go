@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// `tunnelr doctor` runs every check we'd otherwise ask for in a bug report:
+// can we reach the server, does it accept our token, is the local server up,
+// does the public URL resolve, and is our clock right. Like ping it opens no
+// tunnel, it just prints one OK/FAIL/SKIP line per check.
+
+// maxClockSkew is how far our clock may be from the server's before doctor
+// complains - beyond this, certificates and signed tokens start failing
+const maxClockSkew = 30 * time.Second
+
+// doctorLabel is the subdomain looked up when --subdomain isn't given
+const doctorLabel = "doctor-check"
+
+// doctorOptions are the arguments of `tunnelr doctor`
+type doctorOptions struct {
+	serverURL string
+	token     string // Empty = skip the auth check
+	target    string // Local target as given to connect, empty = skip that check
+	subdomain string // Subdomain whose public URL should resolve, empty = doctorLabel
+}
+
+func runDoctor(args []string) {
+	opts, err := parseDoctorArgs(args)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		fmt.Println("Usage: tunnelr doctor [[host:]<port>] [--token token] [--subdomain name]")
+		os.Exit(1)
+	}
+	opts.serverURL = getEnv("TUNNELR_SERVER", "ws://localhost:8080/ws")
+	if !doctor(os.Stdout, opts) {
+		os.Exit(1)
+	}
+}
+
+// parseDoctorArgs reads doctor's flags and optional target
+func parseDoctorArgs(args []string) (doctorOptions, error) {
+	var opts doctorOptions
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	fs.StringVar(&opts.token, "token", getEnv("TUNNELR_TOKEN", ""), "auth token to check")
+	fs.StringVar(&opts.subdomain, "subdomain", "", "subdomain whose public URL should resolve")
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+	// The target may come before or after the flags, like with connect
+	if fs.NArg() > 0 {
+		opts.target = fs.Arg(0)
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return opts, err
+		}
+		if fs.NArg() > 0 {
+			return opts, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+		}
+	}
+	return opts, nil
+}
+
+// doctor runs every check against opts.serverURL, printing one line per
+// check to out
+// Returns whether they all passed (skipped ones don't count).
+func doctor(out io.Writer, opts doctorOptions) bool {
+	serverURL := opts.serverURL
+	fmt.Fprintf(out, "Checking %s\n\n", serverURL)
+
+	ok := true
+	fail := func(name, format string, a ...interface{}) {
+		fmt.Fprintf(out, "  %-13s FAIL (%s)\n", name+":", fmt.Sprintf(format, a...))
+		ok = false
+	}
+	pass := func(name, format string, a ...interface{}) {
+		fmt.Fprintf(out, "  %-13s OK (%s)\n", name+":", fmt.Sprintf(format, a...))
+	}
+	skip := func(name, why string) {
+		fmt.Fprintf(out, "  %-13s SKIP (%s)\n", name+":", why)
+	}
+
+	dialer, err := newDialer(defaultHandshakeTimeout)
+	if err != nil {
+		fail("Settings", "%v", err)
+		return false
+	}
+	healthURL, err := healthURLFor(serverURL)
+	if err != nil {
+		fail("Server URL", "%v", err)
+		return false
+	}
+	client := httpClientFor(dialer)
+
+	// 1. Server reachability, and its clock from the Date header
+	reachable := false
+	var serverDate, midpoint time.Time
+	var skewErr error
+	start := time.Now()
+	resp, err := client.Get(healthURL)
+	if err != nil {
+		fail("Health", "%v", err)
+	} else {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		took := time.Since(start)
+		if resp.StatusCode == http.StatusOK {
+			pass("Health", "%s", took.Round(time.Millisecond))
+			reachable = true
+		} else {
+			fail("Health", "HTTP %d", resp.StatusCode)
+		}
+		// The server stamped the header somewhere during the round trip,
+		// so compare it with the middle of it. The header drops the
+		// fraction of a second, half a second is the best guess for it.
+		serverDate, skewErr = http.ParseTime(resp.Header.Get("Date"))
+		serverDate = serverDate.Add(500 * time.Millisecond)
+		midpoint = start.Add(took / 2)
+	}
+
+	// 2. WebSocket handshake - this is what `connect` needs
+	wsStart := time.Now()
+	conn, resp, err := dialer.Dial(serverURL, nil)
+	if err != nil {
+		fail("WebSocket", "%s", describeDialError(err, resp))
+	} else {
+		pass("WebSocket", "%s", time.Since(wsStart).Round(time.Millisecond))
+		conn.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, "doctor"))
+		conn.Close()
+	}
+
+	// 3. Auth - the token is only checked when a tunnel opens, but the
+	// tunnel list endpoint accepts exactly the same tokens
+	switch {
+	case opts.token == "":
+		skip("Auth", "no token, pass --token or set TUNNELR_TOKEN")
+	case !reachable:
+		skip("Auth", "server not reachable")
+	default:
+		if _, _, err := fetchOwnTunnels(serverURL, opts.token); err != nil {
+			fail("Auth", "%v", err)
+		} else {
+			pass("Auth", "token accepted")
+		}
+	}
+
+	// 4. Local target
+	if opts.target == "" {
+		skip("Local", "no target, e.g. tunnelr doctor 3000")
+	} else if addrs, err := parseTargets(opts.target); err != nil {
+		fail("Local", "%v", err)
+	} else {
+		for _, addr := range addrs {
+			checkLocalTarget(addr, pass, fail)
+		}
+	}
+
+	// 5. DNS of the public URL the server would hand out
+	if !reachable {
+		skip("DNS", "server not reachable")
+	} else {
+		checkPublicDNS(client, serverURL, opts.subdomain, pass, fail, skip)
+	}
+
+	// 6. Clock skew
+	switch {
+	case serverDate.IsZero() && skewErr == nil:
+		skip("Clock", "server not reachable")
+	case skewErr != nil:
+		skip("Clock", "server sent no Date header")
+	default:
+		skew := midpoint.Sub(serverDate).Round(time.Second)
+		if skew.Abs() > maxClockSkew {
+			fail("Clock", "%s off from the server, fix this machine's time", skew)
+		} else {
+			pass("Clock", "%s off from the server", skew)
+		}
+	}
+
+	fmt.Fprintln(out, "")
+	if !ok {
+		fmt.Fprintln(out, "Some checks failed")
+		return false
+	}
+	fmt.Fprintln(out, "All checks passed")
+	return true
+}
+
+// checkLocalTarget opens (and closes) a TCP connection to the local server
+func checkLocalTarget(addr string, pass, fail func(name, format string, a ...interface{})) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		fail("Local", "%s: %v", addr, err)
+		return
+	}
+	conn.Close()
+	pass("Local", "%s in %s", addr, time.Since(start).Round(time.Millisecond))
+}
+
+// checkPublicDNS asks the server how it builds public URLs (GET /status) and
+// resolves the host a tunnel's URL would have
+func checkPublicDNS(client *http.Client, serverURL, subdomain string,
+	pass, fail func(name, format string, a ...interface{}), skip func(name, why string)) {
+	statusURL, err := serverHTTPURL(serverURL, "/status")
+	if err != nil {
+		fail("DNS", "%v", err)
+		return
+	}
+	resp, err := client.Get(statusURL)
+	if err != nil {
+		fail("DNS", "couldn't get the server's domain: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var status struct {
+		BaseDomain  string `json:"base_domain"`
+		RoutingMode string `json:"routing_mode"`
+	}
+	// Older servers, or something else answering on that URL, won't say
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(&status); err != nil || status.BaseDomain == "" {
+		skip("DNS", "the server doesn't say which domain it uses")
+		return
+	}
+
+	host := status.BaseDomain
+	if status.RoutingMode != "path" {
+		label := subdomain
+		if label == "" {
+			label = doctorLabel
+		}
+		host = label + "." + host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		if status.RoutingMode != "path" {
+			fail("DNS", "%s doesn't resolve, the server needs a wildcard record *.%s", host, status.BaseDomain)
+		} else {
+			fail("DNS", "%s doesn't resolve", host)
+		}
+		return
+	}
+	pass("DNS", "%s -> %s", host, strings.Join(addrs, ", "))
+}
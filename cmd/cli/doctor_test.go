@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunnelr/internal/tunnel"
+)
+
+// doctorStub is a tunnel server for doctor to check
+type doctorStub struct {
+	healthStatus int
+	clockSkew    time.Duration // How far the server's clock is ahead of ours
+	token        string        // The one token /api/tunnels accepts
+	baseDomain   string        // What /status says, empty = no /status
+	routingMode  string
+}
+
+// start serves the stub and returns its WebSocket URL
+func (d doctorStub) start(t *testing.T) string {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(d.clockSkew).UTC().Format(http.TimeFormat))
+		w.WriteHeader(d.healthStatus)
+	})
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.ReadMessage() // Until doctor hangs up
+	})
+	mux.HandleFunc("/api/tunnels", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+d.token {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(tunnel.OwnTunnels{})
+	})
+	if d.baseDomain != "" {
+		mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(map[string]string{"base_domain": d.baseDomain, "routing_mode": d.routingMode})
+		})
+	}
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+}
+
+// runDoctorChecks runs doctor and returns its result and output
+func runDoctorChecks(t *testing.T, opts doctorOptions) (bool, string) {
+	t.Helper()
+	var out strings.Builder
+	ok := doctor(&out, opts)
+	return ok, out.String()
+}
+
+// healthy is a stub where every check can pass
+var healthy = doctorStub{healthStatus: http.StatusOK, token: "good-token", baseDomain: "localhost", routingMode: "path"}
+
+func TestDoctorAllChecksPass(t *testing.T) {
+	local := localServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	ok, out := runDoctorChecks(t, doctorOptions{serverURL: healthy.start(t), token: "good-token", target: local})
+	if !ok {
+		t.Fatalf("doctor failed:\n%s", out)
+	}
+	for _, want := range []string{
+		"Health:       OK",
+		"WebSocket:    OK",
+		"Auth:         OK (token accepted)",
+		"Local:        OK (" + local,
+		"DNS:          OK (localhost -> ",
+		"Clock:        OK",
+		"All checks passed",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output is missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestDoctorChecksFail(t *testing.T) {
+	local := localServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name string
+		stub doctorStub
+		opts doctorOptions
+		want string
+	}{
+		{"unhealthy server", doctorStub{healthStatus: http.StatusServiceUnavailable, token: "good-token"},
+			doctorOptions{token: "good-token"}, "Health:       FAIL (HTTP 503)"},
+		{"wrong token", healthy, doctorOptions{token: "bad-token"},
+			"Auth:         FAIL (the server doesn't accept this token)"},
+		{"local server down", healthy, doctorOptions{target: closedPort(t)},
+			"Local:        FAIL ("},
+		{"one of several targets down", healthy, doctorOptions{target: local + "," + closedPort(t)},
+			"Local:        FAIL ("},
+		{"invalid target", healthy, doctorOptions{target: "not-a-port"},
+			"Local:        FAIL ("},
+		{"no wildcard DNS", doctorStub{healthStatus: http.StatusOK, baseDomain: "tunnelr-test.invalid", routingMode: "subdomain"},
+			doctorOptions{subdomain: "myapp"}, "DNS:          FAIL (myapp.tunnelr-test.invalid doesn't resolve, the server needs a wildcard record *.tunnelr-test.invalid)"},
+		{"no DNS for the domain", doctorStub{healthStatus: http.StatusOK, baseDomain: "tunnelr-test.invalid", routingMode: "path"},
+			doctorOptions{}, "DNS:          FAIL (tunnelr-test.invalid doesn't resolve)"},
+		{"clock behind", doctorStub{healthStatus: http.StatusOK, clockSkew: 5 * time.Minute},
+			doctorOptions{}, "Clock:        FAIL (-5m0s off from the server"},
+		{"clock ahead", doctorStub{healthStatus: http.StatusOK, clockSkew: -2 * time.Minute},
+			doctorOptions{}, "Clock:        FAIL (2m0s off from the server"},
+	}
+	for _, tc := range tests {
+		tc.opts.serverURL = tc.stub.start(t)
+		ok, out := runDoctorChecks(t, tc.opts)
+		if ok {
+			t.Errorf("%s: doctor passed:\n%s", tc.name, out)
+		}
+		if !strings.Contains(out, tc.want) || !strings.Contains(out, "Some checks failed") {
+			t.Errorf("%s: output is missing %q:\n%s", tc.name, tc.want, out)
+		}
+	}
+}
+
+func TestDoctorSkipsWhatItCantCheck(t *testing.T) {
+	// No token, no target, and a server that doesn't say its domain
+	stub := doctorStub{healthStatus: http.StatusOK}
+	ok, out := runDoctorChecks(t, doctorOptions{serverURL: stub.start(t)})
+	if !ok {
+		t.Errorf("skipped checks made doctor fail:\n%s", out)
+	}
+	for _, want := range []string{"Auth:         SKIP (no token", "Local:        SKIP (no target", "DNS:          SKIP (the server doesn't say"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output is missing %q:\n%s", want, out)
+		}
+	}
+
+	// Nothing past the health check can run without a server
+	ok, out = runDoctorChecks(t, doctorOptions{serverURL: "ws://" + closedPort(t) + "/ws", token: "good-token"})
+	if ok {
+		t.Errorf("doctor passed without a server:\n%s", out)
+	}
+	for _, want := range []string{"Health:       FAIL", "WebSocket:    FAIL", "Auth:         SKIP (server not reachable)", "DNS:          SKIP (server not reachable)", "Clock:        SKIP (server not reachable)"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output is missing %q:\n%s", want, out)
+		}
+	}
+
+	// A URL connect couldn't use either
+	if ok, out := runDoctorChecks(t, doctorOptions{serverURL: "http://example.com/ws"}); ok || !strings.Contains(out, "Server URL:   FAIL") {
+		t.Errorf("got %v:\n%s", ok, out)
+	}
+}
+
+func TestParseDoctorArgs(t *testing.T) {
+	t.Setenv("TUNNELR_TOKEN", "from-env")
+	tests := []struct {
+		args []string
+		want doctorOptions
+	}{
+		{nil, doctorOptions{token: "from-env"}},
+		{[]string{"3000"}, doctorOptions{token: "from-env", target: "3000"}},
+		{[]string{"3000", "--token", "t", "--subdomain", "myapp"}, doctorOptions{token: "t", target: "3000", subdomain: "myapp"}},
+		{[]string{"--subdomain=myapp", "localhost:8080"}, doctorOptions{token: "from-env", target: "localhost:8080", subdomain: "myapp"}},
+	}
+	for _, tc := range tests {
+		got, err := parseDoctorArgs(tc.args)
+		if err != nil || got != tc.want {
+			t.Errorf("%v: got %+v, %v; want %+v", tc.args, got, err, tc.want)
+		}
+	}
+	if _, err := parseDoctorArgs([]string{"3000", "4000"}); err == nil {
+		t.Error("accepted two targets")
+	}
+}
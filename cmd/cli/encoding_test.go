@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+// gzipped returns n bytes of random (incompressible) data, gzipped
+func gzipped(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	rand.New(rand.NewSource(542)).Read(data)
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// readStreamedBody collects a streamed response body up to its EOF chunk
+func readStreamedBody(t *testing.T, conn *tunnel.SafeConn, requestID string) []byte {
+	t.Helper()
+	var body []byte
+	for {
+		msg := readMessage(t, conn, 10*time.Second)
+		if msg.Type != tunnel.TypeBodyChunk {
+			continue
+		}
+		var chunk tunnel.BodyChunk
+		if err := msg.Unmarshal(&chunk); err != nil {
+			t.Fatal(err)
+		}
+		if chunk.ID != requestID {
+			continue
+		}
+		if chunk.Error != "" {
+			t.Fatalf("body ended with an error: %s", chunk.Error)
+		}
+		body = append(body, chunk.Data...)
+		if chunk.EOF {
+			return body
+		}
+	}
+}
+
+func TestCompressedResponsesPassThroughUntouched(t *testing.T) {
+	small := gzipped(t, 500)
+	large := gzipped(t, 8*1024)
+	old := streamThreshold
+	streamThreshold = 4 * 1024 // So the large one is streamed
+	t.Cleanup(func() { streamThreshold = old })
+
+	addr := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		body := small
+		if r.URL.Path == "/large" {
+			body = large
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body)
+	})
+	_, server := startSession(t, []string{addr}, []string{tunnel.CapStreaming})
+
+	tests := []struct {
+		path     string
+		want     []byte
+		streamed bool
+	}{
+		{"/small", small, false},
+		{"/large", large, true},
+	}
+	for _, tc := range tests {
+		// Whether or not the visitor said it takes gzip, it gets what the
+		// local server sent
+		for _, accept := range []string{"gzip", ""} {
+			headers := http.Header{}
+			if accept != "" {
+				headers.Set("Accept-Encoding", accept)
+			}
+			id := tc.path + "-" + accept
+			sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{
+				ID: id, Method: http.MethodGet, Path: tc.path, Headers: headers,
+			})
+			resp := readResponse(t, server)
+			if resp.Streamed != tc.streamed {
+				t.Fatalf("%s: streamed %v, want %v", id, resp.Streamed, tc.streamed)
+			}
+			body := resp.Body
+			if resp.Streamed {
+				body = readStreamedBody(t, server, id)
+			}
+
+			if !bytes.Equal(body, tc.want) {
+				t.Errorf("%s: got %d bytes, want the local server's %d untouched", id, len(body), len(tc.want))
+			}
+			if got := resp.Headers.Values("Content-Encoding"); len(got) != 1 || got[0] != "gzip" {
+				t.Errorf("%s: Content-Encoding %q, want gzip", id, got)
+			}
+			if got := resp.Headers.Get("Content-Length"); got != strconv.Itoa(len(tc.want)) {
+				t.Errorf("%s: Content-Length %q, want %d", id, got, len(tc.want))
+			}
+		}
+	}
+}
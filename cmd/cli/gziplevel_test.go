@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestGzipLevelFlag(t *testing.T) {
+	t.Setenv("TUNNELR_GZIP_LEVEL", "")
+	tests := []struct {
+		args []string
+		want int
+	}{
+		{[]string{"3000"}, 0},
+		{[]string{"3000", "--gzip-level", "1"}, 1},
+		{[]string{"3000", "--gzip-level=9"}, 9},
+	}
+	for _, tc := range tests {
+		_, opts, err := parseConnectArgs(tc.args)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.args, err)
+		}
+		if opts.gzipLevel != tc.want {
+			t.Errorf("%v: level %d, want %d", tc.args, opts.gzipLevel, tc.want)
+		}
+	}
+
+	for _, level := range []string{"-1", "10", "42"} {
+		if _, _, err := parseConnectArgs([]string{"3000", "--gzip-level", level}); err == nil {
+			t.Errorf("--gzip-level %s was accepted", level)
+		}
+	}
+	t.Setenv("TUNNELR_GZIP_LEVEL", "6")
+	if _, opts, _ := parseConnectArgs([]string{"3000"}); opts.gzipLevel != 6 {
+		t.Errorf("TUNNELR_GZIP_LEVEL ignored: %d", opts.gzipLevel)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunnelr/internal/tunnel"
+)
+
+// A stand-in for the tunnel server: a CLI session runs against one end of a
+// real WebSocket, the test drives the other end.
+
+// startSession connects a session forwarding to targets, as if the server
+// had agreed to caps
+// Returns the session and the server's end of the connection.
+func startSession(t *testing.T, targets []string, caps []string) (*session, *tunnel.SafeConn) {
+	t.Helper()
+	return startSessionWith(t, targets, caps, nil)
+}
+
+// startSessionWith is startSession with setup run on the session before it
+// reads any requests (setup may be nil)
+func startSessionWith(t *testing.T, targets []string, caps []string, setup func(s *session)) (*session, *tunnel.SafeConn) {
+	t.Helper()
+	serverEnd := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		serverEnd <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	cliConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := tunnel.NewSafeConn(<-serverEnd, tunnel.CompressionConfig{})
+	t.Cleanup(func() { server.Close() })
+
+	s := newSession(tunnel.NewSafeConn(cliConn, tunnel.CompressionConfig{}), newLocalTargets(targets), caps)
+	if setup != nil {
+		setup(s)
+	}
+	go s.handleIncomingRequests()
+	return s, server
+}
+
+// sendMessage writes one protocol message from the server's end
+func sendMessage(t *testing.T, conn *tunnel.SafeConn, codec tunnel.Codec, msgType tunnel.MessageType, payload interface{}) {
+	t.Helper()
+	msgBytes, err := codec.Encode(msgType, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Send(msgBytes); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readMessage reads the next message the CLI sent, failing after timeout
+func readMessage(t *testing.T, conn *tunnel.SafeConn, timeout time.Duration) tunnel.Message {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("reading from the CLI: %v", err)
+	}
+	msg, err := tunnel.DecodeMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.Decompress(); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// readResponse skips to the CLI's answer to a request
+func readResponse(t *testing.T, conn *tunnel.SafeConn) *tunnel.HTTPResponse {
+	t.Helper()
+	for {
+		msg := readMessage(t, conn, 10*time.Second)
+		if msg.Type != tunnel.TypeHTTPResponse {
+			continue
+		}
+		var resp tunnel.HTTPResponse
+		if err := msg.Unmarshal(&resp); err != nil {
+			t.Fatal(err)
+		}
+		tunnel.RestoreRawHeaders(resp.Headers, resp.RawHeaders)
+		return &resp
+	}
+}
+
+// localServer runs handler as the local server and returns its address
+func localServer(t *testing.T, handler http.HandlerFunc) string {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+// closedPort returns a local address nothing listens on
+func closedPort(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
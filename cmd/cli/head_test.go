@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestHeadKeepsTheLocalContentLength(t *testing.T) {
+	page := strings.Repeat("x", 1234)
+	addr := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1234")
+		w.Write([]byte(page)) // Dropped by net/http for HEAD
+	})
+	_, server := startSession(t, []string{addr}, nil)
+
+	sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{ID: "head", Method: http.MethodHead, Path: "/"})
+	resp := readResponse(t, server)
+	if resp.StatusCode != http.StatusOK || len(resp.Body) != 0 {
+		t.Errorf("got %d with a %d-byte body, want 200 and no body", resp.StatusCode, len(resp.Body))
+	}
+	if got := resp.Headers.Get("Content-Length"); got != "1234" {
+		t.Errorf("Content-Length = %q, want the GET's 1234", got)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestLocalSetCookieValuesAreKept(t *testing.T) {
+	addr := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc123", Path: "/"})
+		http.SetCookie(w, &http.Cookie{Name: "theme", Value: "dark", Path: "/"})
+
+		// The request's repeated headers arrive as separate values too
+		w.Header().Set("X-Seen-Accept", r.Header.Values("Accept")[0]+" | "+r.Header.Values("Accept")[1])
+	})
+	_, server := startSession(t, []string{addr}, nil)
+
+	sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{
+		ID: "cookies-1", Method: http.MethodGet, Path: "/",
+		Headers: http.Header{"Accept": {"text/html", "application/json"}},
+	})
+	resp := readResponse(t, server)
+
+	got := resp.Headers.Values("Set-Cookie")
+	if len(got) != 2 || got[0] != "session=abc123; Path=/" || got[1] != "theme=dark; Path=/" {
+		t.Errorf("Set-Cookie = %q, want both cookies", got)
+	}
+	if seen := resp.Headers.Get("X-Seen-Accept"); seen != "text/html | application/json" {
+		t.Errorf("local server saw Accept %q", seen)
+	}
+}
+
+func TestOversizedLocalHeadersGetA502(t *testing.T) {
+	addr := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		// Many headers adding up to well over the 64 KB limit
+		size := 1000
+		if r.URL.Path == "/huge" {
+			size = 100 * 1024
+		}
+		for i := 0; i*100 < size; i++ {
+			w.Header().Set(fmt.Sprintf("X-Filler-%d", i), strings.Repeat("x", 90))
+		}
+		w.Write([]byte("body"))
+	})
+	_, server := startSession(t, []string{addr}, nil)
+
+	sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{ID: "huge-1", Method: http.MethodGet, Path: "/huge"})
+	resp := readResponse(t, server)
+	if resp.StatusCode != http.StatusBadGateway || !strings.Contains(string(resp.Body), "larger than 65536 bytes") {
+		t.Errorf("oversized headers: got %d %q, want a 502 naming the limit", resp.StatusCode, resp.Body)
+	}
+	if resp.Headers.Get("X-Filler-0") != "" {
+		t.Error("oversized headers were passed on")
+	}
+
+	// Normal headers on the same connection still go through
+	sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{ID: "small-1", Method: http.MethodGet, Path: "/small"})
+	resp = readResponse(t, server)
+	if resp.StatusCode != http.StatusOK || resp.Headers.Get("X-Filler-0") == "" || string(resp.Body) != "body" {
+		t.Errorf("normal headers: got %d %q", resp.StatusCode, resp.Body)
+	}
+}
+
+func TestInvalidUTF8HeadersReachTheLocalServer(t *testing.T) {
+	addr := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", "attachment; filename=\"r\xe9sum\xe9.pdf\"")
+		fmt.Fprintf(w, "%x", r.Header.Get("X-File-Name"))
+	})
+	_, server := startSession(t, []string{addr}, nil)
+
+	headers := http.Header{"X-File-Name": {"caf\xe9"}}
+	sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{
+		ID: "latin1", Method: http.MethodGet, Path: "/",
+		Headers: headers, RawHeaders: tunnel.SplitRawHeaders(headers),
+	})
+	resp := readResponse(t, server)
+
+	if string(resp.Body) != fmt.Sprintf("%x", "caf\xe9") {
+		t.Errorf("local server got X-File-Name bytes %s, want %x", resp.Body, "caf\xe9")
+	}
+	if v := resp.Headers.Get("Content-Disposition"); v != "attachment; filename=\"r\xe9sum\xe9.pdf\"" {
+		t.Errorf("response Content-Disposition %q", v)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestLocalHostHeader(t *testing.T) {
+	type seen struct{ host, forwarded string }
+	got := make(chan seen, 1)
+	addr := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		got <- seen{r.Host, r.Header.Get("X-Forwarded-Host")}
+	})
+
+	tests := []struct {
+		hostHeader string
+		want       string
+	}{
+		{"", addr}, // What the local server is reached on
+		{"preserve", "abc123.tunnelr.io"},
+		{"myapp.test", "myapp.test"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		_, server := startSessionWith(t, []string{addr}, nil, func(s *session) {
+			s.hostHeader = tc.hostHeader
+		})
+		sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{
+			ID:     "host",
+			Method: http.MethodGet,
+			Path:   "/",
+			Headers: http.Header{
+				"Host":             {"abc123.tunnelr.io"},
+				"X-Forwarded-Host": {"abc123.tunnelr.io"},
+			},
+		})
+		readResponse(t, server)
+
+		s := <-got
+		if s.host != tc.want {
+			t.Errorf("--host-header %q: local server got Host %q, want %q", tc.hostHeader, s.host, tc.want)
+		}
+		if s.forwarded != "abc123.tunnelr.io" {
+			t.Errorf("--host-header %q: X-Forwarded-Host %q, want the public host", tc.hostHeader, s.forwarded)
+		}
+	}
+}
+
+func TestHostHeaderFlag(t *testing.T) {
+	t.Setenv("TUNNELR_HOST_HEADER", "from-env.test")
+	if _, opts, _ := parseConnectArgs([]string{"3000"}); opts.hostHeader != "from-env.test" {
+		t.Errorf("TUNNELR_HOST_HEADER: got %q", opts.hostHeader)
+	}
+	if _, opts, _ := parseConnectArgs([]string{"3000", "--host-header", "preserve"}); opts.hostHeader != "preserve" {
+		t.Errorf("--host-header preserve: got %q", opts.hostHeader)
+	}
+}
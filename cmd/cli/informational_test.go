@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestEarlyHintsAreForwardedFirst(t *testing.T) {
+	addr := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		w.Write([]byte("page"))
+	})
+
+	_, server := startSession(t, []string{addr}, nil)
+	sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{
+		ID: "hints-1", Method: http.MethodGet, Path: "/", Headers: http.Header{},
+	})
+
+	// The 103 comes before the final response, with its own headers
+	msg := readMessage(t, server, 10*time.Second)
+	if msg.Type != tunnel.TypeHTTPInformational {
+		t.Fatalf("first message is %s, want %s", msg.Type, tunnel.TypeHTTPInformational)
+	}
+	var info tunnel.HTTPInformational
+	if err := msg.Unmarshal(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.ID != "hints-1" || info.StatusCode != http.StatusEarlyHints {
+		t.Errorf("got %+v", info)
+	}
+	if got := info.Headers.Get("Link"); got != "</style.css>; rel=preload; as=style" {
+		t.Errorf("103 Link = %q", got)
+	}
+
+	resp := readResponse(t, server)
+	if resp.StatusCode != http.StatusOK || string(resp.Body) != "page" {
+		t.Errorf("final response %d %q", resp.StatusCode, resp.Body)
+	}
+	if got := resp.Headers.Get("Link"); got != "" {
+		t.Errorf("the 103's Link leaked into the final response: %q", got)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"tunnelr/internal/tunnel"
+)
+
+// The inspector is a small local web page listing the requests that came
+// through the tunnel - handy for seeing what a webhook provider actually sent
+
+// defaultInspectAddr keeps the inspector on loopback, so only this machine
+// can see the traffic
+const defaultInspectAddr = "127.0.0.1:4040"
+
+// inspectorHistory is how many recent requests the inspector remembers
+const inspectorHistory = 100
+
+// inspectedRequest is one row in the inspector
+// The headers and body use the same fields as a `tunnelr replay` file, so
+// entries from /api/requests can be replayed as they are
+type inspectedRequest struct {
+	ID         int       `json:"id"` // For POST /inspect/replay/<id>
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	StatusCode int       `json:"status_code"` // 0 if no response was sent
+	DurationMs float64   `json:"duration_ms"`
+
+	// Body sizes in bytes; a streamed request without a Content-Length
+	// counts as -1
+	RequestBytes  int64 `json:"request_bytes"`
+	ResponseBytes int64 `json:"response_bytes"`
+
+	// The request as the tunnel delivered it. Streamed bodies aren't kept,
+	// so those requests can't be replayed.
+	Headers    http.Header `json:"headers,omitempty"`
+	Body       string      `json:"body,omitempty"`
+	BodyBase64 []byte      `json:"body_base64,omitempty"` // Bodies that aren't valid UTF-8
+
+	ReplayOf int `json:"replay_of,omitempty"` // ID of the entry this is a replay of
+
+	LocalCert *certInfo `json:"local_cert,omitempty"` // What the local server presented, with --show-cert
+
+	request *tunnel.HTTPRequest // What a replay sends, nil if it can't be replayed
+}
+
+// replayFunc sends a recorded request to the local server again
+type replayFunc func(ctx context.Context, req *tunnel.HTTPRequest) (*http.Response, error)
+
+// inspector keeps the most recent requests in memory
+// A nil inspector (disabled) silently ignores everything
+type inspector struct {
+	mu      sync.Mutex
+	entries []inspectedRequest // Oldest first
+	lastID  int
+	replay  replayFunc // Set once the tunnel is up, see SetReplay
+}
+
+func newInspector() *inspector {
+	return &inspector{}
+}
+
+// SetReplay sets how replayed requests reach the local server
+// Called for every new connection, so replays use the current settings
+func (ins *inspector) SetReplay(replay replayFunc) {
+	if ins == nil {
+		return
+	}
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	ins.replay = replay
+}
+
+// Record adds a request, dropping the oldest once the history is full
+// If req is given (and its body wasn't streamed), the entry can be replayed
+func (ins *inspector) Record(entry inspectedRequest, req *tunnel.HTTPRequest) {
+	if ins == nil {
+		return
+	}
+	if req != nil && !req.Streamed {
+		entry.request = req
+		entry.Headers = req.Headers
+		if utf8.Valid(req.Body) {
+			entry.Body = string(req.Body)
+		} else {
+			entry.BodyBase64 = req.Body
+		}
+	}
+
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+
+	ins.lastID++
+	entry.ID = ins.lastID
+	ins.entries = append(ins.entries, entry)
+	if len(ins.entries) > inspectorHistory {
+		ins.entries = ins.entries[len(ins.entries)-inspectorHistory:]
+	}
+}
+
+// Recent returns the remembered requests, newest first
+func (ins *inspector) Recent() []inspectedRequest {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+
+	recent := make([]inspectedRequest, len(ins.entries))
+	for i, entry := range ins.entries {
+		recent[len(ins.entries)-1-i] = entry
+	}
+	return recent
+}
+
+// find returns the entry with the given ID and the current replay function
+func (ins *inspector) find(id int) (inspectedRequest, replayFunc, bool) {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+
+	for _, entry := range ins.entries {
+		if entry.ID == id {
+			return entry, ins.replay, true
+		}
+	}
+	return inspectedRequest{}, ins.replay, false
+}
+
+// ServeHTTP shows the request list: JSON at /api/requests, HTML everywhere else
+// POST /inspect/replay/<id> sends a recorded request to the local server again
+func (ins *inspector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if idText, ok := strings.CutPrefix(r.URL.Path, "/inspect/replay/"); ok {
+		ins.serveReplay(w, r, idText)
+		return
+	}
+
+	recent := ins.Recent()
+
+	if r.URL.Path == "/api/requests" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(recent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, `<!DOCTYPE html>
+<html>
+<head><title>Tunnelr Inspector</title><meta http-equiv="refresh" content="2"></head>
+<body style="font-family: monospace">
+<h1>Recent requests</h1>
+<table cellpadding="4">
+<tr><th align="left">Time</th><th align="left">Method</th><th align="left">Path</th><th align="left">Status</th><th align="left">Duration</th><th align="left">In</th><th align="left">Out</th></tr>
+`)
+	for _, entry := range recent {
+		status := "-"
+		if entry.StatusCode != 0 {
+			status = fmt.Sprint(entry.StatusCode)
+		}
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%.1f ms</td><td>%s</td><td>%s</td></tr>\n",
+			entry.Time.Format("15:04:05"), html.EscapeString(entry.Method),
+			html.EscapeString(entry.Path), status, entry.DurationMs,
+			formatSize(entry.RequestBytes), formatSize(entry.ResponseBytes))
+	}
+	fmt.Fprint(w, "</table>\n</body>\n</html>\n")
+}
+
+// serveReplay re-sends a recorded request to the local server and answers
+// with the local server's fresh response
+// Only the local server sees the replay - whoever sent the original request
+// through the tunnel isn't involved.
+func (ins *inspector) serveReplay(w http.ResponseWriter, r *http.Request, idText string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Use POST to replay a request", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(idText)
+	if err != nil {
+		http.Error(w, "Invalid request ID", http.StatusBadRequest)
+		return
+	}
+	original, replay, found := ins.find(id)
+	if !found {
+		http.Error(w, fmt.Sprintf("No request %d - only the last %d are kept", id, inspectorHistory), http.StatusNotFound)
+		return
+	}
+	if original.request == nil {
+		http.Error(w, "This request can't be replayed: its body was streamed and not kept", http.StatusUnprocessableEntity)
+		return
+	}
+	if replay == nil {
+		http.Error(w, "The tunnel isn't connected yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	entry := inspectedRequest{
+		Time:         time.Now(),
+		Method:       original.Method,
+		Path:         original.Path,
+		RequestBytes: original.RequestBytes,
+		ReplayOf:     id,
+	}
+	outcome := ""
+	defer func() {
+		if outcome == "" {
+			outcome = answered(entry.StatusCode, entry.ResponseBytes, "")
+		}
+		logRequest(original.Method, original.Path, original.RequestBytes, fmt.Sprintf("%s, replay of #%d", outcome, id))
+		entry.DurationMs = float64(time.Since(entry.Time).Microseconds()) / 1000
+		ins.Record(entry, original.request)
+	}()
+
+	resp, err := replay(r.Context(), original.request)
+	if err != nil {
+		outcome = fmt.Sprintf("Error: %v", err)
+		http.Error(w, "Failed to reach the local server: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	copyResponseHeaders(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	entry.StatusCode = resp.StatusCode
+	entry.ResponseBytes, _ = io.Copy(w, resp.Body)
+}
+
+// copyResponseHeaders copies every header value from src to dst
+func copyResponseHeaders(dst, src http.Header) {
+	for key, values := range src {
+		for _, value := range values {
+			dst.Add(key, value)
+		}
+	}
+}
+
+// formatSize shows a body size for the inspector page and the request log,
+// "-" if unknown
+func formatSize(n int64) string {
+	switch {
+	case n < 0:
+		return "-"
+	case n < 1024:
+		return fmt.Sprintf("%d B", n)
+	case n < 1024*1024:
+		return fmt.Sprintf("%.1f KB", float64(n)/1024)
+	default:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1024*1024))
+	}
+}
+
+// startInspector serves the inspector on addr in the background
+// It warns when addr isn't loopback, since anyone who can reach it sees
+// every request going through the tunnel
+func startInspector(addr string, ins *inspector) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	if !isLoopbackAddr(addr) {
+		log.Printf("WARNING: inspector is listening on %s, which is reachable from other machines - anyone who can connect can see your tunnel's traffic", addr)
+	}
+
+	go http.Serve(listener, ins)
+	return nil
+}
+
+// isLoopbackAddr reports whether a host:port only listens on this machine
+// An empty host (":4040") means every interface, so it isn't loopback
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestInspectAddrFlag(t *testing.T) {
+	t.Setenv("TUNNELR_INSPECT_ADDR", "")
+	t.Setenv("TUNNELR_INSPECT", "")
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"3000"}, defaultInspectAddr},
+		{[]string{"3000", "--inspect-addr", "0.0.0.0:5000"}, "0.0.0.0:5000"},
+		{[]string{"--inspect-addr=:4041", "3000"}, ":4041"},
+		{[]string{"3000", "--inspect-addr", "off"}, ""},
+		{[]string{"3000", "--inspect=false"}, ""},
+	}
+	for _, tc := range tests {
+		_, opts, err := parseConnectArgs(tc.args)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.args, err)
+		}
+		if opts.inspectAddr != tc.want {
+			t.Errorf("%v: inspect address %q, want %q", tc.args, opts.inspectAddr, tc.want)
+		}
+	}
+
+	// The environment sets the default, the flag still wins
+	t.Setenv("TUNNELR_INSPECT_ADDR", "127.0.0.1:9999")
+	if _, opts, _ := parseConnectArgs([]string{"3000"}); opts.inspectAddr != "127.0.0.1:9999" {
+		t.Errorf("TUNNELR_INSPECT_ADDR ignored: %q", opts.inspectAddr)
+	}
+	if _, opts, _ := parseConnectArgs([]string{"3000", "--inspect-addr", "127.0.0.1:1234"}); opts.inspectAddr != "127.0.0.1:1234" {
+		t.Errorf("flag didn't override the environment: %q", opts.inspectAddr)
+	}
+}
+
+func TestIsLoopbackAddr(t *testing.T) {
+	tests := map[string]bool{
+		"127.0.0.1:4040": true,
+		"127.1.2.3:4040": true,
+		"[::1]:4040":     true,
+		"localhost:4040": true,
+		":4040":          false, // Every interface
+		"0.0.0.0:4040":   false,
+		"[::]:4040":      false,
+		"10.0.0.5:4040":  false,
+		"example.com:80": false,
+		"no-port":        false,
+	}
+	for addr, want := range tests {
+		if got := isLoopbackAddr(addr); got != want {
+			t.Errorf("isLoopbackAddr(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+// inspectorLog runs startInspector on addr and returns what it logged
+func inspectorLog(t *testing.T, addr string) (string, error) {
+	t.Helper()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	err := startInspector(addr, newInspector())
+	return buf.String(), err
+}
+
+func TestStartInspectorWarnsOffLoopback(t *testing.T) {
+	out, err := inspectorLog(t, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "" {
+		t.Errorf("loopback inspector logged %q", out)
+	}
+
+	out, err = inspectorLog(t, ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "WARNING") || !strings.Contains(out, ":0") {
+		t.Errorf("inspector on every interface didn't warn, logged %q", out)
+	}
+}
+
+func TestStartInspectorReportsBusyAddress(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	if _, err := inspectorLog(t, taken.Addr().String()); err == nil {
+		t.Error("started an inspector on an address that's in use")
+	}
+}
+
+// inspectorJSON fetches /api/requests from ins
+func inspectorJSON(t *testing.T, ins *inspector) []inspectedRequest {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	ins.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/requests", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("/api/requests Content-Type %q, want application/json", ct)
+	}
+	var entries []inspectedRequest
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("/api/requests: %v in %s", err, rec.Body)
+	}
+	return entries
+}
+
+func TestForwardedRequestShowsInTheInspector(t *testing.T) {
+	addr := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "created it")
+	})
+	ins := newInspector()
+	_, server := startSessionWith(t, []string{addr}, nil, func(s *session) { s.inspector = ins })
+
+	sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{
+		ID:      "inspected",
+		Method:  http.MethodPost,
+		Path:    "/hooks/github?delivery=1",
+		Headers: http.Header{"Content-Type": {"application/json"}},
+		Body:    []byte(`{"action":"opened"}`),
+	})
+	if resp := readResponse(t, server); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got %d, want 201", resp.StatusCode)
+	}
+
+	// The entry is recorded once the response has gone out
+	var entries []inspectedRequest
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if entries = inspectorJSON(t, ins); len(entries) > 0 {
+			break
+		}
+	}
+	if len(entries) != 1 {
+		t.Fatalf("inspector has %d entries, want 1", len(entries))
+	}
+	got := entries[0]
+	if got.Method != http.MethodPost || got.Path != "/hooks/github?delivery=1" || got.StatusCode != http.StatusCreated {
+		t.Errorf("entry %s %s -> %d, want POST /hooks/github?delivery=1 -> 201", got.Method, got.Path, got.StatusCode)
+	}
+	if got.RequestBytes != int64(len(`{"action":"opened"}`)) || got.ResponseBytes != int64(len("created it")) {
+		t.Errorf("entry sizes in %d, out %d; want %d and %d", got.RequestBytes, got.ResponseBytes, len(`{"action":"opened"}`), len("created it"))
+	}
+	if got.Body != `{"action":"opened"}` || got.Headers.Get("Content-Type") != "application/json" {
+		t.Errorf("entry body %q, headers %v; want the request as sent", got.Body, got.Headers)
+	}
+	if got.ID == 0 || got.Time.IsZero() {
+		t.Errorf("entry has ID %d, time %v", got.ID, got.Time)
+	}
+}
+
+func TestInspectorKeepsTheNewest(t *testing.T) {
+	ins := newInspector()
+	for i := 0; i < inspectorHistory+20; i++ {
+		ins.Record(inspectedRequest{Method: http.MethodGet, Path: "/" + strconv.Itoa(i)}, nil)
+	}
+
+	entries := inspectorJSON(t, ins)
+	if len(entries) != inspectorHistory {
+		t.Fatalf("inspector has %d entries, want %d", len(entries), inspectorHistory)
+	}
+	// Newest first, the oldest 20 are gone
+	if first, last := entries[0].Path, entries[len(entries)-1].Path; first != "/119" || last != "/20" {
+		t.Errorf("entries run from %s to %s, want /119 to /20", first, last)
+	}
+
+	// A disabled inspector records nothing and doesn't crash
+	var disabled *inspector
+	disabled.Record(inspectedRequest{Path: "/"}, nil)
+}
+
+// replayEntry posts to the inspector's replay endpoint for id
+func replayEntry(ins *inspector, method string, id int) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	ins.ServeHTTP(rec, httptest.NewRequest(method, "/inspect/replay/"+strconv.Itoa(id), nil))
+	return rec
+}
+
+func TestReplayFromTheInspector(t *testing.T) {
+	var mu sync.Mutex
+	var hits []string
+	addr := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		hits = append(hits, r.Method+" "+r.URL.RequestURI()+" "+string(body))
+		n := len(hits)
+		mu.Unlock()
+		w.Header().Set("X-Hit", strconv.Itoa(n))
+		io.WriteString(w, "answer "+strconv.Itoa(n))
+	})
+	ins := newInspector()
+	s, server := startSessionWith(t, []string{addr}, nil, func(s *session) { s.inspector = ins })
+	ins.SetReplay(s.replayLocal)
+
+	sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{
+		ID:     "to-replay",
+		Method: http.MethodPost,
+		Path:   "/hooks/stripe",
+		Body:   []byte(`{"event":"paid"}`),
+	})
+	readResponse(t, server)
+	var entries []inspectedRequest
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) && len(entries) == 0; time.Sleep(10 * time.Millisecond) {
+		entries = inspectorJSON(t, ins)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("inspector has %d entries, want 1", len(entries))
+	}
+	original := entries[0].ID
+
+	// The replay hits the local server again and answers with its fresh response
+	rec := replayEntry(ins, http.MethodPost, original)
+	if rec.Code != http.StatusOK || rec.Body.String() != "answer 2" || rec.Header().Get("X-Hit") != "2" {
+		t.Errorf("replay got %d %q (X-Hit %q), want the second answer", rec.Code, rec.Body, rec.Header().Get("X-Hit"))
+	}
+	mu.Lock()
+	got := append([]string(nil), hits...)
+	mu.Unlock()
+	want := `POST /hooks/stripe {"event":"paid"}`
+	if len(got) != 2 || got[0] != want || got[1] != want {
+		t.Errorf("local server saw %q, want the same request twice", got)
+	}
+
+	// The replay is an entry of its own, pointing back at the original
+	entries = inspectorJSON(t, ins)
+	if len(entries) != 2 || entries[0].ReplayOf != original || entries[0].StatusCode != http.StatusOK {
+		t.Errorf("after the replay the inspector has %+v", entries)
+	}
+}
+
+func TestReplayFromTheInspectorRefusals(t *testing.T) {
+	ins := newInspector()
+	ins.Record(inspectedRequest{Method: http.MethodGet, Path: "/kept"}, &tunnel.HTTPRequest{Method: http.MethodGet, Path: "/kept"})
+	ins.Record(inspectedRequest{Method: http.MethodPost, Path: "/streamed"}, &tunnel.HTTPRequest{Method: http.MethodPost, Path: "/streamed", Streamed: true})
+
+	// Not connected yet
+	if rec := replayEntry(ins, http.MethodPost, 1); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("replay before the tunnel is up got %d, want 503", rec.Code)
+	}
+
+	ins.SetReplay(func(ctx context.Context, req *tunnel.HTTPRequest) (*http.Response, error) {
+		t.Errorf("replayed %s when it should have been refused", req.Path)
+		return nil, errors.New("unexpected replay")
+	})
+	tests := []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{http.MethodGet, "/inspect/replay/1", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/inspect/replay/abc", http.StatusBadRequest},
+		{http.MethodPost, "/inspect/replay/99", http.StatusNotFound},
+		{http.MethodPost, "/inspect/replay/2", http.StatusUnprocessableEntity}, // Body wasn't kept
+	}
+	for _, tc := range tests {
+		rec := httptest.NewRecorder()
+		ins.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, nil))
+		if rec.Code != tc.want {
+			t.Errorf("%s %s got %d, want %d", tc.method, tc.path, rec.Code, tc.want)
+		}
+	}
+
+	// A local server that's down is a 502
+	ins.SetReplay(func(ctx context.Context, req *tunnel.HTTPRequest) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	})
+	if rec := replayEntry(ins, http.MethodPost, 1); rec.Code != http.StatusBadGateway {
+		t.Errorf("replay to a dead local server got %d, want 502", rec.Code)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// --local-keepalive sets how often TCP keepalive probes go out on idle
+// connections to the local server. A local server that hangs or disappears
+// without closing its sockets (a killed VM, a paused container) is then
+// noticed and its connections freed, instead of sitting in the pool.
+
+// defaultLocalKeepAlive matches Go's own default for dialers
+const defaultLocalKeepAlive = 15 * time.Second
+
+// localDialTimeout bounds connecting to the local server, like Go's default
+// transport does
+const localDialTimeout = 30 * time.Second
+
+// newLocalDialer returns the dialer for connections to the local server
+// interval 0 turns keepalive off. In Go, a net.Dialer treats 0 as "use the
+// default" and a negative value as "off", so 0 is translated here.
+func newLocalDialer(interval time.Duration) *net.Dialer {
+	if interval == 0 {
+		interval = -1
+	}
+	return &net.Dialer{Timeout: localDialTimeout, KeepAlive: interval}
+}
+
+// useLocalKeepAlive makes requests and WebSockets to the local server use
+// keepalive probes every interval (0 = off)
+func useLocalKeepAlive(interval time.Duration) {
+	dialer := newLocalDialer(interval)
+	localTransport.DialContext = dialer.DialContext
+	localWSDialer.NetDialContext = dialer.DialContext
+}
@@ -0,0 +1,90 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// socketKeepAlive reads whether keepalive is on for conn, and how long (in
+// seconds) it sits idle before the first probe
+// That's what net.Dialer.KeepAlive sets on every Go version; newer ones leave
+// the interval between later probes at 15s.
+func socketKeepAlive(t *testing.T, conn net.Conn) (bool, int) {
+	t.Helper()
+	raw, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var on, idle int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if on, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_KEEPALIVE); sockErr != nil {
+			return
+		}
+		idle, sockErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPIDLE)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return on != 0, idle
+}
+
+func TestLocalConnectionsUseKeepAlive(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	oldDial, oldWSDial := localTransport.DialContext, localWSDialer.NetDialContext
+	t.Cleanup(func() {
+		localTransport.DialContext, localWSDialer.NetDialContext = oldDial, oldWSDial
+	})
+
+	// What the transport and the WebSocket dialer open has the probes on
+	useLocalKeepAlive(7 * time.Second)
+	dials := map[string]func(ctx context.Context, network, addr string) (net.Conn, error){
+		"requests":   localTransport.DialContext,
+		"websockets": localWSDialer.NetDialContext,
+	}
+	for name, dial := range dials {
+		conn, err := dial(context.Background(), "tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if on, idle := socketKeepAlive(t, conn); !on || idle != 7 {
+			t.Errorf("%s: keepalive %v after %ds idle, want on after 7s", name, on, idle)
+		}
+		conn.Close()
+	}
+
+	// And with 0 they're off
+	useLocalKeepAlive(0)
+	conn, err := localTransport.DialContext(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if on, _ := socketKeepAlive(t, conn); on {
+		t.Error("keepalive on with --local-keepalive=0")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestSilentServerIsDetected(t *testing.T) {
+	old := pingInterval
+	pingInterval = 200 * time.Millisecond
+	defer func() { pingInterval = old }()
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	// The server's end never reads, so the CLI's pings go unanswered
+	s, _ := startSession(t, nil, nil)
+
+	limit := tunnel.KeepaliveTimeout(200*time.Millisecond) + time.Second
+	select {
+	case <-s.ctx.Done():
+	case <-time.After(limit):
+		t.Fatalf("session still running %s after the server went silent", limit)
+	}
+	if !strings.Contains(logged.String(), "Server stopped answering pings") {
+		t.Errorf("logged %q, want the ping timeout reported", logged.String())
+	}
+}
+
+func TestLocalKeepAliveFlag(t *testing.T) {
+	t.Setenv("TUNNELR_LOCAL_KEEPALIVE", "")
+	tests := []struct {
+		args []string
+		want time.Duration
+	}{
+		{[]string{"3000"}, defaultLocalKeepAlive},
+		{[]string{"3000", "--local-keepalive", "5s"}, 5 * time.Second},
+		{[]string{"3000", "--local-keepalive=0"}, 0},
+	}
+	for _, tc := range tests {
+		_, opts, err := parseConnectArgs(tc.args)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.args, err)
+		}
+		if opts.localKeepAlive != tc.want {
+			t.Errorf("%v: keepalive %s, want %s", tc.args, opts.localKeepAlive, tc.want)
+		}
+	}
+
+	if _, _, err := parseConnectArgs([]string{"3000", "--local-keepalive", "-1s"}); err == nil {
+		t.Error("a negative --local-keepalive was accepted")
+	}
+	t.Setenv("TUNNELR_LOCAL_KEEPALIVE", "1m")
+	if _, opts, _ := parseConnectArgs([]string{"3000"}); opts.localKeepAlive != time.Minute {
+		t.Errorf("TUNNELR_LOCAL_KEEPALIVE ignored: %s", opts.localKeepAlive)
+	}
+}
+
+func TestNewLocalDialer(t *testing.T) {
+	if d := newLocalDialer(5 * time.Second); d.KeepAlive != 5*time.Second || d.Timeout != localDialTimeout {
+		t.Errorf("5s: KeepAlive %s, Timeout %s", d.KeepAlive, d.Timeout)
+	}
+	// 0 is off, which a net.Dialer spells as negative
+	if d := newLocalDialer(0); d.KeepAlive >= 0 {
+		t.Errorf("0: KeepAlive %s, want it negative (off)", d.KeepAlive)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+// `tunnelr list` shows the tunnels open with your auth token - handy after
+// reconnecting from another terminal, or to find a URL you've lost track of.
+// The server only knows whose tunnel is whose by the token it was opened
+// with, so this needs one.
+
+func runList(args []string) {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	token := fs.String("token", getEnv("TUNNELR_TOKEN", ""), "auth token the tunnels were opened with")
+	asJSON := fs.Bool("json", false, "print the server's JSON as-is")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return
+		}
+		os.Exit(1)
+	}
+	if *token == "" {
+		fmt.Println("Error: tunnels are listed by auth token, pass --token or set TUNNELR_TOKEN")
+		os.Exit(1)
+	}
+
+	list, raw, err := fetchOwnTunnels(getEnv("TUNNELR_SERVER", "ws://localhost:8080/ws"), *token)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *asJSON {
+		os.Stdout.Write(raw)
+		return
+	}
+	if list.Count == 0 {
+		fmt.Println("No tunnels open with this token")
+		return
+	}
+
+	fmt.Printf("%-12s %-6s %-10s %s\n", "ID", "PORT", "UPTIME", "PUBLIC URL")
+	for _, t := range list.Tunnels {
+		uptime := time.Since(t.ConnectedAt).Round(time.Second)
+		fmt.Printf("%-12s %-6d %-10s %s\n", t.ID, t.LocalPort, uptime, t.PublicURL)
+	}
+}
+
+// fetchOwnTunnels asks the server for the tunnels opened with token
+// Returns the raw JSON too, for --json
+func fetchOwnTunnels(serverURL, token string) (*tunnel.OwnTunnels, []byte, error) {
+	dialer, err := newDialer(defaultHandshakeTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	listURL, err := serverHTTPURL(serverURL, "/api/tunnels")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, listURL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := httpClientFor(dialer).Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to reach the server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read the server's answer: %v", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return nil, nil, fmt.Errorf("the server doesn't accept this token")
+	case http.StatusNotFound:
+		return nil, nil, fmt.Errorf("the server doesn't support listing tunnels, it needs to be updated")
+	default:
+		return nil, nil, fmt.Errorf("server answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var list tunnel.OwnTunnels
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, nil, fmt.Errorf("invalid answer from the server: %v", err)
+	}
+	return &list, body, nil
+}
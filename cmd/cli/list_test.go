@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchOwnTunnels(t *testing.T) {
+	var gotAuth, gotPath string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth, gotPath = r.Header.Get("Authorization"), r.URL.Path
+		switch r.Header.Get("Authorization") {
+		case "Bearer mine":
+			w.Write([]byte(`{"count": 2, "tunnels": [
+				{"id": "abc123", "local_port": 3000, "public_url": "https://abc123.tunnelr.io", "connected_at": "2026-10-16T12:00:00Z"},
+				{"id": "def456", "local_port": 8080, "public_url": "https://def456.tunnelr.io", "connected_at": "2026-10-16T12:05:00Z"}
+			]}`))
+		default:
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		}
+	}))
+	defer srv.Close()
+	serverURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	list, raw, err := fetchOwnTunnels(serverURL, "mine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotPath != "/api/tunnels" || gotAuth != "Bearer mine" {
+		t.Errorf("asked %s with %q", gotPath, gotAuth)
+	}
+	if list.Count != 2 || list.Tunnels[1].ID != "def456" || list.Tunnels[1].LocalPort != 8080 ||
+		list.Tunnels[0].PublicURL != "https://abc123.tunnelr.io" ||
+		!list.Tunnels[0].ConnectedAt.Equal(time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("got %+v", list)
+	}
+	if !strings.Contains(string(raw), `"def456"`) {
+		t.Errorf("raw JSON for --json is %q", raw)
+	}
+
+	if _, _, err := fetchOwnTunnels(serverURL, "not-mine"); err == nil || !strings.Contains(err.Error(), "doesn't accept this token") {
+		t.Errorf("refused token: got %v", err)
+	}
+}
+
+func TestFetchOwnTunnelsFromAnOldServer(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	_, _, err := fetchOwnTunnels("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", "mine")
+	if err == nil || !strings.Contains(err.Error(), "needs to be updated") {
+		t.Errorf("got %v, want a hint to update the server", err)
+	}
+}
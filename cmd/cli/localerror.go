@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+)
+
+// When a request to the local server fails, the visitor gets a status and
+// message saying why - "connection refused" and "timed out" call for
+// different fixes, and a bare "502 Bad Gateway" says neither.
+
+// localResponseTimeout caps how long we wait for the local server's response
+// headers, 0 = as long as the tunnel server does (its REQUEST_TIMEOUT)
+var localResponseTimeout = getEnvDuration("TUNNELR_LOCAL_TIMEOUT", 0)
+
+// describeLocalError turns a failed request to addr into the status and
+// message the visitor gets: 504 if the local server was too slow, 502 for
+// anything else
+func describeLocalError(err error, addr string) (int, string) {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return http.StatusBadGateway, fmt.Sprintf("Connection refused by the local server at %s: nothing is listening there", addr)
+	case errors.As(err, &dnsErr):
+		return http.StatusBadGateway, fmt.Sprintf("Couldn't look up the local host %q: %v", dnsErr.Name, dnsErr.Err)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		if isLocalServerDown(err) {
+			return http.StatusGatewayTimeout, fmt.Sprintf("Timed out connecting to the local server at %s", addr)
+		}
+		return http.StatusGatewayTimeout, fmt.Sprintf("The local server at %s didn't respond in time", addr)
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return http.StatusBadGateway, fmt.Sprintf("The local server at %s closed the connection without responding", addr)
+	}
+	return http.StatusBadGateway, fmt.Sprintf("Failed to reach the local server at %s: %v", addr, unwrapURLError(err))
+}
+
+// unwrapURLError drops the `Get "http://...":` prefix net/http puts on
+// errors - the message already says which server it was
+func unwrapURLError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
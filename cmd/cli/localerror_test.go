@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+// timeoutError is a net.Error that timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClosedPortIsConnectionRefused(t *testing.T) {
+	addr := closedPort(t)
+	_, server := startSession(t, []string{addr}, nil)
+	sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{ID: "refused", Method: http.MethodGet, Path: "/"})
+	resp := readResponse(t, server)
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("got %d, want 502", resp.StatusCode)
+	}
+	if body := string(resp.Body); !strings.Contains(body, "Connection refused") || !strings.Contains(body, addr) {
+		t.Errorf("body %q doesn't say the connection to %s was refused", body, addr)
+	}
+	// Still marked, so --warmup retries it
+	if resp.Headers.Get(tunnel.UnreachableHeader) == "" {
+		t.Error("refused connection not marked unreachable")
+	}
+}
+
+func TestHangingLocalServerIs504(t *testing.T) {
+	old := localTransport.ResponseHeaderTimeout
+	localTransport.ResponseHeaderTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { localTransport.ResponseHeaderTimeout = old })
+
+	hang := make(chan struct{})
+	addr := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	})
+	t.Cleanup(func() { close(hang) }) // Before the server shuts down
+
+	_, server := startSession(t, []string{addr}, nil)
+	sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{ID: "slow", Method: http.MethodGet, Path: "/"})
+	resp := readResponse(t, server)
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("got %d, want 504", resp.StatusCode)
+	}
+	if body := string(resp.Body); !strings.Contains(body, "didn't respond in time") {
+		t.Errorf("body %q doesn't say the local server was too slow", body)
+	}
+	// It's up, just slow: retrying during warmup wouldn't help
+	if resp.Headers.Get(tunnel.UnreachableHeader) != "" {
+		t.Error("slow local server marked unreachable")
+	}
+}
+
+func TestLocalServerHangingUpIs502(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// Read the request, then crash without answering
+			conn.Read(make([]byte, 4096))
+			conn.Close()
+		}
+	}()
+
+	_, server := startSession(t, []string{l.Addr().String()}, nil)
+	sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{ID: "hangup", Method: http.MethodGet, Path: "/"})
+	resp := readResponse(t, server)
+	if resp.StatusCode != http.StatusBadGateway || !strings.Contains(string(resp.Body), "closed the connection without responding") {
+		t.Errorf("got %d %q, want a 502 saying the connection was closed", resp.StatusCode, resp.Body)
+	}
+}
+
+func TestDescribeLocalError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantText   string
+	}{
+		{"dns", &net.DNSError{Name: "devbox.internal", Err: "no such host"}, http.StatusBadGateway, `Couldn't look up the local host "devbox.internal": no such host`},
+		{"dial timeout", &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}, http.StatusGatewayTimeout, "Timed out connecting to the local server at 127.0.0.1:3000"},
+		{"read timeout", &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, http.StatusGatewayTimeout, "didn't respond in time"},
+		{"other", &net.OpError{Op: "write", Net: "tcp", Err: net.ErrClosed}, http.StatusBadGateway, "Failed to reach the local server at 127.0.0.1:3000"},
+	}
+	for _, tc := range tests {
+		status, message := describeLocalError(tc.err, "127.0.0.1:3000")
+		if status != tc.wantStatus || !strings.Contains(message, tc.wantText) {
+			t.Errorf("%s: got %d %q, want %d containing %q", tc.name, status, message, tc.wantStatus, tc.wantText)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// --local-https is for local servers that only speak HTTPS, e.g. dev servers
+// with a self-signed certificate. Their certificate is verified like any
+// other unless --insecure-skip-verify is given as well - that's opt-in, since
+// it accepts any certificate at all.
+//
+// --show-cert prints the certificate the local server presented (subject,
+// issuer, validity) the first time it's seen, and adds it to the inspector's
+// entries - handy when the certificate isn't trusted and you want to know why.
+
+// useLocalTLS switches requests and WebSockets to the local server to TLS
+func useLocalTLS(insecureSkipVerify bool) {
+	config := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+	localTransport.TLSClientConfig = config
+	localWSDialer.TLSClientConfig = config
+}
+
+// isUntrustedCert reports whether a request failed because the local
+// server's certificate couldn't be verified
+func isUntrustedCert(err error) bool {
+	var verifyErr *tls.CertificateVerificationError
+	return errors.As(err, &verifyErr)
+}
+
+// certInfo describes the certificate the local server presented
+type certInfo struct {
+	Subject    string    `json:"subject"`
+	Issuer     string    `json:"issuer"`
+	DNSNames   []string  `json:"dns_names,omitempty"`
+	NotBefore  time.Time `json:"not_before"`
+	NotAfter   time.Time `json:"not_after"`
+	SelfSigned bool      `json:"self_signed"`
+	SHA256     string    `json:"sha256"` // Fingerprint of the whole certificate
+}
+
+// localCertFrom returns the local server's certificate from a response, or
+// from the error if it couldn't be verified. nil if there's neither (plain
+// HTTP, or the connection failed before the handshake).
+func localCertFrom(resp *http.Response, err error) *certInfo {
+	var verifyErr *tls.CertificateVerificationError
+	switch {
+	case resp != nil && resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0:
+		return newCertInfo(resp.TLS.PeerCertificates[0])
+	case errors.As(err, &verifyErr) && len(verifyErr.UnverifiedCertificates) > 0:
+		return newCertInfo(verifyErr.UnverifiedCertificates[0])
+	}
+	return nil
+}
+
+func newCertInfo(cert *x509.Certificate) *certInfo {
+	sum := sha256.Sum256(cert.Raw)
+	return &certInfo{
+		Subject:    cert.Subject.String(),
+		Issuer:     cert.Issuer.String(),
+		DNSNames:   cert.DNSNames,
+		NotBefore:  cert.NotBefore,
+		NotAfter:   cert.NotAfter,
+		SelfSigned: cert.CheckSignatureFrom(cert) == nil,
+		SHA256:     hex.EncodeToString(sum[:]),
+	}
+}
+
+// String summarizes the certificate on one line, flagging common problems
+func (c *certInfo) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s, issued by %s", c.Subject, c.Issuer)
+	if c.SelfSigned {
+		b.WriteString(" (self-signed)")
+	}
+	fmt.Fprintf(&b, ", valid %s to %s", c.NotBefore.Format("2006-01-02"), c.NotAfter.Format("2006-01-02"))
+	if len(c.DNSNames) > 0 {
+		fmt.Fprintf(&b, ", names %s", strings.Join(c.DNSNames, " "))
+	}
+
+	now := time.Now()
+	if now.After(c.NotAfter) {
+		b.WriteString(" - EXPIRED")
+	} else if now.Before(c.NotBefore) {
+		b.WriteString(" - NOT YET VALID")
+	}
+	return b.String()
+}
+
+// noteLocalCert prints cert the first time this session sees it
+// Requests run concurrently, so the seen set is a sync.Map.
+func (s *session) noteLocalCert(cert *certInfo) {
+	if cert == nil {
+		return
+	}
+	if _, seen := s.certsSeen.LoadOrStore(cert.SHA256, true); !seen {
+		fmt.Printf("  Local certificate: %s\n", cert)
+	}
+}
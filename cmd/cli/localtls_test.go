@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+// withLocalTLS switches local requests to TLS until the test ends
+func withLocalTLS(t *testing.T, insecureSkipVerify bool) {
+	t.Helper()
+	oldTransport, oldWS := localTransport.TLSClientConfig, localWSDialer.TLSClientConfig
+	useLocalTLS(insecureSkipVerify)
+	localTransport.CloseIdleConnections()
+	t.Cleanup(func() {
+		localTransport.TLSClientConfig, localWSDialer.TLSClientConfig = oldTransport, oldWS
+		localTransport.CloseIdleConnections()
+	})
+}
+
+func TestLocalHTTPS(t *testing.T) {
+	// A dev server with a self-signed certificate
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("over TLS"))
+	}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "https://")
+	useTLS := func(s *session) { s.localTLS = true }
+
+	// Verified like any other certificate: refused, and the error says how
+	// to get past it
+	t.Run("verify", func(t *testing.T) {
+		withLocalTLS(t, false)
+		_, server := startSessionWith(t, []string{addr}, nil, useTLS)
+		sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{ID: "verify", Method: http.MethodGet, Path: "/"})
+		resp := readResponse(t, server)
+		if resp.StatusCode != http.StatusBadGateway || !strings.Contains(string(resp.Body), "--insecure-skip-verify") {
+			t.Errorf("got %d %q, want a 502 about the untrusted certificate", resp.StatusCode, resp.Body)
+		}
+	})
+
+	t.Run("skip-verify", func(t *testing.T) {
+		withLocalTLS(t, true)
+		_, server := startSessionWith(t, []string{addr}, nil, useTLS)
+		sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{ID: "skip", Method: http.MethodGet, Path: "/"})
+		resp := readResponse(t, server)
+		if resp.StatusCode != http.StatusOK || string(resp.Body) != "over TLS" {
+			t.Errorf("got %d %q, want the local server's answer", resp.StatusCode, resp.Body)
+		}
+	})
+}
+
+func TestShowCertCapturesLocalCertificate(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("over TLS"))
+	}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "https://")
+	want := srv.Certificate()
+	sum := sha256.Sum256(want.Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	// Whether the request goes through or the certificate is refused, the
+	// inspector shows what the local server presented
+	for _, skipVerify := range []bool{true, false} {
+		withLocalTLS(t, skipVerify)
+		ins := newInspector()
+		sess, server := startSessionWith(t, []string{addr}, nil, func(s *session) {
+			s.localTLS = true
+			s.showCert = true
+			s.inspector = ins
+		})
+		for _, id := range []string{"first", "second"} {
+			sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{ID: id, Method: http.MethodGet, Path: "/"})
+			readResponse(t, server)
+		}
+
+		var entries []inspectedRequest
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if entries = inspectorJSON(t, ins); len(entries) == 2 {
+				break
+			}
+		}
+		if len(entries) != 2 {
+			t.Fatalf("skip verify %v: inspector has %d entries, want 2", skipVerify, len(entries))
+		}
+		for _, entry := range entries {
+			cert := entry.LocalCert
+			if cert == nil {
+				t.Errorf("skip verify %v: entry %d has no certificate", skipVerify, entry.ID)
+				continue
+			}
+			if cert.SHA256 != fingerprint || !cert.SelfSigned || !strings.Contains(cert.Subject, "Acme Co") {
+				t.Errorf("skip verify %v: got %+v, want the test server's self-signed certificate", skipVerify, cert)
+			}
+			if !cert.NotBefore.Equal(want.NotBefore) || !cert.NotAfter.Equal(want.NotAfter) || strings.Join(cert.DNSNames, " ") != strings.Join(want.DNSNames, " ") {
+				t.Errorf("skip verify %v: validity %s to %s, names %v", skipVerify, cert.NotBefore, cert.NotAfter, cert.DNSNames)
+			}
+		}
+
+		// Printed once, not per request
+		seen := 0
+		sess.certsSeen.Range(func(_, _ any) bool { seen++; return true })
+		if seen != 1 {
+			t.Errorf("skip verify %v: %d certificates noted, want 1", skipVerify, seen)
+		}
+	}
+
+	// Opt-in: without --show-cert nothing is captured
+	withLocalTLS(t, true)
+	ins := newInspector()
+	_, server := startSessionWith(t, []string{addr}, nil, func(s *session) {
+		s.localTLS = true
+		s.inspector = ins
+	})
+	sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{ID: "quiet", Method: http.MethodGet, Path: "/"})
+	readResponse(t, server)
+	for deadline := time.Now().Add(5 * time.Second); len(ins.Recent()) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if entries := ins.Recent(); len(entries) != 1 || entries[0].LocalCert != nil {
+		t.Errorf("without --show-cert got %+v, want one entry and no certificate", entries)
+	}
+}
+
+func TestCertInfoString(t *testing.T) {
+	day := 24 * time.Hour
+	cert := &certInfo{
+		Subject:    "CN=localhost",
+		Issuer:     "CN=localhost",
+		DNSNames:   []string{"localhost", "app.test"},
+		NotBefore:  time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC),
+		NotAfter:   time.Now().Add(day),
+		SelfSigned: true,
+	}
+	got := cert.String()
+	for _, want := range []string{"CN=localhost, issued by CN=localhost (self-signed)", "valid 2025-01-02 to ", "names localhost app.test"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%q doesn't contain %q", got, want)
+		}
+	}
+	if strings.Contains(got, "EXPIRED") {
+		t.Errorf("%q: flagged a valid certificate", got)
+	}
+
+	cert.NotAfter = time.Now().Add(-day)
+	if got := cert.String(); !strings.HasSuffix(got, " - EXPIRED") {
+		t.Errorf("%q: expired certificate not flagged", got)
+	}
+	cert.NotBefore, cert.NotAfter = time.Now().Add(day), time.Now().Add(2*day)
+	if got := cert.String(); !strings.HasSuffix(got, " - NOT YET VALID") {
+		t.Errorf("%q: future certificate not flagged", got)
+	}
+}
+
+func TestLocalHTTPSFlags(t *testing.T) {
+	t.Setenv("TUNNELR_LOCAL_HTTPS", "")
+	_, opts, err := parseConnectArgs([]string{"3000", "--local-https"})
+	if err != nil || !opts.localHTTPS || opts.insecureSkipVerify {
+		t.Errorf("--local-https: got %+v, %v; want verification on by default", opts, err)
+	}
+	if _, opts, err := parseConnectArgs([]string{"3000", "--local-https", "--insecure-skip-verify"}); err != nil || !opts.insecureSkipVerify {
+		t.Errorf("--insecure-skip-verify: got %v, %v", opts.insecureSkipVerify, err)
+	}
+
+	// Skipping verification means nothing without HTTPS, so it's refused
+	// rather than silently ignored
+	for _, flag := range []string{"--insecure-skip-verify", "--show-cert"} {
+		if _, _, err := parseConnectArgs([]string{"3000", flag}); err == nil {
+			t.Errorf("%s accepted without --local-https", flag)
+		}
+	}
+}
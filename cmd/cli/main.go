@@ -2,15 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"tunnelr/internal/tunnel"
 
@@ -29,17 +39,34 @@ func main() {
 
 	switch command {
 	case "connect":
-		if len(os.Args) < 3 {
-			fmt.Println("Error: port number required")
-			fmt.Println("Usage: tunnelr connect <port>")
-			os.Exit(1)
+		targets, opts, err := parseConnectArgs(os.Args[2:])
+		if err == flag.ErrHelp {
+			return
 		}
-		port, err := strconv.Atoi(os.Args[2])
 		if err != nil {
-			fmt.Printf("Error: invalid port number: %s\n", os.Args[2])
+			fmt.Printf("Error: %v\n", err)
+			fmt.Println("Usage: tunnelr connect [host:]<port>[,[host:]<port>...] [--subdomain name] [--inspect-addr host:port]")
 			os.Exit(1)
 		}
-		runConnect(port)
+		runConnect(targets, opts)
+
+	case "ping":
+		runPing()
+
+	case "doctor":
+		runDoctor(os.Args[2:])
+
+	case "list":
+		runList(os.Args[2:])
+
+	case "replay":
+		runReplay(os.Args[2:])
+
+	case "update":
+		runUpdate(os.Args[2:])
+
+	case "version", "--version":
+		printVersion(os.Stdout)
 
 	case "help", "--help", "-h":
 		printUsage()
@@ -51,210 +78,1377 @@ func main() {
 	}
 }
 
+// defaultMaxConcurrent caps the requests in flight unless --max-concurrent
+// says otherwise, so a flood of visitors can't start unlimited work on the
+// local server (or unlimited goroutines here)
+const defaultMaxConcurrent = 50
+
+// connectOptions are the flags accepted by `tunnelr connect`
+type connectOptions struct {
+	inspectAddr string // Where the inspector listens; empty or "off" disables it
+	subdomain   string // Requested tunnel ID, random if empty
+	token       string // Auth token sent when registering
+
+	handshakeTimeout time.Duration // Give up connecting to the server after this long
+	transport        string        // auto, websocket or poll, see poll.go
+
+	maxConcurrent    int    // Requests handled at once, 0 = unlimited
+	overloadFallback string // What the server serves while we're at maxConcurrent
+
+	urlOutput string // File, named pipe or "-" (stdout) that gets the public URL
+
+	warmup time.Duration // How long the server retries requests while the local server starts
+
+	basicAuth string // "user:pass" visitors must log in with, empty for an open tunnel
+
+	hostHeader string // Host sent to the local server, see localHostHeader
+
+	noBuffering bool // Pass every response on as it's written, not in one piece
+
+	localHTTPS         bool // Talk HTTPS to the local server
+	insecureSkipVerify bool // Accept any certificate from it (--local-https only)
+	showCert           bool // Print its certificate and add it to the inspector (--local-https only)
+
+	localKeepAlive time.Duration // TCP keepalive interval on local connections, 0 = off
+
+	gzipLevel int // gzip level for bodies in both directions, 0 = default
+
+	maxBodySize string // Largest request body visitors may send, e.g. "100MB", empty = the server's default
+
+	rewrites        rewriteFlags // Find/replace rules the server applies to bodies
+	rewriteTypes    string       // Comma-separated media types they apply to, empty = text/html
+	rewriteRequests bool         // Rewrite request bodies too
+}
+
+// parseConnectArgs reads `connect <targets> [flags]` - flags may come before
+// or after the targets (see parseTargets)
+func parseConnectArgs(args []string) ([]string, connectOptions, error) {
+	var opts connectOptions
+
+	fs := flag.NewFlagSet("connect", flag.ContinueOnError)
+	fs.StringVar(&opts.inspectAddr, "inspect-addr", getEnv("TUNNELR_INSPECT_ADDR", defaultInspectAddr),
+		`address for the request inspector ("off" to disable)`)
+	inspect := fs.Bool("inspect", getEnvBool("TUNNELR_INSPECT", true), "record requests for the inspector (--inspect=false to disable)")
+	fs.DurationVar(&opts.handshakeTimeout, "handshake-timeout", defaultHandshakeTimeout, "give up connecting to the server after this long")
+	fs.StringVar(&opts.transport, "transport", getEnv("TUNNELR_TRANSPORT", transportAuto),
+		"how to reach the server: websocket, poll (HTTP long-polling) or auto (poll if WebSockets are blocked)")
+	fs.StringVar(&opts.token, "token", getEnv("TUNNELR_TOKEN", ""), "auth token for the tunnel server")
+	fs.StringVar(&opts.subdomain, "subdomain", getEnv("TUNNELR_SUBDOMAIN", ""), "ask for this subdomain instead of a random one")
+	fs.StringVar(&opts.urlOutput, "url-output", getEnv("TUNNELR_URL_OUTPUT", ""), `write the public URL to this file or named pipe ("-" for stdout)`)
+	fs.IntVar(&opts.maxConcurrent, "max-concurrent", getEnvInt("TUNNELR_MAX_CONCURRENT", defaultMaxConcurrent), "most requests sent to the local server at once (0 = unlimited)")
+	fs.StringVar(&opts.overloadFallback, "overload-fallback", getEnv("TUNNELR_OVERLOAD_FALLBACK", ""),
+		"what visitors get while --max-concurrent is reached: error, page or stale (default: the server's choice)")
+	fs.StringVar(&opts.hostHeader, "host-header", getEnv("TUNNELR_HOST_HEADER", ""),
+		`Host header sent to the local server (default localhost:<port>, "preserve" for the public host)`)
+	fs.BoolVar(&opts.noBuffering, "no-buffering", getEnvBool("TUNNELR_NO_BUFFERING", false),
+		"pass responses on as the local server writes them (for progress output and logs)")
+	fs.BoolVar(&opts.localHTTPS, "local-https", getEnvBool("TUNNELR_LOCAL_HTTPS", false), "the local server speaks HTTPS")
+	fs.BoolVar(&opts.insecureSkipVerify, "insecure-skip-verify", false,
+		"with --local-https, accept the local server's certificate without verifying it (e.g. self-signed)")
+	fs.BoolVar(&opts.showCert, "show-cert", getEnvBool("TUNNELR_SHOW_CERT", false),
+		"with --local-https, print the local server's certificate and show it in the inspector")
+	fs.DurationVar(&opts.localKeepAlive, "local-keepalive", getEnvDuration("TUNNELR_LOCAL_KEEPALIVE", defaultLocalKeepAlive),
+		"TCP keepalive interval on connections to the local server (0 = off)")
+	fs.IntVar(&opts.gzipLevel, "gzip-level", getEnvInt("TUNNELR_GZIP_LEVEL", 0),
+		"gzip level for bodies through the tunnel, 1 (fastest) to 9 (smallest), 0 = default")
+	fs.StringVar(&opts.maxBodySize, "max-body-size", getEnv("TUNNELR_MAX_BODY_SIZE", ""),
+		"largest request body visitors may send, e.g. 500KB or 100MB (the server may cap it)")
+	fs.StringVar(&opts.basicAuth, "basic-auth", getEnv("TUNNELR_BASIC_AUTH", ""), "require visitors to log in with user:pass")
+	fs.DurationVar(&opts.warmup, "warmup", getEnvDuration("TUNNELR_WARMUP", 0),
+		"after connecting, retry requests for this long while the local server starts up")
+	fs.Var(&opts.rewrites, "rewrite", `find/replace in response bodies, "pattern=>replacement" (repeatable, {public_url} is the tunnel URL)`)
+	fs.StringVar(&opts.rewriteTypes, "rewrite-types", getEnv("TUNNELR_REWRITE_TYPES", ""),
+		"comma-separated content types --rewrite applies to (default text/html)")
+	fs.BoolVar(&opts.rewriteRequests, "rewrite-requests", false, "apply --rewrite to request bodies too")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, opts, err
+	}
+	if fs.NArg() < 1 {
+		return nil, opts, fmt.Errorf("port number required")
+	}
+	target := fs.Arg(0)
+
+	// In Go, the flag package stops at the first non-flag argument, so parse
+	// whatever follows the port as well
+	if err := fs.Parse(fs.Args()[1:]); err != nil {
+		return nil, opts, err
+	}
+	if fs.NArg() > 0 {
+		return nil, opts, fmt.Errorf("unexpected argument: %s", fs.Arg(0))
+	}
+
+	targets, err := parseTargets(target)
+	if err != nil {
+		return nil, opts, err
+	}
+	if opts.inspectAddr == "off" || !*inspect {
+		opts.inspectAddr = ""
+	}
+
+	// Subdomains are case-insensitive, the server only takes lowercase
+	opts.subdomain = strings.ToLower(opts.subdomain)
+	if opts.subdomain != "" && !tunnel.ValidSubdomain(opts.subdomain) {
+		return nil, opts, fmt.Errorf("invalid subdomain %q: use letters, digits and hyphens, not starting or ending with a hyphen", opts.subdomain)
+	}
+	switch opts.transport {
+	case transportAuto, transportWebSocket, transportPoll:
+	default:
+		return nil, opts, fmt.Errorf("invalid --transport %q: use auto, websocket or poll", opts.transport)
+	}
+	if opts.maxConcurrent < 0 {
+		return nil, opts, fmt.Errorf("--max-concurrent can't be negative")
+	}
+	if opts.overloadFallback != "" && !tunnel.ValidFallback(opts.overloadFallback) {
+		return nil, opts, fmt.Errorf("invalid --overload-fallback %q: use error, page or stale", opts.overloadFallback)
+	}
+	if opts.basicAuth != "" && !tunnel.ValidBasicAuth(opts.basicAuth) {
+		// Not echoing the value - it's a password
+		return nil, opts, fmt.Errorf("invalid --basic-auth: use user:password with a non-empty user and password")
+	}
+	if opts.insecureSkipVerify && !opts.localHTTPS {
+		return nil, opts, fmt.Errorf("--insecure-skip-verify only applies with --local-https")
+	}
+	if opts.showCert && !opts.localHTTPS {
+		return nil, opts, fmt.Errorf("--show-cert only applies with --local-https")
+	}
+	if opts.warmup < 0 {
+		return nil, opts, fmt.Errorf("--warmup can't be negative")
+	}
+	if opts.localKeepAlive < 0 {
+		return nil, opts, fmt.Errorf("--local-keepalive can't be negative (use 0 to turn it off)")
+	}
+	if !tunnel.ValidGzipLevel(opts.gzipLevel) {
+		return nil, opts, fmt.Errorf("invalid --gzip-level %d: use 1 (fastest) to 9 (smallest), or 0 for the default", opts.gzipLevel)
+	}
+	if _, err := tunnel.NewBodyRewriter(opts.bodyRewrite()); err != nil {
+		return nil, opts, fmt.Errorf("--rewrite: %v", err)
+	}
+	if _, err := parseSize(opts.maxBodySize); err != nil {
+		return nil, opts, fmt.Errorf("invalid --max-body-size: %v", err)
+	}
+	return targets, opts, nil
+}
+
+// parseSize reads a size in bytes, with an optional KB, MB or GB suffix
+// (1024-based, like the sizes the CLI prints), "" = 0
+func parseSize(text string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(text))
+	if s == "" {
+		return 0, nil
+	}
+	unit := int64(1)
+	for _, suffix := range []struct {
+		name string
+		size int64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"B", 1}} {
+		if number, found := strings.CutSuffix(s, suffix.name); found {
+			s, unit = strings.TrimSpace(number), suffix.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q isn't a size, use e.g. 500KB or 100MB", text)
+	}
+	return int64(n * float64(unit)), nil
+}
+
 func printUsage() {
 	fmt.Println("Tunnelr - Localhost to Live")
 	fmt.Println("")
 	fmt.Println("Usage:")
-	fmt.Println("  tunnelr connect <port>   Create a tunnel to localhost:<port>")
+	fmt.Println("  tunnelr connect <port>   Create a tunnel to localhost:<port> (or <host>:<port>)")
+	fmt.Println("  tunnelr ping             Check that the tunnel server is reachable")
+	fmt.Println("  tunnelr doctor [port]    Check the server, token, local server, DNS and clock")
+	fmt.Println("  tunnelr list             Show the tunnels open with your token (--token, --json)")
+	fmt.Println("  tunnelr replay <file>    Send recorded requests to a tunnel (--url, --concurrency, --rate)")
+	fmt.Println("  tunnelr update           Install the latest release (--url, --check, --force)")
+	fmt.Println("  tunnelr version          Show the version of this binary")
 	fmt.Println("  tunnelr help             Show this help message")
 	fmt.Println("")
+	fmt.Println("Connect options:")
+	fmt.Println("  --subdomain <name>       Ask for a fixed subdomain instead of a random one")
+	fmt.Println("  --token <token>          Auth token for the server (or set TUNNELR_TOKEN)")
+	fmt.Println("  --handshake-timeout <d>  Give up connecting to the server after this long (default 15s)")
+	fmt.Println("  --transport <t>          websocket, poll (HTTP long-polling) or auto (default: poll if WebSockets are blocked)")
+	fmt.Println("  --inspect-addr <addr>    Request inspector address (default 127.0.0.1:4040, \"off\" to disable)")
+	fmt.Println("  --inspect=false          Don't run the request inspector")
+	fmt.Println("  --url-output <path>      Write the public URL to a file or named pipe (\"-\" for stdout)")
+	fmt.Println("  --max-concurrent <n>     Most requests sent to the local server at once (default 50, 0 = unlimited)")
+	fmt.Println("  --overload-fallback <f>  What visitors get beyond that: error, page or stale")
+	fmt.Println("  --host-header <host>     Host sent to the local server (default localhost:<port>, \"preserve\" = public host)")
+	fmt.Println("  --no-buffering           Pass responses on as the local server writes them")
+	fmt.Println("  --local-https            The local server speaks HTTPS")
+	fmt.Println("  --insecure-skip-verify   With --local-https, don't verify its certificate (self-signed)")
+	fmt.Println("  --show-cert              With --local-https, print the local server's certificate")
+	fmt.Println("  --local-keepalive <d>    TCP keepalive interval to the local server (default 15s, 0 = off)")
+	fmt.Println("  --gzip-level <n>         gzip level for bodies, 1 (fastest) to 9 (smallest)")
+	fmt.Println("  --max-body-size <size>   Largest request body visitors may send, e.g. 100MB (capped by the server)")
+	fmt.Println("  --basic-auth <user:pass> Require visitors to log in (or set TUNNELR_BASIC_AUTH)")
+	fmt.Println("  --warmup <d>             Retry requests for this long while the local server starts (e.g. 30s)")
+	fmt.Println("  --rewrite <find=>repl>   Find/replace in HTML responses, repeatable ({public_url} = tunnel URL)")
+	fmt.Println("  --rewrite-types <types>  Content types --rewrite applies to (default text/html)")
+	fmt.Println("  --rewrite-requests       Apply --rewrite to request bodies too")
+	fmt.Println("")
 	fmt.Println("Example:")
 	fmt.Println("  tunnelr connect 3000     Expose localhost:3000 to the internet")
+	fmt.Println("  tunnelr connect 192.168.1.50:8080   Expose a server on another machine")
 }
 
-func runConnect(localPort int) {
+// wsCompression configures permessage-deflate on the tunnel connection
+// Only used when the server enables it too
+var wsCompression = tunnel.CompressionConfig{
+	Enabled:   getEnvBool("TUNNELR_COMPRESSION", false),
+	Level:     getEnvInt("TUNNELR_COMPRESSION_LEVEL", 1),
+	Threshold: getEnvInt("TUNNELR_COMPRESSION_THRESHOLD", 1024),
+}
+
+// streamThreshold is the largest response body sent in a single message
+// Anything bigger is streamed in chunks, if the server supports it
+var streamThreshold = int64(getEnvInt("TUNNELR_STREAM_THRESHOLD", 1024*1024))
+
+// bodyStallTimeout is how long a streamed response waits for the server to
+// ask for more, i.e. for the visitor to read the chunks already sent
+const bodyStallTimeout = 2 * time.Minute
+
+// timingHeaders adds how long the local server took to each response, so
+// browser devtools can tell tunnel overhead apart from local latency
+var timingHeaders = getEnvBool("TUNNELR_TIMING_HEADERS", false)
+
+// pingInterval is how often we ping the server, so a dead connection is
+// noticed instead of waiting forever - 0 turns keepalives off
+var pingInterval = getEnvDuration("TUNNELR_PING_INTERVAL", 30*time.Second)
+
+// maxResponseHeaderBytes caps the size of the local server's response headers
+// A buggy app sending megabytes of headers gets a 502 instead of us copying
+// them all into a message for the server
+var maxResponseHeaderBytes = int64(getEnvInt("TUNNELR_MAX_RESPONSE_HEADER_BYTES", 64*1024))
+
+// localTransport is shared by all requests to the local server, so
+// connections to it are reused
+var localTransport = newLocalTransport()
+
+func newLocalTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if maxResponseHeaderBytes > 0 {
+		transport.MaxResponseHeaderBytes = maxResponseHeaderBytes
+	}
+	transport.ResponseHeaderTimeout = localResponseTimeout
+	// Otherwise Go asks for gzip when the visitor didn't, and quietly
+	// unzips the answer - dropping Content-Encoding and Content-Length on
+	// the way. Bodies and those headers have to reach the visitor as the
+	// local server sent them.
+	transport.DisableCompression = true
+	return transport
+}
+
+// isHeaderTooLarge reports whether a request failed because the response
+// headers went over MaxResponseHeaderBytes
+// net/http doesn't export an error value for this, so we match the message
+func isHeaderTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "server response headers exceeded")
+}
+
+// isLocalServerDown reports whether a request failed because nothing accepted
+// the connection on the local port (e.g. the app is still starting)
+func isLocalServerDown(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func runConnect(addrs []string, opts connectOptions) {
+	targets := newLocalTargets(addrs)
+	scheme := "http"
+	if opts.localHTTPS {
+		scheme = "https"
+		useLocalTLS(opts.insecureSkipVerify)
+	}
+	useLocalKeepAlive(opts.localKeepAlive)
+
+	// The server only shows where we forward to - the first target stands
+	// in for all of them
+	localHost, portArg, _ := net.SplitHostPort(addrs[0])
+	localPort, _ := strconv.Atoi(portArg)
+
 	// Server URL - in production, this would be configurable
 	serverURL := getEnv("TUNNELR_SERVER", "ws://localhost:8080/ws")
 
+	// Set up first: with "-" it moves our regular output to stderr
+	urls := newURLOutput(opts.urlOutput)
+
 	fmt.Printf("Connecting to tunnel server...\n")
 
 	// Connect to server
-	conn, _, err := websocket.DefaultDialer.Dial(serverURL, nil)
-	if err != nil {
-		log.Fatalf("Failed to connect to server: %v", err)
+	if wsCompression.Enabled && !wsCompression.ValidLevel() {
+		log.Fatalf("TUNNELR_COMPRESSION_LEVEL must be between 1 and 9, got %d", wsCompression.Level)
 	}
-	defer conn.Close()
 
-	// Send register message
-	regPayload := tunnel.TunnelRegister{LocalPort: localPort}
-	regBytes, _ := json.Marshal(regPayload)
-	regMsg := tunnel.Message{
-		Type:    tunnel.TypeTunnelRegister,
-		Payload: regBytes,
+	wsDialer, err := newDialer(opts.handshakeTimeout)
+	if err != nil {
+		log.Fatalf("%v", err)
 	}
-	regMsgBytes, _ := json.Marshal(regMsg)
+	dialer := newTransportDialer(wsDialer, opts.transport)
 
-	if err := conn.WriteMessage(websocket.TextMessage, regMsgBytes); err != nil {
-		log.Fatalf("Failed to register tunnel: %v", err)
+	// Ctrl+C cancels ctx - whether we're connected or waiting to reconnect
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	reg := tunnel.TunnelRegister{
+		LocalPort:    localPort,
+		Capabilities: tunnel.SupportedCapabilities,
+		AuthToken:    opts.token,
+		Subdomain:    opts.subdomain,
+
+		OverloadFallback: opts.overloadFallback,
+		WarmupSeconds:    int(opts.warmup.Round(time.Second) / time.Second),
+		BasicAuth:        opts.basicAuth,
+		Unbuffered:       opts.noBuffering,
+		Rewrite:          opts.bodyRewrite(),
+		GzipLevel:        opts.gzipLevel,
+		ProtocolVersion:  tunnel.ProtocolVersion,
 	}
+	reg.MaxBodyBytes, _ = parseSize(opts.maxBodySize) // Checked by parseConnectArgs
 
-	// Wait for tunnel assignment
-	_, assignBytes, err := conn.ReadMessage()
-	if err != nil {
-		log.Fatalf("Failed to receive tunnel assignment: %v", err)
+	if localHost != defaultLocalHost {
+		reg.LocalHost = localHost
 	}
 
-	var assignMsg tunnel.Message
-	if err := json.Unmarshal(assignBytes, &assignMsg); err != nil {
-		log.Fatalf("Invalid assignment message: %v", err)
+	// The first attempt doesn't retry - a wrong server URL or token should
+	// fail right away
+	conn, assigned, err := connectTunnel(ctx, dialer, serverURL, reg)
+	if err != nil {
+		log.Fatalf("%v", err)
 	}
 
-	var assigned tunnel.TunnelAssigned
-	if err := json.Unmarshal(assignMsg.Payload, &assigned); err != nil {
-		log.Fatalf("Invalid assignment payload: %v", err)
+	// The inspector is a convenience - if its port is taken, carry on without it
+	var ins *inspector
+	var inspectURL string
+	if opts.inspectAddr != "" {
+		ins = newInspector()
+		if err := startInspector(opts.inspectAddr, ins); err != nil {
+			log.Printf("Inspector disabled: %v", err)
+			ins = nil
+		} else {
+			inspectURL = "http://" + opts.inspectAddr
+		}
 	}
 
 	// Show the user their tunnel URL
+	urls.Publish(assigned.PublicURL)
 	fmt.Println("")
 	fmt.Println("Tunnel established!")
 	fmt.Println("")
 	fmt.Printf("  Public URL:  %s\n", assigned.PublicURL)
-	fmt.Printf("  Forwarding:  %s -> http://localhost:%d\n", assigned.PublicURL, localPort)
+	for _, addr := range targets.Addrs() {
+		fmt.Printf("  Forwarding:  %s -> %s://%s\n", assigned.PublicURL, scheme, addr)
+	}
+	if targets.Len() > 1 {
+		fmt.Printf("               (round-robin over %d servers)\n", targets.Len())
+	}
+	if opts.insecureSkipVerify {
+		fmt.Println("  Warning:     the local server's certificate is not verified")
+	}
+	if inspectURL != "" {
+		fmt.Printf("  Inspector:   %s\n", inspectURL)
+	}
+	if opts.basicAuth != "" {
+		user, _, _ := strings.Cut(opts.basicAuth, ":")
+		fmt.Printf("  Basic auth:  required (user %q)\n", user)
+	}
 	fmt.Println("")
 	fmt.Println("Press Ctrl+C to close the tunnel")
 	fmt.Println("")
 
-	// Handle Ctrl+C
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	for {
+		sess := newSession(conn, targets, assigned.Capabilities)
+		sess.inspector = ins
+		ins.SetReplay(sess.replayLocal)
+		sess.hostHeader = opts.hostHeader
+		sess.unbuffered = opts.noBuffering
+		sess.localTLS = opts.localHTTPS
+		sess.showCert = opts.showCert
+		sess.codec.Level = opts.gzipLevel
+		if opts.maxConcurrent > 0 {
+			sess.slots = make(chan struct{}, opts.maxConcurrent)
+		}
 
-	// Channel to signal when we should exit
-	done := make(chan struct{})
+		// Channel to signal when the connection is gone
+		done := make(chan struct{})
 
-	// Listen for incoming requests
-	go func() {
-		defer close(done)
-		handleIncomingRequests(conn, localPort)
-	}()
+		// Listen for incoming requests
+		go func() {
+			defer close(done)
+			sess.handleIncomingRequests()
+		}()
 
-	// Wait for interrupt or connection close
-	select {
-	case <-interrupt:
-		fmt.Println("\nClosing tunnel...")
-		conn.WriteMessage(websocket.CloseMessage,
-			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-	case <-done:
-		fmt.Println("Connection closed by server")
+		// Wait for interrupt, connection close, or the server moving us
+		var movedConn *tunnel.SafeConn
+		var movedTo *tunnel.TunnelAssigned
+		ended := false
+		for !ended && movedConn == nil {
+			select {
+			case <-ctx.Done():
+				fmt.Println("\nClosing tunnel...")
+				conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				conn.Close()
+				return
+			case <-done:
+				conn.Close()
+				ended = true
+			case target := <-sess.migrate:
+				// If the move fails we stay, and keep waiting here
+				movedConn, movedTo = migrateTunnel(ctx, dialer, target, reg, assigned.TunnelID)
+				if movedConn == nil {
+					sess.migrating.Store(false)
+				} else {
+					serverURL = target
+					go sess.drain()
+				}
+			}
+		}
+		if movedConn == nil && sess.closedForGood {
+			return
+		}
+
+		previousURL := assigned.PublicURL
+		if movedConn != nil {
+			conn, assigned = movedConn, movedTo
+		} else {
+			// Dial again until it works or the user gives up
+			conn, assigned = reconnect(ctx, dialer, serverURL, reg, assigned.TunnelID)
+			if conn == nil {
+				return
+			}
+		}
+		if assigned.PublicURL != previousURL {
+			fmt.Printf("\n  New public URL:  %s\n\n", assigned.PublicURL)
+		}
+		urls.Publish(assigned.PublicURL)
+	}
+}
+
+// connectError is a failed attempt to open the tunnel
+type connectError struct {
+	msg       string
+	code      string // The server's TunnelError code, if it sent one
+	permanent bool   // Retrying can't help, e.g. the server rejected our token
+}
+
+func (e *connectError) Error() string {
+	return e.msg
+}
+
+// connectTunnel dials the server and registers a tunnel
+// Errors are always a *connectError
+func connectTunnel(ctx context.Context, dialer tunnelDialer, serverURL string, reg tunnel.TunnelRegister) (*tunnel.SafeConn, *tunnel.TunnelAssigned, error) {
+	wsConn, resp, err := dialer.DialContext(ctx, serverURL, nil)
+	if err != nil {
+		return nil, nil, &connectError{msg: "Failed to connect to server: " + describeDialError(err, resp)}
+	}
+
+	// Requests are answered from parallel goroutines - SafeConn serializes
+	// their writes
+	conn := tunnel.NewSafeConn(wsConn, wsCompression)
+
+	assigned, err := registerTunnel(conn, reg)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, assigned, nil
+}
+
+// registerTunnel sends the register message and waits for the assignment
+func registerTunnel(conn *tunnel.SafeConn, reg tunnel.TunnelRegister) (*tunnel.TunnelAssigned, error) {
+	regMsgBytes, err := tunnel.Encode(tunnel.TypeTunnelRegister, reg)
+	if err != nil {
+		return nil, &connectError{msg: fmt.Sprintf("Failed to encode register message: %v", err), permanent: true}
+	}
+
+	if err := conn.Send(regMsgBytes); err != nil {
+		return nil, &connectError{msg: fmt.Sprintf("Failed to register tunnel: %v", err)}
+	}
+
+	// Wait for tunnel assignment
+	_, assignBytes, err := conn.ReadMessage()
+	if err != nil {
+		// A server that rejects our token closes with a reason
+		if closeErr, ok := err.(*websocket.CloseError); ok && closeErr.Text != "" {
+			return nil, &connectError{msg: "Server refused the tunnel: " + closeErr.Text, permanent: true}
+		}
+		return nil, &connectError{msg: fmt.Sprintf("Failed to receive tunnel assignment: %v", err)}
+	}
+
+	var assignMsg tunnel.Message
+	if err := json.Unmarshal(assignBytes, &assignMsg); err != nil {
+		return nil, &connectError{msg: fmt.Sprintf("Invalid assignment message: %v", err)}
+	}
+
+	// The server refuses with a tunnel_error instead of an assignment
+	if assignMsg.Type == tunnel.TypeTunnelError {
+		var tunnelErr tunnel.TunnelError
+		json.Unmarshal(assignMsg.Payload, &tunnelErr)
+		// Retrying won't help when what we asked for is invalid
+		permanent := tunnelErr.Code == tunnel.ErrCodeSubdomainInvalid || tunnelErr.Code == tunnel.ErrCodeSubdomainReserved ||
+			tunnelErr.Code == tunnel.ErrCodeBasicAuthInvalid || tunnelErr.Code == tunnel.ErrCodeRewriteInvalid ||
+			tunnelErr.Code == tunnel.ErrCodeProtocolVersion
+		return nil, &connectError{
+			msg:       "Server refused the tunnel: " + tunnelErr.Message,
+			code:      tunnelErr.Code,
+			permanent: permanent,
+		}
+	}
+
+	var assigned tunnel.TunnelAssigned
+	if err := json.Unmarshal(assignMsg.Payload, &assigned); err != nil {
+		return nil, &connectError{msg: fmt.Sprintf("Invalid assignment payload: %v", err)}
+	}
+
+	// The server must answer in our version - a newer one that still
+	// accepted us may speak several, an older one sends none at all
+	if !tunnel.CompatibleVersion(assigned.ProtocolVersion) {
+		advice := "upgrade the CLI (tunnelr update)"
+		if assigned.ProtocolVersion < tunnel.ProtocolVersion {
+			advice = "the server needs upgrading, or use an older CLI"
+		}
+		return nil, &connectError{
+			msg: fmt.Sprintf("Server speaks protocol version %d but this CLI speaks version %d: %s",
+				assigned.ProtocolVersion, tunnel.ProtocolVersion, advice),
+			permanent: true,
+		}
+	}
+
+	// An older server ignores the credentials - don't expose the app
+	// unprotected when the user asked for a login
+	if reg.BasicAuth != "" && !tunnel.HasCapability(assigned.Capabilities, tunnel.CapBasicAuth) {
+		return nil, &connectError{msg: "Server doesn't support --basic-auth, not opening an unprotected tunnel", permanent: true}
+	}
+	if reg.Rewrite != nil && !tunnel.HasCapability(assigned.Capabilities, tunnel.CapRewrite) {
+		return nil, &connectError{msg: "Server doesn't support --rewrite", permanent: true}
+	}
+	return &assigned, nil
+}
+
+// describeDialError explains a failed WebSocket dial
+// If the server answered the handshake with an HTTP error (401, 503...) the
+// status and the start of its body say far more than the bare dial error
+func describeDialError(err error, resp *http.Response) string {
+	if resp == nil {
+		return err.Error()
+	}
+	defer resp.Body.Close()
+
+	msg := fmt.Sprintf("server rejected the connection: %s", resp.Status)
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if text := strings.TrimSpace(string(body)); text != "" {
+		msg += " - " + text
+	}
+	return msg
+}
+
+// session is the state of one established tunnel connection
+type session struct {
+	conn      *tunnel.SafeConn
+	targets   *localTargets // Local servers requests are sent to
+	streaming bool          // Server agreed to chunked bodies
+	paced     bool          // Server agreed to flow control, see tunnel/flow.go
+	codec     tunnel.Codec  // How messages are encoded (gzip, binary frames)
+	inspector *inspector    // Records requests for the inspector page, may be nil
+
+	// Host header for local requests: "" = the local address, "preserve" =
+	// the host the visitor used, anything else is sent as-is
+	hostHeader string
+
+	// Every response is streamed as it's written (--no-buffering)
+	unbuffered bool
+
+	// The local server speaks HTTPS (--local-https)
+	localTLS bool
+
+	// Show the local server's certificate (--show-cert), each one once
+	showCert  bool
+	certsSeen sync.Map
+
+	// One entry per request in flight when --max-concurrent is set, nil
+	// means unlimited
+	slots chan struct{}
+
+	// ctx is canceled when the connection to the server goes away, which
+	// aborts any local requests still in flight - nobody is left to answer
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// The server closed the tunnel for having no traffic, or an admin
+	// disconnected it - reconnecting would only bring back the tunnel it
+	// wanted gone
+	closedForGood bool
+
+	// Server URLs the server asked us to move to (TypeMigrate), and whether
+	// we're moving - this connection ending is then expected
+	migrate   chan string
+	migrating atomic.Bool
+
+	// Requests being answered, so a migrated connection knows when it's done
+	inflight atomic.Int64
+
+	// Request bodies still arriving from the server, by request ID
+	bodiesMu sync.Mutex
+	bodies   map[string]*incomingBody
+
+	// Response bodies we're streaming to the server
+	windows *tunnel.SendWindows
+
+	// WebSockets relayed to the local server, by ID
+	socketsMu sync.Mutex
+	sockets   map[string]*localSocket
+}
+
+// incomingBody is a streamed request body being fed to the local server
+type incomingBody struct {
+	chunks chan *tunnel.BodyChunk
+	pipe   *io.PipeWriter
+}
+
+func newSession(conn *tunnel.SafeConn, targets *localTargets, capabilities []string) *session {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &session{
+		ctx:       ctx,
+		cancel:    cancel,
+		conn:      conn,
+		targets:   targets,
+		streaming: tunnel.HasCapability(capabilities, tunnel.CapStreaming),
+		paced:     tunnel.HasCapability(capabilities, tunnel.CapFlowControl),
+		codec:     tunnel.NewCodec(capabilities),
+		bodies:    make(map[string]*incomingBody),
+		windows:   tunnel.NewSendWindows(),
+		sockets:   make(map[string]*localSocket),
+		migrate:   make(chan string, 1),
 	}
 }
 
 // handleIncomingRequests listens for HTTP requests from the server
-func handleIncomingRequests(conn *websocket.Conn, localPort int) {
+func (s *session) handleIncomingRequests() {
+	// If the connection drops, cancel in-flight local requests and fail
+	// any bodies that will never finish
+	defer s.cancel()
+	defer s.abortBodies()
+	defer s.abortSockets()
+	defer s.windows.StopAll()
+
+	stopKeepalive := s.conn.StartKeepalive(pingInterval)
+	defer stopKeepalive()
+
 	for {
-		_, msgBytes, err := conn.ReadMessage()
+		_, msgBytes, err := s.conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+			if s.migrating.Load() {
+				return // The server is sending us elsewhere, see migrate.go
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				log.Printf("Server stopped answering pings, connection lost")
+			} else if closeErr, ok := err.(*websocket.CloseError); ok && closeErr.Code == tunnel.CloseIdle {
+				fmt.Printf("\nServer closed the idle tunnel (%s), run tunnelr connect again to reopen it\n", closeErr.Text)
+				s.closedForGood = true
+			} else if closeErr, ok := err.(*websocket.CloseError); ok && closeErr.Code == tunnel.CloseDisconnected {
+				fmt.Printf("\nAn admin disconnected the tunnel (%s)\n", closeErr.Text)
+				s.closedForGood = true
+			} else if closeErr, ok := err.(*websocket.CloseError); ok && closeErr.Code == websocket.CloseGoingAway && closeErr.Text != "" {
+				fmt.Printf("\nServer closed the tunnel: %s\n", closeErr.Text)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
 				log.Printf("Connection error: %v", err)
 			}
 			return
 		}
 
-		var msg tunnel.Message
-		if err := json.Unmarshal(msgBytes, &msg); err != nil {
+		msg, err := tunnel.DecodeMessage(msgBytes)
+		if err != nil {
 			log.Printf("Invalid message: %v", err)
 			continue
 		}
+		if err := msg.Decompress(); err != nil {
+			log.Printf("Invalid compressed message: %v", err)
+			continue
+		}
 
-		if msg.Type == tunnel.TypeHTTPRequest {
+		switch msg.Type {
+		case tunnel.TypeHTTPRequest:
 			var req tunnel.HTTPRequest
-			if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			if err := msg.Unmarshal(&req); err != nil {
 				log.Printf("Invalid request: %v", err)
 				continue
 			}
+			tunnel.RestoreRawHeaders(req.Headers, req.RawHeaders)
+
+			// A streamed body arrives in later messages - hand the local
+			// request a pipe that fills up as chunks come in
+			body := requestBody(&req)
+			if req.Streamed {
+				body = s.startBody(req.ID)
+			}
+
+			// At the concurrency limit, turn the request away straight off
+			if !s.acquireSlot() {
+				if pr, ok := body.(*io.PipeReader); ok {
+					pr.Close() // The body's chunks are drained and dropped
+				}
+				go s.sendOverloaded(&req)
+				continue
+			}
 
 			// Process request in a goroutine so we can handle concurrent requests
-			go processRequest(conn, localPort, &req)
+			s.inflight.Add(1)
+			go func() {
+				defer s.inflight.Add(-1)
+				defer s.releaseSlot()
+				s.processRequest(&req, body)
+			}()
+
+		case tunnel.TypeBodyChunk:
+			var chunk tunnel.BodyChunk
+			if err := msg.Unmarshal(&chunk); err != nil {
+				log.Printf("Invalid body chunk: %v", err)
+				continue
+			}
+			s.deliverChunk(&chunk)
+
+		case tunnel.TypeBodyAck:
+			var ack tunnel.BodyAck
+			if err := msg.Unmarshal(&ack); err != nil {
+				log.Printf("Invalid body ack: %v", err)
+				continue
+			}
+			s.windows.Ack(ack)
+
+		case tunnel.TypeWSOpen:
+			var open tunnel.WSOpen
+			if err := msg.Unmarshal(&open); err != nil {
+				log.Printf("Invalid WebSocket open: %v", err)
+				continue
+			}
+			go s.openWebSocket(&open)
+
+		case tunnel.TypeWSData:
+			var data tunnel.WSData
+			if err := msg.Unmarshal(&data); err != nil {
+				log.Printf("Invalid WebSocket message: %v", err)
+				continue
+			}
+			s.deliverWSData(&data)
+
+		case tunnel.TypeWSClose:
+			var closed tunnel.WSClose
+			if err := msg.Unmarshal(&closed); err != nil {
+				log.Printf("Invalid WebSocket close: %v", err)
+				continue
+			}
+			s.closeWebSocket(&closed)
+
+		case tunnel.TypeMigrate:
+			var migrate tunnel.Migrate
+			if err := msg.Unmarshal(&migrate); err != nil || !tunnel.ValidServerURL(migrate.ServerURL) {
+				log.Printf("Invalid migrate message: %s", msg.Payload)
+				continue
+			}
+			if migrate.Reason != "" {
+				fmt.Fprintf(os.Stderr, "Server is moving the tunnel to %s (%s)\n", migrate.ServerURL, migrate.Reason)
+			} else {
+				fmt.Fprintf(os.Stderr, "Server is moving the tunnel to %s\n", migrate.ServerURL)
+			}
+			// The main loop does the move - we keep answering meanwhile
+			s.migrating.Store(true)
+			select {
+			case s.migrate <- migrate.ServerURL:
+			default: // A move is already pending
+			}
 		}
 	}
 }
 
-// processRequest forwards an HTTP request to localhost and sends the response back
-func processRequest(conn *websocket.Conn, localPort int, req *tunnel.HTTPRequest) {
-	fmt.Printf("%s %s\n", req.Method, req.Path)
+// startBody sets up a pipe for a streamed request body and returns the read end
+func (s *session) startBody(requestID string) *io.PipeReader {
+	pr, pw := io.Pipe()
+	body := &incomingBody{
+		chunks: make(chan *tunnel.BodyChunk, tunnel.ChunkQueueSize),
+		pipe:   pw,
+	}
 
-	// Build the local URL
-	localURL := fmt.Sprintf("http://localhost:%d%s", localPort, req.Path)
+	s.bodiesMu.Lock()
+	s.bodies[requestID] = body
+	s.bodiesMu.Unlock()
 
-	// Create the HTTP request
-	httpReq, err := http.NewRequest(req.Method, localURL, bytes.NewReader(req.Body))
+	// Copy chunks into the pipe, acking each one the local server took so
+	// the server sends the next. Once writing fails (local server stopped
+	// reading) tell the server to stop, and drop whatever is on its way.
+	go func() {
+		var err error
+		for chunk := range body.chunks {
+			if err == nil && len(chunk.Data) > 0 {
+				if _, err = pw.Write(chunk.Data); err == nil {
+					s.sendBodyAck(requestID, 1, false)
+				} else if !chunk.EOF {
+					s.sendBodyAck(requestID, 0, true)
+				}
+			}
+			if err == nil && chunk.Error != "" {
+				err = fmt.Errorf("request body aborted: %s", chunk.Error)
+			}
+		}
+		pw.CloseWithError(err) // nil error = clean EOF
+	}()
+
+	return pr
+}
+
+// deliverChunk routes a request body chunk to its pipe
+func (s *session) deliverChunk(chunk *tunnel.BodyChunk) {
+	s.bodiesMu.Lock()
+	body, exists := s.bodies[chunk.ID]
+	if exists && chunk.EOF {
+		delete(s.bodies, chunk.ID)
+	}
+	s.bodiesMu.Unlock()
+
+	if !exists {
+		return
+	}
+
+	// Never waits for the local server - the server only sends what we
+	// acked, and a body that fell further behind than that fails on its
+	// own instead of holding up the tunnel
+	select {
+	case body.chunks <- chunk:
+		if chunk.EOF {
+			close(body.chunks)
+		}
+	default:
+		log.Printf("Request body for %s overflowed its buffer, failing the request", chunk.ID)
+		body.pipe.CloseWithError(fmt.Errorf("request body overflowed its buffer"))
+		if !chunk.EOF {
+			s.bodiesMu.Lock()
+			delete(s.bodies, chunk.ID)
+			s.bodiesMu.Unlock()
+			s.sendBodyAck(chunk.ID, 0, true)
+		}
+		close(body.chunks)
+	}
+}
+
+// sendBodyAck gives the server credit for more chunks of a request body, or
+// asks it to stop sending the body
+// Servers that don't do flow control get no acks.
+func (s *session) sendBodyAck(requestID string, chunks int, stop bool) {
+	if !s.paced {
+		return
+	}
+	msgBytes, err := tunnel.EncodeBodyAck(s.codec, requestID, chunks, stop)
 	if err != nil {
-		sendErrorResponse(conn, req.ID, 500, "Failed to create request")
+		log.Printf("Failed to encode body ack: %v", err)
 		return
 	}
+	s.conn.Send(msgBytes) // If this fails the connection is going away anyway
+}
 
-	// Copy headers
-	for key, value := range req.Headers {
-		// Skip hop-by-hop headers
-		if key == "Connection" || key == "Keep-Alive" || key == "Transfer-Encoding" {
-			continue
+// abortBodies fails every body still waiting for chunks
+func (s *session) abortBodies() {
+	s.bodiesMu.Lock()
+	defer s.bodiesMu.Unlock()
+
+	for id, body := range s.bodies {
+		body.pipe.CloseWithError(fmt.Errorf("tunnel connection closed"))
+		close(body.chunks)
+		delete(s.bodies, id)
+	}
+}
+
+// processRequest forwards an HTTP request to localhost and sends the response back
+func (s *session) processRequest(req *tunnel.HTTPRequest, body io.Reader) {
+	reqBytes := requestBodySize(req)
+
+	// Whatever happens, log the request once it's answered and show it in
+	// the inspector. outcome is set when something goes wrong, otherwise
+	// the log shows the status and response size.
+	status := 0
+	start := time.Now()
+	var respBytes int64
+	var localCert *certInfo
+	outcome := ""
+	streamNote := ""
+	defer func() {
+		if outcome == "" {
+			outcome = answered(status, respBytes, streamNote)
 		}
-		httpReq.Header.Set(key, value)
+		logRequest(req.Method, req.Path, reqBytes, outcome)
+		s.inspector.Record(inspectedRequest{
+			Time:          start,
+			Method:        req.Method,
+			Path:          req.Path,
+			StatusCode:    status,
+			DurationMs:    float64(time.Since(start).Microseconds()) / 1000,
+			RequestBytes:  reqBytes,
+			ResponseBytes: respBytes,
+			LocalCert:     localCert,
+		}, req)
+	}()
+
+	// If we bail out early, make sure a streamed body stops waiting on us
+	if pr, ok := body.(*io.PipeReader); ok {
+		defer pr.Close()
 	}
 
-	// Make the request to localhost
-	client := &http.Client{}
-	resp, err := client.Do(httpReq)
+	httpReq, err := s.newLocalRequest(s.ctx, req, body)
 	if err != nil {
-		fmt.Printf("  -> Error: %v\n", err)
-		sendErrorResponse(conn, req.ID, 502, "Failed to reach localhost")
+		status = 500
+		outcome = "500 (failed to create the request)"
+		s.sendErrorResponse(req.ID, 500, "Failed to create request")
 		return
 	}
-	defer resp.Body.Close()
+	// Pass 1xx responses like 103 Early Hints on as they happen (100 Continue
+	// and 101 are handled by the HTTP client itself and never get here)
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			s.sendInformational(req.ID, code, header)
+			return nil
+		},
+	}
+	httpReq = httpReq.WithContext(httptrace.WithClientTrace(httpReq.Context(), trace))
 
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
+	// Make the request, moving on to the next local server if one refuses
+	// the connection
+	client := &http.Client{Transport: localTransport}
+	localStart := time.Now()
+	resp, target, err := s.sendToTargets(client, httpReq, req.Headers)
+	localDuration := time.Since(localStart)
+	if s.showCert {
+		localCert = localCertFrom(resp, err)
+		s.noteLocalCert(localCert)
+	}
 	if err != nil {
-		sendErrorResponse(conn, req.ID, 500, "Failed to read response")
+		if s.ctx.Err() != nil {
+			outcome = "Canceled: tunnel connection closed"
+			return
+		}
+		outcome = fmt.Sprintf("Error: %v", err)
+		status = 502
+		if isHeaderTooLarge(err) {
+			s.sendErrorResponse(req.ID, 502, fmt.Sprintf("Local server's response headers are larger than %d bytes", maxResponseHeaderBytes))
+			return
+		}
+		if isUntrustedCert(err) {
+			s.sendErrorResponse(req.ID, 502, "The local server's certificate isn't trusted (for a self-signed certificate, use --insecure-skip-verify)")
+			return
+		}
+		var message string
+		status, message = describeLocalError(err, target.addr)
+		if isLocalServerDown(err) && status == http.StatusBadGateway {
+			// Marked so the server can retry it during --warmup
+			s.sendUnreachable(req.ID, message)
+			return
+		}
+		s.sendErrorResponse(req.ID, status, message)
 		return
 	}
+	defer resp.Body.Close()
+
+	// A server that switches protocols anyway would leave us waiting on a
+	// connection that never ends - fail clearly instead
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		outcome = fmt.Sprintf("Error: local server switched protocols (%s)", resp.Header.Get("Upgrade"))
+		status = 502
+		s.sendErrorResponse(req.ID, 502, "Local server switched protocols; upgrades are not supported through the tunnel")
+		return
+	}
+
+	// Unbuffered responses are streamed from the first byte, so progress
+	// output reaches the visitor as the local server writes it
+	unbuffered := s.streaming && (s.unbuffered || tunnel.IsUnbuffered(resp.Header))
 
-	// Convert response headers
-	headers := make(map[string]string)
-	for key, values := range resp.Header {
-		if len(values) > 0 {
-			headers[key] = values[0]
+	// Otherwise read the response body, up to the streaming threshold
+	var respBody []byte
+	if !unbuffered {
+		respBody, err = io.ReadAll(io.LimitReader(resp.Body, streamThreshold+1))
+		if err != nil {
+			status = 500
+			outcome = "500 (failed to read the response)"
+			s.sendErrorResponse(req.ID, 500, "Failed to read response")
+			return
+		}
+	}
+
+	streamBody := unbuffered || int64(len(respBody)) > streamThreshold
+	if streamBody && !s.streaming {
+		// Server can't take chunks - buffer the rest
+		rest, err := io.ReadAll(resp.Body)
+		if err != nil {
+			status = 500
+			outcome = "500 (failed to read the response)"
+			s.sendErrorResponse(req.ID, 500, "Failed to read response")
+			return
 		}
+		respBody = append(respBody, rest...)
+		streamBody = false
 	}
 
-	fmt.Printf("  -> %d %s (%d bytes)\n", resp.StatusCode, resp.Status, len(body))
+	// Copy response headers, keeping every value - a response often sets
+	// several cookies
+	headers := resp.Header.Clone()
+	if timingHeaders {
+		addLocalTiming(headers, localDuration)
+	}
 
 	// Send response back through WebSocket
 	httpResp := tunnel.HTTPResponse{
 		ID:         req.ID,
 		StatusCode: resp.StatusCode,
 		Headers:    headers,
-		Body:       body,
+		Streamed:   streamBody,
+		RawHeaders: tunnel.SplitRawHeaders(headers),
+	}
+	if !streamBody {
+		httpResp.Body = respBody
 	}
 
-	respBytes, _ := json.Marshal(httpResp)
-	msg := tunnel.Message{
-		Type:    tunnel.TypeHTTPResponse,
-		Payload: respBytes,
+	msgBytes, err := s.codec.Encode(tunnel.TypeHTTPResponse, httpResp)
+	if err != nil {
+		log.Printf("Failed to encode response: %v", err)
+		status = 502
+		outcome = "502 (failed to encode the response)"
+		s.sendErrorResponse(req.ID, 502, "Failed to encode the local server's response")
+		return
 	}
-	msgBytes, _ := json.Marshal(msg)
 
-	if err := conn.WriteMessage(websocket.TextMessage, msgBytes); err != nil {
+	if err := s.conn.Send(msgBytes); err != nil {
 		log.Printf("Failed to send response: %v", err)
+		outcome = fmt.Sprintf("%d (not sent, tunnel connection lost)", resp.StatusCode)
+		return
+	}
+	status = resp.StatusCode
+	respBytes = int64(len(respBody))
+
+	if streamBody {
+		// The server acks the chunks as the visitor reads them
+		var window *tunnel.SendWindow
+		if s.paced {
+			window = s.windows.Open(req.ID, bodyStallTimeout)
+			defer s.windows.Close(req.ID)
+		}
+		sent, err := tunnel.StreamBody(s.conn.Send, req.ID, respBody, resp.Body, s.codec, window)
+		respBytes = sent
+		streamNote = " streamed"
+		switch {
+		case err == tunnel.ErrStreamStopped:
+			streamNote = " streamed, visitor left"
+		case err != nil:
+			log.Printf("Failed to stream response: %v", err)
+			streamNote = " streamed, cut short"
+		}
+	}
+}
+
+// addLocalTiming records how long the local server took to answer
+// X-Tunnel-Local-Duration is read by the tunnel server, Server-Timing shows
+// up in browser devtools
+func addLocalTiming(headers http.Header, d time.Duration) {
+	ms := strconv.FormatFloat(float64(d.Microseconds())/1000, 'f', 3, 64)
+	headers.Set("X-Tunnel-Local-Duration", ms)
+	headers.Add("Server-Timing", "local;desc=\"Local server\";dur="+ms)
+}
+
+// sendInformational forwards a 1xx response to the server
+func (s *session) sendInformational(reqID string, statusCode int, header textproto.MIMEHeader) {
+	msgBytes, err := tunnel.Encode(tunnel.TypeHTTPInformational, tunnel.HTTPInformational{
+		ID:         reqID,
+		StatusCode: statusCode,
+		Headers:    http.Header(header),
+	})
+	if err != nil {
+		log.Printf("Failed to encode informational response: %v", err)
+		return
+	}
+
+	if err := s.conn.Send(msgBytes); err != nil {
+		log.Printf("Failed to send informational response: %v", err)
 	}
 }
 
 // sendErrorResponse sends an error response back through the tunnel
-func sendErrorResponse(conn *websocket.Conn, reqID string, statusCode int, message string) {
+func (s *session) sendErrorResponse(reqID string, statusCode int, message string) {
 	resp := tunnel.HTTPResponse{
 		ID:         reqID,
 		StatusCode: statusCode,
-		Headers:    map[string]string{"Content-Type": "text/plain"},
+		Headers:    http.Header{"Content-Type": {"text/plain"}},
 		Body:       []byte(message),
 	}
 
-	respBytes, _ := json.Marshal(resp)
-	msg := tunnel.Message{
-		Type:    tunnel.TypeHTTPResponse,
-		Payload: respBytes,
+	msgBytes, err := tunnel.Encode(tunnel.TypeHTTPResponse, resp)
+	if err != nil {
+		log.Printf("Failed to encode error response: %v", err)
+		return
+	}
+
+	if err := s.conn.Send(msgBytes); err != nil {
+		log.Printf("Failed to send error response: %v", err)
+	}
+}
+
+// sendToTargets sends httpReq to the next local server in turn
+// If that server refuses the connection, it's marked down and the request
+// goes to the next one - as long as the body can be sent again (streamed
+// bodies can't). Returns the response and the target that was tried last.
+func (s *session) sendToTargets(client *http.Client, httpReq *http.Request, headers http.Header) (*http.Response, *localTarget, error) {
+	var tried []*localTarget
+	for {
+		target := s.targets.Pick(tried)
+		tried = append(tried, target)
+
+		httpReq.URL.Host = target.addr
+		// In Go, the Host header lives in httpReq.Host rather than the header map
+		httpReq.Host = s.localHostHeader(headers, target.addr)
+
+		resp, err := client.Do(httpReq)
+		if err == nil {
+			s.targets.MarkUp(target)
+			return resp, target, nil
+		}
+		if !isLocalServerDown(err) {
+			return nil, target, err
+		}
+		s.targets.MarkDown(target)
+
+		if len(tried) == s.targets.Len() || !canResend(httpReq) {
+			return nil, target, err
+		}
+		if httpReq.GetBody != nil {
+			if httpReq.Body, err = httpReq.GetBody(); err != nil {
+				return nil, target, err
+			}
+		}
+		log.Printf("%s is down, trying the next server", target.addr)
+	}
+}
+
+// newLocalRequest builds the request for the local server out of one that
+// came through the tunnel - the host is filled in per target by sendToTargets
+func (s *session) newLocalRequest(ctx context.Context, req *tunnel.HTTPRequest, body io.Reader) (*http.Request, error) {
+	localURL := s.localScheme("http") + "://" + s.targets.Addrs()[0] + req.Path
+	httpReq, err := http.NewRequestWithContext(ctx, req.Method, localURL, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy headers
+	for key, values := range req.Headers {
+		// Skip hop-by-hop headers
+		if key == "Connection" || key == "Keep-Alive" || key == "Transfer-Encoding" {
+			continue
+		}
+		// Never offer protocol upgrades (e.g. h2c) - the tunnel carries
+		// plain HTTP/1.1 request/response pairs only
+		if key == "Upgrade" || key == "Http2-Settings" {
+			continue
+		}
+		for _, value := range values {
+			httpReq.Header.Add(key, value)
+		}
+	}
+
+	// Only the tunnel sets the attempt header - a visitor can't fake a resend
+	if req.Attempt > 1 {
+		httpReq.Header.Set(tunnel.AttemptHeader, strconv.Itoa(req.Attempt))
+	} else {
+		httpReq.Header.Del(tunnel.AttemptHeader)
+	}
+
+	// A streamed body's length isn't known from the pipe, so carry over the
+	// declared length - otherwise the local server gets a chunked upload
+	if req.Streamed {
+		if n, err := strconv.ParseInt(req.Headers.Get("Content-Length"), 10, 64); err == nil {
+			httpReq.ContentLength = n
+		}
+	} else if body == http.NoBody {
+		// Go sends "Content-Length: 0" by itself for POST, PUT and PATCH
+		// only; "identity" makes it do so for the other methods with a body
+		// (DELETE...) - never for GET and HEAD
+		httpReq.TransferEncoding = []string{"identity"}
+	}
+	return httpReq, nil
+}
+
+// requestBody returns the body to send the local server: nil if the
+// visitor's request had none, so the local server doesn't see a body (or a
+// Content-Length) that wasn't there, and http.NoBody if it was explicitly
+// empty ("Content-Length: 0")
+// Streamed bodies come from startBody instead.
+func requestBody(req *tunnel.HTTPRequest) io.Reader {
+	switch {
+	case len(req.Body) > 0:
+		return bytes.NewReader(req.Body)
+	case req.Headers.Get("Content-Length") == "0":
+		return http.NoBody
+	}
+	return nil
+}
+
+// requestBodySize is the size of req's body, -1 if it's streamed without
+// a Content-Length
+func requestBodySize(req *tunnel.HTTPRequest) int64 {
+	if !req.Streamed {
+		return int64(len(req.Body))
+	}
+	if n, err := strconv.ParseInt(req.Headers.Get("Content-Length"), 10, 64); err == nil && n >= 0 {
+		return n
+	}
+	return -1
+}
+
+// logRequest prints a request's line in the log once it's been answered,
+// e.g. "POST /upload (req 2.1 MB) -> 200 (resp 14 B)"
+func logRequest(method, path string, reqBytes int64, outcome string) {
+	fmt.Printf("%s %s%s -> %s\n", method, path, requestSizeNote(reqBytes), outcome)
+}
+
+// answered is how the log line ends for a request that got a response,
+// e.g. "200 (resp 14 B)", with note added after the size
+func answered(status int, respBytes int64, note string) string {
+	return fmt.Sprintf("%d (resp %s%s)", status, formatSize(respBytes), note)
+}
+
+// requestSizeNote is the request body size for the log line, e.g.
+// " (req 2.1 MB)" - nothing for requests without a body
+func requestSizeNote(n int64) string {
+	switch {
+	case n < 0:
+		return " (req streamed)"
+	case n == 0:
+		return ""
+	}
+	return " (req " + formatSize(n) + ")"
+}
+
+// replayLocal sends a request recorded by the inspector to the local server
+// again. Nothing goes through the tunnel.
+func (s *session) replayLocal(ctx context.Context, req *tunnel.HTTPRequest) (*http.Response, error) {
+	httpReq, err := s.newLocalRequest(ctx, req, requestBody(req))
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: localTransport}
+	resp, _, err := s.sendToTargets(client, httpReq, req.Headers)
+	return resp, err
+}
+
+// localScheme returns the URL scheme for the local server: plain, or its
+// TLS version with --local-https ("http" -> "https", "ws" -> "wss")
+func (s *session) localScheme(plain string) string {
+	if s.localTLS {
+		return plain + "s"
+	}
+	return plain
+}
+
+// canResend reports whether a request's body can be sent a second time
+func canResend(httpReq *http.Request) bool {
+	return httpReq.Body == nil || httpReq.Body == http.NoBody || httpReq.GetBody != nil
+}
+
+// localHostHeader returns the Host header to send the local server at addr
+// Apps that route by virtual host or build absolute URLs may need something
+// other than the local address. The public host is always available to them
+// in X-Forwarded-Host, which the tunnel server sets.
+func (s *session) localHostHeader(headers http.Header, addr string) string {
+	switch s.hostHeader {
+	case "":
+		return addr
+	case "preserve":
+		if host := headers.Get("X-Forwarded-Host"); host != "" {
+			return host
+		}
+		return addr
+	default:
+		return s.hostHeader
+	}
+}
+
+// acquireSlot reserves room for one more request in flight
+// Returns false when --max-concurrent requests are already running
+func (s *session) acquireSlot() bool {
+	if s.slots == nil {
+		return true
 	}
-	msgBytes, _ := json.Marshal(msg)
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
 
-	conn.WriteMessage(websocket.TextMessage, msgBytes)
+// releaseSlot frees the room taken by acquireSlot
+func (s *session) releaseSlot() {
+	if s.slots != nil {
+		<-s.slots
+	}
+}
+
+// sendUnreachable answers a request no local server was up to take, message
+// says what went wrong with the last one tried
+// The marker header lets the server retry it while the tunnel warms up
+func (s *session) sendUnreachable(reqID string, message string) {
+	if s.targets.Len() > 1 {
+		message = "Failed to reach any of the local servers. " + message
+	}
+
+	resp := tunnel.HTTPResponse{
+		ID:         reqID,
+		StatusCode: http.StatusBadGateway,
+		Headers: http.Header{
+			"Content-Type":           {"text/plain"},
+			tunnel.UnreachableHeader: {"1"},
+		},
+		Body: []byte(message),
+	}
+	msgBytes, err := tunnel.Encode(tunnel.TypeHTTPResponse, resp)
+	if err != nil {
+		log.Printf("Failed to encode error response: %v", err)
+		return
+	}
+	if err := s.conn.Send(msgBytes); err != nil {
+		log.Printf("Failed to send error response: %v", err)
+	}
+}
+
+// sendOverloaded answers a request we have no room for
+// The marker header lets the server serve the tunnel's fallback instead
+func (s *session) sendOverloaded(req *tunnel.HTTPRequest) {
+	// Logged once the answer has gone out, like any other request
+	defer logRequest(req.Method, req.Path, requestBodySize(req), fmt.Sprintf("503 Overloaded (%d requests in flight)", cap(s.slots)))
+	s.inspector.Record(inspectedRequest{
+		Time:       time.Now(),
+		Method:     req.Method,
+		Path:       req.Path,
+		StatusCode: http.StatusServiceUnavailable,
+	}, req)
+
+	resp := tunnel.HTTPResponse{
+		ID:         req.ID,
+		StatusCode: http.StatusServiceUnavailable,
+		Headers: http.Header{
+			"Content-Type":          {"text/plain"},
+			"Cache-Control":         {"no-store"},
+			"Retry-After":           {"1"},
+			tunnel.OverloadedHeader: {"1"},
+		},
+		Body: []byte("The tunnel is busy, try again shortly"),
+	}
+	msgBytes, err := tunnel.Encode(tunnel.TypeHTTPResponse, resp)
+	if err != nil {
+		log.Printf("Failed to encode overloaded response: %v", err)
+		return
+	}
+	if err := s.conn.Send(msgBytes); err != nil {
+		log.Printf("Failed to send overloaded response: %v", err)
+	}
 }
 
 func getEnv(key, defaultValue string) string {
@@ -263,3 +1457,49 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+// getEnvBool reads a boolean env var ("true", "1", "false", "0" etc.)
+func getEnvBool(key string, defaultValue bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using default %t", key, value, defaultValue)
+		return defaultValue
+	}
+	return b
+}
+
+// getEnvInt reads an integer env var, falling back to the default if unset or invalid
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using default %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+// getEnvDuration reads a duration env var like "30s" or "2m"
+// A bare number is taken as seconds
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using default %s", key, value, defaultValue)
+		return defaultValue
+	}
+	return d
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestDeliverChunkNeverBlocks(t *testing.T) {
+	s := newSession(nil, nil, []string{tunnel.CapStreaming})
+	body := s.startBody("req1")
+
+	// Nobody reads the body, but delivering way more than a window must
+	// return right away and fail only this body
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 4*tunnel.ChunkQueueSize; i++ {
+			s.deliverChunk(&tunnel.BodyChunk{ID: "req1", Data: []byte("x")})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("deliverChunk blocked on a body nobody reads")
+	}
+
+	if _, err := io.ReadAll(body); err == nil {
+		t.Error("overflowed body read to a clean EOF")
+	}
+	s.bodiesMu.Lock()
+	defer s.bodiesMu.Unlock()
+	if len(s.bodies) != 0 {
+		t.Errorf("overflowed body still tracked: %v", s.bodies)
+	}
+}
+
+func TestDeliverChunkCompletesBody(t *testing.T) {
+	s := newSession(nil, nil, []string{tunnel.CapStreaming})
+	body := s.startBody("req1")
+
+	go func() {
+		s.deliverChunk(&tunnel.BodyChunk{ID: "req1", Data: []byte("hello ")})
+		s.deliverChunk(&tunnel.BodyChunk{ID: "req1", Data: []byte("world")})
+		s.deliverChunk(&tunnel.BodyChunk{ID: "req1", EOF: true})
+	}()
+
+	got, err := io.ReadAll(body)
+	if err != nil || string(got) != "hello world" {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+func TestConnectReportsRejectedHandshake(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		want   string
+	}{
+		{http.StatusServiceUnavailable, "at capacity", "server rejected the connection: 503 Service Unavailable - at capacity"},
+		{http.StatusUnauthorized, "", "server rejected the connection: 401 Unauthorized"},
+	}
+	for _, tc := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.status)
+			io.WriteString(w, tc.body)
+		}))
+
+		_, _, err := connectTunnel(context.Background(), websocket.DefaultDialer,
+			"ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", tunnel.TunnelRegister{LocalPort: 3000})
+		srv.Close()
+
+		if err == nil {
+			t.Fatalf("%d: connected to a server refusing the upgrade", tc.status)
+		}
+		if !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%d: error %q doesn't contain %q", tc.status, err, tc.want)
+		}
+	}
+}
+
+func TestDescribeDialErrorWithoutResponse(t *testing.T) {
+	err := io.ErrUnexpectedEOF
+	if got := describeDialError(err, nil); got != err.Error() {
+		t.Errorf("got %q, want the plain error", got)
+	}
+}
+
+func TestDisconnectCancelsLocalRequests(t *testing.T) {
+	started := make(chan struct{})
+	canceled := make(chan struct{})
+	addr := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+			close(canceled)
+		case <-time.After(30 * time.Second):
+		}
+	})
+
+	_, server := startSession(t, []string{addr}, nil)
+	sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{
+		ID: "slow-1", Method: http.MethodGet, Path: "/slow", Headers: http.Header{},
+	})
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request never reached the local server")
+	}
+
+	// The connection drops while the local server is still working
+	server.Close()
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("local request kept running after the tunnel connection closed")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+// hugeBody is what the memory test sends each way
+const hugeBody = 100 << 20
+
+// maxHeapGrowth is how much the live heap may grow while hugeBody goes
+// through: a window of chunks, nowhere near the body itself
+const maxHeapGrowth = 16 << 20
+
+// peakHeapGrowth runs transfer while sampling the live heap, and returns how
+// far it grew over where it started
+func peakHeapGrowth(transfer func()) int64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	base := m.HeapAlloc
+
+	var peak atomic.Uint64
+	stop := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				runtime.GC()
+				var m runtime.MemStats
+				runtime.ReadMemStats(&m)
+				if m.HeapAlloc > peak.Load() {
+					peak.Store(m.HeapAlloc)
+				}
+			}
+		}
+	}()
+
+	transfer()
+	close(stop)
+	<-sampled
+	return int64(peak.Load()) - int64(base)
+}
+
+func TestHugeBodiesUseConstantMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("moves 200 MB")
+	}
+	caps := []string{tunnel.CapStreaming, tunnel.CapBinary, tunnel.CapFlowControl}
+	codec := tunnel.NewCodec(caps)
+
+	addr := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			n, _ := io.Copy(io.Discard, r.Body)
+			w.Write([]byte(strconv.FormatInt(n, 10)))
+			return
+		}
+		io.Copy(w, io.LimitReader(zeros{}, hugeBody))
+	})
+	_, server := startSession(t, []string{addr}, caps)
+
+	// The server's end: route acks to our windows, ack every chunk we get,
+	// and pass on responses
+	windows := tunnel.NewSendWindows()
+	responses := make(chan *tunnel.HTTPResponse, 1)
+	received := make(chan int64, 1)
+	go func() {
+		defer windows.StopAll()
+		var n int64
+		for {
+			_, data, err := server.ReadMessage()
+			if err != nil {
+				return
+			}
+			msg, err := tunnel.DecodeMessage(data)
+			if err != nil || msg.Decompress() != nil {
+				t.Error("invalid message from the CLI")
+				return
+			}
+			switch msg.Type {
+			case tunnel.TypeBodyAck:
+				var ack tunnel.BodyAck
+				msg.Unmarshal(&ack)
+				windows.Ack(ack)
+			case tunnel.TypeHTTPResponse:
+				var resp tunnel.HTTPResponse
+				msg.Unmarshal(&resp)
+				responses <- &resp
+			case tunnel.TypeBodyChunk:
+				var chunk tunnel.BodyChunk
+				msg.Unmarshal(&chunk)
+				n += int64(len(chunk.Data))
+				if chunk.EOF {
+					received <- n
+					n = 0
+					continue
+				}
+				ackBytes, _ := tunnel.EncodeBodyAck(codec, chunk.ID, 1, false)
+				server.Send(ackBytes)
+			}
+		}
+	}()
+
+	t.Run("upload", func(t *testing.T) {
+		growth := peakHeapGrowth(func() {
+			sendMessage(t, server, codec, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{
+				ID: "up", Method: http.MethodPost, Path: "/", Headers: http.Header{}, Streamed: true,
+			})
+			window := windows.Open("up", 0)
+			defer windows.Close("up")
+			if _, err := tunnel.StreamBody(server.Send, "up", nil, io.LimitReader(zeros{}, hugeBody), codec, window); err != nil {
+				t.Errorf("sending the upload: %v", err)
+			}
+			resp := <-responses
+			if string(resp.Body) != strconv.Itoa(hugeBody) {
+				t.Errorf("local server got %s bytes, want %d", resp.Body, hugeBody)
+			}
+		})
+		t.Logf("heap grew by %d KB", growth>>10)
+		if growth > maxHeapGrowth {
+			t.Errorf("heap grew by %d MB uploading %d MB", growth>>20, hugeBody>>20)
+		}
+	})
+
+	t.Run("download", func(t *testing.T) {
+		growth := peakHeapGrowth(func() {
+			sendMessage(t, server, codec, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{
+				ID: "down", Method: http.MethodGet, Path: "/", Headers: http.Header{},
+			})
+			if resp := <-responses; !resp.Streamed {
+				t.Error("a 100 MB response wasn't streamed")
+				return
+			}
+			if n := <-received; n != hugeBody {
+				t.Errorf("got %d bytes, want %d", n, hugeBody)
+			}
+		})
+		t.Logf("heap grew by %d KB", growth>>10)
+		if growth > maxHeapGrowth {
+			t.Errorf("heap grew by %d MB downloading %d MB", growth>>20, hugeBody>>20)
+		}
+	})
+}
+
+// zeros is an endless body
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"tunnelr/internal/tunnel"
+
+	"github.com/gorilla/websocket"
+)
+
+// Migration - the server can ask us to move the tunnel to another server
+// instance (TypeMigrate), e.g. before it's upgraded. We register there with
+// the same tunnel ID before letting go of the old connection, so the public
+// URL keeps working throughout.
+
+// migrateDrainTimeout is the longest the old connection is kept open for
+// requests still being answered after a move
+const migrateDrainTimeout = time.Minute
+
+// migrateTunnel registers our tunnel on the server at target, asking for the
+// ID we have now
+// Returns nil if that failed - the caller stays on the current server.
+func migrateTunnel(ctx context.Context, dialer tunnelDialer, target string, reg tunnel.TunnelRegister, tunnelID string) (*tunnel.SafeConn, *tunnel.TunnelAssigned) {
+	reg.Subdomain = tunnelID
+	conn, assigned, err := connectTunnel(ctx, dialer, target, reg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't move the tunnel, staying on the current server: %v\n", err)
+		return nil, nil
+	}
+	fmt.Fprintf(os.Stderr, "Tunnel moved to %s\n", target)
+	return conn, assigned
+}
+
+// drain closes the session's connection once the requests in flight on it
+// are answered, after the tunnel moved to another server
+// The old server may still send a few requests meanwhile; they're answered
+// too. WebSockets relayed over this connection end when it closes.
+func (s *session) drain() {
+	deadline := time.Now().Add(migrateDrainTimeout)
+	for s.inflight.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	s.conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "tunnel moved"))
+	s.conn.Close()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestMigrationHandoff(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	addr := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("answered on the old server"))
+	})
+	caps := []string{tunnel.CapMigrate}
+	sess, oldServer := startSession(t, []string{addr}, caps)
+	newURL, registered := fakeRegistrar(t, tunnel.TypeTunnelAssigned, tunnel.TunnelAssigned{TunnelID: "abc123", PublicURL: "https://abc123.tunnelr.io", ProtocolVersion: tunnel.ProtocolVersion})
+
+	// A request is still being answered when the old server sends us away
+	sendMessage(t, oldServer, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{ID: "slow", Method: http.MethodGet, Path: "/"})
+	<-started
+	sendMessage(t, oldServer, tunnel.Codec{}, tunnel.TypeMigrate, tunnel.Migrate{ServerURL: newURL, Reason: "upgrading"})
+
+	var target string
+	select {
+	case target = <-sess.migrate:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session never asked to move")
+	}
+	if target != newURL || !sess.migrating.Load() {
+		t.Fatalf("asked to move to %q (migrating %v), want %q", target, sess.migrating.Load(), newURL)
+	}
+
+	// What runConnect does next: register on the new server with the same
+	// ID, then drain the old connection
+	reg := tunnel.TunnelRegister{LocalPort: 3000, ProtocolVersion: tunnel.ProtocolVersion}
+	newConn, assigned := migrateTunnel(context.Background(), websocket.DefaultDialer, target, reg, "abc123")
+	if newConn == nil {
+		t.Fatal("move failed")
+	}
+	defer newConn.Close()
+	if got := (<-registered).Subdomain; got != "abc123" || assigned.TunnelID != "abc123" {
+		t.Errorf("registered as %q and got %q, want the tunnel's own ID abc123", got, assigned.TunnelID)
+	}
+	drained := make(chan struct{})
+	go func() {
+		sess.drain()
+		close(drained)
+	}()
+
+	// The old connection stays up until the request in flight is answered
+	select {
+	case <-drained:
+		t.Fatal("old connection closed with a request still in flight")
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(release)
+	if resp := readResponse(t, oldServer); resp.StatusCode != http.StatusOK || string(resp.Body) != "answered on the old server" {
+		t.Errorf("in-flight request got %d %q", resp.StatusCode, resp.Body)
+	}
+
+	// Then it's closed cleanly, saying why
+	oldServer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := oldServer.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok || closeErr.Code != websocket.CloseNormalClosure || closeErr.Text != "tunnel moved" {
+		t.Errorf("old connection ended with %v, want a normal close saying the tunnel moved", err)
+	}
+	<-drained
+}
+
+func TestMigrateToInvalidURLIsIgnored(t *testing.T) {
+	sess, server := startSession(t, []string{closedPort(t)}, []string{tunnel.CapMigrate})
+	for _, bad := range []string{"https://elsewhere.example/ws", "not a url", ""} {
+		sendMessage(t, server, tunnel.Codec{}, tunnel.TypeMigrate, tunnel.Migrate{ServerURL: bad})
+	}
+	// Still answering, and not moving
+	sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{ID: "after", Method: http.MethodGet, Path: "/"})
+	readResponse(t, server)
+	if sess.migrating.Load() || len(sess.migrate) != 0 {
+		t.Error("an invalid server URL started a move")
+	}
+}
+
+func TestFailedMigrationStays(t *testing.T) {
+	// Nothing listening where we're sent: no connection, the caller stays
+	reg := tunnel.TunnelRegister{LocalPort: 3000, ProtocolVersion: tunnel.ProtocolVersion}
+	conn, assigned := migrateTunnel(context.Background(), websocket.DefaultDialer, "ws://"+closedPort(t)+"/ws", reg, "abc123")
+	if conn != nil || assigned != nil {
+		t.Errorf("got %v, %+v from a server that isn't there", conn, assigned)
+	}
+}
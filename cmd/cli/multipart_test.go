@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestMultipartUploadsReachLocalServerIntact(t *testing.T) {
+	// A form with a text field and a file, with a boundary that needs
+	// quoting and has a comma in it
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	if err := mw.SetBoundary("----tunnelr,543 (x=y) part:1/2?"); err != nil {
+		t.Fatal(err)
+	}
+	mw.WriteField("title", "holiday photos, day 1")
+	fw, _ := mw.CreateFormFile("file", "photo.jpg")
+	file := make([]byte, 64*1024)
+	rand.New(rand.NewSource(543)).Read(file)
+	fw.Write(file)
+	mw.Close()
+	contentType, upload := mw.FormDataContentType(), buf.Bytes()
+
+	type received struct {
+		contentTypes []string
+		body         []byte
+		title        string
+		file         []byte
+	}
+	got := make(chan received, 1)
+	addr := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rec := received{contentTypes: r.Header.Values("Content-Type"), body: body}
+		// And it parses as the form that was sent
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if err := r.ParseMultipartForm(1 << 20); err == nil {
+			rec.title = r.FormValue("title")
+			if f, _, err := r.FormFile("file"); err == nil {
+				rec.file, _ = io.ReadAll(f)
+			}
+		}
+		got <- rec
+	})
+	_, server := startSession(t, []string{addr}, []string{tunnel.CapStreaming})
+
+	headers := http.Header{"Content-Type": {contentType}, "Content-Length": {strconv.Itoa(len(upload))}}
+	for _, streamed := range []bool{false, true} {
+		req := tunnel.HTTPRequest{
+			ID: "upload-" + strconv.FormatBool(streamed), Method: http.MethodPost, Path: "/upload",
+			Headers: headers, RawHeaders: tunnel.SplitRawHeaders(headers), Streamed: streamed,
+		}
+		if !streamed {
+			req.Body = upload
+		}
+		sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, req)
+		if streamed {
+			if _, err := tunnel.StreamBody(server.Send, req.ID, nil, bytes.NewReader(upload), tunnel.Codec{}, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		readResponse(t, server)
+
+		r := <-got
+		if len(r.contentTypes) != 1 || r.contentTypes[0] != contentType {
+			t.Errorf("streamed %v: local server got Content-Type %q, want %q", streamed, r.contentTypes, contentType)
+		}
+		if !bytes.Equal(r.body, upload) {
+			t.Errorf("streamed %v: local server got %d bytes, want %d byte for byte", streamed, len(r.body), len(upload))
+		}
+		if r.title != "holiday photos, day 1" || !bytes.Equal(r.file, file) {
+			t.Errorf("streamed %v: form parsed to title %q and a %d-byte file", streamed, r.title, len(r.file))
+		}
+	}
+}
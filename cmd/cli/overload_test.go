@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestRequestsPastMaxConcurrentAreTurnedAway(t *testing.T) {
+	arrived := make(chan struct{}, 1)
+	release := make(chan struct{})
+	addr := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+		w.Write([]byte("done"))
+	})
+	_, server := startSessionWith(t, []string{addr}, nil, func(s *session) {
+		s.slots = make(chan struct{}, 1)
+	})
+
+	sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{ID: "first", Method: http.MethodGet, Path: "/"})
+	<-arrived
+
+	// The one slot is taken: turned away right off, marked for the server
+	sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{ID: "second", Method: http.MethodGet, Path: "/"})
+	resp := readResponse(t, server)
+	if resp.ID != "second" || resp.StatusCode != http.StatusServiceUnavailable || resp.Headers.Get(tunnel.OverloadedHeader) == "" {
+		t.Fatalf("got %s %d %v, want second turned away with %s", resp.ID, resp.StatusCode, resp.Headers, tunnel.OverloadedHeader)
+	}
+
+	// Once the first finishes there's room again
+	close(release)
+	if resp := readResponse(t, server); resp.ID != "first" || resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %s %d, want first answered", resp.ID, resp.StatusCode)
+	}
+	sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{ID: "third", Method: http.MethodGet, Path: "/"})
+	<-arrived
+	if resp := readResponse(t, server); resp.ID != "third" || resp.StatusCode != http.StatusOK {
+		t.Errorf("got %s %d, want third answered", resp.ID, resp.StatusCode)
+	}
+}
+
+func TestOverloadFallbackFlag(t *testing.T) {
+	t.Setenv("TUNNELR_OVERLOAD_FALLBACK", "")
+	_, opts, err := parseConnectArgs([]string{"3000", "--max-concurrent", "4", "--overload-fallback", "stale"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.maxConcurrent != 4 || opts.overloadFallback != tunnel.FallbackStale {
+		t.Errorf("got %d, %q", opts.maxConcurrent, opts.overloadFallback)
+	}
+	if _, _, err := parseConnectArgs([]string{"3000", "--overload-fallback", "retry"}); err == nil {
+		t.Error("accepted an unknown fallback")
+	}
+}
+
+func TestMaxConcurrentIsRespected(t *testing.T) {
+	const limit, sent = 5, 20
+	var mu sync.Mutex
+	inFlight, peak := 0, 0
+	arrived := make(chan struct{}, sent)
+	release := make(chan struct{})
+	addr := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		peak = max(peak, inFlight)
+		mu.Unlock()
+		arrived <- struct{}{}
+		<-release
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		w.Write([]byte("done"))
+	})
+	_, server := startSessionWith(t, []string{addr}, nil, func(s *session) {
+		s.slots = make(chan struct{}, limit)
+	})
+
+	for i := 0; i < sent; i++ {
+		sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{
+			ID: fmt.Sprintf("flood-%d", i), Method: http.MethodGet, Path: "/",
+		})
+	}
+
+	// Everything past the limit is turned away while the rest hang
+	statuses := make(map[int]int)
+	for i := 0; i < sent-limit; i++ {
+		statuses[readResponse(t, server).StatusCode]++
+	}
+	for i := 0; i < limit; i++ {
+		select {
+		case <-arrived:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d requests reached the local server, want %d", i, limit)
+		}
+	}
+	close(release)
+	for i := 0; i < limit; i++ {
+		statuses[readResponse(t, server).StatusCode]++
+	}
+
+	if statuses[http.StatusOK] != limit || statuses[http.StatusServiceUnavailable] != sent-limit {
+		t.Errorf("got statuses %v, want %d 200s and %d 503s", statuses, limit, sent-limit)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if peak != limit {
+		t.Errorf("local server saw %d requests at once, want %d", peak, limit)
+	}
+}
+
+func TestMaxConcurrentDefault(t *testing.T) {
+	t.Setenv("TUNNELR_MAX_CONCURRENT", "")
+	tests := []struct {
+		env  string
+		args []string
+		want int
+	}{
+		{"", []string{"3000"}, defaultMaxConcurrent},
+		{"", []string{"3000", "--max-concurrent", "0"}, 0},
+		{"8", []string{"3000"}, 8},
+		{"8", []string{"3000", "--max-concurrent", "2"}, 2},
+	}
+	for _, tc := range tests {
+		t.Setenv("TUNNELR_MAX_CONCURRENT", tc.env)
+		_, opts, err := parseConnectArgs(tc.args)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.args, err)
+		}
+		if opts.maxConcurrent != tc.want {
+			t.Errorf("TUNNELR_MAX_CONCURRENT=%q %v: got %d, want %d", tc.env, tc.args, opts.maxConcurrent, tc.want)
+		}
+	}
+	if defaultMaxConcurrent != 50 {
+		t.Errorf("defaultMaxConcurrent = %d, want 50", defaultMaxConcurrent)
+	}
+}
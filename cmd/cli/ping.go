@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// runPing checks we can reach the tunnel server without opening a tunnel
+func runPing() {
+	if !pingServer(os.Stdout, getEnv("TUNNELR_SERVER", "ws://localhost:8080/ws")) {
+		os.Exit(1)
+	}
+}
+
+// pingServer hits /health over HTTP, then does a WebSocket handshake on /ws
+// and hangs up, printing one line per check to out
+// Returns whether the server is reachable.
+func pingServer(out io.Writer, serverURL string) bool {
+	fmt.Fprintf(out, "Pinging %s\n\n", serverURL)
+
+	ok := true
+
+	dialer, err := newDialer(defaultHandshakeTimeout)
+	if err != nil {
+		fmt.Printf("  Settings:    FAIL (%v)\n", err)
+		os.Exit(1)
+	}
+
+	healthURL, err := healthURLFor(serverURL)
+	if err != nil {
+		fmt.Fprintf(out, "  Server URL:  FAIL (%v)\n", err)
+		return false
+	}
+
+	// 1. Plain HTTP reachability
+	start := time.Now()
+	resp, err := httpClientFor(dialer).Get(healthURL)
+	if err != nil {
+		fmt.Fprintf(out, "  Health:      FAIL (%v)\n", err)
+		ok = false
+	} else {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			fmt.Fprintf(out, "  Health:      OK (%s)\n", time.Since(start).Round(time.Millisecond))
+		} else {
+			fmt.Fprintf(out, "  Health:      FAIL (HTTP %d)\n", resp.StatusCode)
+			ok = false
+		}
+	}
+
+	// 2. WebSocket handshake - this is what `connect` needs
+	start = time.Now()
+	conn, resp, err := dialer.Dial(serverURL, nil)
+	if err != nil {
+		if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			fmt.Fprintf(out, "  WebSocket:   FAIL (auth rejected: %s)\n", describeDialError(err, resp))
+		} else {
+			fmt.Fprintf(out, "  WebSocket:   FAIL (%s)\n", describeDialError(err, resp))
+		}
+		ok = false
+	} else {
+		fmt.Fprintf(out, "  WebSocket:   OK (%s)\n", time.Since(start).Round(time.Millisecond))
+		conn.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, "ping"))
+		conn.Close()
+	}
+
+	fmt.Fprintln(out, "")
+	if !ok {
+		fmt.Fprintln(out, "Server is not reachable")
+		return false
+	}
+	fmt.Fprintln(out, "Server is reachable")
+	return true
+}
+
+// healthURLFor turns the WebSocket URL into the server's /health URL
+// e.g., "wss://tunnel.example.com/ws" -> "https://tunnel.example.com/health"
+func healthURLFor(serverURL string) (string, error) {
+	return serverHTTPURL(serverURL, "/health")
+}
+
+// serverHTTPURL turns the WebSocket URL into the URL of another endpoint on
+// the same server
+func serverHTTPURL(serverURL, path string) (string, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return "", err
+	}
+
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	default:
+		return "", fmt.Errorf("expected a ws:// or wss:// URL, got %q", serverURL)
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/ws") + path
+	u.RawQuery = ""
+	return u.String(), nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// stubServer answers /health with healthStatus, and /ws with a WebSocket
+// handshake or, if wsStatus is set, that status instead
+func stubServer(t *testing.T, healthStatus, wsStatus int) string {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(healthStatus)
+	})
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		if wsStatus != 0 {
+			http.Error(w, http.StatusText(wsStatus), wsStatus)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.ReadMessage() // Until ping hangs up
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+}
+
+func TestPingReachableServer(t *testing.T) {
+	var out strings.Builder
+	if !pingServer(&out, stubServer(t, http.StatusOK, 0)) {
+		t.Fatalf("ping failed:\n%s", out.String())
+	}
+	for _, want := range []string{"Health:      OK", "WebSocket:   OK", "Server is reachable"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output is missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestPingFailures(t *testing.T) {
+	tests := []struct {
+		name         string
+		healthStatus int
+		wsStatus     int
+		want         []string
+	}{
+		{"unhealthy", http.StatusServiceUnavailable, 0, []string{"Health:      FAIL (HTTP 503)", "WebSocket:   OK"}},
+		{"auth rejected", http.StatusOK, http.StatusUnauthorized, []string{"Health:      OK", "WebSocket:   FAIL (auth rejected"}},
+		{"no WebSocket endpoint", http.StatusOK, http.StatusNotFound, []string{"WebSocket:   FAIL"}},
+	}
+	for _, tc := range tests {
+		var out strings.Builder
+		if pingServer(&out, stubServer(t, tc.healthStatus, tc.wsStatus)) {
+			t.Errorf("%s: ping succeeded:\n%s", tc.name, out.String())
+			continue
+		}
+		for _, want := range append(tc.want, "Server is not reachable") {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("%s: output is missing %q:\n%s", tc.name, want, out.String())
+			}
+		}
+	}
+}
+
+func TestPingUnreachableServer(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	srv.Close() // Nothing listens there any more
+
+	var out strings.Builder
+	if pingServer(&out, url) {
+		t.Fatalf("ping of a closed port succeeded:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "Health:      FAIL") || !strings.Contains(out.String(), "WebSocket:   FAIL") {
+		t.Errorf("expected both checks to fail:\n%s", out.String())
+	}
+}
+
+func TestPingRejectsNonWebSocketURL(t *testing.T) {
+	var out strings.Builder
+	if pingServer(&out, "http://example.com/ws") {
+		t.Fatal("ping accepted an http:// server URL")
+	}
+	if !strings.Contains(out.String(), "Server URL:  FAIL") {
+		t.Errorf("output:\n%s", out.String())
+	}
+}
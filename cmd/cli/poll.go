@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"tunnelr/internal/tunnel"
+
+	"github.com/gorilla/websocket"
+)
+
+// Transports - how the CLI reaches the server (--transport)
+//
+// Normally the tunnel is one WebSocket. Some corporate proxies block
+// WebSocket upgrades, so the CLI can instead carry the same WebSocket over
+// HTTP long-polling (see tunnel/poll.go). With "auto" it tries a WebSocket
+// first and switches to long-polling if the upgrade fails.
+const (
+	transportAuto      = "auto"
+	transportWebSocket = "websocket"
+	transportPoll      = "poll"
+)
+
+// tunnelDialer opens the WebSocket to the server - *websocket.Dialer is one
+type tunnelDialer interface {
+	DialContext(ctx context.Context, urlStr string, requestHeader http.Header) (*websocket.Conn, *http.Response, error)
+}
+
+// transportDialer picks the transport for each connection
+type transportDialer struct {
+	ws *websocket.Dialer
+
+	// Set once a WebSocket upgrade failed in auto mode - reconnects then
+	// go straight to long-polling
+	polling atomic.Bool
+}
+
+// newTransportDialer wraps dialer for the --transport mode
+func newTransportDialer(dialer *websocket.Dialer, mode string) tunnelDialer {
+	if mode == transportWebSocket {
+		return dialer
+	}
+	d := &transportDialer{ws: dialer}
+	d.polling.Store(mode == transportPoll)
+	return d
+}
+
+func (d *transportDialer) DialContext(ctx context.Context, urlStr string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	if d.polling.Load() {
+		return d.dialPoll(ctx, urlStr, header)
+	}
+
+	conn, resp, err := d.ws.DialContext(ctx, urlStr, header)
+	if err == nil || !upgradeBlocked(err) {
+		return conn, resp, err
+	}
+
+	conn, pollResp, pollErr := d.dialPoll(ctx, urlStr, header)
+	if pollErr != nil {
+		// Long-polling didn't help, so report the original problem
+		return nil, resp, err
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	fmt.Fprintln(os.Stderr, "WebSocket upgrade failed, using long-polling instead (--transport poll skips the attempt)")
+	d.polling.Store(true)
+	return conn, pollResp, nil
+}
+
+// dialPoll opens the WebSocket over long-polling to urlStr's server - the
+// URL can change when the server moves us (see migrate.go)
+func (d *transportDialer) dialPoll(ctx context.Context, urlStr string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	poll, err := newPollDialer(d.ws, urlStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return poll.DialContext(ctx, urlStr, header)
+}
+
+// upgradeBlocked reports whether a WebSocket dial failed in a way a proxy
+// blocking upgrades would cause: the server (or something in between)
+// answered without upgrading, or dropped the connection mid-handshake
+// A server that can't be reached at all fails long-polling too, so that
+// isn't worth a second try.
+func upgradeBlocked(err error) bool {
+	return errors.Is(err, websocket.ErrBadHandshake) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+// newPollDialer returns a copy of dialer that carries the WebSocket over
+// long-polling requests to serverURL's /poll endpoints
+func newPollDialer(dialer *websocket.Dialer, serverURL string) (*websocket.Dialer, error) {
+	base, err := pollBaseURL(serverURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// No client timeout: a recv legitimately waits up to tunnel.PollWait
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           dialer.Proxy,
+			TLSClientConfig: dialer.TLSClientConfig,
+		},
+	}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialPoll(ctx, client, base)
+	}
+
+	poll := *dialer
+	poll.NetDialContext = dial
+	// The polls already go over HTTPS for a wss:// server, and through the
+	// proxy - the WebSocket inside needs neither
+	poll.NetDialTLSContext = dial
+	poll.Proxy = nil
+	return &poll, nil
+}
+
+// pollBaseURL turns the server's WebSocket URL into the base URL of its
+// long-polling endpoints, e.g. wss://host/ws -> https://host/poll
+func pollBaseURL(serverURL string) (string, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid server URL: %v", err)
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/ws") + tunnel.PollPath
+	u.RawQuery = ""
+	return u.String(), nil
+}
+
+// pollClient moves a session's bytes between its buffers and the server
+type pollClient struct {
+	client  *http.Client
+	base    string
+	session string
+	conn    *tunnel.PollConn
+}
+
+// dialPoll opens a long-polling session and returns it as a net.Conn
+func dialPoll(ctx context.Context, client *http.Client, base string) (net.Conn, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+"/open", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("long-polling: server answered %s", resp.Status)
+	}
+	var opened struct {
+		Session string `json:"session"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&opened); err != nil || opened.Session == "" {
+		return nil, errors.New("long-polling: invalid answer from the server")
+	}
+
+	// The receive loop outlives the dial's ctx, it stops when the
+	// connection is closed
+	recvCtx, stopRecv := context.WithCancel(context.Background())
+	pc := &pollClient{client: client, base: base, session: opened.Session}
+	in, out := tunnel.NewPollBuffer(), tunnel.NewPollBuffer()
+	pc.conn = tunnel.NewPollConn(in, out, tunnel.PollAddr("poll:"+opened.Session), tunnel.PollAddr(base), stopRecv)
+
+	go pc.sendLoop(out)
+	go pc.recvLoop(recvCtx, in)
+	return pc.conn, nil
+}
+
+// sendLoop posts what the WebSocket writes, one request at a time so the
+// bytes arrive in order, then closes the session once the connection is
+// closed and everything was sent
+func (pc *pollClient) sendLoop(out *tunnel.PollBuffer) {
+	// Each session has its own client, nothing else will use its connections
+	defer pc.client.CloseIdleConnections()
+
+	for {
+		data, err := out.Take(tunnel.PollMaxBytes, -1)
+		if err != nil {
+			pc.post("close", nil)
+			return
+		}
+		if err := pc.post("send", data); err != nil {
+			pc.conn.Close()
+			return
+		}
+	}
+}
+
+// recvLoop keeps a recv waiting on the server and queues whatever it
+// returns for the WebSocket to read
+// When the session ends (or a recv fails) the WebSocket reads EOF, and
+// closes the connection as it would a dropped socket.
+func (pc *pollClient) recvLoop(ctx context.Context, in *tunnel.PollBuffer) {
+	defer in.Close()
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, pc.url("recv"), nil)
+		if err != nil {
+			return
+		}
+		resp, err := pc.client.Do(req)
+		if err != nil {
+			return
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, tunnel.PollMaxBytes+1))
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			return // 410 Gone: the server ended the session
+		}
+		if len(data) > 0 {
+			if _, err := in.Write(data); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// post sends one request to the session's send or close endpoint
+func (pc *pollClient) post(action string, data []byte) error {
+	resp, err := pc.client.Post(pc.url(action), "application/octet-stream", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("long-polling: server answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (pc *pollClient) url(action string) string {
+	return pc.base + "/" + action + "?session=" + url.QueryEscape(pc.session)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunnelr/internal/tunnel"
+)
+
+// connListener hands out connections sent on its channel
+type connListener chan net.Conn
+
+func (l connListener) Accept() (net.Conn, error) {
+	conn, ok := <-l
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return conn, nil
+}
+func (l connListener) Close() error   { return nil }
+func (l connListener) Addr() net.Addr { return tunnel.PollAddr(tunnel.PollPath) }
+
+// startBlockedServer runs a tunnel server behind a proxy that refuses
+// WebSocket upgrades: /ws answers 403, the /poll endpoints work
+// Returns its WebSocket URL and the server's end of each tunnel connection.
+func startBlockedServer(t *testing.T) (string, <-chan *tunnel.SafeConn) {
+	t.Helper()
+	accepted := make(chan *tunnel.SafeConn, 1)
+	upgrader := websocket.Upgrader{}
+	sessions := connListener(make(chan net.Conn))
+	inner := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		server := tunnel.NewSafeConn(conn, tunnel.CompressionConfig{})
+		t.Cleanup(func() { server.Close() })
+		accepted <- server
+	})}
+	go inner.Serve(sessions)
+	t.Cleanup(func() { close(sessions) }) // After srv.Close, so no more sessions open
+
+	var mu sync.Mutex
+	buffers := make(map[string][2]*tunnel.PollBuffer) // in, out
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "WebSockets are not allowed", http.StatusForbidden)
+	})
+	mux.HandleFunc(tunnel.PollPath+"/open", func(w http.ResponseWriter, r *http.Request) {
+		in, out := tunnel.NewPollBuffer(), tunnel.NewPollBuffer()
+		mu.Lock()
+		buffers["s1"] = [2]*tunnel.PollBuffer{in, out}
+		mu.Unlock()
+		sessions <- tunnel.NewPollConn(in, out, tunnel.PollAddr("server"), tunnel.PollAddr("cli"), nil)
+		json.NewEncoder(w).Encode(map[string]string{"session": "s1"})
+	})
+	mux.HandleFunc(tunnel.PollPath+"/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		bufs, ok := buffers[r.URL.Query().Get("session")]
+		mu.Unlock()
+		if !ok {
+			http.Error(w, "No such poll session", http.StatusGone)
+			return
+		}
+		switch strings.TrimPrefix(r.URL.Path, tunnel.PollPath+"/") {
+		case "send":
+			data, _ := io.ReadAll(r.Body)
+			bufs[0].Write(data)
+		case "recv":
+			data, err := bufs[1].Take(tunnel.PollMaxBytes, time.Second)
+			if err != nil {
+				http.Error(w, "Poll session closed", http.StatusGone)
+				return
+			}
+			w.Write(data)
+		case "close":
+			bufs[0].Close()
+		}
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws", accepted
+}
+
+func TestFallBackToLongPolling(t *testing.T) {
+	addr := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(append([]byte("local got: "), body...))
+	})
+	serverURL, accepted := startBlockedServer(t)
+
+	// Without fallback the blocked upgrade is the end of it
+	if _, _, err := newTransportDialer(&websocket.Dialer{}, transportWebSocket).DialContext(context.Background(), serverURL, nil); err == nil {
+		t.Fatal("--transport websocket got through a proxy that blocks upgrades")
+	}
+
+	dialer := newTransportDialer(&websocket.Dialer{}, transportAuto)
+	conn, _, err := dialer.DialContext(context.Background(), serverURL, nil)
+	if err != nil {
+		t.Fatalf("auto transport: %v", err)
+	}
+	if !dialer.(*transportDialer).polling.Load() {
+		t.Error("reconnects would try WebSocket again")
+	}
+	var server *tunnel.SafeConn
+	select {
+	case server = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server never got the WebSocket")
+	}
+
+	// A request and its response over the polled WebSocket
+	s := newSession(tunnel.NewSafeConn(conn, tunnel.CompressionConfig{}), newLocalTargets([]string{addr}), nil)
+	t.Cleanup(func() { s.conn.Close() })
+	go s.handleIncomingRequests()
+	for _, body := range []string{"hello", strings.Repeat("long-polled ", 5000)} {
+		sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{ID: "polled", Method: http.MethodPost, Path: "/", Body: []byte(body)})
+		resp := readResponse(t, server)
+		if resp.StatusCode != http.StatusOK || string(resp.Body) != "local got: "+body {
+			t.Errorf("got %d %q for a %d byte body", resp.StatusCode, resp.Body[:min(len(resp.Body), 40)], len(body))
+		}
+	}
+}
+
+func TestPollBaseURL(t *testing.T) {
+	tests := map[string]string{
+		"ws://localhost:8080/ws":           "http://localhost:8080/poll",
+		"wss://tunnelr.io/ws":              "https://tunnelr.io/poll",
+		"wss://example.com/tunnelr/ws?x=1": "https://example.com/tunnelr/poll",
+	}
+	for serverURL, want := range tests {
+		if got, err := pollBaseURL(serverURL); err != nil || got != want {
+			t.Errorf("pollBaseURL(%q) = %q, %v; want %q", serverURL, got, err, want)
+		}
+	}
+}
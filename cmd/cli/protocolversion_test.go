@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"tunnelr/internal/tunnel"
+)
+
+// fakeRegistrar answers the CLI's registration with msgType and payload,
+// and reports the registration the CLI sent
+func fakeRegistrar(t *testing.T, msgType tunnel.MessageType, payload interface{}) (string, <-chan tunnel.TunnelRegister) {
+	t.Helper()
+	sent := make(chan tunnel.TunnelRegister, 1)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		msg, _ := tunnel.DecodeMessage(data)
+		var reg tunnel.TunnelRegister
+		msg.Unmarshal(&reg)
+		sent <- reg
+
+		reply, _ := tunnel.Encode(msgType, payload)
+		conn.WriteMessage(websocket.TextMessage, reply)
+		conn.ReadMessage() // Until the CLI hangs up
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws", sent
+}
+
+func TestProtocolVersionHandshake(t *testing.T) {
+	reg := tunnel.TunnelRegister{LocalPort: 3000, ProtocolVersion: tunnel.ProtocolVersion}
+
+	// Compatible: our version only
+	serverURL, sent := fakeRegistrar(t, tunnel.TypeTunnelAssigned, tunnel.TunnelAssigned{TunnelID: "abc123", ProtocolVersion: tunnel.ProtocolVersion})
+	conn, assigned, err := connectTunnel(context.Background(), websocket.DefaultDialer, serverURL, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if assigned.TunnelID != "abc123" {
+		t.Errorf("assigned %+v", assigned)
+	}
+	if v := (<-sent).ProtocolVersion; v != tunnel.ProtocolVersion {
+		t.Errorf("CLI sent version %d, want %d", v, tunnel.ProtocolVersion)
+	}
+
+	// A server answering in a version we don't know: give up, don't retry
+	tests := []struct {
+		version int
+		advice  string
+	}{
+		{tunnel.ProtocolVersion + 1, "upgrade the CLI"},
+		{0, "the server needs upgrading"}, // From before versioning
+	}
+	var connErr *connectError
+	for _, tc := range tests {
+		serverURL, _ := fakeRegistrar(t, tunnel.TypeTunnelAssigned, tunnel.TunnelAssigned{TunnelID: "abc123", ProtocolVersion: tc.version})
+		_, _, err := connectTunnel(context.Background(), websocket.DefaultDialer, serverURL, reg)
+		if !errors.As(err, &connErr) || !connErr.permanent || !strings.Contains(connErr.msg, tc.advice) {
+			t.Errorf("server version %d: got %v, want a permanent error saying %q", tc.version, err, tc.advice)
+		}
+	}
+
+	// A server refusing our version: also permanent, with its message
+	serverURL, _ = fakeRegistrar(t, tunnel.TypeTunnelError, tunnel.TunnelError{
+		Code:    tunnel.ErrCodeProtocolVersion,
+		Message: "This CLI speaks protocol version 1 but the server speaks version 2: upgrade the CLI (tunnelr update)",
+	})
+	_, _, err = connectTunnel(context.Background(), websocket.DefaultDialer, serverURL, reg)
+	if !errors.As(err, &connErr) || !connErr.permanent || connErr.code != tunnel.ErrCodeProtocolVersion || !strings.Contains(connErr.msg, "tunnelr update") {
+		t.Errorf("refused version: got %v, want a permanent %s error", err, tunnel.ErrCodeProtocolVersion)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+// Reconnecting - when the connection to the server drops (network blip,
+// server restart) we dial again with exponential backoff, asking for the
+// same tunnel ID so the public URL stays the same
+
+const (
+	reconnectMinDelay = 1 * time.Second
+	reconnectMaxDelay = 30 * time.Second
+
+	// How long to keep asking for our previous ID. Until the server notices
+	// the old connection is dead (it pings every 30s by default) it still
+	// holds the ID, so "taken" is expected for a while.
+	reconnectKeepIDFor = 90 * time.Second
+)
+
+// reconnect opens a new tunnel after the connection dropped
+// previousID is the tunnel we had. Keeps trying until it works, the server
+// refuses us for good, or ctx is canceled (then it returns nil).
+// Status goes to stderr, so it doesn't mix with --url-output on stdout.
+func reconnect(ctx context.Context, dialer tunnelDialer, serverURL string, reg tunnel.TunnelRegister, previousID string) (*tunnel.SafeConn, *tunnel.TunnelAssigned) {
+	fixedSubdomain := reg.Subdomain != ""
+	reg.Subdomain = previousID
+
+	fmt.Fprintln(os.Stderr, "Connection to the server lost")
+
+	lostAt := time.Now()
+	delay := reconnectMinDelay
+	for attempt := 1; ; attempt++ {
+		fmt.Fprintf(os.Stderr, "Reconnecting in %s (attempt %d)...\n", delay, attempt)
+
+		select {
+		case <-time.After(withJitter(delay)):
+		case <-ctx.Done():
+			return nil, nil
+		}
+
+		conn, assigned, err := connectTunnel(ctx, dialer, serverURL, reg)
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "Reconnected after %s\n", time.Since(lostAt).Round(time.Second))
+			return conn, assigned
+		}
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+
+		var connErr *connectError
+		errors.As(err, &connErr)
+		if connErr != nil && connErr.permanent {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Reconnect failed: %v\n", err)
+
+		// If the server still thinks our old ID is in use after all this
+		// time, someone else has it - settle for a new URL
+		if !fixedSubdomain && reg.Subdomain != "" && connErr != nil && connErr.code == tunnel.ErrCodeSubdomainTaken &&
+			time.Since(lostAt) > reconnectKeepIDFor {
+			fmt.Fprintf(os.Stderr, "Tunnel %s is still taken, asking for a new URL\n", previousID)
+			reg.Subdomain = ""
+		}
+
+		delay *= 2
+		if delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
+		}
+	}
+}
+
+// withJitter adds up to 20% to d, so many CLIs dropped by the same server
+// restart don't all reconnect at the same instant
+func withJitter(d time.Duration) time.Duration {
+	return d + time.Duration(rand.Int63n(int64(d)/5+1))
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunnelr/internal/tunnel"
+)
+
+// dialAttempt is one registration a fake server got
+type dialAttempt struct {
+	at  time.Time
+	reg tunnel.TunnelRegister
+}
+
+// reconnectServer answers registrations with the replies in order (a
+// *tunnel.TunnelError or *tunnel.TunnelAssigned), repeating the last one
+func reconnectServer(t *testing.T, replies ...interface{}) (url string, attempts func() []dialAttempt) {
+	t.Helper()
+	var mu sync.Mutex
+	var seen []dialAttempt
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		msg, _ := tunnel.DecodeMessage(data)
+		var reg tunnel.TunnelRegister
+		msg.Unmarshal(&reg)
+
+		mu.Lock()
+		seen = append(seen, dialAttempt{at: time.Now(), reg: reg})
+		reply := replies[len(replies)-1]
+		if len(seen) <= len(replies) {
+			reply = replies[len(seen)-1]
+		}
+		mu.Unlock()
+
+		var out []byte
+		switch reply := reply.(type) {
+		case *tunnel.TunnelError:
+			out, _ = tunnel.Encode(tunnel.TypeTunnelError, reply)
+		case *tunnel.TunnelAssigned:
+			out, _ = tunnel.Encode(tunnel.TypeTunnelAssigned, reply)
+		}
+		conn.WriteMessage(websocket.TextMessage, out)
+		conn.ReadMessage() // Hold the connection until the client hangs up
+	}))
+	t.Cleanup(srv.Close)
+
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws", func() []dialAttempt {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]dialAttempt(nil), seen...)
+	}
+}
+
+func TestReconnectKeepsTheTunnelID(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits out two backoff delays")
+	}
+	url, attempts := reconnectServer(t,
+		// The server hasn't noticed the old connection is gone yet
+		&tunnel.TunnelError{Code: tunnel.ErrCodeSubdomainTaken, Message: "taken"},
+		&tunnel.TunnelAssigned{TunnelID: "abc123", PublicURL: "https://abc123.example.com", ProtocolVersion: tunnel.ProtocolVersion},
+	)
+
+	lost := time.Now()
+	conn, assigned := reconnect(context.Background(), websocket.DefaultDialer, url, tunnel.TunnelRegister{LocalPort: 3000}, "abc123")
+	if conn == nil {
+		t.Fatal("didn't reconnect")
+	}
+	defer conn.Close()
+	if assigned.PublicURL != "https://abc123.example.com" {
+		t.Errorf("reconnected as %s", assigned.PublicURL)
+	}
+
+	seen := attempts()
+	if len(seen) != 2 {
+		t.Fatalf("dialed %d times, want 2", len(seen))
+	}
+	for i, a := range seen {
+		if a.reg.Subdomain != "abc123" {
+			t.Errorf("attempt %d asked for %q, want the previous ID abc123", i+1, a.reg.Subdomain)
+		}
+	}
+
+	// 1s, then 2s, each with up to 20% jitter
+	if first := seen[0].at.Sub(lost); first < reconnectMinDelay || first > reconnectMinDelay*6/5+500*time.Millisecond {
+		t.Errorf("first re-dial after %s, want 1s-1.2s", first)
+	}
+	if second := seen[1].at.Sub(seen[0].at); second < 2*reconnectMinDelay || second > 2*reconnectMinDelay*6/5+500*time.Millisecond {
+		t.Errorf("second re-dial %s after the first, want 2s-2.4s", second)
+	}
+}
+
+func TestReconnectStopsOnCancel(t *testing.T) {
+	url, attempts := reconnectServer(t, &tunnel.TunnelError{Code: tunnel.ErrCodeTunnelLimit, Message: "full"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	start := time.Now()
+	conn, assigned := reconnect(ctx, websocket.DefaultDialer, url, tunnel.TunnelRegister{LocalPort: 3000}, "abc123")
+	if conn != nil || assigned != nil {
+		t.Error("reconnected after Ctrl+C")
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("took %s to give up after Ctrl+C", took)
+	}
+	if n := len(attempts()); n != 0 {
+		t.Errorf("dialed %d times before the first backoff was over", n)
+	}
+}
+
+func TestReconnectJitter(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		if d := withJitter(time.Second); d < time.Second || d > 1200*time.Millisecond {
+			t.Fatalf("withJitter(1s) = %s, want 1s-1.2s", d)
+		}
+	}
+}
+
+func TestIdleCloseEndsTheSessionForGood(t *testing.T) {
+	s, server := startSession(t, nil, nil)
+	server.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(tunnel.CloseIdle, "no traffic for 1h0m0s"), time.Now().Add(time.Second))
+
+	select {
+	case <-s.ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session still running after the idle close")
+	}
+	if !s.closedForGood {
+		t.Error("an idle close would be followed by a reconnect")
+	}
+
+	// Any other close is worth reconnecting after
+	s, server = startSession(t, nil, nil)
+	server.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, "restarting"), time.Now().Add(time.Second))
+	select {
+	case <-s.ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session still running after the server went away")
+	}
+	if s.closedForGood {
+		t.Error("a restarting server stopped the CLI from reconnecting")
+	}
+}
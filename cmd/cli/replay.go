@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// `tunnelr replay` fires a recorded set of requests at a tunnel - handy for
+// re-running the same webhooks against your handler while you fix it
+
+// replayRecord is one line of a replay file, e.g.
+//
+//	{"method": "POST", "path": "/webhook", "headers": {"Content-Type": ["application/json"]}, "body": "{\"ok\":true}"}
+//
+// Only path is required. Binary bodies go in body_base64 instead of body.
+// Unknown fields are ignored, so inspector entries can be replayed as-is.
+type replayRecord struct {
+	Method     string              `json:"method"`
+	Path       string              `json:"path"`
+	Headers    map[string][]string `json:"headers"`
+	Body       string              `json:"body"`
+	BodyBase64 []byte              `json:"body_base64"` // In Go, []byte fields are base64 in JSON
+}
+
+// replayResult is the outcome of one replayed request
+type replayResult struct {
+	record     replayRecord
+	statusCode int // 0 if the request failed
+	err        error
+	duration   time.Duration
+}
+
+// replayOptions are the flags accepted by `tunnelr replay`
+type replayOptions struct {
+	file        string
+	baseURL     string        // Public tunnel URL the paths are appended to
+	concurrency int           // Requests in flight at once
+	rate        float64       // Max requests per second, 0 = unlimited
+	timeout     time.Duration // Per-request timeout
+}
+
+func runReplay(args []string) {
+	opts, err := parseReplayArgs(args)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		fmt.Println("Usage: tunnelr replay --url <public-url> [--concurrency n] [--rate n] <file>")
+		os.Exit(1)
+	}
+
+	f, err := os.Open(opts.file)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	records, err := parseReplayRecords(f)
+	f.Close()
+	if err != nil {
+		fmt.Printf("Error: %s: %v\n", opts.file, err)
+		os.Exit(1)
+	}
+	if len(records) == 0 {
+		fmt.Printf("No requests in %s\n", opts.file)
+		return
+	}
+
+	fmt.Printf("Replaying %d requests against %s\n\n", len(records), opts.baseURL)
+
+	start := time.Now()
+	results := replayAll(records, opts, func(res replayResult) {
+		if res.err != nil {
+			fmt.Printf("  ERR %s %s (%v)\n", res.record.Method, res.record.Path, res.err)
+		} else {
+			fmt.Printf("  %d %s %s (%s)\n", res.statusCode, res.record.Method, res.record.Path, res.duration.Round(time.Millisecond))
+		}
+	})
+
+	printReplaySummary(results, time.Since(start))
+
+	for _, res := range results {
+		if res.err != nil || res.statusCode >= 500 {
+			os.Exit(1)
+		}
+	}
+}
+
+// parseReplayArgs reads `replay [flags] <file>`
+func parseReplayArgs(args []string) (replayOptions, error) {
+	var opts replayOptions
+
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.StringVar(&opts.baseURL, "url", getEnv("TUNNELR_REPLAY_URL", ""), "public tunnel URL to send the requests to")
+	fs.IntVar(&opts.concurrency, "concurrency", 1, "requests in flight at once")
+	fs.Float64Var(&opts.rate, "rate", 0, "max requests per second (0 = as fast as possible)")
+	fs.DurationVar(&opts.timeout, "timeout", 30*time.Second, "timeout per request")
+
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+	if fs.NArg() < 1 {
+		return opts, fmt.Errorf("replay file required")
+	}
+	opts.file = fs.Arg(0)
+
+	// Allow flags after the file name too
+	if err := fs.Parse(fs.Args()[1:]); err != nil {
+		return opts, err
+	}
+	if fs.NArg() > 0 {
+		return opts, fmt.Errorf("unexpected argument: %s", fs.Arg(0))
+	}
+
+	if opts.baseURL == "" {
+		return opts, fmt.Errorf("--url is required (the tunnel's public URL)")
+	}
+	opts.baseURL = strings.TrimRight(opts.baseURL, "/")
+	if opts.concurrency < 1 {
+		return opts, fmt.Errorf("--concurrency must be at least 1")
+	}
+	if opts.rate < 0 {
+		return opts, fmt.Errorf("--rate can't be negative")
+	}
+	return opts, nil
+}
+
+// parseReplayRecords reads newline-delimited JSON records
+// Blank lines and lines starting with # are skipped
+func parseReplayRecords(r io.Reader) ([]replayRecord, error) {
+	var records []replayRecord
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024) // Allow big bodies
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var rec replayRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		if rec.Path == "" {
+			return nil, fmt.Errorf("line %d: path is required", lineNum)
+		}
+		if !strings.HasPrefix(rec.Path, "/") {
+			rec.Path = "/" + rec.Path
+		}
+		if rec.Method == "" {
+			rec.Method = http.MethodGet
+		}
+		rec.Method = strings.ToUpper(rec.Method)
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// replayAll sends every record, at most opts.concurrency at a time and no
+// faster than opts.rate per second. report is called as each one finishes.
+// Results come back in file order.
+func replayAll(records []replayRecord, opts replayOptions, report func(replayResult)) []replayResult {
+	client := &http.Client{
+		Timeout: opts.timeout,
+		// Show redirects as they were recorded instead of following them
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	// A ticker paces the start of each request when a rate is set
+	var tick <-chan time.Time
+	if opts.rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	results := make([]replayResult, len(records))
+	var reportMu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, opts.concurrency)
+
+	for i, rec := range records {
+		if tick != nil && i > 0 {
+			<-tick
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+
+		go func(i int, rec replayRecord) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			res := replayOne(client, opts.baseURL, rec)
+			results[i] = res
+
+			reportMu.Lock()
+			report(res)
+			reportMu.Unlock()
+		}(i, rec)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// replayOne sends a single recorded request
+func replayOne(client *http.Client, baseURL string, rec replayRecord) replayResult {
+	res := replayResult{record: rec}
+
+	body := []byte(rec.Body)
+	if len(rec.BodyBase64) > 0 {
+		body = rec.BodyBase64
+	}
+
+	req, err := http.NewRequest(rec.Method, baseURL+rec.Path, bytes.NewReader(body))
+	if err != nil {
+		res.err = err
+		return res
+	}
+	for key, values := range rec.Headers {
+		// Length and host come from the request we're actually making
+		if http.CanonicalHeaderKey(key) == "Content-Length" || http.CanonicalHeaderKey(key) == "Host" {
+			continue
+		}
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	res.statusCode = resp.StatusCode
+	res.duration = time.Since(start)
+	return res
+}
+
+// printReplaySummary shows how many requests got each status
+func printReplaySummary(results []replayResult, elapsed time.Duration) {
+	byStatus := make(map[int]int)
+	failed := 0
+	var total time.Duration
+	for _, res := range results {
+		if res.err != nil {
+			failed++
+			continue
+		}
+		byStatus[res.statusCode]++
+		total += res.duration
+	}
+
+	fmt.Println("")
+	fmt.Printf("Sent %d requests in %s\n", len(results), elapsed.Round(time.Millisecond))
+
+	codes := make([]int, 0, len(byStatus))
+	for code := range byStatus {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Printf("  %d: %d\n", code, byStatus[code])
+	}
+	if failed > 0 {
+		fmt.Printf("  failed: %d\n", failed)
+	}
+	if ok := len(results) - failed; ok > 0 {
+		fmt.Printf("  average: %s\n", (total / time.Duration(ok)).Round(time.Millisecond))
+	}
+}
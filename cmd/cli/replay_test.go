@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseReplayRecords(t *testing.T) {
+	input := `
+# recorded webhooks
+{"method": "post", "path": "/webhook", "headers": {"Content-Type": ["application/json"]}, "body": "{\"ok\":true}"}
+{"path": "health"}
+{"method": "PUT", "path": "/blob", "body_base64": "AAEC/w==", "id": 7, "status": 200}
+`
+	records, err := parseReplayRecords(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("got %d records, want 3", len(records))
+	}
+
+	if r := records[0]; r.Method != http.MethodPost || r.Path != "/webhook" || r.Body != `{"ok":true}` || r.Headers["Content-Type"][0] != "application/json" {
+		t.Errorf("record 1: %+v", r)
+	}
+	// Defaults: GET, and a leading slash
+	if r := records[1]; r.Method != http.MethodGet || r.Path != "/health" {
+		t.Errorf("record 2: %+v", r)
+	}
+	// Binary body, unknown (inspector) fields ignored
+	if r := records[2]; string(r.BodyBase64) != "\x00\x01\x02\xff" {
+		t.Errorf("record 3 body = %q", r.BodyBase64)
+	}
+}
+
+func TestParseReplayRecordsErrors(t *testing.T) {
+	tests := map[string]string{
+		"{\"path\": \"/a\"}\n{not json}":                  "line 2",
+		"{\"method\": \"GET\"}":                           "path is required",
+		"\n\n{\"path\": \"/a\", \"body_base64\": \"!!\"}": "line 3",
+	}
+	for input, want := range tests {
+		_, err := parseReplayRecords(strings.NewReader(input))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got error %v, want one mentioning %q", input, err, want)
+		}
+	}
+}
+
+func TestParseReplayArgs(t *testing.T) {
+	t.Setenv("TUNNELR_REPLAY_URL", "")
+
+	opts, err := parseReplayArgs([]string{"--url", "https://abc.example.com/", "reqs.jsonl", "--concurrency", "4", "--rate", "2.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.file != "reqs.jsonl" || opts.baseURL != "https://abc.example.com" || opts.concurrency != 4 || opts.rate != 2.5 {
+		t.Errorf("got %+v", opts)
+	}
+
+	for _, args := range [][]string{
+		{"--url", "https://x"}, // No file
+		{"reqs.jsonl"},         // No URL
+		{"--url", "https://x", "a.jsonl", "b.jsonl"},      // Two files
+		{"--url", "https://x", "--concurrency", "0", "a"}, // Nothing in flight
+		{"--url", "https://x", "--rate", "-1", "a.jsonl"}, // Negative rate
+	} {
+		if _, err := parseReplayArgs(args); err == nil {
+			t.Errorf("%v: accepted", args)
+		}
+	}
+}
+
+func TestReplayAllSendsRecords(t *testing.T) {
+	type seen struct {
+		method, path, body, contentType, host string
+	}
+	var mu sync.Mutex
+	var got []seen
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		got = append(got, seen{r.Method, r.URL.RequestURI(), string(body), r.Header.Get("Content-Type"), r.Host})
+		mu.Unlock()
+		if r.URL.Path == "/moved" {
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	records := []replayRecord{
+		{Method: http.MethodPost, Path: "/webhook?x=1", Body: "payload",
+			Headers: map[string][]string{"Content-Type": {"text/plain"}, "Content-Length": {"999"}, "Host": {"recorded.example"}}},
+		{Method: http.MethodGet, Path: "/moved"},
+	}
+	var reported int
+	results := replayAll(records, replayOptions{baseURL: srv.URL, concurrency: 1, timeout: 5 * time.Second},
+		func(replayResult) { reported++ })
+
+	if reported != 2 || len(results) != 2 {
+		t.Fatalf("reported %d, got %d results", reported, len(results))
+	}
+	// Results in file order; redirects shown as recorded, not followed
+	if results[0].statusCode != http.StatusAccepted || results[1].statusCode != http.StatusFound {
+		t.Errorf("statuses %d, %d", results[0].statusCode, results[1].statusCode)
+	}
+	if len(got) != 2 {
+		t.Fatalf("server got %d requests, want 2", len(got))
+	}
+	first := got[0]
+	if first.method != http.MethodPost || first.path != "/webhook?x=1" || first.body != "payload" || first.contentType != "text/plain" {
+		t.Errorf("server got %+v", first)
+	}
+	if first.host == "recorded.example" {
+		t.Error("recorded Host header was sent instead of the tunnel's")
+	}
+}
+
+func TestReplayAllLimitsConcurrencyAndRate(t *testing.T) {
+	var inFlight, peak atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	records := make([]replayRecord, 12)
+	for i := range records {
+		records[i] = replayRecord{Method: http.MethodGet, Path: "/"}
+	}
+
+	replayAll(records, replayOptions{baseURL: srv.URL, concurrency: 3, timeout: 5 * time.Second}, func(replayResult) {})
+	if p := peak.Load(); p > 3 {
+		t.Errorf("%d requests in flight with --concurrency 3", p)
+	}
+
+	// 20 per second: 12 requests take at least 11 ticks of 50ms
+	start := time.Now()
+	results := replayAll(records, replayOptions{baseURL: srv.URL, concurrency: 12, rate: 20, timeout: 5 * time.Second}, func(replayResult) {})
+	if took := time.Since(start); took < 550*time.Millisecond {
+		t.Errorf("12 requests at --rate 20 took only %s", took)
+	}
+	for i, res := range results {
+		if res.err != nil || res.statusCode != http.StatusOK {
+			t.Errorf("request %d: %d %v", i, res.statusCode, res.err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+// rawRequest is what a local server got, as sent on the wire
+type rawRequest struct {
+	header http.Header
+	body   string
+}
+
+// rawLocalServer answers every request with 200 and reports exactly what
+// it received - unlike net/http, which fills in what's missing
+func rawLocalServer(t *testing.T) (string, <-chan rawRequest) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	got := make(chan rawRequest, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r := textproto.NewReader(bufio.NewReader(conn))
+			r.ReadLine() // Request line
+			header, err := r.ReadMIMEHeader()
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			length, _ := strconv.Atoi(header.Get("Content-Length"))
+			body := make([]byte, length)
+			io.ReadFull(r.R, body)
+			got <- rawRequest{http.Header(header), string(body)}
+			io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+			conn.Close()
+		}
+	}()
+	return l.Addr().String(), got
+}
+
+func TestRequestBodyOnlyWhenSent(t *testing.T) {
+	addr, received := rawLocalServer(t)
+	_, server := startSession(t, []string{addr}, nil)
+
+	tests := []struct {
+		name          string
+		method        string
+		headers       http.Header
+		body          string
+		contentLength string // "" = no Content-Length header at all
+	}{
+		{"GET without a body", http.MethodGet, http.Header{}, "", ""},
+		{"POST with a body", http.MethodPost, http.Header{"Content-Length": {"5"}}, "hello", "5"},
+		{"POST, explicitly empty", http.MethodPost, http.Header{"Content-Length": {"0"}}, "", "0"},
+		{"DELETE, explicitly empty", http.MethodDelete, http.Header{"Content-Length": {"0"}}, "", "0"},
+	}
+	for _, tc := range tests {
+		sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{
+			ID: tc.name, Method: tc.method, Path: "/", Headers: tc.headers, Body: []byte(tc.body),
+		})
+		if resp := readResponse(t, server); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got %d", tc.name, resp.StatusCode)
+		}
+		got := <-received
+		if cl := got.header.Get("Content-Length"); cl != tc.contentLength {
+			t.Errorf("%s: local server got Content-Length %q, want %q", tc.name, cl, tc.contentLength)
+		}
+		if te := got.header.Get("Transfer-Encoding"); te != "" {
+			t.Errorf("%s: local server got Transfer-Encoding %q", tc.name, te)
+		}
+		if got.body != tc.body {
+			t.Errorf("%s: local server got body %q, want %q", tc.name, got.body, tc.body)
+		}
+	}
+}
+
+func TestRequestBody(t *testing.T) {
+	if body := requestBody(&tunnel.HTTPRequest{Headers: http.Header{}}); body != nil {
+		t.Errorf("no body: got %v, want nil", body)
+	}
+	if body := requestBody(&tunnel.HTTPRequest{Headers: http.Header{"Content-Length": {"0"}}}); body != http.NoBody {
+		t.Errorf("Content-Length 0: got %v, want http.NoBody", body)
+	}
+	body := requestBody(&tunnel.HTTPRequest{Headers: http.Header{}, Body: []byte("hello")})
+	if data, _ := io.ReadAll(body); string(data) != "hello" {
+		t.Errorf("with a body: read %q", data)
+	}
+}
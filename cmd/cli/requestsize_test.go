@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+// captureStdout collects what's printed until the returned function is
+// called, and returns it
+func captureStdout(t *testing.T) func() string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := os.Stdout
+	os.Stdout = w
+	done := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(&buf, r)
+		done <- buf.String()
+	}()
+	return func() string {
+		os.Stdout = old
+		w.Close()
+		return <-done
+	}
+}
+
+func TestRequestLogShowsBodySizes(t *testing.T) {
+	old := streamThreshold
+	streamThreshold = 4 * 1024 // So /download is streamed
+	t.Cleanup(func() { streamThreshold = old })
+
+	addr := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if r.URL.Path == "/download" {
+			w.Write(make([]byte, 20*1024))
+			return
+		}
+		io.WriteString(w, "stored it, thanks")
+	})
+	ins := newInspector()
+	_, server := startSessionWith(t, []string{addr}, []string{tunnel.CapStreaming}, func(s *session) { s.inspector = ins })
+
+	upload := bytes.Repeat([]byte("x"), 2200*1024)
+	output := captureStdout(t)
+	sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{
+		ID: "upload-539", Method: http.MethodPost, Path: "/upload",
+		Headers: http.Header{}, Body: upload,
+	})
+	readResponse(t, server)
+	sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{
+		ID: "get-539", Method: http.MethodGet, Path: "/status", Headers: http.Header{},
+	})
+	readResponse(t, server)
+	sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{
+		ID: "download-539", Method: http.MethodGet, Path: "/download", Headers: http.Header{},
+	})
+	if resp := readResponse(t, server); !resp.Streamed {
+		t.Fatal("/download wasn't streamed")
+	}
+	readStreamedBody(t, server, "download-539")
+
+	// A request is logged and recorded once it's done, which for a stream
+	// is just after its last chunk goes out
+	var entries []inspectedRequest
+	deadline := time.Now().Add(5 * time.Second)
+	for len(entries) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		entries = inspectorJSON(t, ins)
+	}
+	out := output()
+
+	// One line per request, written after the response
+	want := []string{
+		"POST /upload (req 2.1 MB) -> 200 (resp 17 B)",
+		"GET /status -> 200 (resp 17 B)", // No body, no size
+		"GET /download -> 200 (resp 20.0 KB streamed)",
+	}
+	if got := strings.Split(strings.TrimSpace(out), "\n"); !reflect.DeepEqual(got, want) {
+		t.Errorf("log is\n%s\nwant\n%s", out, strings.Join(want, "\n"))
+	}
+
+	// The inspector has the same sizes, newest first
+	if len(entries) != 3 {
+		t.Fatalf("inspector has %d entries, want 3", len(entries))
+	}
+	if entries[2].Path != "/upload" || entries[2].RequestBytes != int64(len(upload)) {
+		t.Errorf("inspector shows %s with %d request bytes, want /upload with %d", entries[2].Path, entries[2].RequestBytes, len(upload))
+	}
+	if entries[1].RequestBytes != 0 {
+		t.Errorf("inspector shows %d request bytes for the GET, want 0", entries[1].RequestBytes)
+	}
+}
+
+func TestOverloadedRequestIsLoggedOnce(t *testing.T) {
+	s, server := startSession(t, []string{"127.0.0.1:1"}, nil)
+	output := captureStdout(t)
+	s.sendOverloaded(&tunnel.HTTPRequest{ID: "busy-539", Method: http.MethodPut, Path: "/files/a", Body: []byte("hello")})
+	readResponse(t, server)
+	out := output()
+
+	want := fmt.Sprintf("PUT /files/a (req 5 B) -> 503 Overloaded (%d requests in flight)\n", cap(s.slots))
+	if out != want {
+		t.Errorf("log is %q, want %q", out, want)
+	}
+}
+
+func TestRequestBodySize(t *testing.T) {
+	tests := []struct {
+		name string
+		req  tunnel.HTTPRequest
+		want int64
+	}{
+		{"no body", tunnel.HTTPRequest{}, 0},
+		{"buffered", tunnel.HTTPRequest{Body: []byte("hello")}, 5},
+		{"streamed with a length", tunnel.HTTPRequest{Streamed: true, Headers: http.Header{"Content-Length": {"1048576"}}}, 1048576},
+		{"streamed, chunked", tunnel.HTTPRequest{Streamed: true, Headers: http.Header{}}, -1},
+		{"streamed, bad length", tunnel.HTTPRequest{Streamed: true, Headers: http.Header{"Content-Length": {"-3"}}}, -1},
+	}
+	for _, tc := range tests {
+		if got := requestBodySize(&tc.req); got != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, got, tc.want)
+		}
+	}
+
+	notes := map[int64]string{
+		-1:          " (req streamed)",
+		0:           "",
+		14:          " (req 14 B)",
+		1536:        " (req 1.5 KB)",
+		2200 * 1024: " (req 2.1 MB)",
+	}
+	for n, want := range notes {
+		if got := requestSizeNote(n); got != want {
+			t.Errorf("requestSizeNote(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"tunnelr/internal/tunnel"
+)
+
+// --rewrite asks the server to find/replace in bodies passing through the
+// tunnel, e.g. to point an app's hard-coded localhost links at the public URL:
+//
+//	tunnelr connect 3000 --rewrite 'http://localhost:3000=>{public_url}'
+
+// rewriteSeparator splits a --rewrite value into pattern and replacement
+const rewriteSeparator = "=>"
+
+// rewriteFlags collects repeated --rewrite flags
+// In Go, any type with String and Set methods can be used as a flag
+// (flag.Value), which is how a flag can be given more than once.
+type rewriteFlags []tunnel.RewriteRule
+
+func (f *rewriteFlags) String() string {
+	var rules []string
+	for _, rule := range *f {
+		rules = append(rules, rule.Find+rewriteSeparator+rule.Replace)
+	}
+	return strings.Join(rules, " ")
+}
+
+func (f *rewriteFlags) Set(value string) error {
+	find, replace, ok := strings.Cut(value, rewriteSeparator)
+	if !ok || find == "" {
+		return fmt.Errorf("use pattern%sreplacement", rewriteSeparator)
+	}
+	*f = append(*f, tunnel.RewriteRule{Find: find, Replace: replace})
+	return nil
+}
+
+// bodyRewrite builds the registration's rewrite setup, nil without rules
+func (opts *connectOptions) bodyRewrite() *tunnel.BodyRewrite {
+	if len(opts.rewrites) == 0 {
+		return nil
+	}
+	rw := &tunnel.BodyRewrite{Rules: opts.rewrites, Requests: opts.rewriteRequests}
+	for _, t := range strings.Split(opts.rewriteTypes, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			rw.ContentTypes = append(rw.ContentTypes, t)
+		}
+	}
+	return rw
+}
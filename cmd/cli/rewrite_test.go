@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRewriteFlags(t *testing.T) {
+	_, opts, err := parseConnectArgs([]string{"3000",
+		"--rewrite", "http://localhost:3000=>{public_url}",
+		"--rewrite", `port=(\d+)=>port=$1`,
+		"--rewrite-types", "text/html, application/javascript",
+		"--rewrite-requests",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := opts.bodyRewrite()
+	if rw == nil || len(rw.Rules) != 2 {
+		t.Fatalf("got %+v, want two rules", rw)
+	}
+	if rw.Rules[0].Find != "http://localhost:3000" || rw.Rules[0].Replace != "{public_url}" {
+		t.Errorf("rule 1 = %+v", rw.Rules[0])
+	}
+	if rw.Rules[1].Find != `port=(\d+)` || rw.Rules[1].Replace != "port=$1" {
+		t.Errorf("rule 2 = %+v", rw.Rules[1])
+	}
+	if strings.Join(rw.ContentTypes, ",") != "text/html,application/javascript" || !rw.Requests {
+		t.Errorf("types %v, requests %v", rw.ContentTypes, rw.Requests)
+	}
+
+	// No rules, nothing to register
+	if _, opts, _ := parseConnectArgs([]string{"3000", "--rewrite-types", "text/css"}); opts.bodyRewrite() != nil {
+		t.Error("--rewrite-types alone set up rewriting")
+	}
+}
+
+func TestRewriteFlagErrors(t *testing.T) {
+	for _, value := range []string{"no separator", "=>replacement only", "(unclosed=>x"} {
+		if _, _, err := parseConnectArgs([]string{"3000", "--rewrite", value}); err == nil {
+			t.Errorf("--rewrite %q was accepted", value)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSubdomainFlag(t *testing.T) {
+	t.Setenv("TUNNELR_SUBDOMAIN", "")
+
+	// Case doesn't matter, the server gets lowercase
+	_, opts, err := parseConnectArgs([]string{"--subdomain", "MyApp", "3000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.subdomain != "myapp" {
+		t.Errorf("subdomain = %q, want myapp", opts.subdomain)
+	}
+
+	// Bad names are caught before connecting
+	for _, name := range []string{"my_app", "my.app", "-myapp", "my app", strings.Repeat("a", 64)} {
+		if _, _, err := parseConnectArgs([]string{"--subdomain", name, "3000"}); err == nil || !strings.Contains(err.Error(), "invalid subdomain") {
+			t.Errorf("--subdomain %q: got %v, want an invalid subdomain error", name, err)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultLocalHost is where requests go when the target is just a port
+const defaultLocalHost = "localhost"
+
+// targetRetryAfter is how long a local server that refused a connection is
+// skipped before it gets requests again
+var targetRetryAfter = getEnvDuration("TUNNELR_TARGET_RETRY_AFTER", 5*time.Second)
+
+// parseTargets reads the `connect` target: one or more servers separated by
+// commas, each a port ("3000") or host:port ("192.168.1.50:8080",
+// "app.internal:80", "[::1]:3000"). With several, requests are spread over
+// them round-robin.
+// Returns each server's host:port
+func parseTargets(arg string) ([]string, error) {
+	var addrs []string
+	for _, part := range strings.Split(arg, ",") {
+		host, port, err := parseTarget(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	return addrs, nil
+}
+
+// parseTarget reads a single server: a port, or host:port
+// Returns the host (localhost for a bare port) and the port
+func parseTarget(arg string) (string, int, error) {
+	host, portArg := defaultLocalHost, arg
+	if strings.Contains(arg, ":") {
+		var err error
+		host, portArg, err = net.SplitHostPort(arg)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid target %q: use <port> or <host>:<port>", arg)
+		}
+		if !validTargetHost(host) {
+			return "", 0, fmt.Errorf("invalid host %q: use a hostname or IP address, without a scheme or path", host)
+		}
+	}
+
+	port, err := strconv.Atoi(portArg)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port number: %s", portArg)
+	}
+	// Anything else would only fail later, with a confusing error about the
+	// local URL
+	if port < 1 || port > 65535 {
+		return "", 0, fmt.Errorf("port %d is out of range, it must be between 1 and 65535", port)
+	}
+	return host, port, nil
+}
+
+// validTargetHost accepts IP addresses and hostnames made of letters,
+// digits, dots, hyphens and underscores (Docker service names use them)
+// Catches the usual mistakes, like "http://host:3000" or "host/path:3000"
+func validTargetHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	if host == "" || len(host) > 253 || strings.HasPrefix(host, ".") || strings.HasPrefix(host, "-") {
+		return false
+	}
+	for _, c := range host {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// localTarget is one local server requests can go to
+type localTarget struct {
+	addr      string    // host:port
+	downUntil time.Time // Skipped until then after refusing a connection
+}
+
+// localTargets spreads requests over the local servers round-robin
+// A server that refuses a connection is skipped for targetRetryAfter, so a
+// dead instance doesn't fail every Nth request. Shared by every session, so
+// what we learned survives a reconnect.
+type localTargets struct {
+	mu   sync.Mutex
+	list []*localTarget
+	next int // Where the round-robin continues
+}
+
+// newLocalTargets creates the set from host:port addresses
+func newLocalTargets(addrs []string) *localTargets {
+	t := &localTargets{}
+	for _, addr := range addrs {
+		t.list = append(t.list, &localTarget{addr: addr})
+	}
+	return t
+}
+
+// Pick returns the next target for a request, never one in tried
+// Targets that are up come first; when all of them are down, one that's
+// down is tried anyway (it may be back). Returns nil once every target
+// has been tried.
+func (t *localTargets) Pick(tried []*localTarget) *localTarget {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	var fallback *localTarget
+	fallbackAt := 0
+	for i := 0; i < len(t.list); i++ {
+		at := (t.next + i) % len(t.list)
+		target := t.list[at]
+		if containsTarget(tried, target) {
+			continue
+		}
+		if now.Before(target.downUntil) {
+			if fallback == nil {
+				fallback, fallbackAt = target, at
+			}
+			continue
+		}
+		t.next = at + 1
+		return target
+	}
+	if fallback != nil {
+		t.next = fallbackAt + 1
+	}
+	return fallback
+}
+
+// MarkDown skips target for a while after it refused a connection
+func (t *localTargets) MarkDown(target *localTarget) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	target.downUntil = time.Now().Add(targetRetryAfter)
+}
+
+// MarkUp puts target back in rotation after it answered
+func (t *localTargets) MarkUp(target *localTarget) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	target.downUntil = time.Time{}
+}
+
+// Len returns how many targets there are
+func (t *localTargets) Len() int {
+	return len(t.list)
+}
+
+// Addrs returns every target's host:port
+func (t *localTargets) Addrs() []string {
+	addrs := make([]string, len(t.list))
+	for i, target := range t.list {
+		addrs[i] = target.addr
+	}
+	return addrs
+}
+
+// containsTarget reports whether list contains target
+func containsTarget(list []*localTarget, target *localTarget) bool {
+	for _, have := range list {
+		if have == target {
+			return true
+		}
+	}
+	return false
+}
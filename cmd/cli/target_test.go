@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestLocalPortRange(t *testing.T) {
+	for _, port := range []string{"1", "80", "3000", "65535"} {
+		targets, _, err := parseConnectArgs([]string{port})
+		if err != nil {
+			t.Errorf("port %s refused: %v", port, err)
+			continue
+		}
+		if len(targets) != 1 || !strings.HasSuffix(targets[0], ":"+port) {
+			t.Errorf("port %s: targets %v", port, targets)
+		}
+	}
+
+	tests := []struct {
+		port string
+		want string
+	}{
+		{"0", "out of range"},
+		{"65536", "out of range"},
+		{"99999", "out of range"},
+		{"localhost:0", "out of range"},
+		{"abc", "invalid port number"},
+		{"30o0", "invalid port number"},
+	}
+	for _, tc := range tests {
+		_, _, err := parseConnectArgs([]string{tc.port})
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("port %s: got %v, want an error saying %q", tc.port, err, tc.want)
+		}
+	}
+
+	// On the command line -1 would be taken for a flag
+	if _, _, err := parseTarget("-1"); err == nil || !strings.Contains(err.Error(), "out of range") {
+		t.Errorf("port -1: got %v", err)
+	}
+}
+
+func TestParseTargets(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want string
+	}{
+		{"3000", "localhost:3000"},
+		{"192.168.1.5:8080", "192.168.1.5:8080"},
+		{"api:8080", "api:8080"},
+		{"my_service.internal:80", "my_service.internal:80"},
+		{"[::1]:3000", "[::1]:3000"},
+		{"3000,3001", "localhost:3000,localhost:3001"},
+	}
+	for _, tc := range tests {
+		addrs, err := parseTargets(tc.arg)
+		if err != nil {
+			t.Errorf("%s: %v", tc.arg, err)
+			continue
+		}
+		if got := strings.Join(addrs, ","); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.arg, got, tc.want)
+		}
+	}
+
+	for _, arg := range []string{"http://localhost:3000", "host/path:3000", ":3000", "host:", "-bad:80", ".bad:80", "a:b:c", "localhost:3000,"} {
+		if addrs, err := parseTargets(arg); err == nil {
+			t.Errorf("%s: accepted as %v", arg, addrs)
+		}
+	}
+}
+
+func TestTargetsRoundRobin(t *testing.T) {
+	targets := newLocalTargets([]string{"a:1", "b:1", "c:1"})
+	pick := func(tried ...*localTarget) string {
+		if target := targets.Pick(tried); target != nil {
+			return target.addr
+		}
+		return "none"
+	}
+
+	var got []string
+	for i := 0; i < 6; i++ {
+		got = append(got, pick())
+	}
+	if strings.Join(got, " ") != "a:1 b:1 c:1 a:1 b:1 c:1" {
+		t.Errorf("order %v, want round-robin", got)
+	}
+
+	// A server that's down is skipped until it's back
+	b := targets.list[1]
+	targets.MarkDown(b)
+	got = nil
+	for i := 0; i < 4; i++ {
+		got = append(got, pick())
+	}
+	if strings.Join(got, " ") != "a:1 c:1 a:1 c:1" {
+		t.Errorf("with b down: order %v", got)
+	}
+	targets.MarkUp(b)
+	if next := pick(); next != "a:1" {
+		t.Errorf("after b came back, picked %s", next)
+	}
+	if next := pick(); next != "b:1" {
+		t.Errorf("b not back in rotation, picked %s", next)
+	}
+
+	// All down: one is tried anyway, it may be back
+	for _, target := range targets.list {
+		targets.MarkDown(target)
+	}
+	if next := pick(); next == "none" {
+		t.Error("nothing picked with every server down")
+	}
+
+	// Never the same one twice for a request
+	if next := pick(targets.list...); next != "none" {
+		t.Errorf("picked %s after every server was tried", next)
+	}
+}
+
+func TestRequestsSpreadOverTargets(t *testing.T) {
+	var hits [3]atomic.Int32
+	var addrs []string
+	for i := range hits {
+		i := i
+		addrs = append(addrs, localServer(t, func(w http.ResponseWriter, r *http.Request) {
+			hits[i].Add(1)
+		}))
+	}
+	_, server := startSession(t, addrs, nil)
+
+	for i := 0; i < 9; i++ {
+		sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{ID: fmt.Sprint(i), Method: http.MethodGet, Path: "/"})
+		if resp := readResponse(t, server); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d got %d", i, resp.StatusCode)
+		}
+	}
+	for i := range hits {
+		if got := hits[i].Load(); got != 3 {
+			t.Errorf("server %d got %d of 9 requests, want 3", i, got)
+		}
+	}
+}
+
+func TestDeadTargetFailsOver(t *testing.T) {
+	old := targetRetryAfter
+	targetRetryAfter = time.Minute
+	t.Cleanup(func() { targetRetryAfter = old })
+	var hits atomic.Int32
+	alive := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.Copy(w, r.Body)
+	})
+	dead := closedPort(t)
+	_, server := startSession(t, []string{dead, alive}, nil)
+
+	// Every request is answered, bodies included, by the one that's up
+	for i := 0; i < 4; i++ {
+		sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{ID: fmt.Sprint(i), Method: http.MethodPost, Path: "/", Body: []byte("hello")})
+		resp := readResponse(t, server)
+		if resp.StatusCode != http.StatusOK || string(resp.Body) != "hello" {
+			t.Fatalf("request %d got %d %q", i, resp.StatusCode, resp.Body)
+		}
+	}
+	if got := hits.Load(); got != 4 {
+		t.Errorf("live server got %d requests, want all 4", got)
+	}
+
+	// With nothing up, the visitor gets the unreachable 502
+	_, server = startSession(t, []string{closedPort(t), closedPort(t)}, nil)
+	sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{ID: "all-down", Method: http.MethodGet, Path: "/"})
+	resp := readResponse(t, server)
+	if resp.StatusCode != http.StatusBadGateway || resp.Headers.Get(tunnel.UnreachableHeader) == "" {
+		t.Errorf("all down: got %d %v, want an unreachable 502", resp.StatusCode, resp.Headers)
+	}
+}
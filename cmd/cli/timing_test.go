@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+// requestTiming sends one request through a session and returns the
+// response headers, with TUNNELR_TIMING_HEADERS set to enabled
+func requestTiming(t *testing.T, enabled bool, handler http.HandlerFunc) http.Header {
+	t.Helper()
+	old := timingHeaders
+	timingHeaders = enabled
+	t.Cleanup(func() { timingHeaders = old })
+
+	_, server := startSession(t, []string{localServer(t, handler)}, nil)
+	sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{
+		ID: "timing-1", Method: http.MethodGet, Path: "/", Headers: http.Header{},
+	})
+	return readResponse(t, server).Headers
+}
+
+func TestTimingHeadersMeasureLocalServer(t *testing.T) {
+	headers := requestTiming(t, true, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("slow"))
+	})
+
+	ms, err := strconv.ParseFloat(headers.Get("X-Tunnel-Local-Duration"), 64)
+	if err != nil {
+		t.Fatalf("X-Tunnel-Local-Duration = %q: %v", headers.Get("X-Tunnel-Local-Duration"), err)
+	}
+	if ms < 50 || ms > 5000 {
+		t.Errorf("local duration %.3fms for a 50ms handler", ms)
+	}
+	if got := headers.Get("Server-Timing"); !strings.HasPrefix(got, `local;desc="Local server";dur=`) {
+		t.Errorf("Server-Timing = %q", got)
+	}
+}
+
+func TestTimingHeadersAreOptIn(t *testing.T) {
+	headers := requestTiming(t, false, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	if got := headers.Get("X-Tunnel-Local-Duration"); got != "" {
+		t.Errorf("X-Tunnel-Local-Duration = %q without TUNNELR_TIMING_HEADERS", got)
+	}
+	if got := headers.Get("Server-Timing"); got != "" {
+		t.Errorf("Server-Timing = %q without TUNNELR_TIMING_HEADERS", got)
+	}
+}
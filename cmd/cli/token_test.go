@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestTokenFlag(t *testing.T) {
+	t.Setenv("TUNNELR_TOKEN", "from-env")
+
+	_, opts, err := parseConnectArgs([]string{"3000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.token != "from-env" {
+		t.Errorf("token = %q, want TUNNELR_TOKEN's from-env", opts.token)
+	}
+
+	// The flag wins over the environment
+	_, opts, err = parseConnectArgs([]string{"3000", "--token", "from-flag"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.token != "from-flag" {
+		t.Errorf("token = %q, want --token's from-flag", opts.token)
+	}
+}
+
+func TestRefusedTokenIsReported(t *testing.T) {
+	// A server that reads the registration and closes the connection the
+	// way tunnelr-server does for a bad token
+	var sent tunnel.TunnelRegister
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		msg, _ := tunnel.DecodeMessage(data)
+		msg.Unmarshal(&sent)
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "invalid auth token"), time.Now().Add(time.Second))
+	}))
+	defer srv.Close()
+
+	_, _, err := connectTunnel(context.Background(), websocket.DefaultDialer,
+		"ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", tunnel.TunnelRegister{LocalPort: 3000, AuthToken: "wrong"})
+
+	if sent.AuthToken != "wrong" {
+		t.Errorf("server got token %q, want wrong", sent.AuthToken)
+	}
+	var connErr *connectError
+	if !errors.As(err, &connErr) {
+		t.Fatalf("got %v, want a connectError", err)
+	}
+	if !strings.Contains(connErr.msg, "invalid auth token") {
+		t.Errorf("error %q doesn't give the server's reason", connErr.msg)
+	}
+	// Reconnecting with the same token can't help
+	if !connErr.permanent {
+		t.Error("a refused token is retried")
+	}
+}
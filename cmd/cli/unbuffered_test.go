@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+// trickle is a local server that writes "first", then the rest once release
+// is closed
+func trickle(header http.Header, release chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for name, values := range header {
+			w.Header()[name] = values
+		}
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte(" and the rest"))
+	}
+}
+
+// readFirstChunk reads the response and its first body chunk
+// Fails if they don't arrive while the local server is still writing.
+func readFirstChunk(t *testing.T, server *tunnel.SafeConn) (*tunnel.HTTPResponse, string) {
+	t.Helper()
+	resp := readResponse(t, server)
+	if !resp.Streamed {
+		t.Fatalf("response sent in one piece (%q), want it streamed", resp.Body)
+	}
+	for {
+		msg := readMessage(t, server, 2*time.Second)
+		if msg.Type != tunnel.TypeBodyChunk {
+			continue
+		}
+		var chunk tunnel.BodyChunk
+		msg.Unmarshal(&chunk)
+		return resp, string(chunk.Data)
+	}
+}
+
+func TestUnbufferedResponsesStreamAsWritten(t *testing.T) {
+	caps := []string{tunnel.CapStreaming}
+	tests := []struct {
+		name        string
+		header      http.Header
+		noBuffering bool
+	}{
+		{"X-Accel-Buffering", http.Header{"X-Accel-Buffering": {"no"}}, false},
+		{"event stream", http.Header{"Content-Type": {"text/event-stream"}}, false},
+		{"--no-buffering", nil, true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		release := make(chan struct{})
+		addr := localServer(t, trickle(tc.header, release))
+		_, server := startSessionWith(t, []string{addr}, caps, func(s *session) {
+			s.unbuffered = tc.noBuffering
+		})
+
+		sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{ID: "log", Method: http.MethodGet, Path: "/"})
+		if _, first := readFirstChunk(t, server); first != "first" {
+			t.Errorf("%s: first chunk %q, want what the local server has written so far", tc.name, first)
+		}
+		close(release)
+	}
+}
+
+func TestSmallResponsesAreStillBuffered(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+	addr := localServer(t, trickle(nil, release))
+	_, server := startSession(t, []string{addr}, []string{tunnel.CapStreaming})
+
+	sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{ID: "page", Method: http.MethodGet, Path: "/"})
+	resp := readResponse(t, server)
+	if resp.Streamed || string(resp.Body) != "first and the rest" {
+		t.Errorf("got streamed=%v %q, want the whole body in one message", resp.Streamed, resp.Body)
+	}
+}
+
+func TestNoBufferingFlag(t *testing.T) {
+	t.Setenv("TUNNELR_NO_BUFFERING", "")
+	if _, opts, _ := parseConnectArgs([]string{"3000", "--no-buffering"}); !opts.noBuffering {
+		t.Error("--no-buffering not set")
+	}
+	t.Setenv("TUNNELR_NO_BUFFERING", "true")
+	if _, opts, _ := parseConnectArgs([]string{"3000"}); !opts.noBuffering {
+		t.Error("TUNNELR_NO_BUFFERING=true not honored")
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+// `tunnelr update` replaces this binary with the latest release, so clients
+// keep up with protocol changes on the server.
+//
+// Releases are described by a manifest at TUNNELR_UPDATE_URL (or --url):
+//
+//	{
+//	  "version": "1.4.0",
+//	  "binaries": {
+//	    "linux-amd64":  {"url": "https://.../tunnelr-linux-amd64", "sha256": "9f86d0...", "signature": "base64..."},
+//	    "darwin-arm64": {"url": "https://.../tunnelr-darwin-arm64", "sha256": "..."}
+//	  }
+//	}
+//
+// The download must match sha256. If TUNNELR_UPDATE_PUBLIC_KEY is set
+// (base64 ed25519 key), it must also carry a valid signature of the binary.
+
+// version is the release this binary was built from, set at build time
+// along with the commit and build date:
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%d)" -o tunnelr ./cmd/cli
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// printVersion is `tunnelr version`
+func printVersion(out io.Writer) {
+	fmt.Fprintf(out, "tunnelr %s\n", tunnel.VersionString(version, commit, buildDate))
+}
+
+// updateDownloadLimit caps how much we download - a CLI binary is ~10 MB
+const updateDownloadLimit = 200 << 20
+
+// updateManifest describes the latest release
+type updateManifest struct {
+	Version  string                  `json:"version"`
+	Binaries map[string]updateBinary `json:"binaries"` // By "<GOOS>-<GOARCH>"
+}
+
+// updateBinary is one platform's download
+type updateBinary struct {
+	URL       string `json:"url"`
+	SHA256    string `json:"sha256"`              // Hex
+	Signature string `json:"signature,omitempty"` // Base64 ed25519 signature of the binary
+}
+
+func runUpdate(args []string) {
+	fs := flag.NewFlagSet("update", flag.ContinueOnError)
+	manifestURL := fs.String("url", getEnv("TUNNELR_UPDATE_URL", ""), "URL of the release manifest")
+	checkOnly := fs.Bool("check", false, "only report whether a newer version is available")
+	force := fs.Bool("force", false, "install the release even if it isn't newer (or this is a dev build)")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return
+		}
+		os.Exit(1)
+	}
+	if *manifestURL == "" {
+		fmt.Println("Error: no update source, pass --url or set TUNNELR_UPDATE_URL to your release manifest")
+		os.Exit(1)
+	}
+
+	publicKey, err := parsePublicKey(getEnv("TUNNELR_UPDATE_PUBLIC_KEY", ""))
+	if err != nil {
+		fmt.Printf("Error: TUNNELR_UPDATE_PUBLIC_KEY: %v\n", err)
+		os.Exit(1)
+	}
+
+	client := &http.Client{Timeout: 5 * time.Minute}
+	manifest, err := fetchManifest(client, *manifestURL)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Current version: %s\n", version)
+	fmt.Printf("Latest version:  %s\n", manifest.Version)
+
+	newer := version != "dev" && compareVersions(manifest.Version, version) > 0
+	if !newer && !*force {
+		if version == "dev" {
+			fmt.Println("\nThis is a development build, use --force to replace it with the release")
+		} else {
+			fmt.Println("\nAlready up to date")
+		}
+		return
+	}
+	if *checkOnly {
+		fmt.Println("\nA newer version is available, run `tunnelr update` to install it")
+		return
+	}
+
+	platform := runtime.GOOS + "-" + runtime.GOARCH
+	bin, ok := manifest.Binaries[platform]
+	if !ok {
+		fmt.Printf("Error: the release has no binary for %s\n", platform)
+		os.Exit(1)
+	}
+
+	if err := installUpdate(client, bin, publicKey); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("\nUpdated to %s\n", manifest.Version)
+}
+
+// fetchManifest downloads and parses the release manifest
+func fetchManifest(client *http.Client, manifestURL string) (*updateManifest, error) {
+	resp, err := client.Get(manifestURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the release manifest: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch the release manifest: HTTP %d", resp.StatusCode)
+	}
+
+	var manifest updateManifest
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("invalid release manifest: %v", err)
+	}
+	if _, err := parseVersion(manifest.Version); err != nil {
+		return nil, fmt.Errorf("invalid release manifest: %v", err)
+	}
+	return &manifest, nil
+}
+
+// installUpdate downloads bin, checks it, and swaps it in for this binary
+// The old binary is kept until the new one has proven it runs, and put back
+// if anything goes wrong.
+func installUpdate(client *http.Client, bin updateBinary, publicKey ed25519.PublicKey) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("can't find this binary: %v", err)
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return fmt.Errorf("can't find this binary: %v", err)
+	}
+
+	// Download next to the binary, so the final rename stays on one filesystem
+	// (renames are only atomic within a filesystem)
+	tmp, err := os.CreateTemp(filepath.Dir(exe), ".tunnelr-update-*")
+	if err != nil {
+		return fmt.Errorf("can't write next to %s (try running with sudo): %v", exe, err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // No-op once it's been renamed into place
+
+	fmt.Printf("\nDownloading %s\n", bin.URL)
+	data, err := download(client, bin.URL)
+	if err == nil {
+		err = verifyBinary(data, bin, publicKey)
+	}
+	if err == nil {
+		_, err = tmp.Write(data)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, 0o755); err != nil {
+		return err
+	}
+
+	// Swap: current -> .old, new -> current
+	backup := exe + ".old"
+	if err := os.Rename(exe, backup); err != nil {
+		return fmt.Errorf("can't replace %s: %v", exe, err)
+	}
+	if err := os.Rename(tmpPath, exe); err != nil {
+		os.Rename(backup, exe)
+		return fmt.Errorf("can't replace %s: %v", exe, err)
+	}
+
+	// Make sure the new binary actually runs here before dropping the old one
+	if out, err := exec.Command(exe, "version").CombinedOutput(); err != nil {
+		os.Rename(backup, exe)
+		return fmt.Errorf("the new binary doesn't run (%v: %s), kept the old one", err, strings.TrimSpace(string(out)))
+	}
+
+	// On Windows a running binary can't be deleted - it's left behind then
+	os.Remove(backup)
+	return nil
+}
+
+// download fetches url into memory, up to updateDownloadLimit
+func download(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("download failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download failed: HTTP %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, updateDownloadLimit+1))
+	if err != nil {
+		return nil, fmt.Errorf("download failed: %v", err)
+	}
+	if len(data) > updateDownloadLimit {
+		return nil, fmt.Errorf("download failed: larger than %d MB", updateDownloadLimit>>20)
+	}
+	return data, nil
+}
+
+// verifyBinary checks data against the manifest's checksum, and its
+// signature if we have a public key
+func verifyBinary(data []byte, bin updateBinary, publicKey ed25519.PublicKey) error {
+	if bin.SHA256 == "" {
+		return errors.New("the release manifest has no sha256 for this binary")
+	}
+	sum := sha256.Sum256(data)
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), strings.TrimSpace(bin.SHA256)) {
+		return errors.New("checksum mismatch: the download is corrupt or was tampered with")
+	}
+
+	if publicKey == nil {
+		return nil
+	}
+	signature, err := base64.StdEncoding.DecodeString(bin.Signature)
+	if err != nil || len(signature) == 0 {
+		return errors.New("the release isn't signed, but TUNNELR_UPDATE_PUBLIC_KEY requires a signature")
+	}
+	if !ed25519.Verify(publicKey, data, signature) {
+		return errors.New("invalid signature: the download wasn't signed with TUNNELR_UPDATE_PUBLIC_KEY")
+	}
+	return nil
+}
+
+// parsePublicKey decodes a base64 ed25519 public key, nil if s is empty
+func parsePublicKey(s string) (ed25519.PublicKey, error) {
+	if s == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("not valid base64: %v", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("expected a %d byte ed25519 key, got %d bytes", ed25519.PublicKeySize, len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// parseVersion splits "1.4.0" (or "v1.4.0") into its numbers
+// Anything after a "-" or "+" (pre-release, build info) is ignored.
+func parseVersion(v string) ([]int, error) {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if i := strings.IndexAny(v, "-+"); i != -1 {
+		v = v[:i]
+	}
+	if v == "" {
+		return nil, errors.New("empty version")
+	}
+
+	var parts []int
+	for _, field := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid version %q", v)
+		}
+		parts = append(parts, n)
+	}
+	return parts, nil
+}
+
+// compareVersions returns 1 if a is newer than b, -1 if older, 0 if the
+// same. Missing numbers count as 0 ("1.4" == "1.4.0"), and an unparseable
+// version is older than any valid one.
+func compareVersions(a, b string) int {
+	pa, errA := parseVersion(a)
+	pb, errB := parseVersion(b)
+	switch {
+	case errA != nil && errB != nil:
+		return 0
+	case errA != nil:
+		return -1
+	case errB != nil:
+		return 1
+	}
+
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			if x > y {
+				return 1
+			}
+			return -1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.4.0", "1.4.0", 0},
+		{"1.4", "1.4.0", 0},
+		{"v1.4.0", "1.4.0", 0},
+		{"1.4.1", "1.4.0", 1},
+		{"1.10.0", "1.9.0", 1}, // Numbers, not strings
+		{"2.0.0", "1.99.99", 1},
+		{"1.3.9", "1.4.0", -1},
+		{"1.4.0-rc1", "1.4.0", 0}, // Pre-release info is ignored
+		{"1.4.0+build5", "1.3.0", 1},
+		{"garbage", "1.0.0", -1},
+		{"1.0.0", "dev", 1},
+		{"dev", "garbage", 0},
+	}
+	for _, tc := range tests {
+		if got := compareVersions(tc.a, tc.b); got != tc.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestParseVersionErrors(t *testing.T) {
+	for _, v := range []string{"", "v", "1..2", "1.x", "1.-2", "-1"} {
+		if parts, err := parseVersion(v); err == nil {
+			t.Errorf("parseVersion(%q) = %v, want an error", v, parts)
+		}
+	}
+}
+
+func TestVerifyBinaryChecksum(t *testing.T) {
+	data := []byte("pretend this is a tunnelr binary")
+	sum := sha256.Sum256(data)
+	good := hex.EncodeToString(sum[:])
+
+	if err := verifyBinary(data, updateBinary{SHA256: good}, nil); err != nil {
+		t.Errorf("matching checksum: %v", err)
+	}
+	if err := verifyBinary(data, updateBinary{SHA256: " " + strings.ToUpper(good) + "\n"}, nil); err != nil {
+		t.Errorf("upper-case checksum with spaces: %v", err)
+	}
+
+	tampered := append([]byte(nil), data...)
+	tampered[0] ^= 1
+	if err := verifyBinary(tampered, updateBinary{SHA256: good}, nil); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("tampered download: got %v, want a checksum mismatch", err)
+	}
+	if err := verifyBinary(data, updateBinary{}, nil); err == nil {
+		t.Error("a manifest without a checksum was accepted")
+	}
+}
+
+func TestVerifyBinarySignature(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublic, _, _ := ed25519.GenerateKey(nil)
+
+	data := []byte("pretend this is a tunnelr binary")
+	sum := sha256.Sum256(data)
+	bin := updateBinary{
+		SHA256:    hex.EncodeToString(sum[:]),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, data)),
+	}
+
+	if err := verifyBinary(data, bin, publicKey); err != nil {
+		t.Errorf("valid signature: %v", err)
+	}
+	if err := verifyBinary(data, bin, otherPublic); err == nil || !strings.Contains(err.Error(), "invalid signature") {
+		t.Errorf("signed with another key: got %v, want an invalid signature", err)
+	}
+	unsigned := bin
+	unsigned.Signature = ""
+	if err := verifyBinary(data, unsigned, publicKey); err == nil {
+		t.Error("an unsigned release was accepted with a public key set")
+	}
+	// Without a key the signature isn't checked
+	if err := verifyBinary(data, unsigned, nil); err != nil {
+		t.Errorf("unsigned release without a key: %v", err)
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	publicKey, _, _ := ed25519.GenerateKey(nil)
+	if key, err := parsePublicKey(base64.StdEncoding.EncodeToString(publicKey)); err != nil || !key.Equal(publicKey) {
+		t.Errorf("valid key: %v, %v", key, err)
+	}
+	if key, err := parsePublicKey(""); key != nil || err != nil {
+		t.Errorf("no key: %v, %v", key, err)
+	}
+	for _, bad := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("too short"))} {
+		if _, err := parsePublicKey(bad); err == nil {
+			t.Errorf("parsePublicKey(%q) accepted it", bad)
+		}
+	}
+}
+
+func TestFetchManifest(t *testing.T) {
+	var manifest string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if manifest == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(manifest))
+	}))
+	defer srv.Close()
+
+	manifest = `{"version": "1.4.0", "binaries": {"linux-amd64": {"url": "https://example.com/tunnelr", "sha256": "abc"}}}`
+	m, err := fetchManifest(srv.Client(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Version != "1.4.0" || m.Binaries["linux-amd64"].URL != "https://example.com/tunnelr" {
+		t.Errorf("got %+v", m)
+	}
+
+	for _, bad := range []string{"", "not json", `{"version": "latest"}`} {
+		manifest = bad
+		if _, err := fetchManifest(srv.Client(), srv.URL); err == nil {
+			t.Errorf("manifest %q was accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// --url-output writes the tunnel's public URL, one line each time a tunnel is
+// established, for other tools to pick up:
+//
+//	mkfifo /tmp/tunnelr-url
+//	tunnelr connect 3000 --url-output /tmp/tunnelr-url &
+//	while read url; do echo "tunnel is at $url"; done < /tmp/tunnelr-url
+//
+// The target can be a regular file (follow it with tail -f), a named pipe, or
+// "-" for stdout. Writing never holds up the tunnel: a consumer that isn't
+// reading only ever misses URLs that were already replaced by a newer one.
+
+// urlOutput streams public URLs to a file, pipe or stdout
+// A nil *urlOutput does nothing, so callers don't need to check
+type urlOutput struct {
+	path   string
+	stdout *os.File    // Set when writing to stdout
+	latest chan string // The newest URL not yet written
+}
+
+// newURLOutput starts writing URLs to path ("-" = stdout), or returns nil if
+// path is empty
+func newURLOutput(path string) *urlOutput {
+	if path == "" {
+		return nil
+	}
+	o := &urlOutput{path: path, latest: make(chan string, 1)}
+
+	if path == "-" {
+		// Keep stdout for the URLs alone - everything else we print goes to
+		// stderr instead. In Go, fmt.Printf looks up os.Stdout on every call.
+		o.stdout = os.Stdout
+		os.Stdout = os.Stderr
+
+		// A consumer that exits must not kill us: without this, writing to a
+		// closed stdout pipe ends the process with SIGPIPE
+		signal.Ignore(syscall.SIGPIPE)
+	}
+
+	go o.run()
+	return o
+}
+
+// Publish queues url to be written, replacing one that's still waiting
+func (o *urlOutput) Publish(url string) {
+	if o == nil {
+		return
+	}
+	for {
+		select {
+		case o.latest <- url:
+			return
+		default:
+			// Drop the older URL nobody has read yet
+			select {
+			case <-o.latest:
+			default:
+			}
+		}
+	}
+}
+
+// run writes queued URLs until the process exits
+func (o *urlOutput) run() {
+	var out *os.File
+	firstOpen := true
+
+	for url := range o.latest {
+		for {
+			// Only the newest URL matters
+			select {
+			case url = <-o.latest:
+			default:
+			}
+
+			if out == nil {
+				var err error
+				out, err = o.open(firstOpen) // Waits for a reader if it's a named pipe
+				firstOpen = false
+				if err != nil {
+					log.Printf("URL output: %v", err)
+					break
+				}
+			}
+
+			_, err := io.WriteString(out, url+"\n")
+			if err == nil {
+				break
+			}
+
+			if out != o.stdout {
+				out.Close()
+			}
+			out = nil
+
+			// The pipe's reader went away - wait for the next one and give it
+			// the current URL. Anything else (disk full, stdout closed) isn't
+			// worth retrying until the next URL comes along.
+			if !errors.Is(err, syscall.EPIPE) || o.stdout != nil {
+				log.Printf("URL output: %v", err)
+				break
+			}
+		}
+	}
+}
+
+// open opens the output for writing
+// A regular file is truncated the first time, so it only ever holds URLs
+// from this run
+func (o *urlOutput) open(first bool) (*os.File, error) {
+	if o.stdout != nil {
+		return o.stdout, nil
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if first {
+		flags |= os.O_TRUNC
+	}
+	return os.OpenFile(o.path, flags, 0o644)
+}
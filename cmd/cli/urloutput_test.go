@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitForFile waits until path holds want, failing after a few seconds
+func waitForFile(t *testing.T, path, want string) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		data, _ := os.ReadFile(path)
+		if string(data) == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s holds %q, want %q", path, data, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestURLOutputToFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "url")
+	os.WriteFile(path, []byte("https://from-last-run.example.com\n"), 0o644)
+
+	out := newURLOutput(path)
+	out.Publish("https://abc123.example.com")
+	// Each run starts the file afresh
+	waitForFile(t, path, "https://abc123.example.com\n")
+
+	// Reconnects add a line, for tail -f
+	out.Publish("https://def456.example.com")
+	waitForFile(t, path, "https://abc123.example.com\nhttps://def456.example.com\n")
+}
+
+func TestNoURLOutput(t *testing.T) {
+	out := newURLOutput("")
+	if out != nil {
+		t.Fatal("got an output without a path")
+	}
+	out.Publish("https://abc123.example.com") // Does nothing, doesn't panic
+}
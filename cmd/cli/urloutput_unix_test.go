@@ -0,0 +1,65 @@
+//go:build unix
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestURLOutputToNamedPipe(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "url-pipe")
+	if err := syscall.Mkfifo(path, 0o600); err != nil {
+		t.Skipf("can't make a named pipe here: %v", err)
+	}
+	out := newURLOutput(path)
+
+	// Nobody is reading yet: publishing doesn't block, and only the newest
+	// URL is kept for the reader
+	done := make(chan struct{})
+	go func() {
+		out.Publish("https://old.example.com")
+		out.Publish("https://new.example.com")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Publish blocked with no reader on the pipe")
+	}
+
+	readLine := func() string {
+		t.Helper()
+		pipe, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pipe.Close()
+		lines := make(chan string, 1)
+		go func() {
+			line, _ := bufio.NewReader(pipe).ReadString('\n')
+			lines <- strings.TrimSuffix(line, "\n")
+		}()
+		select {
+		case line := <-lines:
+			return line
+		case <-time.After(3 * time.Second):
+			t.Fatal("no URL written to the pipe")
+			return ""
+		}
+	}
+	if got := readLine(); got != "https://new.example.com" {
+		t.Errorf("first reader got %q, want the newest URL", got)
+	}
+
+	// The reader went away; the next one gets the next URL
+	out.Publish("https://after-reconnect.example.com")
+	if got := readLine(); got != "https://after-reconnect.example.com" {
+		t.Errorf("second reader got %q", got)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestVersionCommand(t *testing.T) {
+	oldVersion, oldCommit, oldDate := version, commit, buildDate
+	t.Cleanup(func() { version, commit, buildDate = oldVersion, oldCommit, oldDate })
+
+	// As -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..." sets them
+	version, commit, buildDate = "1.4.0", "9f86d08", "2026-03-01"
+	var out bytes.Buffer
+	printVersion(&out)
+	if want := "tunnelr 1.4.0 (commit 9f86d08, built 2026-03-01)\n"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+
+	// A plain go build
+	version, commit, buildDate = "dev", "", ""
+	out.Reset()
+	printVersion(&out)
+	if want := "tunnelr dev\n"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestUnreachableLocalServerIsMarked(t *testing.T) {
+	_, server := startSession(t, []string{closedPort(t)}, nil)
+	sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{ID: "early", Method: http.MethodGet, Path: "/"})
+	resp := readResponse(t, server)
+	if resp.StatusCode != http.StatusBadGateway || resp.Headers.Get(tunnel.UnreachableHeader) == "" {
+		t.Errorf("got %d %v, want a 502 marked with %s", resp.StatusCode, resp.Headers, tunnel.UnreachableHeader)
+	}
+
+	// A local server that's up but failing isn't "unreachable" - retrying
+	// it wouldn't help
+	addr := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusBadGateway)
+	})
+	_, server = startSession(t, []string{addr}, nil)
+	sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{ID: "up", Method: http.MethodGet, Path: "/"})
+	if resp := readResponse(t, server); resp.Headers.Get(tunnel.UnreachableHeader) != "" {
+		t.Errorf("the local server's own 502 was marked unreachable")
+	}
+}
+
+func TestWarmupFlag(t *testing.T) {
+	t.Setenv("TUNNELR_WARMUP", "")
+	_, opts, err := parseConnectArgs([]string{"3000", "--warmup", "30s"})
+	if err != nil || opts.warmup != 30*time.Second {
+		t.Errorf("--warmup 30s: got %s, %v", opts.warmup, err)
+	}
+
+	t.Setenv("TUNNELR_WARMUP", "10s")
+	if _, opts, _ := parseConnectArgs([]string{"3000"}); opts.warmup != 10*time.Second {
+		t.Errorf("TUNNELR_WARMUP=10s: got %s", opts.warmup)
+	}
+
+	if _, _, err := parseConnectArgs([]string{"3000", "--warmup", "-5s"}); err == nil {
+		t.Error("accepted a negative warmup")
+	}
+}
+
+func TestAttemptHeader(t *testing.T) {
+	seen := make(chan string, 10)
+	addr := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Header.Get(tunnel.AttemptHeader)
+	})
+	_, server := startSession(t, []string{addr}, nil)
+
+	tests := []struct {
+		attempt int
+		visitor string // What the visitor sent in the header
+		want    string
+	}{
+		{1, "", ""},
+		{2, "", "2"},
+		{3, "", "3"},
+		{1, "7", ""}, // A visitor can't pass a first attempt off as a resend
+		{0, "7", ""}, // Older servers don't number attempts
+		{2, "7", "2"},
+	}
+	for i, tc := range tests {
+		headers := http.Header{}
+		if tc.visitor != "" {
+			headers.Set(tunnel.AttemptHeader, tc.visitor)
+		}
+		sendMessage(t, server, tunnel.Codec{}, tunnel.TypeHTTPRequest, tunnel.HTTPRequest{
+			ID: strconv.Itoa(i), Method: http.MethodPost, Path: "/", Headers: headers, Attempt: tc.attempt,
+		})
+		readResponse(t, server)
+		if got := <-seen; got != tc.want {
+			t.Errorf("attempt %d, visitor sent %q: local server got %q, want %q", tc.attempt, tc.visitor, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"tunnelr/internal/tunnel"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket forwarding - when a public client opens a WebSocket, the server
+// sends ws_open and we open the same WebSocket to the local server. Messages
+// are then passed along in both directions until either end closes.
+
+// localWSDialer opens WebSockets to the local server, never through a proxy
+var localWSDialer = &websocket.Dialer{HandshakeTimeout: 30 * time.Second}
+
+// localWSWriteWait is how long a write to the local server may take
+const localWSWriteWait = 10 * time.Second
+
+// localSocket is a WebSocket open to the local server
+type localSocket struct {
+	conn *websocket.Conn
+	out  chan *tunnel.WSData // Messages waiting to be written to the local server
+	done chan struct{}       // Closed when the local side has gone away
+
+	// Set before out is closed: how to close the local WebSocket
+	closeWith tunnel.WSClose
+}
+
+// openWebSocket dials the local server and relays the WebSocket until it closes
+func (s *session) openWebSocket(open *tunnel.WSOpen) {
+	start := time.Now()
+
+	// The dialer does its own handshake - only pass on the app's headers
+	header := http.Header{}
+	for key, values := range open.Headers {
+		switch http.CanonicalHeaderKey(key) {
+		case "Host", "Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version", "Sec-Websocket-Extensions":
+			continue
+		}
+		header[key] = values
+	}
+
+	// WebSockets go to the next local server in turn, like requests
+	target := s.targets.Pick(nil)
+
+	// gorilla/websocket takes the Host for the handshake from here
+	header.Set("Host", s.localHostHeader(open.Headers, target.addr))
+
+	localURL := fmt.Sprintf("%s://%s%s", s.localScheme("ws"), target.addr, open.Path)
+	conn, resp, err := localWSDialer.DialContext(s.ctx, localURL, header)
+	if err != nil {
+		if isLocalServerDown(err) {
+			s.targets.MarkDown(target)
+		}
+		reason := err.Error()
+		status := http.StatusBadGateway
+		if resp != nil {
+			reason = "local server answered " + resp.Status
+			status = resp.StatusCode
+			resp.Body.Close()
+		}
+		s.recordWebSocket(open, status, start)
+		s.sendWSMessage(tunnel.TypeWSClose, tunnel.WSClose{ID: open.ID, Code: websocket.CloseInternalServerErr, Reason: reason})
+		fmt.Printf("WS %s -> Error: %s\n", open.Path, reason)
+		return
+	}
+	s.targets.MarkUp(target)
+
+	sock := &localSocket{
+		conn: conn,
+		out:  make(chan *tunnel.WSData, 16),
+		done: make(chan struct{}),
+	}
+
+	// Register before answering, the server may send messages right away
+	s.socketsMu.Lock()
+	s.sockets[open.ID] = sock
+	s.socketsMu.Unlock()
+
+	s.recordWebSocket(open, http.StatusSwitchingProtocols, start)
+	s.sendWSMessage(tunnel.TypeWSOpen, tunnel.WSOpen{ID: open.ID, Subprotocol: conn.Subprotocol()})
+	fmt.Printf("WS %s -> 101 WebSocket open\n", open.Path)
+
+	go s.writeLocalSocket(sock)
+
+	// Local server -> tunnel
+	for {
+		msgType, data, err := conn.ReadMessage()
+		if err != nil {
+			close(sock.done)
+			conn.Close()
+
+			// If the server closed its side first, it already knows
+			if s.removeSocket(open.ID) {
+				s.sendWSMessage(tunnel.TypeWSClose, tunnel.WSCloseFromError(open.ID, err))
+			}
+			fmt.Printf("WS %s closed\n", open.Path)
+			return
+		}
+
+		s.sendWSMessage(tunnel.TypeWSData, tunnel.WSData{
+			ID:     open.ID,
+			Binary: msgType == websocket.BinaryMessage,
+			Data:   data,
+		})
+	}
+}
+
+// writeLocalSocket writes messages from the tunnel to the local server
+// When out is closed it sends the close frame and hangs up
+func (s *session) writeLocalSocket(sock *localSocket) {
+	for {
+		select {
+		case data, ok := <-sock.out:
+			if !ok {
+				sock.conn.WriteControl(websocket.CloseMessage, tunnel.CloseFrame(sock.closeWith), time.Now().Add(localWSWriteWait))
+				sock.conn.Close()
+				return
+			}
+
+			msgType := websocket.TextMessage
+			if data.Binary {
+				msgType = websocket.BinaryMessage
+			}
+			sock.conn.SetWriteDeadline(time.Now().Add(localWSWriteWait))
+			if err := sock.conn.WriteMessage(msgType, data.Data); err != nil {
+				// The read side notices and reports the close
+				sock.conn.Close()
+				return
+			}
+
+		case <-sock.done:
+			return
+		}
+	}
+}
+
+// deliverWSData queues a message for the local server
+func (s *session) deliverWSData(data *tunnel.WSData) {
+	s.socketsMu.Lock()
+	sock, exists := s.sockets[data.ID]
+	s.socketsMu.Unlock()
+
+	if !exists {
+		return
+	}
+
+	select {
+	case sock.out <- data:
+	case <-sock.done:
+	}
+}
+
+// closeWebSocket closes a local WebSocket after the public client closed its end
+func (s *session) closeWebSocket(closed *tunnel.WSClose) {
+	s.socketsMu.Lock()
+	sock, exists := s.sockets[closed.ID]
+	delete(s.sockets, closed.ID)
+	s.socketsMu.Unlock()
+
+	if exists {
+		sock.closeWith = *closed
+		close(sock.out)
+	}
+}
+
+// removeSocket forgets a WebSocket, reporting whether it was still open
+func (s *session) removeSocket(id string) bool {
+	s.socketsMu.Lock()
+	defer s.socketsMu.Unlock()
+
+	_, exists := s.sockets[id]
+	delete(s.sockets, id)
+	return exists
+}
+
+// abortSockets closes every local WebSocket when the tunnel goes away
+func (s *session) abortSockets() {
+	s.socketsMu.Lock()
+	defer s.socketsMu.Unlock()
+
+	for id, sock := range s.sockets {
+		sock.closeWith = tunnel.WSClose{ID: id, Code: websocket.CloseGoingAway, Reason: "tunnel closed"}
+		close(sock.out)
+		delete(s.sockets, id)
+	}
+}
+
+// sendWSMessage sends a WebSocket message to the server
+func (s *session) sendWSMessage(msgType tunnel.MessageType, payload interface{}) {
+	msgBytes, err := s.codec.Encode(msgType, payload)
+	if err != nil {
+		return
+	}
+	s.conn.Send(msgBytes)
+}
+
+// recordWebSocket shows the WebSocket handshake in the inspector
+func (s *session) recordWebSocket(open *tunnel.WSOpen, status int, start time.Time) {
+	s.inspector.Record(inspectedRequest{
+		Time:       start,
+		Method:     http.MethodGet,
+		Path:       open.Path,
+		StatusCode: status,
+		DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+	}, nil)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunnelr/internal/tunnel"
+)
+
+// echoServer is a local WebSocket server that sends every message back
+// and closes with 4000 when told to "hang up"
+func echoServer(t *testing.T) string {
+	t.Helper()
+	upgrader := websocket.Upgrader{Subprotocols: []string{"echo"}}
+	return localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			msgType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if string(data) == "hang up" {
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(4000, "asked to"), time.Now().Add(time.Second))
+				return
+			}
+			if err := conn.WriteMessage(msgType, data); err != nil {
+				return
+			}
+		}
+	})
+}
+
+// readWSMessage skips to the CLI's next WebSocket message of msgType
+func readWSMessage(t *testing.T, conn *tunnel.SafeConn, msgType tunnel.MessageType, payload interface{}) {
+	t.Helper()
+	for {
+		msg := readMessage(t, conn, 5*time.Second)
+		if msg.Type != msgType {
+			continue
+		}
+		if err := msg.Unmarshal(payload); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+}
+
+func TestWebSocketRelayedToLocalServer(t *testing.T) {
+	addr := echoServer(t)
+	_, server := startSession(t, []string{addr}, []string{tunnel.CapWebSocket})
+	codec := tunnel.Codec{}
+
+	sendMessage(t, server, codec, tunnel.TypeWSOpen, tunnel.WSOpen{
+		ID: "ws-1", Path: "/socket", Headers: http.Header{"Sec-Websocket-Protocol": {"echo"}},
+	})
+	var opened tunnel.WSOpen
+	readWSMessage(t, server, tunnel.TypeWSOpen, &opened)
+	if opened.ID != "ws-1" || opened.Subprotocol != "echo" {
+		t.Fatalf("open answer %+v, want ws-1 with the echo subprotocol", opened)
+	}
+
+	for _, sent := range []tunnel.WSData{
+		{ID: "ws-1", Data: []byte("hello")},
+		{ID: "ws-1", Binary: true, Data: []byte{0, 1, 2, 0xff}},
+	} {
+		sendMessage(t, server, codec, tunnel.TypeWSData, sent)
+		var echoed tunnel.WSData
+		readWSMessage(t, server, tunnel.TypeWSData, &echoed)
+		if echoed.ID != "ws-1" || echoed.Binary != sent.Binary || !bytes.Equal(echoed.Data, sent.Data) {
+			t.Errorf("sent %+v, got back %+v", sent, echoed)
+		}
+	}
+
+	// The local server's close comes back with its code and reason
+	sendMessage(t, server, codec, tunnel.TypeWSData, tunnel.WSData{ID: "ws-1", Data: []byte("hang up")})
+	var closed tunnel.WSClose
+	readWSMessage(t, server, tunnel.TypeWSClose, &closed)
+	if closed.ID != "ws-1" || closed.Code != 4000 || closed.Reason != "asked to" {
+		t.Errorf("close %+v, want ws-1 4000 \"asked to\"", closed)
+	}
+}
+
+func TestWebSocketToMissingLocalServer(t *testing.T) {
+	addr := localServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no websockets here", http.StatusNotFound)
+	})
+	_, server := startSession(t, []string{addr}, []string{tunnel.CapWebSocket})
+
+	sendMessage(t, server, tunnel.Codec{}, tunnel.TypeWSOpen, tunnel.WSOpen{ID: "ws-2", Path: "/socket"})
+	var closed tunnel.WSClose
+	readWSMessage(t, server, tunnel.TypeWSClose, &closed)
+	if closed.ID != "ws-2" || closed.Reason != "local server answered 404 Not Found" {
+		t.Errorf("close %+v, want the local server's 404 as the reason", closed)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+// Adaptive concurrency - with ADAPTIVE_CONCURRENCY=true each tunnel's requests
+// in flight are capped, and the cap follows the local server's latency: it's
+// halved while the p95 is over ADAPTIVE_TARGET_LATENCY and grows back as
+// responses speed up. Requests over the cap get the tunnel's overload
+// fallback (a 503 by default) without ever reaching the local server.
+var (
+	adaptiveConcurrency    = getEnvBool("ADAPTIVE_CONCURRENCY", false)
+	adaptiveTargetLatency  = getEnvDuration("ADAPTIVE_TARGET_LATENCY", time.Second)
+	adaptiveMaxConcurrency = getEnvInt("ADAPTIVE_MAX_CONCURRENCY", 100)
+)
+
+// respondOverloaded answers a request the adaptive limiter turned away
+func respondOverloaded(w http.ResponseWriter, r *http.Request, tun *tunnel.Tunnel, forwardPath string, start time.Time) {
+	metrics.requestsShed.Add(1)
+
+	status := serveOverloadFallback(w, r, tun)
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, fmt.Sprintf("Tunnel %s is overloaded: the local server is responding slowly, try again shortly", tun.ID), status)
+	}
+	logAccess(tun, r, forwardPath, status, time.Since(start))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestAdaptiveConcurrencyShedsLoadFromASlowServer(t *testing.T) {
+	target := 20 * time.Millisecond
+	registry.SetAdaptiveConcurrency(target, 4)
+	t.Cleanup(func() { registry.SetAdaptiveConcurrency(0, 0) })
+	srv := startTestServer(t)
+
+	// The local server is slow until told otherwise, then holds requests
+	// until released
+	var reached atomic.Int32
+	var holding atomic.Bool
+	release := make(chan struct{})
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		if req.Path == "/healthz" {
+			cli.respond(req.ID, http.StatusOK, nil, []byte("ok"))
+			return
+		}
+		reached.Add(1)
+		if holding.Load() {
+			<-release
+		} else {
+			time.Sleep(3 * target)
+		}
+		cli.respond(req.ID, http.StatusOK, nil, []byte("ok"))
+	})
+	tun, _ := registry.Get(cli.ID)
+	if got := tun.Concurrency.Limit(); got != 4 {
+		t.Fatalf("new tunnel's cap is %d, want ADAPTIVE_MAX_CONCURRENCY's 4", got)
+	}
+
+	// Slow responses bring the cap down
+	for i := 0; i < 10; i++ {
+		if status, _ := cli.get("/"); status != http.StatusOK {
+			t.Fatalf("slow request %d got %d", i+1, status)
+		}
+	}
+	if got := tun.Concurrency.Limit(); got != 2 {
+		t.Fatalf("cap is %d after slow responses, want 2", got)
+	}
+
+	// With 2 requests held at the local server, the next ones are turned
+	// away without reaching it
+	holding.Store(true)
+	reachedBefore := reached.Load()
+	shedBefore := metrics.requestsShed.Load()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cli.get("/held")
+		}()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for reached.Load() < reachedBefore+2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	resp, err := http.DefaultClient.Do(cli.newRequest(http.MethodGet, "/one-too-many", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("request over the cap got %d (Retry-After %q) %s, want a 503", resp.StatusCode, resp.Header.Get("Retry-After"), body)
+	}
+	if got := reached.Load() - reachedBefore; got != 2 {
+		t.Errorf("%d requests reached the local server, want the 2 under the cap", got)
+	}
+	if got := metrics.requestsShed.Load() - shedBefore; got != 1 {
+		t.Errorf("requests_shed went up by %d, want 1", got)
+	}
+
+	// Health checks get through regardless
+	if status, _ := cli.get("/healthz"); status != http.StatusOK {
+		t.Errorf("health check at the cap got %d", status)
+	}
+	close(release)
+	wg.Wait()
+
+	// The cap is in the registry snapshot
+	for _, ts := range registry.Snapshot().Tunnels {
+		if ts.ID == cli.ID && ts.ConcurrencyLimit != tun.Concurrency.Limit() {
+			t.Errorf("snapshot shows a cap of %d, want %d", ts.ConcurrencyLimit, tun.Concurrency.Limit())
+		}
+	}
+}
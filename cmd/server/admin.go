@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"tunnelr/internal/tunnel"
+)
+
+// Admin endpoints are for operators, protected by bearer tokens
+// Clients send "Authorization: Bearer <token>"
+//
+// There are two tiers:
+//   - VIEWER_TOKEN can read (tunnel listings, registry dumps, stats)
+//   - ADMIN_TOKEN can read and also change things (disconnect tunnels etc.)
+//
+// If neither is set, admin endpoints are disabled entirely
+var (
+	adminToken  = getEnv("ADMIN_TOKEN", "")
+	viewerToken = getEnv("VIEWER_TOKEN", "")
+)
+
+// role is what a token is allowed to do
+type role int
+
+const (
+	roleNone role = iota
+	roleViewer
+	roleAdmin
+)
+
+// roleFor returns the role a request's bearer token grants
+func roleFor(r *http.Request) role {
+	return roleForToken(bearerToken(r))
+}
+
+// roleForToken returns the role a token grants
+func roleForToken(token string) role {
+	if token == "" {
+		return roleNone
+	}
+	if adminToken != "" && tokenMatches(token, adminToken) {
+		return roleAdmin
+	}
+	if viewerToken != "" && tokenMatches(token, viewerToken) {
+		return roleViewer
+	}
+	return roleNone
+}
+
+// requireRole wraps a handler so it only runs for tokens with at least the
+// given role (admin tokens can do everything viewers can)
+func requireRole(min role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" && viewerToken == "" {
+			http.Error(w, "Admin API disabled (set ADMIN_TOKEN)", http.StatusForbidden)
+			return
+		}
+
+		got := roleFor(r)
+		if got == roleNone {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="tunnelr-admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if got < min {
+			http.Error(w, "Forbidden: this action needs the admin token", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// bearerToken pulls the token out of an "Authorization: Bearer ..." header
+func bearerToken(r *http.Request) string {
+	return parseBearer(r.Header.Get("Authorization"))
+}
+
+// parseBearer returns the token in an Authorization value, "" if it isn't
+// "Bearer <token>"
+func parseBearer(auth string) string {
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// tokenMatches compares tokens in constant time so response timing doesn't
+// leak how much of a guess was right
+func tokenMatches(got, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// handleRegistryDump returns the full registry state as JSON, for debugging
+func handleRegistryDump(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(registry.Snapshot())
+}
+
+// TunnelList is the JSON body of /admin/tunnels
+type TunnelList struct {
+	Count   int                 `json:"count"`
+	Tunnels []tunnel.TunnelInfo `json:"tunnels"`
+}
+
+// handleTunnelList lists the active tunnels
+func handleTunnelList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tunnels := registry.List()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(TunnelList{Count: len(tunnels), Tunnels: tunnels})
+}
+
+// handleTunnelDelete closes a tunnel: DELETE /admin/tunnels/<id>, with an
+// optional ?reason= shown to the CLI's user
+func handleTunnelDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodDelete)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/admin/tunnels/")
+	if !disconnectTunnel(id, r.URL.Query().Get("reason"), "admin API") {
+		http.Error(w, fmt.Sprintf("Tunnel %q not found", id), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// disconnectTunnel closes a tunnel for an admin, via the admin API or gRPC
+// The close code tells the CLI not to reconnect. Returns false if there's no
+// tunnel with that ID.
+func disconnectTunnel(id, reason, via string) bool {
+	if reason == "" {
+		reason = "disconnected by an admin"
+	}
+	if !registry.CloseAndRemove(id, tunnel.CloseDisconnected, reason) {
+		return false
+	}
+	log.Printf("Closed tunnel %s: %s (%s)", id, reason, via)
+	return true
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"tunnelr/internal/adminrpc"
+	"tunnelr/internal/tunnel"
+)
+
+// adminRoutes are the admin endpoints as main registers them
+func adminRoutes() http.Handler {
+	return newMux()
+}
+
+// adminCall sends an admin request with token ("" for none) and returns the status
+func adminCall(t *testing.T, handler http.Handler, token, method, path, body string) int {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestViewerTokenCantChangeThings(t *testing.T) {
+	setForTest(t, &adminToken, "admin-secret")
+	setForTest(t, &viewerToken, "viewer-secret")
+	t.Cleanup(func() { maintenance.Set(false, "") })
+
+	srv := startTestServer(t)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, nil)
+	routes := adminRoutes()
+
+	// Reading is fine
+	for _, path := range []string{"/admin/tunnels", "/admin/debug/registry", "/admin/maintenance"} {
+		if got := adminCall(t, routes, "viewer-secret", http.MethodGet, path, ""); got != http.StatusOK {
+			t.Errorf("viewer GET %s = %d, want 200", path, got)
+		}
+	}
+
+	// Changing things isn't, and nothing changes
+	if got := adminCall(t, routes, "viewer-secret", http.MethodDelete, "/admin/tunnels/"+cli.ID, ""); got != http.StatusForbidden {
+		t.Errorf("viewer disconnecting a tunnel = %d, want 403", got)
+	}
+	if _, ok := registry.Get(cli.ID); !ok {
+		t.Error("viewer token disconnected a tunnel")
+	}
+	if got := adminCall(t, routes, "viewer-secret", http.MethodPost, "/admin/maintenance", `{"enabled": true}`); got != http.StatusForbidden {
+		t.Errorf("viewer turning on maintenance = %d, want 403", got)
+	}
+	if enabled, _ := maintenance.Get(); enabled {
+		t.Error("viewer token turned on maintenance")
+	}
+	if got := adminCall(t, routes, "viewer-secret", http.MethodPost, "/admin/migrate", `{"server_url": "wss://other.example"}`); got != http.StatusForbidden {
+		t.Errorf("viewer migrating tunnels = %d, want 403", got)
+	}
+
+	// The admin token can do both
+	if got := adminCall(t, routes, "admin-secret", http.MethodPost, "/admin/maintenance", `{"enabled": true}`); got != http.StatusOK {
+		t.Errorf("admin turning on maintenance = %d, want 200", got)
+	}
+	if got := adminCall(t, routes, "admin-secret", http.MethodDelete, "/admin/tunnels/"+cli.ID, ""); got != http.StatusNoContent {
+		t.Errorf("admin disconnecting a tunnel = %d, want 204", got)
+	}
+	if _, ok := registry.Get(cli.ID); ok {
+		t.Error("tunnel still registered after the admin disconnected it")
+	}
+}
+
+func TestAdminEndpointsNeedAToken(t *testing.T) {
+	routes := adminRoutes()
+
+	// Without any token configured the admin API is off
+	setForTest(t, &adminToken, "")
+	setForTest(t, &viewerToken, "")
+	if got := adminCall(t, routes, "anything", http.MethodGet, "/admin/tunnels", ""); got != http.StatusForbidden {
+		t.Errorf("with no tokens configured got %d, want 403", got)
+	}
+
+	adminToken, viewerToken = "admin-secret", "viewer-secret"
+	for _, token := range []string{"", "wrong", "viewer-secret-but-longer", "Admin-Secret"} {
+		if got := adminCall(t, routes, token, http.MethodGet, "/admin/tunnels", ""); got != http.StatusUnauthorized {
+			t.Errorf("token %q got %d, want 401", token, got)
+		}
+	}
+}
+
+func TestGRPCDisconnectNeedsAdminToken(t *testing.T) {
+	setForTest(t, &adminToken, "admin-secret")
+	setForTest(t, &viewerToken, "viewer-secret")
+
+	disconnect := adminrpc.Admin_Disconnect_FullMethodName
+	list := adminrpc.Admin_ListTunnels_FullMethodName
+	tests := []struct {
+		token  string
+		method string
+		want   codes.Code
+	}{
+		{"viewer-secret", list, codes.OK},
+		{"viewer-secret", disconnect, codes.PermissionDenied},
+		{"admin-secret", disconnect, codes.OK},
+		{"admin-secret", list, codes.OK},
+		{"", list, codes.Unauthenticated},
+		{"wrong", disconnect, codes.Unauthenticated},
+	}
+	for _, tc := range tests {
+		ctx := context.Background()
+		if tc.token != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+tc.token))
+		}
+		if got := status.Code(grpcAuthorize(ctx, tc.method)); got != tc.want {
+			t.Errorf("%q calling %s: got %s, want %s", tc.token, tc.method, got, tc.want)
+		}
+	}
+}
+
+func TestAdminRoutesOnlyOnBaseHost(t *testing.T) {
+	setForTest(t, &adminToken, "admin-secret")
+	srv := startTestServer(t)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		cli.respond(req.ID, http.StatusOK, nil, []byte("the app's own admin page"))
+	})
+
+	paths := []string{"/admin/tunnels", "/admin/tunnels/" + cli.ID, "/admin/debug/registry", "/admin/maintenance", "/admin/migrate"}
+	for _, path := range paths {
+		// On a tunnel's host it's the app's page, token or not
+		status, body := cli.get(path)
+		if status != http.StatusOK || string(body) != "the app's own admin page" {
+			t.Errorf("%s on the tunnel's host got %d %q, want it forwarded", path, status, body)
+		}
+
+		// On the base domain it's ours, and needs a token
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		req.Host = baseDomain
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s on the base domain got %d, want 401", path, resp.StatusCode)
+		}
+	}
+
+	// The operator's token is never sent to a tunnel
+	req := cli.newRequest(http.MethodDelete, "/admin/tunnels/"+cli.ID, nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if _, ok := registry.Get(cli.ID); !ok {
+		t.Error("an admin request on the tunnel's host disconnected the tunnel")
+	}
+
+	// Path routing has no tunnel hosts, the admin API is on every host
+	setForTest(t, &routingMode, "path")
+	if got := adminCall(t, newMux(), "", http.MethodGet, "/admin/tunnels", ""); got != http.StatusUnauthorized {
+		t.Errorf("path mode: /admin/tunnels got %d, want 401", got)
+	}
+}
+
+func TestTunnelListJSON(t *testing.T) {
+	setForTest(t, &viewerToken, "viewer-secret")
+	srv := startTestServer(t)
+	before := time.Now().Add(-time.Second)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{LocalPort: 8510}, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/tunnels", nil)
+	req.Header.Set("Authorization", "Bearer viewer-secret")
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	var list struct {
+		Count   int                      `json:"count"`
+		Tunnels []map[string]interface{} `json:"tunnels"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if list.Count != len(list.Tunnels) {
+		t.Errorf("count %d for %d tunnels", list.Count, len(list.Tunnels))
+	}
+
+	var ours map[string]interface{}
+	for _, info := range list.Tunnels {
+		if info["id"] == cli.ID {
+			ours = info
+		}
+	}
+	if ours == nil {
+		t.Fatalf("tunnel %s not listed in %s", cli.ID, rec.Body)
+	}
+
+	// Exactly these fields - nothing from the live connection
+	var keys []string
+	for key := range ours {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if got := strings.Join(keys, ","); got != "connected_at,id,local_port,remote_addr" {
+		t.Errorf("fields %s, want connected_at,id,local_port,remote_addr", got)
+	}
+	if ours["local_port"] != float64(8510) {
+		t.Errorf("local_port = %v, want 8510", ours["local_port"])
+	}
+	connected, err := time.Parse(time.RFC3339Nano, ours["connected_at"].(string))
+	if err != nil || connected.Before(before) || connected.After(time.Now()) {
+		t.Errorf("connected_at = %v (%v), want the registration time", ours["connected_at"], err)
+	}
+	if addr, _ := ours["remote_addr"].(string); !strings.HasPrefix(addr, "127.0.0.1:") {
+		t.Errorf("remote_addr = %v, want the CLI's address", ours["remote_addr"])
+	}
+}
+
+func TestAdminDeleteClosesTunnel(t *testing.T) {
+	setForTest(t, &adminToken, "admin-secret")
+	srv := startTestServer(t)
+	_, conn, err := registerFakeCLI(srv, tunnel.TunnelRegister{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var id string
+	for _, tun := range registry.All() {
+		if tun.RemoteAddr == conn.LocalAddr().String() {
+			id = tun.ID
+		}
+	}
+	if id == "" {
+		t.Fatal("registered tunnel not found")
+	}
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				closed <- err
+				return
+			}
+		}
+	}()
+
+	// Only DELETE
+	if got := adminCall(t, newMux(), "admin-secret", http.MethodGet, "/admin/tunnels/"+id, ""); got != http.StatusMethodNotAllowed {
+		t.Errorf("GET /admin/tunnels/<id> = %d, want 405", got)
+	}
+
+	if got := adminCall(t, newMux(), "admin-secret", http.MethodDelete, "/admin/tunnels/"+id+"?reason=moving+house", ""); got != http.StatusNoContent {
+		t.Fatalf("DELETE = %d, want 204", got)
+	}
+	if _, ok := registry.Get(id); ok {
+		t.Error("tunnel still registered")
+	}
+
+	// The CLI is told why, with the code that stops it reconnecting
+	select {
+	case err := <-closed:
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != tunnel.CloseDisconnected || closeErr.Text != "moving house" {
+			t.Errorf("CLI got %v, want a %d \"moving house\" close frame", err, tunnel.CloseDisconnected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("CLI connection never closed")
+	}
+
+	// It's gone for visitors too, and can't be deleted twice
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/", nil)
+	req.Host = id + ".localhost"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("visitor got %d after the DELETE, want 404", resp.StatusCode)
+	}
+	if got := adminCall(t, newMux(), "admin-secret", http.MethodDelete, "/admin/tunnels/"+id, ""); got != http.StatusNotFound {
+		t.Errorf("deleting it again = %d, want 404", got)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+// Admission queue - MAX_CONCURRENT_REQUESTS caps the requests in flight
+// across all tunnels. Past the cap, requests wait in line for up to
+// ADMISSION_QUEUE_TIMEOUT, and the line isn't first come, first served:
+// important requests go first, so they aren't starved during a spike.
+//
+// A request's priority comes from:
+//   - PRIORITY_IPS: clients from these addresses or CIDR ranges get
+//     priorityAllowlisted
+//   - PRIORITY_HEADER: the value of this header, 0-99 (higher goes first).
+//     Anyone can send a header, so only use this behind a proxy that sets or
+//     strips it.
+//
+// Everything else has priority 0. WebSockets and health checks skip the line.
+var (
+	maxConcurrentRequests = getEnvInt("MAX_CONCURRENT_REQUESTS", 0) // 0 = unlimited
+	admissionQueueSize    = getEnvInt("ADMISSION_QUEUE_SIZE", 1000)
+	admissionQueueTimeout = getEnvDuration("ADMISSION_QUEUE_TIMEOUT", 5*time.Second)
+	priorityNets          = parsePriorityIPs(getEnv("PRIORITY_IPS", ""))
+	priorityHeader        = getEnv("PRIORITY_HEADER", "")
+
+	admission = tunnel.NewAdmissionQueue(maxConcurrentRequests, admissionQueueSize)
+)
+
+// Priorities - an allowlisted client outranks any header value
+const (
+	maxHeaderPriority   = 99
+	priorityAllowlisted = 100
+)
+
+// requestPriority decides where r goes in the admission queue
+func requestPriority(r *http.Request) int {
+	if len(priorityNets) > 0 {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err == nil && ip != nil {
+			for _, ipNet := range priorityNets {
+				if ipNet.Contains(ip) {
+					return priorityAllowlisted
+				}
+			}
+		}
+	}
+
+	if priorityHeader != "" {
+		if p, err := strconv.Atoi(strings.TrimSpace(r.Header.Get(priorityHeader))); err == nil {
+			return min(max(p, 0), maxHeaderPriority)
+		}
+	}
+	return 0
+}
+
+// admitRequest waits for a slot in the admission queue
+// Returns false if the request was turned away (the response is written);
+// otherwise the caller must call admission.Release when done.
+func admitRequest(w http.ResponseWriter, r *http.Request, tun *tunnel.Tunnel, forwardPath string, start time.Time) bool {
+	ctx, cancel := context.WithTimeout(r.Context(), admissionQueueTimeout)
+	defer cancel()
+
+	err := admission.Acquire(ctx, requestPriority(r))
+	if err == nil {
+		return true
+	}
+	if r.Context().Err() != nil {
+		return false // The client gave up, nobody to answer
+	}
+
+	metrics.admissionRejected.Add(1)
+	reason := "too many requests are waiting"
+	if !errors.Is(err, tunnel.ErrQueueFull) {
+		reason = fmt.Sprintf("no slot freed up within %s", admissionQueueTimeout)
+	}
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "The server is at capacity ("+reason+"), try again shortly", http.StatusServiceUnavailable)
+	logAccess(tun, r, forwardPath, http.StatusServiceUnavailable, time.Since(start))
+	return false
+}
+
+// parsePriorityIPs parses comma-separated IPs and CIDR ranges
+// Malformed entries are logged and skipped
+func parsePriorityIPs(value string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		// A plain IP is a range of one
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				log.Printf("Ignoring invalid PRIORITY_IPS entry %q", entry)
+				continue
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("Ignoring invalid PRIORITY_IPS entry %q", entry)
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestRequestPriority(t *testing.T) {
+	setForTest(t, &priorityNets, parsePriorityIPs("10.0.0.0/8, 192.0.2.7, not-an-ip"))
+	setForTest(t, &priorityHeader, "X-Priority")
+
+	tests := []struct {
+		remoteAddr string
+		header     string
+		want       int
+	}{
+		{"10.1.2.3:4000", "", priorityAllowlisted},
+		{"10.1.2.3:4000", "5", priorityAllowlisted}, // The allowlist beats any header
+		{"192.0.2.7:4000", "", priorityAllowlisted},
+		{"192.0.2.8:4000", "", 0},
+		{"192.0.2.8:4000", "42", 42},
+		{"192.0.2.8:4000", " 7 ", 7},
+		{"192.0.2.8:4000", "500", maxHeaderPriority}, // Can't claim the allowlist's spot
+		{"192.0.2.8:4000", "-3", 0},
+		{"192.0.2.8:4000", "urgent", 0},
+	}
+	for _, tc := range tests {
+		r, _ := http.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.remoteAddr
+		if tc.header != "" {
+			r.Header.Set("X-Priority", tc.header)
+		}
+		if got := requestPriority(r); got != tc.want {
+			t.Errorf("%s with header %q: priority %d, want %d", tc.remoteAddr, tc.header, got, tc.want)
+		}
+	}
+
+	// Without PRIORITY_HEADER the header means nothing
+	priorityHeader = ""
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "192.0.2.8:4000"
+	r.Header.Set("X-Priority", "42")
+	if got := requestPriority(r); got != 0 {
+		t.Errorf("header counted with PRIORITY_HEADER unset: priority %d", got)
+	}
+}
+
+func TestParsePriorityIPs(t *testing.T) {
+	captureLog(t)
+	nets := parsePriorityIPs(" 203.0.113.9 ,2001:db8::/32,,bogus,10.0.0.0/33")
+	var got []string
+	for _, ipNet := range nets {
+		got = append(got, ipNet.String())
+	}
+	if want := "203.0.113.9/32 2001:db8::/32"; strings.Join(got, " ") != want {
+		t.Errorf("parsed %v, want %s", got, want)
+	}
+}
+
+// waitForQueue waits until n requests are waiting for admission
+func waitForQueue(t *testing.T, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); admission.Waiting() != n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests waiting, want %d", admission.Waiting(), n)
+		}
+	}
+}
+
+func TestHigherPriorityAdmittedFirst(t *testing.T) {
+	setForTest(t, &admission, tunnel.NewAdmissionQueue(1, 10))
+	setForTest(t, &admissionQueueTimeout, 10*time.Second)
+	setForTest(t, &priorityHeader, "X-Priority")
+
+	srv := startTestServer(t)
+	holding := make(chan struct{})
+	release := make(chan struct{})
+	forwarded := make(chan string, 3)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		if req.Path == "/hold" {
+			close(holding)
+			<-release
+		} else {
+			forwarded <- req.Path
+		}
+		cli.respond(req.ID, http.StatusOK, nil, nil)
+	})
+
+	send := func(path, priority string, done chan<- int) {
+		req := cli.newRequest(http.MethodGet, path, nil)
+		if priority != "" {
+			req.Header.Set("X-Priority", priority)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}
+
+	// One request takes the only slot...
+	done := make(chan int, 3)
+	go send("/hold", "", done)
+	<-holding
+
+	// ...so these line up, the less important one first
+	go send("/low", "1", done)
+	waitForQueue(t, 1)
+	go send("/high", "50", done)
+	waitForQueue(t, 2)
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		if status := <-done; status != http.StatusOK {
+			t.Errorf("got %d, want every request answered", status)
+		}
+	}
+	if first, second := <-forwarded, <-forwarded; first != "/high" || second != "/low" {
+		t.Errorf("forwarded %s then %s, want /high then /low", first, second)
+	}
+}
+
+func TestAdmissionTimeoutIs503(t *testing.T) {
+	setForTest(t, &admission, tunnel.NewAdmissionQueue(1, 10))
+	setForTest(t, &admissionQueueTimeout, 50*time.Millisecond)
+
+	srv := startTestServer(t)
+	holding := make(chan struct{})
+	release := make(chan struct{})
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		if req.Path == "/hold" {
+			close(holding)
+			<-release
+		}
+		cli.respond(req.ID, http.StatusOK, nil, nil)
+	})
+	held := make(chan struct{})
+	go func() {
+		defer close(held)
+		cli.get("/hold")
+	}()
+	<-holding
+	defer func() {
+		close(release)
+		<-held
+	}()
+
+	rejected := metrics.admissionRejected.Load()
+	resp, err := http.DefaultClient.Do(cli.newRequest(http.MethodGet, "/waits", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("got %d with Retry-After %q, want 503 and 1", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if !strings.Contains(string(body), "no slot freed up within 50ms") {
+		t.Errorf("body %q doesn't say why", body)
+	}
+	if got := metrics.admissionRejected.Load() - rejected; got != 1 {
+		t.Errorf("admission_rejected went up by %d, want 1", got)
+	}
+	if n := admission.Waiting(); n != 0 {
+		t.Errorf("%d requests still waiting after the timeout", n)
+	}
+}
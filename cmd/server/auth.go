@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Tunnel authentication
+//
+// AUTH_TOKENS is a comma-separated list of tokens allowed to open tunnels.
+// When it's empty anyone who can reach /ws may connect.
+var authTokens = parseAuthTokens(getEnv("AUTH_TOKENS", ""))
+
+// tunnelTokenAllowed reports whether token may open a tunnel
+func tunnelTokenAllowed(token string) bool {
+	if len(authTokens) == 0 {
+		return true
+	}
+	if token == "" {
+		return false
+	}
+	for _, allowed := range authTokens {
+		if tokenMatches(token, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAuthTokens splits AUTH_TOKENS, dropping blanks
+func parseAuthTokens(value string) []string {
+	var tokens []string
+	for _, token := range strings.Split(value, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// Per-token limits
+//
+// MAX_TUNNELS_PER_TOKEN caps every token, TOKEN_TUNNEL_LIMITS overrides it for
+// specific tokens: "token1=10,token2=1". A limit of 0 means unlimited.
+var (
+	maxTunnelsPerToken = getEnvInt("MAX_TUNNELS_PER_TOKEN", 0)
+	tokenTunnelLimits  = parseTokenLimits(getEnv("TOKEN_TUNNEL_LIMITS", ""))
+)
+
+// tunnelLimitFor returns how many tunnels a token may hold at once
+func tunnelLimitFor(token string) int {
+	if limit, ok := tokenTunnelLimits[token]; ok {
+		return limit
+	}
+	return maxTunnelsPerToken
+}
+
+// parseTokenLimits parses "token=limit" pairs separated by commas
+// Malformed entries are logged and skipped
+func parseTokenLimits(value string) map[string]int {
+	limits := make(map[string]int)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		// Split on the last "=" so tokens may contain "=" (e.g. base64)
+		idx := strings.LastIndex(entry, "=")
+		if idx <= 0 {
+			log.Printf("Ignoring malformed TOKEN_TUNNEL_LIMITS entry (expected token=limit)")
+			continue
+		}
+		limit, err := strconv.Atoi(entry[idx+1:])
+		if err != nil || limit < 0 {
+			log.Printf("Ignoring TOKEN_TUNNEL_LIMITS entry with invalid limit %q", entry[idx+1:])
+			continue
+		}
+		limits[entry[:idx]] = limit
+	}
+	return limits
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestParseTokenLimits(t *testing.T) {
+	got := parseTokenLimits(" team=10, solo=1,bad, neg=-1, nan=x, b64+/==2,,zero=0")
+	want := map[string]int{"team": 10, "solo": 1, "b64+/=": 2, "zero": 0}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for token, limit := range want {
+		if got[token] != limit {
+			t.Errorf("%s: got %d, want %d", token, got[token], limit)
+		}
+	}
+}
+
+func TestTunnelLimitFor(t *testing.T) {
+	setForTest(t, &maxTunnelsPerToken, 5)
+	setForTest(t, &tokenTunnelLimits, map[string]int{"vip": 0, "solo": 1})
+
+	for token, want := range map[string]int{"anyone": 5, "vip": 0, "solo": 1} {
+		if got := tunnelLimitFor(token); got != want {
+			t.Errorf("tunnelLimitFor(%q) = %d, want %d", token, got, want)
+		}
+	}
+}
+
+func TestRegistrationRefusedAtTokenLimit(t *testing.T) {
+	srv := startTestServer(t)
+	setForTest(t, &maxTunnelsPerToken, 2)
+	setForTest(t, &tokenTunnelLimits, map[string]int{"solo-491": 1})
+
+	for i := 0; i < 2; i++ {
+		startFakeCLI(t, srv, tunnel.TunnelRegister{AuthToken: "team-491"}, nil)
+	}
+	_, _, err := registerFakeCLI(srv, tunnel.TunnelRegister{AuthToken: "team-491"})
+	var refused *refusedError
+	if !errors.As(err, &refused) || refused.Code != tunnel.ErrCodeTunnelLimit {
+		t.Fatalf("third tunnel: got %v, want a %s error", err, tunnel.ErrCodeTunnelLimit)
+	}
+	// The connection is closed with the reason, not just dropped
+	want := "This token already has the maximum of 2 tunnels open"
+	if refused.Close == nil || refused.Close.Code != websocket.ClosePolicyViolation || refused.Close.Text != want {
+		t.Errorf("third tunnel closed with %v, want %d %q", refused.Close, websocket.ClosePolicyViolation, want)
+	}
+
+	// The per-token override applies instead of the global limit
+	startFakeCLI(t, srv, tunnel.TunnelRegister{AuthToken: "solo-491"}, nil)
+	if _, _, err := registerFakeCLI(srv, tunnel.TunnelRegister{AuthToken: "solo-491"}); !errors.As(err, &refused) {
+		t.Errorf("second tunnel for a token limited to one: got %v", err)
+	}
+}
+
+func TestTunnelLimitCountsOpenTunnels(t *testing.T) {
+	srv := startTestServer(t)
+	setForTest(t, &maxTunnelsPerToken, 3)
+
+	var open []*fakeCLI
+	for i := 0; i < 3; i++ {
+		open = append(open, startFakeCLI(t, srv, tunnel.TunnelRegister{AuthToken: "limit-530"}, nil))
+	}
+	_, _, err := registerFakeCLI(srv, tunnel.TunnelRegister{AuthToken: "limit-530", Subdomain: "over-limit-530"})
+	var refused *refusedError
+	if !errors.As(err, &refused) || refused.Code != tunnel.ErrCodeTunnelLimit || refused.Close == nil {
+		t.Fatalf("fourth tunnel: got %v, want a %s error and a close frame", err, tunnel.ErrCodeTunnelLimit)
+	}
+	if _, ok := registry.Get("over-limit-530"); ok {
+		t.Error("the refused tunnel was registered")
+	}
+
+	// Other tokens aren't affected
+	startFakeCLI(t, srv, tunnel.TunnelRegister{AuthToken: "other-530"}, nil)
+
+	// Closing a tunnel makes room for another
+	open[0].conn.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, ok := registry.Get(open[0].ID); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("closed tunnel still registered")
+		}
+	}
+	startFakeCLI(t, srv, tunnel.TunnelRegister{AuthToken: "limit-530"}, nil)
+}
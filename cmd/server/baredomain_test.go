@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// bareRequest sends path on the base domain itself through handleRequest
+func bareRequest(path string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.Host = "tunnelr.test"
+	w := httptest.NewRecorder()
+	handleRequest(w, r)
+	return w
+}
+
+func TestBareDomainLandingPage(t *testing.T) {
+	setForTest(t, &baseDomain, "tunnelr.test")
+	setForTest(t, &bareDomainAction, "landing")
+
+	if w := bareRequest("/"); w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Errorf("/ got %d with %d bytes, want the landing page", w.Code, w.Body.Len())
+	}
+	if w := bareRequest("/elsewhere"); w.Code != http.StatusNotFound {
+		t.Errorf("/elsewhere got %d, want 404", w.Code)
+	}
+}
+
+func TestBareDomainRedirect(t *testing.T) {
+	setForTest(t, &baseDomain, "tunnelr.test")
+	setForTest(t, &bareDomainAction, "redirect")
+	setForTest(t, &bareDomainRedirect, "https://example.com/")
+
+	for _, path := range []string{"/", "/pricing"} {
+		w := bareRequest(path)
+		if w.Code != http.StatusFound || w.Header().Get("Location") != "https://example.com/" {
+			t.Errorf("%s got %d to %q, want a 302 to https://example.com/", path, w.Code, w.Header().Get("Location"))
+		}
+	}
+
+	// Without a target the landing page stays
+	setForTest(t, &bareDomainRedirect, "")
+	if w := bareRequest("/"); w.Code != http.StatusOK {
+		t.Errorf("redirect without a URL got %d, want the landing page", w.Code)
+	}
+}
+
+func TestBareDomainStatus(t *testing.T) {
+	setForTest(t, &baseDomain, "tunnelr.test")
+	setForTest(t, &bareDomainAction, "status")
+	setForTest(t, &bareDomainStatus, http.StatusGone)
+
+	setForTest(t, &bareDomainBody, "")
+	if w := bareRequest("/"); w.Code != http.StatusGone || strings.TrimSpace(w.Body.String()) != "Gone" {
+		t.Errorf("got %d %q, want 410 Gone", w.Code, w.Body.String())
+	}
+
+	setForTest(t, &bareDomainBody, "Nothing to see here")
+	if w := bareRequest("/x"); w.Code != http.StatusGone || strings.TrimSpace(w.Body.String()) != "Nothing to see here" {
+		t.Errorf("got %d %q, want the custom body", w.Code, w.Body.String())
+	}
+}
+
+func TestBareDomainActionIgnoredInPathMode(t *testing.T) {
+	setForTest(t, &baseDomain, "tunnelr.test")
+	setForTest(t, &routingMode, "path")
+	setForTest(t, &bareDomainAction, "status")
+	setForTest(t, &bareDomainStatus, http.StatusTeapot)
+
+	if w := bareRequest("/"); w.Code != http.StatusOK {
+		t.Errorf("path mode got %d, want the landing page", w.Code)
+	}
+}
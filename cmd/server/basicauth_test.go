@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestBasicAuth(t *testing.T) {
+	logs := captureLog(t)
+	srv := startTestServer(t)
+
+	var reached atomic.Int32
+	var forwardedAuth atomic.Value
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{BasicAuth: "alice:s3cret-516"}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		reached.Add(1)
+		forwardedAuth.Store(req.Headers.Get("Authorization"))
+		cli.respond(req.ID, http.StatusOK, nil, []byte("staging app"))
+	})
+	challengesBefore := metrics.authChallenges.Load()
+
+	visit := func(user, pass string) (*http.Response, string) {
+		t.Helper()
+		req := cli.newRequest(http.MethodGet, "/", nil)
+		if user != "" || pass != "" {
+			req.SetBasicAuth(user, pass)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	// No credentials, or wrong ones: challenged, and the app never sees it
+	for _, creds := range [][2]string{{"", ""}, {"alice", "wrong"}, {"bob", "s3cret-516"}, {"alice", "s3cret-516x"}} {
+		resp, _ := visit(creds[0], creds[1])
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%q:%q got %d, want 401", creds[0], creds[1], resp.StatusCode)
+		}
+		if got := resp.Header.Get("WWW-Authenticate"); !strings.HasPrefix(got, `Basic realm="tunnelr"`) {
+			t.Errorf("%q:%q challenge = %q, want a Basic one", creds[0], creds[1], got)
+		}
+		if resp.Header.Get("Cache-Control") != "no-store" {
+			t.Errorf("401 can be cached: Cache-Control %q", resp.Header.Get("Cache-Control"))
+		}
+	}
+	if got := reached.Load(); got != 0 {
+		t.Errorf("%d unauthenticated requests reached the app", got)
+	}
+	if got := metrics.authChallenges.Load() - challengesBefore; got != 4 {
+		t.Errorf("auth_challenges went up by %d, want 4", got)
+	}
+
+	// The right credentials get through, stripped off on the way
+	resp, body := visit("alice", "s3cret-516")
+	if resp.StatusCode != http.StatusOK || body != "staging app" {
+		t.Fatalf("right credentials got %d %q", resp.StatusCode, body)
+	}
+	if got, _ := forwardedAuth.Load().(string); got != "" {
+		t.Errorf("Authorization %q was sent down the tunnel", got)
+	}
+
+	// Whatever was logged, the password isn't in it
+	if strings.Contains(logs.String(), "s3cret-516") {
+		t.Errorf("the password was logged:\n%s", logs)
+	}
+
+	// Other tunnels stay open
+	open := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		cli.respond(req.ID, http.StatusOK, nil, nil)
+	})
+	if status, _ := open.get("/"); status != http.StatusOK {
+		t.Errorf("tunnel without --basic-auth got %d", status)
+	}
+}
+
+func TestInvalidBasicAuthRefusesTheTunnel(t *testing.T) {
+	logs := captureLog(t)
+	srv := startTestServer(t)
+
+	for _, creds := range []string{"no-colon-516", ":pw-516", "user:", ":"} {
+		_, _, err := registerFakeCLI(srv, tunnel.TunnelRegister{BasicAuth: creds})
+		var refused *refusedError
+		if !errors.As(err, &refused) || refused.Code != tunnel.ErrCodeBasicAuthInvalid {
+			t.Errorf("%q: got %v, want a %s refusal", creds, err, tunnel.ErrCodeBasicAuthInvalid)
+		}
+	}
+	if out := logs.String(); strings.Contains(out, "no-colon-516") || strings.Contains(out, "pw-516") {
+		t.Errorf("refused credentials were logged:\n%s", out)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"tunnelr/internal/tunnel"
+)
+
+// Request body limits - visitors get a 413 for bodies larger than their
+// tunnel allows. A CLI can pick its tunnel's limit (tunnelr connect
+// --max-body-size), e.g. higher for an upload endpoint or lower for a
+// webhook receiver, up to MAX_BODY_SIZE. Tunnels that don't pick one get
+// DEFAULT_BODY_SIZE.
+var (
+	maxBodySize     = int64(getEnvInt("MAX_BODY_SIZE", 0))     // Most a tunnel may allow, 0 = no cap
+	defaultBodySize = int64(getEnvInt("DEFAULT_BODY_SIZE", 0)) // For tunnels that don't say, 0 = MAX_BODY_SIZE
+)
+
+// validateMaxBody returns the body limit for a tunnel that asked for
+// requested bytes (0 = the default), capped at MAX_BODY_SIZE
+func validateMaxBody(requested int64, remoteAddr string) int64 {
+	if requested <= 0 {
+		requested = defaultBodySize
+	}
+	switch {
+	case maxBodySize <= 0:
+		return requested
+	case requested <= 0:
+		return maxBodySize
+	case requested > maxBodySize:
+		log.Printf("Limiting request bodies from %s to %d bytes (asked for %d)", remoteAddr, maxBodySize, requested)
+		return maxBodySize
+	}
+	return requested
+}
+
+// limitRequestBody applies the tunnel's body limit to r, answering with a
+// 413 right away if the Content-Length is already too large
+// Returns false if the request was answered.
+func limitRequestBody(w http.ResponseWriter, r *http.Request, tun *tunnel.Tunnel) bool {
+	limit := tun.MaxBodyBytes
+	if limit <= 0 {
+		return true
+	}
+	if r.ContentLength > limit {
+		respondBodyTooLarge(w, limit)
+		return false
+	}
+	// Chunked bodies have no Content-Length - reading past the limit fails
+	// with an *http.MaxBytesError instead, see isBodyTooLarge
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	return true
+}
+
+// isBodyTooLarge reports whether reading a body failed because of
+// limitRequestBody
+func isBodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+// respondBodyTooLarge answers a request whose body is over limit bytes
+func respondBodyTooLarge(w http.ResponseWriter, limit int64) {
+	http.Error(w, fmt.Sprintf("Request body too large: this tunnel accepts at most %d bytes", limit),
+		http.StatusRequestEntityTooLarge)
+}
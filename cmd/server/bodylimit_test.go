@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestValidateMaxBody(t *testing.T) {
+	tests := []struct {
+		max, def, requested int64
+		want                int64
+	}{
+		{0, 0, 0, 0},            // No limits anywhere
+		{0, 0, 5000, 5000},      // No cap, the tunnel's own
+		{0, 100, 0, 100},        // The default
+		{2000, 0, 0, 2000},      // No default, the cap
+		{2000, 100, 0, 100},     // The default, under the cap
+		{2000, 100, 50, 50},     // Stricter than the default
+		{2000, 100, 1000, 1000}, // Looser than the default, within the cap
+		{2000, 100, 5000, 2000}, // Capped
+	}
+	for _, tc := range tests {
+		setForTest(t, &maxBodySize, tc.max)
+		setForTest(t, &defaultBodySize, tc.def)
+		if got := validateMaxBody(tc.requested, "127.0.0.1:1234"); got != tc.want {
+			t.Errorf("MAX_BODY_SIZE=%d DEFAULT_BODY_SIZE=%d, asked for %d: got %d, want %d",
+				tc.max, tc.def, tc.requested, got, tc.want)
+		}
+	}
+}
+
+// postBody sends a visitor POST of n bytes, chunked or with a Content-Length,
+// and returns the status
+func postBody(t *testing.T, cli *fakeCLI, n int, chunked bool) int {
+	t.Helper()
+	var body io.Reader = bytes.NewReader(bytes.Repeat([]byte("x"), n))
+	if chunked {
+		body = io.MultiReader(body) // Hides the length
+	}
+	resp, err := http.DefaultClient.Do(cli.newRequest(http.MethodPost, "/upload", body))
+	if err != nil {
+		t.Fatalf("POST of %d bytes: %v", n, err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestPerTunnelBodyLimit(t *testing.T) {
+	setForTest(t, &maxBodySize, 2000)
+	setForTest(t, &defaultBodySize, 100)
+	setForTest(t, &streamThreshold, 512) // So larger bodies take the streamed path
+	srv := startTestServer(t)
+
+	echoSize := func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+		n, err := io.Copy(io.Discard, body)
+		if err != nil {
+			return // The server gave up on the request
+		}
+		cli.respond(req.ID, http.StatusOK, nil, []byte(fmt.Sprint(n)))
+	}
+	defaultTunnel := startFakeCLI(t, srv, tunnel.TunnelRegister{}, echoSize)
+	uploads := startFakeCLI(t, srv, tunnel.TunnelRegister{MaxBodyBytes: 1000}, echoSize)
+	greedy := startFakeCLI(t, srv, tunnel.TunnelRegister{MaxBodyBytes: 1 << 30}, echoSize)
+
+	tests := []struct {
+		name string
+		cli  *fakeCLI
+		size int
+		want int
+	}{
+		{"default tunnel, within DEFAULT_BODY_SIZE", defaultTunnel, 100, http.StatusOK},
+		{"default tunnel, over DEFAULT_BODY_SIZE", defaultTunnel, 101, http.StatusRequestEntityTooLarge},
+		{"own limit, over the default", uploads, 900, http.StatusOK},
+		{"own limit, exactly", uploads, 1000, http.StatusOK},
+		{"own limit, over", uploads, 1001, http.StatusRequestEntityTooLarge},
+		{"asked for more than MAX_BODY_SIZE, within it", greedy, 2000, http.StatusOK},
+		{"asked for more than MAX_BODY_SIZE, over it", greedy, 3000, http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range tests {
+		for _, chunked := range []bool{false, true} {
+			if got := postBody(t, tc.cli, tc.size, chunked); got != tc.want {
+				t.Errorf("%s, %d bytes (chunked %v): got %d, want %d", tc.name, tc.size, chunked, got, tc.want)
+			}
+		}
+	}
+
+	// Bodyless requests aren't affected
+	if status, _ := defaultTunnel.get("/"); status != http.StatusOK {
+		t.Errorf("GET got %d, want 200", status)
+	}
+
+	// The limit is what the tunnel was registered with
+	for cli, want := range map[*fakeCLI]int64{defaultTunnel: 100, uploads: 1000, greedy: 2000} {
+		if tun, _ := registry.Get(cli.ID); tun.MaxBodyBytes != want {
+			t.Errorf("tunnel %s has MaxBodyBytes %d, want %d", cli.ID, tun.MaxBodyBytes, want)
+		}
+	}
+}
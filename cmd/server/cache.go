@@ -0,0 +1,203 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Response caching - GET responses can be kept for a while and served
+// without going through the tunnel at all
+//
+// CACHE_TTLS is a comma-separated list of "status=duration" rules, where
+// status is an exact code ("404") or a class ("2xx"); exact codes win over
+// classes. "2xx=5m,404=30s,5xx=0" keeps successes for 5 minutes, 404s for 30
+// seconds and never caches errors. Statuses without a rule aren't cached, so
+// the cache is off while CACHE_TTLS is empty.
+//
+// The upstream's Cache-Control has the last word: no-store, no-cache and
+// private responses are never cached, and s-maxage / max-age replace the
+// configured TTL. Responses that set cookies are never cached.
+var (
+	cacheRules      = parseCacheTTLs(getEnv("CACHE_TTLS", ""))
+	cacheMaxEntries = getEnvInt("CACHE_MAX_ENTRIES", 1000)
+	responseCache   = &responseCacheStore{entries: make(map[string]*cacheEntry)}
+)
+
+// cacheHeader tells clients a response came from the cache
+const cacheHeader = "X-Tunnel-Cache"
+
+// cacheEnabled reports whether any response could be cached
+func cacheEnabled() bool {
+	return len(cacheRules) > 0
+}
+
+// cacheRule is the TTL for one code or class of codes
+type cacheRule struct {
+	code  int // Exact status, or 0 for a class rule
+	class int // 1-5 for "1xx".."5xx", 0 for an exact rule
+	ttl   time.Duration
+}
+
+// cacheEntry is a stored response and when it stops being fresh
+type cacheEntry struct {
+	resp    *coalescedResponse
+	stored  time.Time
+	expires time.Time
+}
+
+// responseCacheStore holds cached responses by request key
+type responseCacheStore struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+// Get returns a fresh cached response for key and how old it is
+func (c *responseCacheStore) Get(key string) (*coalescedResponse, time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, exists := c.entries[key]
+	if !exists {
+		return nil, 0, false
+	}
+	now := time.Now()
+	if now.After(entry.expires) {
+		delete(c.entries, key)
+		return nil, 0, false
+	}
+	return entry.resp, now.Sub(entry.stored), true
+}
+
+// Put stores a response for ttl
+// When the cache is full, expired entries are cleared out first; if it's
+// still full the response simply isn't cached
+func (c *responseCacheStore) Put(key string, resp *coalescedResponse, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= cacheMaxEntries {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= cacheMaxEntries {
+			return
+		}
+	}
+	c.entries[key] = &cacheEntry{resp: resp, stored: now, expires: now.Add(ttl)}
+}
+
+// cacheTTL decides how long a response may be cached, 0 meaning not at all
+// r is the request it answered
+func cacheTTL(r *http.Request, resp *coalescedResponse) time.Duration {
+	if resp == nil || len(resp.header.Values("Set-Cookie")) > 0 || resp.header.Get("Vary") == "*" {
+		return 0
+	}
+
+	// Cache-Control from the local app overrides our configuration
+	directives := parseCacheControl(resp.header.Values("Cache-Control"))
+	if _, ok := directives["no-store"]; ok {
+		return 0
+	}
+	if _, ok := directives["no-cache"]; ok {
+		return 0
+	}
+	if _, ok := directives["private"]; ok {
+		return 0
+	}
+	// Like any shared cache, only keep answers to authenticated requests
+	// when the app explicitly allows it (RFC 9111 section 3.5)
+	_, public := directives["public"]
+	_, sharedMaxAge := directives["s-maxage"]
+	if r.Header.Get("Authorization") != "" && !public && !sharedMaxAge {
+		return 0
+	}
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[name]; ok {
+			if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+				return time.Duration(secs) * time.Second
+			}
+		}
+	}
+
+	return statusTTL(resp.status)
+}
+
+// statusTTL returns the configured TTL for a status
+func statusTTL(status int) time.Duration {
+	var classMatch *cacheRule
+	for i := range cacheRules {
+		rule := &cacheRules[i]
+		if rule.code == status {
+			return rule.ttl
+		}
+		if rule.class != 0 && rule.class == status/100 && classMatch == nil {
+			classMatch = rule
+		}
+	}
+	if classMatch != nil {
+		return classMatch.ttl
+	}
+	return 0
+}
+
+// parseCacheControl splits Cache-Control headers into lowercase directives
+// e.g. "public, max-age=60" -> {"public": "", "max-age": "60"}
+func parseCacheControl(values []string) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				directives[name] = strings.Trim(strings.TrimSpace(arg), `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// parseCacheTTLs parses "2xx=5m,404=30s" into rules
+// Malformed rules are logged and skipped
+func parseCacheTTLs(value string) []cacheRule {
+	var rules []cacheRule
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		from, to, found := strings.Cut(entry, "=")
+		ttl, err := parseTTL(strings.TrimSpace(to))
+		if !found || err != nil || ttl < 0 {
+			log.Printf("Ignoring invalid CACHE_TTLS rule %q", entry)
+			continue
+		}
+
+		from = strings.ToLower(strings.TrimSpace(from))
+		rule := cacheRule{ttl: ttl}
+		if len(from) == 3 && strings.HasSuffix(from, "xx") && from[0] >= '1' && from[0] <= '5' {
+			rule.class = int(from[0] - '0')
+		} else if code, err := strconv.Atoi(from); err == nil && code >= 100 && code <= 599 {
+			rule.code = code
+		} else {
+			log.Printf("Ignoring invalid CACHE_TTLS rule %q", entry)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// parseTTL reads "30s", "5m" or a bare number of seconds
+func parseTTL(value string) (time.Duration, error) {
+	if secs, err := strconv.Atoi(value); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestStatusTTL(t *testing.T) {
+	setForTest(t, &cacheRules, parseCacheTTLs("2xx=5m, 404=30s, 4xx=10s, 5xx=0, 301=1h, nonsense, 600=1s, 3xx=soon"))
+
+	tests := map[int]time.Duration{
+		200: 5 * time.Minute,
+		204: 5 * time.Minute,
+		301: time.Hour, // Exact code
+		302: 0,         // 3xx rule was invalid
+		404: 30 * time.Second,
+		410: 10 * time.Second, // Class
+		500: 0,
+		503: 0,
+	}
+	for status, want := range tests {
+		if got := statusTTL(status); got != want {
+			t.Errorf("statusTTL(%d) = %s, want %s", status, got, want)
+		}
+	}
+	if len(cacheRules) != 5 {
+		t.Errorf("parsed %d rules, want 5 (invalid ones skipped)", len(cacheRules))
+	}
+}
+
+func TestCacheControlOverridesTTL(t *testing.T) {
+	setForTest(t, &cacheRules, parseCacheTTLs("2xx=5m"))
+
+	tests := []struct {
+		name   string
+		status int
+		header http.Header
+		auth   bool
+		want   time.Duration
+	}{
+		{"configured", 200, nil, false, 5 * time.Minute},
+		{"no-store", 200, http.Header{"Cache-Control": {"no-store"}}, false, 0},
+		{"no-cache", 200, http.Header{"Cache-Control": {"No-Cache"}}, false, 0},
+		{"private", 200, http.Header{"Cache-Control": {"private, max-age=60"}}, false, 0},
+		{"max-age", 200, http.Header{"Cache-Control": {"public, max-age=60"}}, false, time.Minute},
+		{"s-maxage wins", 200, http.Header{"Cache-Control": {"max-age=60, s-maxage=10"}}, false, 10 * time.Second},
+		{"max-age on uncached status", 500, http.Header{"Cache-Control": {"max-age=30"}}, false, 30 * time.Second},
+		{"max-age=0", 200, http.Header{"Cache-Control": {"max-age=0"}}, false, 0},
+		{"bad max-age", 200, http.Header{"Cache-Control": {"max-age=soon"}}, false, 5 * time.Minute},
+		{"Set-Cookie", 200, http.Header{"Set-Cookie": {"session=1"}}, false, 0},
+		{"Vary *", 200, http.Header{"Vary": {"*"}}, false, 0},
+		{"authorized", 200, nil, true, 0},
+		{"authorized, public", 200, http.Header{"Cache-Control": {"public"}}, true, 5 * time.Minute},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tc.auth {
+			r.Header.Set("Authorization", "Bearer x")
+		}
+		header := tc.header
+		if header == nil {
+			header = http.Header{}
+		}
+		if got := cacheTTL(r, &coalescedResponse{status: tc.status, header: header}); got != tc.want {
+			t.Errorf("%s: TTL = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCachedResponsesSkipTheTunnel(t *testing.T) {
+	setForTest(t, &cacheRules, parseCacheTTLs("2xx=5m,404=200ms,5xx=0"))
+	setForTest(t, &responseCache, &responseCacheStore{entries: make(map[string]*cacheEntry)})
+	srv := startTestServer(t)
+
+	var calls atomic.Int32
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		calls.Add(1)
+		switch req.Path {
+		case "/page":
+			cli.respond(req.ID, http.StatusOK, nil, []byte("page"))
+		case "/gone":
+			cli.respond(req.ID, http.StatusNotFound, nil, []byte("gone"))
+		case "/live":
+			cli.respond(req.ID, http.StatusOK, http.Header{"Cache-Control": {"no-store"}}, []byte("live"))
+		default:
+			cli.respond(req.ID, http.StatusInternalServerError, nil, []byte("broken"))
+		}
+	})
+
+	// get fetches path and reports how many times the CLI was asked for it
+	get := func(path string) (string, int32) {
+		t.Helper()
+		before := calls.Load()
+		resp, err := http.DefaultClient.Do(cli.newRequest(http.MethodGet, path, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.Header.Get(cacheHeader), calls.Load() - before
+	}
+
+	hitsBefore := metrics.cacheHits.Load()
+	for path, cached := range map[string]bool{"/page": true, "/gone": true, "/live": false, "/error": false} {
+		get(path)
+		mark, reached := get(path)
+		if cached && (mark != "HIT" || reached != 0) {
+			t.Errorf("%s: second request reached the CLI %d times (%s = %q), want a cache hit", path, reached, cacheHeader, mark)
+		}
+		if !cached && (mark != "" || reached != 1) {
+			t.Errorf("%s: second request reached the CLI %d times (%s = %q), want it not cached", path, reached, cacheHeader, mark)
+		}
+	}
+	if got := metrics.cacheHits.Load() - hitsBefore; got != 2 {
+		t.Errorf("cache_hits went up by %d, want 2", got)
+	}
+
+	// The 404 expires long before the 200
+	time.Sleep(300 * time.Millisecond)
+	if _, reached := get("/gone"); reached != 1 {
+		t.Error("404 still cached after its 200ms TTL")
+	}
+	if _, reached := get("/page"); reached != 0 {
+		t.Error("200 no longer cached well within its 5m TTL")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// `server --check` runs the same DNS checks as /status and exits, so
+// operators can validate BASE_DOMAIN and ROUTING_MODE (and their DNS
+// records) before going live. It reads the same environment variables as
+// the server and exits non-zero if the setup isn't ready.
+
+// runCheck handles the server's command line, printing the report to out,
+// and returns the exit code
+func runCheck(out io.Writer, args []string) int {
+	if len(args) != 1 || (args[0] != "--check" && args[0] != "-check") {
+		fmt.Fprintf(out, "Unknown arguments: %s\n", strings.Join(args, " "))
+		fmt.Fprintln(out, "Usage: server [--check]")
+		fmt.Fprintln(out, "  --check   Check BASE_DOMAIN and ROUTING_MODE against DNS, then exit")
+		return 2
+	}
+
+	if routingMode != "path" && routingMode != "subdomain" {
+		fmt.Fprintf(out, "ROUTING_MODE must be subdomain or path, got %q\n", routingMode)
+		return 1
+	}
+
+	status := domainStatus()
+	fmt.Fprintf(out, "Base domain:   %s\n", status.BaseDomain)
+	fmt.Fprintf(out, "Routing mode:  %s\n", status.RoutingMode)
+	fmt.Fprintf(out, "Domain:        %s\n", describeDNSCheck(status.DomainCheck))
+	if status.RoutingMode == "subdomain" {
+		fmt.Fprintf(out, "Wildcard:      %s\n", describeDNSCheck(status.WildcardCheck))
+	}
+	fmt.Fprintln(out, "")
+	fmt.Fprintln(out, status.Message)
+
+	if !status.Ready {
+		return 1
+	}
+	return 0
+}
+
+// describeDNSCheck turns a lookup result into one line of the report
+func describeDNSCheck(check DNSCheck) string {
+	if !check.OK {
+		return fmt.Sprintf("FAIL %s (%s)", check.Domain, check.Error)
+	}
+	return fmt.Sprintf("OK %s -> %s", check.Domain, strings.Join(check.IPs, ", "))
+}
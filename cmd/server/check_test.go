@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckExitCodes(t *testing.T) {
+	t.Cleanup(func() { maintenance.Set(false, "") })
+
+	tests := []struct {
+		name       string
+		baseDomain string
+		mode       string
+		args       []string
+		wantCode   int
+		want       []string
+	}{
+		{"resolvable domain", "localhost", "path", []string{"--check"}, 0,
+			[]string{"Domain:        OK localhost -> ", "Ready!"}},
+		{"single-dash flag", "localhost", "path", []string{"-check"}, 0, []string{"Ready!"}},
+		{"unresolvable domain", "tunnelr-check.invalid", "path", []string{"--check"}, 1,
+			[]string{"Domain:        FAIL tunnelr-check.invalid", "does not resolve"}},
+		{"no wildcard record", "localhost", "subdomain", []string{"--check"}, 1,
+			[]string{"Domain:        OK localhost", "Wildcard:      FAIL test-dns-check.localhost", "Wildcard subdomain not configured"}},
+		{"invalid routing mode", "localhost", "folders", []string{"--check"}, 1,
+			[]string{`ROUTING_MODE must be subdomain or path, got "folders"`}},
+		{"unknown argument", "localhost", "path", []string{"--chek"}, 2,
+			[]string{"Unknown arguments: --chek", "Usage: server [--check]"}},
+		{"extra argument", "localhost", "path", []string{"--check", "now"}, 2,
+			[]string{"Unknown arguments: --check now"}},
+	}
+	for _, tc := range tests {
+		setForTest(t, &baseDomain, tc.baseDomain)
+		setForTest(t, &routingMode, tc.mode)
+		var out strings.Builder
+		if code := runCheck(&out, tc.args); code != tc.wantCode {
+			t.Errorf("%s: exit code %d, want %d\n%s", tc.name, code, tc.wantCode, out.String())
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("%s: output is missing %q:\n%s", tc.name, want, out.String())
+			}
+		}
+	}
+
+	// Maintenance mode isn't ready either
+	setForTest(t, &baseDomain, "localhost")
+	setForTest(t, &routingMode, "path")
+	maintenance.Set(true, "moving servers")
+	var out strings.Builder
+	if code := runCheck(&out, []string{"--check"}); code != 1 || !strings.Contains(out.String(), "Maintenance: moving servers") {
+		t.Errorf("in maintenance: exit code %d, want 1\n%s", code, out.String())
+	}
+}
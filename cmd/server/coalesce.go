@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+// Request coalescing (single-flight) - when several identical GETs for the
+// same tunnel arrive at once, only the first goes through the tunnel and the
+// others get a copy of its response. Saves a slow local server from doing the
+// same work many times over (e.g. a page shared in a busy chat).
+// Opt-in with COALESCE_REQUESTS=true.
+
+var coalesceRequests = getEnvBool("COALESCE_REQUESTS", false)
+
+// coalescedHeader marks responses that were copied from another request
+const coalescedHeader = "X-Tunnel-Coalesced"
+
+// coalesceKeyHeaders are the request headers that can change a response
+// Requests only share a response if these match exactly, so one user never
+// gets another user's page
+var coalesceKeyHeaders = []string{"Authorization", "Cookie", "Accept", "Accept-Encoding", "Accept-Language", "Range"}
+
+// coalescedResponse is a finished response that followers can replay
+type coalescedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// coalescedCall is one in-flight request that others are waiting on
+type coalescedCall struct {
+	done chan struct{}
+	resp *coalescedResponse // nil if the response couldn't be shared
+}
+
+// coalescer tracks in-flight requests by key
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+var inflight = &coalescer{calls: make(map[string]*coalescedCall)}
+
+// join returns the call for key, and whether we're the leader that has to
+// actually forward the request
+func (c *coalescer) join(key string) (*coalescedCall, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if call, exists := c.calls[key]; exists {
+		return call, false
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	c.calls[key] = call
+	return call, true
+}
+
+// finish publishes the leader's response and wakes up the followers
+func (c *coalescer) finish(key string, call *coalescedCall, resp *coalescedResponse) {
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+
+	call.resp = resp
+	close(call.done)
+}
+
+// coalesceKey identifies requests that can share a response
+// Returns "" for requests that must always be forwarded on their own
+func coalesceKey(r *http.Request, tun *tunnel.Tunnel) string {
+	if r.Method != http.MethodGet || r.ContentLength != 0 || len(r.TransferEncoding) > 0 {
+		return ""
+	}
+
+	var key strings.Builder
+	key.WriteString(tun.ID)
+	key.WriteString(" ")
+	key.WriteString(r.URL.RequestURI())
+	for _, name := range coalesceKeyHeaders {
+		key.WriteString("\n")
+		key.WriteString(strings.Join(r.Header.Values(name), ", "))
+	}
+	return key.String()
+}
+
+// forwardCoalesced forwards a request, sharing the response with identical
+// requests already in flight when coalescing is enabled, and answering from
+// (or filling) the response cache when caching is enabled. Tunnels with the
+// stale overload fallback also keep their last good responses.
+func forwardCoalesced(w http.ResponseWriter, r *http.Request, tun *tunnel.Tunnel, forwardPath string) {
+	key := ""
+	if coalesceRequests || cacheEnabled() || fallbackMode(tun) == tunnel.FallbackStale {
+		key = coalesceKey(r, tun)
+	}
+	if key == "" {
+		forwardRequest(w, r, tun, forwardPath)
+		return
+	}
+
+	start := time.Now()
+
+	if cacheEnabled() {
+		if cached, age, ok := responseCache.Get(key); ok {
+			w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+			w.Header().Set(cacheHeader, "HIT")
+			writeSharedResponse(w, cached)
+
+			metrics.cacheHits.Add(1)
+			logAccess(tun, r, forwardPath, cached.status, time.Since(start))
+			return
+		}
+	}
+
+	if !coalesceRequests {
+		rec := &recordingWriter{ResponseWriter: w, limit: streamThreshold}
+		forwardRequest(rec, r, tun, forwardPath)
+		resp := rec.response()
+		storeInCache(key, r, resp)
+		rememberLastGood(key, tun, resp)
+		return
+	}
+
+	call, leader := inflight.join(key)
+
+	if !leader {
+		select {
+		case <-call.done:
+		case <-r.Context().Done():
+			if serverTimeLimitHit(r) {
+				respondServerTimeLimit(w, r, tun, forwardPath, start)
+			}
+			return // Otherwise the client gave up
+		}
+
+		if call.resp != nil {
+			w.Header().Set(coalescedHeader, "true")
+			writeSharedResponse(w, call.resp)
+
+			metrics.requestsCoalesced.Add(1)
+			logAccess(tun, r, forwardPath, call.resp.status, time.Since(start))
+			return
+		}
+
+		// The leader's response was too big (or never finished) - go ourselves
+		forwardRequest(w, r, tun, forwardPath)
+		return
+	}
+
+	// We're the leader: forward as usual while keeping a copy of the response
+	// If forwardRequest aborts (panics) the copy is never published
+	rec := &recordingWriter{ResponseWriter: w, limit: streamThreshold}
+	var shared *coalescedResponse
+	defer func() {
+		inflight.finish(key, call, shared)
+	}()
+
+	forwardRequest(rec, r, tun, forwardPath)
+	shared = rec.response()
+	storeInCache(key, r, shared)
+	rememberLastGood(key, tun, shared)
+}
+
+// writeSharedResponse replays a recorded response
+func writeSharedResponse(w http.ResponseWriter, resp *coalescedResponse) {
+	copyHeaders(w.Header(), resp.header)
+	w.WriteHeader(resp.status)
+	w.Write(resp.body)
+}
+
+// storeInCache caches a recorded response if its TTL allows
+func storeInCache(key string, r *http.Request, resp *coalescedResponse) {
+	if !cacheEnabled() {
+		return
+	}
+	if ttl := cacheTTL(r, resp); ttl > 0 {
+		responseCache.Put(key, resp, ttl)
+	}
+}
+
+// recordingWriter passes a response through while keeping a copy of it
+// Bodies larger than limit aren't kept - they're not worth holding in memory
+type recordingWriter struct {
+	http.ResponseWriter
+	limit    int64
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (rw *recordingWriter) WriteHeader(code int) {
+	// 1xx responses (e.g. Early Hints) pass through but aren't the answer
+	if code >= 200 && rw.status == 0 {
+		rw.status = code
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	if !rw.overflow {
+		if int64(rw.body.Len()+len(p)) > rw.limit {
+			rw.overflow = true
+			rw.body = bytes.Buffer{}
+		} else {
+			rw.body.Write(p)
+		}
+	}
+	return rw.ResponseWriter.Write(p)
+}
+
+// Flush keeps streamed responses flowing if the real writer supports it
+func (rw *recordingWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// response returns the recorded response, or nil if it can't be shared
+func (rw *recordingWriter) response() *coalescedResponse {
+	if rw.status == 0 || rw.overflow {
+		return nil
+	}
+	return &coalescedResponse{
+		status: rw.status,
+		header: rw.Header().Clone(),
+		body:   rw.body.Bytes(),
+	}
+}
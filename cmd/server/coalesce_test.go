@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestConcurrentIdenticalRequestsAreCoalesced(t *testing.T) {
+	setForTest(t, &coalesceRequests, true)
+	srv := startTestServer(t)
+
+	var calls atomic.Int32
+	first := make(chan struct{})
+	release := make(chan struct{})
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+		if calls.Add(1) == 1 {
+			close(first)
+		}
+		<-release
+		cli.respond(req.ID, http.StatusOK, http.Header{"Content-Type": {"text/plain"}}, []byte("shared page"))
+	})
+
+	coalescedBefore := metrics.requestsCoalesced.Load()
+	forwardedBefore := metrics.requestsForwarded.Load()
+
+	const visitors = 10
+	var wg sync.WaitGroup
+	var marked atomic.Int32
+	visit := func() {
+		defer wg.Done()
+		resp, err := http.DefaultClient.Do(cli.newRequest(http.MethodGet, "/page", nil))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "shared page" {
+			t.Errorf("visitor got %d %q", resp.StatusCode, body)
+		}
+		if resp.Header.Get(coalescedHeader) == "true" {
+			marked.Add(1)
+		}
+	}
+
+	// The first visitor's request reaches the CLI, the others arrive while
+	// it's still in flight
+	wg.Add(1)
+	go visit()
+	<-first
+	for i := 1; i < visitors; i++ {
+		wg.Add(1)
+		go visit()
+	}
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := calls.Load(); got != 1 {
+		t.Errorf("the CLI got %d requests, want 1", got)
+	}
+	if got := marked.Load(); got != visitors-1 {
+		t.Errorf("%d responses marked %s, want %d", got, coalescedHeader, visitors-1)
+	}
+	if got := metrics.requestsCoalesced.Load() - coalescedBefore; got != visitors-1 {
+		t.Errorf("requests_coalesced went up by %d, want %d", got, visitors-1)
+	}
+	if got := metrics.requestsForwarded.Load() - forwardedBefore; got != 1 {
+		t.Errorf("requests_forwarded went up by %d, want 1", got)
+	}
+}
+
+func TestCoalesceKey(t *testing.T) {
+	tun := &tunnel.Tunnel{ID: "abc123"}
+	request := func(method, target string, headers map[string]string) *http.Request {
+		var body io.Reader
+		if method == http.MethodPost {
+			body = strings.NewReader("data")
+		}
+		r := httptest.NewRequest(method, target, body)
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		return r
+	}
+
+	base := coalesceKey(request(http.MethodGet, "/page?x=1", nil), tun)
+	if base == "" {
+		t.Fatal("a plain GET can't be coalesced")
+	}
+	if got := coalesceKey(request(http.MethodGet, "/page?x=1", map[string]string{"User-Agent": "other"}), tun); got != base {
+		t.Error("a header that doesn't change the response split the key")
+	}
+
+	// Never shared
+	if got := coalesceKey(request(http.MethodPost, "/page?x=1", nil), tun); got != "" {
+		t.Errorf("POST got key %q", got)
+	}
+
+	// Shared only with identical requests
+	for name, r := range map[string]*http.Request{
+		"other query":  request(http.MethodGet, "/page?x=2", nil),
+		"other cookie": request(http.MethodGet, "/page?x=1", map[string]string{"Cookie": "session=someone-else"}),
+		"other auth":   request(http.MethodGet, "/page?x=1", map[string]string{"Authorization": "Bearer x"}),
+		"range":        request(http.MethodGet, "/page?x=1", map[string]string{"Range": "bytes=0-10"}),
+	} {
+		if got := coalesceKey(r, tun); got == base {
+			t.Errorf("%s shares the plain request's key", name)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestConcurrentRequestsThroughOneTunnel(t *testing.T) {
+	srv := startTestServer(t)
+
+	// The fake CLI answers every request in its own goroutine, so responses
+	// are written to the connection concurrently too
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{Capabilities: allCapabilities},
+		func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+			data, _ := io.ReadAll(body)
+			cli.respond(req.ID, http.StatusOK, nil, []byte(req.Path+" "+string(data)))
+		})
+
+	const requests = 100
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path := fmt.Sprintf("/item/%d", i)
+			payload := fmt.Sprintf("payload-%d", i)
+			resp, err := http.DefaultClient.Do(cli.newRequest(http.MethodPost, path, strings.NewReader(payload)))
+			if err != nil {
+				t.Errorf("%s: %v", path, err)
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			// Each visitor gets its own answer, not a neighbour's
+			if want := path + " " + payload; resp.StatusCode != http.StatusOK || string(body) != want {
+				t.Errorf("%s: got %d %q, want %q", path, resp.StatusCode, body, want)
+			}
+		}()
+	}
+	wg.Wait()
+}
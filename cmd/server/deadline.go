@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+// serverRequestTimeout is a hard cap on how long any request to a tunnel may
+// take, whatever the tunnel does - 0 means no cap
+// It composes with the forward timeout: whichever runs out first wins
+var serverRequestTimeout = getEnvDuration("SERVER_REQUEST_TIMEOUT", 0)
+
+// withServerTimeout gives each request a context deadline of
+// SERVER_REQUEST_TIMEOUT. We use a deadline rather than http.TimeoutHandler
+// because that buffers the whole response, which would break streaming.
+func withServerTimeout(next http.HandlerFunc) http.HandlerFunc {
+	if serverRequestTimeout <= 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), serverRequestTimeout)
+		defer cancel()
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// serverTimeLimitHit reports whether the request ran out of time because of
+// SERVER_REQUEST_TIMEOUT (as opposed to the client going away)
+func serverTimeLimitHit(r *http.Request) bool {
+	return r.Context().Err() == context.DeadlineExceeded
+}
+
+// respondServerTimeLimit answers a request that hit SERVER_REQUEST_TIMEOUT
+func respondServerTimeLimit(w http.ResponseWriter, r *http.Request, tun *tunnel.Tunnel, forwardPath string, start time.Time) {
+	if !isHealthCheck(r, forwardPath) {
+		metrics.requestTimeouts.Add(1)
+		promTimeouts.Inc()
+		tun.Stats.Timeouts.Add(1)
+	}
+	http.Error(w, "Request exceeded the server's time limit", http.StatusGatewayTimeout)
+	logAccess(tun, r, forwardPath, http.StatusGatewayTimeout, time.Since(start))
+}
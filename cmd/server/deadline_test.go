@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+// silentCLI registers a tunnel that never answers
+func silentCLI(t *testing.T) *fakeCLI {
+	t.Helper()
+	srv := startTestServer(t)
+	return startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+		if req.Path == "/fast" {
+			cli.respond(req.ID, http.StatusOK, nil, []byte("fast"))
+		}
+	})
+}
+
+// timedGet sends a visitor GET and returns the status, body and how long it took
+func timedGet(t *testing.T, cli *fakeCLI, path string) (int, string, time.Duration) {
+	t.Helper()
+	start := time.Now()
+	status, body := cli.get(path)
+	return status, string(body), time.Since(start)
+}
+
+func TestServerTimeoutCapsRequests(t *testing.T) {
+	setForTest(t, &serverRequestTimeout, 300*time.Millisecond)
+	setForTest(t, &forwardTimeout, 10*time.Second)
+	cli := silentCLI(t) // Wrapped with the cap above
+
+	status, body, took := timedGet(t, cli, "/stuck")
+	if status != http.StatusGatewayTimeout || !strings.Contains(body, "server's time limit") {
+		t.Errorf("got %d %q, want the server time limit's 504", status, body)
+	}
+	if took < 300*time.Millisecond || took > 3*time.Second {
+		t.Errorf("answered after %s with a 300ms cap", took)
+	}
+
+	// Requests inside the cap are untouched
+	if status, body, _ := timedGet(t, cli, "/fast"); status != http.StatusOK || body != "fast" {
+		t.Errorf("fast request got %d %q", status, body)
+	}
+}
+
+func TestShorterTimeoutWins(t *testing.T) {
+	// The forward timeout runs out first, so its 504 is the one visitors see
+	setForTest(t, &serverRequestTimeout, 10*time.Second)
+	setForTest(t, &forwardTimeout, 300*time.Millisecond)
+	cli := silentCLI(t)
+
+	status, body, took := timedGet(t, cli, "/stuck")
+	if status != http.StatusGatewayTimeout || !strings.Contains(body, "Tunnel "+cli.ID+" timed out") {
+		t.Errorf("got %d %q, want the forward timeout's 504", status, body)
+	}
+	if took > 3*time.Second {
+		t.Errorf("answered after %s, the 300ms forward timeout should win", took)
+	}
+}
+
+func TestForwardTimeoutIsConfigurable(t *testing.T) {
+	setForTest(t, &forwardTimeout, time.Second)
+	cli := silentCLI(t)
+	timeoutsBefore := metrics.requestTimeouts.Load()
+
+	status, body, took := timedGet(t, cli, "/report")
+	if status != http.StatusGatewayTimeout {
+		t.Fatalf("got %d, want 504", status)
+	}
+	// The body says which tunnel timed out, and after how long
+	if !strings.Contains(body, "Tunnel "+cli.ID+" timed out") || !strings.Contains(body, "within 1s") {
+		t.Errorf("504 body %q doesn't explain the timeout", body)
+	}
+	if took < time.Second || took > 4*time.Second {
+		t.Errorf("504 after %s with a 1s timeout", took)
+	}
+	if got := metrics.requestTimeouts.Load() - timeoutsBefore; got != 1 {
+		t.Errorf("request_timeouts went up by %d, want 1", got)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestRemovedTunnelFailsInFlightRequests(t *testing.T) {
+	setForTest(t, &forwardTimeout, 10*time.Second)
+	srv := startTestServer(t)
+
+	const visitors = 20
+	arrived := make(chan string, visitors)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+		arrived <- req.ID // And never answer
+	})
+	tun, _ := registry.Get(cli.ID)
+
+	var wg sync.WaitGroup
+	for i := 0; i < visitors; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			status, body := cli.get("/slow")
+			if status != http.StatusBadGateway || !strings.Contains(string(body), "disconnected before responding") {
+				t.Errorf("got %d %q, want a 502 saying the tunnel disconnected", status, body)
+			}
+			if took := time.Since(start); took > 3*time.Second {
+				t.Errorf("answered after %s, not right after the disconnect", took)
+			}
+		}()
+	}
+	var ids []string
+	for i := 0; i < visitors; i++ {
+		ids = append(ids, <-arrived)
+	}
+
+	// The CLI goes away while every request is waiting on it
+	registry.RemoveTunnel(tun)
+	wg.Wait()
+
+	if n := tun.Pending.Len(); n != 0 {
+		t.Errorf("%d pending requests left behind", n)
+	}
+
+	// Late answers for the dropped requests go nowhere
+	for _, id := range ids {
+		cli.respond(id, http.StatusOK, nil, []byte("too late"))
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := tun.Pending.Len(); n != 0 {
+		t.Errorf("late responses left %d pending entries", n)
+	}
+}
+
+func TestRemovedTunnelCutsStreamedResponse(t *testing.T) {
+	setForTest(t, &forwardTimeout, 10*time.Second)
+	srv := startTestServer(t)
+
+	bodyWriter := make(chan *io.PipeWriter, 1)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{Capabilities: allCapabilities}, func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.Write([]byte("first part"))
+			bodyWriter <- pw
+		}()
+		cli.respondStreamed(req.ID, http.StatusOK, nil, pr)
+	})
+	tun, _ := registry.Get(cli.ID)
+
+	resp, err := http.DefaultClient.Do(cli.newRequest(http.MethodGet, "/download", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	pw := <-bodyWriter
+	defer pw.Close()
+	first := make([]byte, len("first part"))
+	if _, err := io.ReadFull(resp.Body, first); err != nil {
+		t.Fatalf("reading the first chunk: %v", err)
+	}
+
+	// The visitor sees a cut-off body, not a complete-looking one, and
+	// doesn't wait out the timeout for it
+	start := time.Now()
+	registry.RemoveTunnel(tun)
+	if _, err := io.ReadAll(resp.Body); err == nil {
+		t.Error("body ended cleanly after the tunnel was removed")
+	}
+	if took := time.Since(start); took > 3*time.Second {
+		t.Errorf("body cut off after %s", took)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestCompressedResponsesReachVisitorsUntouched(t *testing.T) {
+	data := make([]byte, 64*1024)
+	rand.New(rand.NewSource(542)).Read(data)
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	encoded := buf.Bytes()
+
+	srv := startTestServer(t)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{Capabilities: allCapabilities}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		headers := http.Header{
+			"Content-Type":     {"application/octet-stream"},
+			"Content-Encoding": {"gzip"},
+			"Content-Length":   {strconv.Itoa(len(encoded))},
+		}
+		if req.Path == "/streamed" {
+			cli.respondStreamed(req.ID, http.StatusOK, headers, bytes.NewReader(encoded))
+		} else {
+			cli.respond(req.ID, http.StatusOK, headers, encoded)
+		}
+	})
+
+	// A client that leaves Content-Encoding alone, to see what was sent
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	for _, path := range []string{"/buffered", "/streamed"} {
+		for _, accept := range []string{"gzip", ""} {
+			req := cli.newRequest(http.MethodGet, path, nil)
+			if accept != "" {
+				req.Header.Set("Accept-Encoding", accept)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatalf("%s: %v", path, err)
+			}
+
+			if !bytes.Equal(body, encoded) {
+				t.Errorf("%s (Accept-Encoding %q): got %d bytes, want the CLI's %d untouched", path, accept, len(body), len(encoded))
+			}
+			if got := resp.Header.Values("Content-Encoding"); len(got) != 1 || got[0] != "gzip" {
+				t.Errorf("%s (Accept-Encoding %q): Content-Encoding %q, want gzip", path, accept, got)
+			}
+			if got := resp.Header.Get("Content-Length"); got != strconv.Itoa(len(encoded)) {
+				t.Errorf("%s (Accept-Encoding %q): Content-Length %q, want %d", path, accept, got, len(encoded))
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// The event hub fans tunnel events out to everyone following them: the
+// webhook, and gRPC StreamEvents calls (see grpcapi.go)
+
+// eventBuffer is how many events a subscriber may fall behind by before it
+// misses some
+const eventBuffer = 256
+
+// eventHub hands each event to every subscriber
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan WebhookEvent]bool // Channel -> wants request.forwarded events
+}
+
+var events = &eventHub{subs: make(map[chan WebhookEvent]bool)}
+
+// Subscribe returns a channel of events and a function that ends the
+// subscription; requests says whether to include request.forwarded events
+// A subscriber that doesn't keep up misses events rather than slowing
+// everyone else down.
+func (h *eventHub) Subscribe(requests bool) (<-chan WebhookEvent, func()) {
+	ch := make(chan WebhookEvent, eventBuffer)
+	h.mu.Lock()
+	h.subs[ch] = requests
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs, ch)
+		h.mu.Unlock()
+	}
+}
+
+// Publish sends event to the subscribers
+func (h *eventHub) Publish(event WebhookEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch, requests := range h.subs {
+		if event.Type == EventRequestForwarded && !requests {
+			continue
+		}
+		select {
+		case ch <- event:
+		default: // Too far behind, drop it
+		}
+	}
+}
+
+// publishEvent sends a tunnel event to the webhook and the hub's subscribers
+func publishEvent(event WebhookEvent) {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+	webhook.Notify(event)
+	events.Publish(event)
+}
+
+// publishRequestEvent is publishEvent for a request.forwarded event - the
+// webhook only gets those with WEBHOOK_REQUEST_EVENTS set
+func publishRequestEvent(event WebhookEvent) {
+	event.Type = EventRequestForwarded
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+	webhook.NotifyRequest(event)
+	events.Publish(event)
+}
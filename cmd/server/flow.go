@@ -0,0 +1,33 @@
+package main
+
+import (
+	"log"
+
+	"tunnelr/internal/tunnel"
+)
+
+// Flow control for streamed response bodies, see internal/tunnel/flow.go
+// The CLI sends a window of chunks and then waits for us to ack them. CLIs
+// that don't do flow control send as fast as they can and get no acks.
+
+// ackBodyChunk gives the CLI credit for one more chunk of a response body
+func ackBodyChunk(tun *tunnel.Tunnel, requestID string) {
+	sendBodyAck(tun, requestID, 1, false)
+}
+
+// stopBody tells the CLI we won't read the rest of a response body
+func stopBody(tun *tunnel.Tunnel, requestID string) {
+	sendBodyAck(tun, requestID, 0, true)
+}
+
+func sendBodyAck(tun *tunnel.Tunnel, requestID string, chunks int, stop bool) {
+	if !tun.Supports(tunnel.CapFlowControl) {
+		return
+	}
+	msgBytes, err := tunnel.EncodeBodyAck(tun.Codec(), requestID, chunks, stop)
+	if err != nil {
+		log.Printf("Failed to encode body ack: %v", err)
+		return
+	}
+	tun.Conn.Send(msgBytes) // If this fails the tunnel is going away anyway
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestSlowVisitorDoesNotStallTunnel(t *testing.T) {
+	srv := startTestServer(t)
+
+	// /big streams far more than a window, and notes how far it got
+	sent := make(chan int64, 1)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{Capabilities: allCapabilities},
+		func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+			if req.Path != "/big" {
+				cli.respond(req.ID, http.StatusOK, nil, []byte("fast"))
+				return
+			}
+			n, _ := cli.respondStreamed(req.ID, http.StatusOK, nil, io.LimitReader(zeros{}, 64<<20))
+			sent <- n
+		})
+
+	// A visitor that reads the headers and then nothing
+	resp, err := http.DefaultClient.Do(cli.newRequest(http.MethodGet, "/big", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Other requests on the same tunnel still get through right away
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		status, body := cli.get("/small")
+		if status != http.StatusOK || string(body) != "fast" {
+			t.Fatalf("got %d %q next to a stuck download", status, body)
+		}
+		if took := time.Since(start); took > 2*time.Second {
+			t.Fatalf("request took %s next to a stuck download", took)
+		}
+	}
+
+	// Leaving makes the server tell the CLI to stop. By then it was held
+	// to about a window plus what the sockets buffer, not the 64 MB.
+	resp.Body.Close()
+	select {
+	case n := <-sent:
+		if n >= 32<<20 {
+			t.Errorf("CLI sent %d bytes to a visitor that read none", n)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("CLI still sending after the visitor left")
+	}
+}
+
+func TestVisitorLeavingStopsStreamedResponse(t *testing.T) {
+	srv := startTestServer(t)
+	result := make(chan error, 1)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{Capabilities: allCapabilities},
+		func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+			_, err := cli.respondStreamed(req.ID, http.StatusOK, nil, io.LimitReader(zeros{}, 1<<30))
+			result <- err
+		})
+
+	resp, err := http.DefaultClient.Do(cli.newRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.CopyN(io.Discard, resp.Body, 1<<20)
+	resp.Body.Close()
+
+	select {
+	case err := <-result:
+		if err != tunnel.ErrStreamStopped {
+			t.Errorf("StreamBody returned %v, want ErrStreamStopped", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("CLI still sending after the visitor left")
+	}
+}
+
+func TestLegacyCLIOverflowFailsOnlyThatRequest(t *testing.T) {
+	srv := startTestServer(t)
+
+	// No flow control: the CLI sends as fast as the connection takes it
+	legacy := []string{tunnel.CapStreaming, tunnel.CapBinary}
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{Capabilities: legacy},
+		func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+			if req.Path != "/big" {
+				cli.respond(req.ID, http.StatusOK, nil, []byte("fast"))
+				return
+			}
+			cli.respondStreamed(req.ID, http.StatusOK, nil, io.LimitReader(zeros{}, 64<<20))
+		})
+
+	// The download overflows while the visitor isn't reading and is cut
+	// off, before or after its headers went out...
+	resp, err := http.DefaultClient.Do(cli.newRequest(http.MethodGet, "/big", nil))
+	if err == nil {
+		time.Sleep(500 * time.Millisecond)
+		_, err = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Error("overflowed download came through whole")
+	}
+
+	// ...while the tunnel keeps working
+	if status, body := cli.get("/small"); status != http.StatusOK || string(body) != "fast" {
+		t.Errorf("got %d %q after the overflow", status, body)
+	}
+}
+
+func TestUploadIsPacedByCLI(t *testing.T) {
+	srv := startTestServer(t)
+
+	// The local server reads the upload slowly
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{Capabilities: allCapabilities},
+		func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+			var total int
+			buf := make([]byte, 64*1024)
+			for {
+				n, err := body.Read(buf)
+				total += n
+				if err != nil {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+			cli.respond(req.ID, http.StatusOK, nil, []byte(http.StatusText(http.StatusOK)))
+			if total != 8<<20 {
+				t.Errorf("CLI read %d bytes of an 8 MB upload", total)
+			}
+		})
+
+	resp, err := http.DefaultClient.Do(cli.newRequest(http.MethodPost, "/upload", io.LimitReader(zeros{}, 8<<20)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("upload got %d", resp.StatusCode)
+	}
+}
+
+// zeros is an endless body
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestForwardedHostIsTheVisitorsHost(t *testing.T) {
+	srv := startTestServer(t)
+	forwarded := make(chan []string, 1)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		forwarded <- req.Headers.Values("X-Forwarded-Host")
+		cli.respond(req.ID, http.StatusOK, nil, nil)
+	})
+
+	// A value the visitor sent is replaced, not added to
+	req := cli.newRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Forwarded-Host", "spoofed.example")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	got := <-forwarded
+	if len(got) != 1 || got[0] != cli.ID+".localhost" {
+		t.Errorf("X-Forwarded-Host = %q, want only %q", got, cli.ID+".localhost")
+	}
+}
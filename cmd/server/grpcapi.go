@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+
+	"tunnelr/internal/adminrpc"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Optional gRPC control API - the same tunnel listing, stats and disconnects
+// as the /admin endpoints, plus a stream of events, for clients generated
+// from internal/adminrpc/admin.proto
+//
+// It's off unless GRPC_ADDR is set, and uses the admin tokens: calls send
+// "authorization: Bearer <token>" metadata, VIEWER_TOKEN can read and
+// ADMIN_TOKEN can also disconnect tunnels.
+
+// grpcAddr is where the gRPC API listens, e.g. ":9090" - empty = disabled
+var grpcAddr = getEnv("GRPC_ADDR", "")
+
+// grpcServer is the running gRPC server, nil when disabled
+var grpcServer *grpc.Server
+
+// grpcStopping is closed on shutdown so event streams end - graceful stop
+// waits for every call to return
+var grpcStopping = make(chan struct{})
+
+// startGRPCServer serves the gRPC API on GRPC_ADDR in the background, over
+// TLS if tlsConfig isn't nil
+func startGRPCServer(tlsConfig *tls.Config) error {
+	if adminToken == "" && viewerToken == "" {
+		return fmt.Errorf("GRPC_ADDR needs ADMIN_TOKEN or VIEWER_TOKEN to be set")
+	}
+	listener, err := net.Listen("tcp", grpcAddr)
+	if err != nil {
+		return fmt.Errorf("gRPC API: %v", err)
+	}
+
+	grpcServer = newGRPCServer(tlsConfig)
+	go func() {
+		if err := grpcServer.Serve(listener); err != nil {
+			log.Printf("gRPC API stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// newGRPCServer returns a gRPC server with the Admin service and the token
+// checks, over TLS if tlsConfig isn't nil
+func newGRPCServer(tlsConfig *tls.Config) *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(grpcUnaryAuth),
+		grpc.StreamInterceptor(grpcStreamAuth),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	s := grpc.NewServer(opts...)
+	adminrpc.RegisterAdminServer(s, adminService{})
+	return s
+}
+
+// stopGRPCServer ends the event streams and waits for other calls to finish
+func stopGRPCServer() {
+	if grpcServer == nil {
+		return
+	}
+	close(grpcStopping)
+	grpcServer.GracefulStop()
+}
+
+// grpcMethodRoles is the role each method needs, anything not listed needs
+// the viewer token
+var grpcMethodRoles = map[string]role{
+	adminrpc.Admin_Disconnect_FullMethodName: roleAdmin,
+}
+
+// grpcAuthorize checks a call's bearer token against the role its method needs
+func grpcAuthorize(ctx context.Context, method string) error {
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if auth := md.Get("authorization"); len(auth) > 0 {
+			token = parseBearer(auth[0])
+		}
+	}
+
+	got := roleForToken(token)
+	if got == roleNone {
+		return status.Error(codes.Unauthenticated, "missing or invalid bearer token")
+	}
+	min, ok := grpcMethodRoles[method]
+	if !ok {
+		min = roleViewer
+	}
+	if got < min {
+		return status.Error(codes.PermissionDenied, "this call needs the admin token")
+	}
+	return nil
+}
+
+func grpcUnaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := grpcAuthorize(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func grpcStreamAuth(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := grpcAuthorize(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// adminService implements the Admin service on the server's registry
+type adminService struct {
+	adminrpc.UnimplementedAdminServer
+}
+
+func (adminService) ListTunnels(ctx context.Context, req *adminrpc.ListTunnelsRequest) (*adminrpc.ListTunnelsResponse, error) {
+	resp := &adminrpc.ListTunnelsResponse{}
+	for _, t := range registry.List() {
+		resp.Tunnels = append(resp.Tunnels, &adminrpc.Tunnel{
+			Id:          t.ID,
+			LocalPort:   int32(t.LocalPort),
+			LocalHost:   t.LocalHost,
+			PublicUrl:   publicURLFor(t.ID),
+			ConnectedAt: timestamppb.New(t.CreatedAt),
+			RemoteAddr:  t.RemoteAddr,
+		})
+	}
+	return resp, nil
+}
+
+func (adminService) GetStats(ctx context.Context, req *adminrpc.GetStatsRequest) (*adminrpc.Stats, error) {
+	return &adminrpc.Stats{
+		Version:           versionString(),
+		ActiveTunnels:     int64(registry.Count()),
+		RequestsForwarded: metrics.requestsForwarded.Load(),
+		RequestsCoalesced: metrics.requestsCoalesced.Load(),
+		CacheHits:         metrics.cacheHits.Load(),
+		RequestTimeouts:   metrics.requestTimeouts.Load(),
+		RateLimited:       metrics.rateLimited.Load(),
+		OverloadFallbacks: metrics.overloadFallbacks.Load(),
+		RequestsShed:      metrics.requestsShed.Load(),
+		SlowRequests:      metrics.slowRequests.Load(),
+		IdleTunnelsClosed: metrics.idleTunnelsClosed.Load(),
+	}, nil
+}
+
+// Disconnect closes a tunnel like DELETE /admin/tunnels/<id>
+func (adminService) Disconnect(ctx context.Context, req *adminrpc.DisconnectRequest) (*adminrpc.DisconnectResponse, error) {
+	if !disconnectTunnel(req.TunnelId, req.Reason, "gRPC API") {
+		return nil, status.Errorf(codes.NotFound, "tunnel %q not found", req.TunnelId)
+	}
+	return &adminrpc.DisconnectResponse{}, nil
+}
+
+// StreamEvents sends events as they happen until the client hangs up or the
+// server shuts down
+func (adminService) StreamEvents(req *adminrpc.StreamEventsRequest, stream adminrpc.Admin_StreamEventsServer) error {
+	ch, cancel := events.Subscribe(req.IncludeRequests)
+	defer cancel()
+
+	for {
+		select {
+		case event := <-ch:
+			if err := stream.Send(rpcEvent(event)); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		case <-grpcStopping:
+			return status.Error(codes.Unavailable, "server shutting down")
+		}
+	}
+}
+
+// rpcEvent converts a hub event to its gRPC message
+func rpcEvent(e WebhookEvent) *adminrpc.Event {
+	return &adminrpc.Event{
+		Type:       e.Type,
+		TunnelId:   e.TunnelID,
+		Timestamp:  timestamppb.New(e.Timestamp),
+		LocalPort:  int32(e.LocalPort),
+		RemoteAddr: e.RemoteAddr,
+		Method:     e.Method,
+		Path:       e.Path,
+		StatusCode: int32(e.StatusCode),
+		DurationMs: e.DurationMs,
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"tunnelr/internal/adminrpc"
+	"tunnelr/internal/tunnel"
+)
+
+// grpcClient calls the gRPC API over an in-memory connection
+type grpcClient struct {
+	adminrpc.AdminClient
+	t *testing.T
+}
+
+// startGRPCTest serves the gRPC API the way startGRPCServer does, on an
+// in-memory listener
+func startGRPCTest(t *testing.T) *grpcClient {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	s := newGRPCServer(nil)
+	go s.Serve(listener)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &grpcClient{AdminClient: adminrpc.NewAdminClient(conn), t: t}
+}
+
+// streamEvents starts a StreamEvents call, and waits until the server is
+// subscribed to the event hub
+func (c *grpcClient) streamEvents(ctx context.Context, token string, includeRequests bool) adminrpc.Admin_StreamEventsClient {
+	c.t.Helper()
+	before := subscriberCount()
+	ctx = metadata.NewOutgoingContext(ctx, metadata.Pairs("authorization", "Bearer "+token))
+	stream, err := c.StreamEvents(ctx, &adminrpc.StreamEventsRequest{IncludeRequests: includeRequests})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for subscriberCount() == before {
+		if time.Now().After(deadline) {
+			c.t.Fatal("StreamEvents never subscribed to the event hub")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return stream
+}
+
+// nextEvent returns the next event on stream about tunnelID, skipping events
+// of tunnels left over from other tests
+func nextEvent(t *testing.T, stream adminrpc.Admin_StreamEventsClient, tunnelID string) *adminrpc.Event {
+	t.Helper()
+	for {
+		event, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("waiting for an event about %s: %v", tunnelID, err)
+		}
+		if event.TunnelId == tunnelID {
+			return event
+		}
+	}
+}
+
+func withToken(token string) context.Context {
+	ctx := context.Background()
+	if token == "" {
+		return ctx
+	}
+	return metadata.NewOutgoingContext(ctx, metadata.Pairs("authorization", "Bearer "+token))
+}
+
+func subscriberCount() int {
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	return len(events.subs)
+}
+
+func TestGRPCListTunnelsAndStats(t *testing.T) {
+	setForTest(t, &viewerToken, "viewer-secret")
+	srv := startTestServer(t)
+	client := startGRPCTest(t)
+	before := time.Now().Add(-time.Second)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{LocalPort: 8538}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		cli.respond(req.ID, http.StatusOK, nil, nil)
+	})
+
+	list, err := client.ListTunnels(withToken("viewer-secret"), &adminrpc.ListTunnelsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ours *adminrpc.Tunnel
+	for _, tun := range list.Tunnels {
+		if tun.Id == cli.ID {
+			ours = tun
+		}
+	}
+	if ours == nil {
+		t.Fatalf("tunnel %s not in %d listed", cli.ID, len(list.Tunnels))
+	}
+	if ours.LocalPort != 8538 || ours.PublicUrl != publicURLFor(cli.ID) || ours.RemoteAddr == "" {
+		t.Errorf("got %v", ours)
+	}
+	if connected := ours.ConnectedAt.AsTime(); connected.Before(before) || connected.After(time.Now()) {
+		t.Errorf("ConnectedAt = %v, want the registration time", connected)
+	}
+
+	// Stats come from the same counters as /health
+	cli.get("/")
+	stats, err := client.GetStats(withToken("viewer-secret"), &adminrpc.GetStatsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Version != versionString() || stats.ActiveTunnels != int64(registry.Count()) || stats.ActiveTunnels < 1 {
+		t.Errorf("got %v", stats)
+	}
+	if stats.RequestsForwarded < 1 || stats.RequestsForwarded > metrics.requestsForwarded.Load() {
+		t.Errorf("RequestsForwarded = %d, counter is %d", stats.RequestsForwarded, metrics.requestsForwarded.Load())
+	}
+}
+
+func TestGRPCDisconnect(t *testing.T) {
+	setForTest(t, &adminToken, "admin-secret")
+	setForTest(t, &viewerToken, "viewer-secret")
+	srv := startTestServer(t)
+	client := startGRPCTest(t)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, nil)
+
+	req := &adminrpc.DisconnectRequest{TunnelId: cli.ID, Reason: "moving house"}
+	tests := []struct {
+		token string
+		want  codes.Code
+	}{
+		{"", codes.Unauthenticated},
+		{"wrong", codes.Unauthenticated},
+		{"viewer-secret", codes.PermissionDenied},
+	}
+	for _, tc := range tests {
+		_, err := client.Disconnect(withToken(tc.token), req)
+		if got := status.Code(err); got != tc.want {
+			t.Errorf("%q: got %s, want %s", tc.token, got, tc.want)
+		}
+	}
+	if _, ok := registry.Get(cli.ID); !ok {
+		t.Fatal("tunnel disconnected without the admin token")
+	}
+
+	if _, err := client.Disconnect(withToken("admin-secret"), req); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := registry.Get(cli.ID); ok {
+		t.Error("tunnel still registered after Disconnect")
+	}
+	_, err := client.Disconnect(withToken("admin-secret"), req)
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("disconnecting it again got %v, want NotFound", err)
+	}
+}
+
+func TestGRPCStreamEvents(t *testing.T) {
+	setForTest(t, &viewerToken, "viewer-secret")
+	srv := startTestServer(t)
+	client := startGRPCTest(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	everything := client.streamEvents(ctx, "viewer-secret", true)
+	tunnelsOnly := client.streamEvents(ctx, "viewer-secret", false)
+
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{LocalPort: 8539}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		cli.respond(req.ID, http.StatusTeapot, nil, nil)
+	})
+	cli.get("/brew")
+	disconnectTunnel(cli.ID, "", "test")
+
+	// Registered, the request, disconnected - in that order
+	event := nextEvent(t, everything, cli.ID)
+	if event.Type != EventTunnelRegistered || event.LocalPort != 8539 || event.Timestamp.AsTime().IsZero() {
+		t.Errorf("first event %v, want the registration", event)
+	}
+	event = nextEvent(t, everything, cli.ID)
+	if event.Type != EventRequestForwarded || event.Method != http.MethodGet || event.Path != "/brew" || event.StatusCode != http.StatusTeapot {
+		t.Errorf("second event %v, want the request", event)
+	}
+	if event = nextEvent(t, everything, cli.ID); event.Type != EventTunnelDisconnected {
+		t.Errorf("third event %v, want the disconnect", event)
+	}
+
+	// Without IncludeRequests the request isn't sent
+	if event = nextEvent(t, tunnelsOnly, cli.ID); event.Type != EventTunnelRegistered {
+		t.Errorf("first event %v, want the registration", event)
+	}
+	if event = nextEvent(t, tunnelsOnly, cli.ID); event.Type != EventTunnelDisconnected {
+		t.Errorf("second event %v, want the disconnect", event)
+	}
+}
+
+func TestGRPCStreamEventsEnds(t *testing.T) {
+	setForTest(t, &viewerToken, "viewer-secret")
+	client := startGRPCTest(t)
+
+	// The client hanging up ends the subscription
+	before := subscriberCount()
+	ctx, cancel := context.WithCancel(context.Background())
+	client.streamEvents(ctx, "viewer-secret", false)
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for subscriberCount() != before && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if subscriberCount() != before {
+		t.Error("subscription left behind after the client hung up")
+	}
+
+	// Shutting down ends it with Unavailable
+	setForTest(t, &grpcStopping, make(chan struct{}))
+	stream := client.streamEvents(context.Background(), "viewer-secret", false)
+	close(grpcStopping)
+	for {
+		if _, err := stream.Recv(); err != nil {
+			if status.Code(err) != codes.Unavailable {
+				t.Errorf("stream ended with %v, want Unavailable", err)
+			}
+			break
+		}
+	}
+
+	// And it needs a token like the rest
+	stream, err := client.StreamEvents(context.Background(), &adminrpc.StreamEventsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("without a token got %v, want Unauthenticated", err)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestH2CUpgradeIsDroppedAndServedAsHTTP1(t *testing.T) {
+	srv := startTestServer(t)
+	seen := make(chan http.Header, 1)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{Capabilities: allCapabilities},
+		func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+			seen <- req.Headers
+			cli.respond(req.ID, http.StatusOK, nil, []byte("plain http/1.1"))
+		})
+
+	req := cli.newRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Connection", "Upgrade, HTTP2-Settings")
+	req.Header.Set("Upgrade", "h2c")
+	req.Header.Set("HTTP2-Settings", "AAMAAABkAARAAAAAAAIAAAAA")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != "plain http/1.1" {
+		t.Errorf("got %d %q, want the HTTP/1.1 answer", resp.StatusCode, body)
+	}
+	headers := <-seen
+	for _, name := range []string{"Upgrade", "Http2-Settings"} {
+		if v := headers.Get(name); v != "" {
+			t.Errorf("local server got %s: %q", name, v)
+		}
+	}
+}
+
+func TestH2CPriorKnowledgeIsRefused(t *testing.T) {
+	srv := startTestServer(t)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{Capabilities: allCapabilities},
+		func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+			t.Errorf("h2c request reached the CLI: %s %s", req.Method, req.Path)
+			cli.respond(req.ID, http.StatusOK, nil, nil)
+		})
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// The HTTP/2 connection preface, as sent by gRPC clients using h2c
+	io.WriteString(conn, "PRI * HTTP/2.0\r\nHost: "+cli.ID+".localhost\r\n\r\nSM\r\n\r\n")
+
+	// A clear answer instead of a hang (reading would time out). Go's
+	// HTTP/1 server answers the bare preface itself with a 400, anything
+	// that reaches handleRequest as HTTP/2 gets our 505.
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("no answer to the h2c preface: %v", err)
+	}
+	if !strings.Contains(line, " 505 ") && !strings.Contains(line, " 400 ") {
+		t.Errorf("got %q, want a 400 or 505 refusal", strings.TrimSpace(line))
+	}
+}
+
+func TestDropH2CUpgrade(t *testing.T) {
+	tests := []struct {
+		name           string
+		header         http.Header
+		dropped        bool
+		wantConnection string
+	}{
+		{
+			name: "h2c offer",
+			header: http.Header{
+				"Upgrade":        {"h2c"},
+				"Http2-Settings": {"AAMAAABkAAQCAAAAAAIAAAAA"},
+				"Connection":     {"Upgrade, HTTP2-Settings, keep-alive"},
+			},
+			dropped:        true,
+			wantConnection: "keep-alive",
+		},
+		{
+			name:    "WebSocket upgrade is left alone",
+			header:  http.Header{"Upgrade": {"websocket"}, "Connection": {"Upgrade"}},
+			dropped: false,
+			// Untouched
+			wantConnection: "Upgrade",
+		},
+		{
+			name:           "no upgrade",
+			header:         http.Header{"Connection": {"close"}},
+			wantConnection: "close",
+		},
+	}
+	for _, tc := range tests {
+		if got := dropH2CUpgrade(tc.header); got != tc.dropped {
+			t.Errorf("%s: dropH2CUpgrade = %v, want %v", tc.name, got, tc.dropped)
+		}
+		if got := tc.header.Get("Connection"); got != tc.wantConnection {
+			t.Errorf("%s: Connection = %q, want %q", tc.name, got, tc.wantConnection)
+		}
+		if tc.dropped && (tc.header.Get("Upgrade") != "" || tc.header.Get("Http2-Settings") != "") {
+			t.Errorf("%s: h2c headers left: %v", tc.name, tc.header)
+		}
+	}
+}
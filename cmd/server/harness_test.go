@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunnelr/internal/tunnel"
+)
+
+// A test harness for requests going through a tunnel: the server's handlers
+// on a local port, and a fake CLI that registers over a real WebSocket and
+// answers requests the way the test tells it to.
+
+// startTestServer serves everything main does
+func startTestServer(t testing.TB) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(newMux())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// fakeHandler answers one request sent through the tunnel
+// body is the request body, streamed or not.
+type fakeHandler func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader)
+
+// fakeCLI is a tunnel client run by a test
+type fakeCLI struct {
+	t       *testing.T
+	srv     *httptest.Server
+	conn    *tunnel.SafeConn
+	ID      string
+	codec   tunnel.Codec
+	paced   bool // Flow control was agreed on
+	windows *tunnel.SendWindows
+	handle  fakeHandler
+
+	// onMessage, if set before the first message, gets every message type
+	// the harness doesn't handle itself (WebSocket frames...)
+	onMessage func(cli *fakeCLI, msg *tunnel.Message)
+
+	mu     sync.Mutex
+	bodies map[string]chan *tunnel.BodyChunk
+}
+
+// allCapabilities is what an up-to-date CLI asks for
+var allCapabilities = tunnel.SupportedCapabilities
+
+// startFakeCLI registers a tunnel on srv and answers its requests with handle
+func startFakeCLI(t *testing.T, srv *httptest.Server, reg tunnel.TunnelRegister, handle fakeHandler) *fakeCLI {
+	t.Helper()
+	return startFakeCLIVia(t, srv, websocket.DefaultDialer, reg, handle)
+}
+
+// startFakeCLIVia is startFakeCLI with the WebSocket opened by dialer
+func startFakeCLIVia(t *testing.T, srv *httptest.Server, dialer *websocket.Dialer, reg tunnel.TunnelRegister, handle fakeHandler) *fakeCLI {
+	t.Helper()
+	assigned, conn, err := registerFakeCLIVia(srv, dialer, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cli := &fakeCLI{
+		t:       t,
+		srv:     srv,
+		conn:    conn,
+		ID:      assigned.TunnelID,
+		codec:   tunnel.NewCodec(assigned.Capabilities),
+		paced:   tunnel.HasCapability(assigned.Capabilities, tunnel.CapFlowControl),
+		windows: tunnel.NewSendWindows(),
+		handle:  handle,
+		bodies:  make(map[string]chan *tunnel.BodyChunk),
+	}
+	go cli.readLoop()
+	t.Cleanup(func() { conn.Close() })
+	return cli
+}
+
+// registerFakeCLI opens a tunnel connection and registers
+// A refused registration comes back as a *refusedError.
+func registerFakeCLI(srv *httptest.Server, reg tunnel.TunnelRegister) (*tunnel.TunnelAssigned, *tunnel.SafeConn, error) {
+	return registerFakeCLIVia(srv, websocket.DefaultDialer, reg)
+}
+
+// registerFakeCLIVia is registerFakeCLI with the WebSocket opened by dialer
+func registerFakeCLIVia(srv *httptest.Server, dialer *websocket.Dialer, reg tunnel.TunnelRegister) (*tunnel.TunnelAssigned, *tunnel.SafeConn, error) {
+	wsConn, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn := tunnel.NewSafeConn(wsConn, tunnel.CompressionConfig{})
+
+	if reg.ProtocolVersion == 0 {
+		reg.ProtocolVersion = tunnel.ProtocolVersion
+	}
+	if reg.LocalPort == 0 {
+		reg.LocalPort = 3000
+	}
+	msgBytes, err := tunnel.Encode(tunnel.TypeTunnelRegister, reg)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if err := conn.Send(msgBytes); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	_, reply, err := conn.ReadMessage()
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	msg, err := tunnel.DecodeMessage(reply)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if msg.Type == tunnel.TypeTunnelError {
+		var refused refusedError
+		msg.Unmarshal(&refused.TunnelError)
+		// Keep the close frame, if the server sent one after the error
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if closeErr, ok := err.(*websocket.CloseError); ok && closeErr.Code != websocket.CloseAbnormalClosure {
+				refused.Close = closeErr
+			}
+		}
+		conn.Close()
+		return nil, nil, &refused
+	}
+	var assigned tunnel.TunnelAssigned
+	if err := msg.Unmarshal(&assigned); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return &assigned, conn, nil
+}
+
+// refusedError is the server's TypeTunnelError answer to a registration
+type refusedError struct {
+	tunnel.TunnelError
+	Close *websocket.CloseError // The close frame that followed, nil if the connection was just dropped
+}
+
+func (e *refusedError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func (c *fakeCLI) readLoop() {
+	defer c.windows.StopAll()
+	for {
+		_, msgBytes, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		msg, err := tunnel.DecodeMessage(msgBytes)
+		if err != nil {
+			c.t.Errorf("fake CLI got an invalid message: %v", err)
+			continue
+		}
+		if err := msg.Decompress(); err != nil {
+			c.t.Errorf("fake CLI got an invalid compressed message: %v", err)
+			continue
+		}
+
+		switch msg.Type {
+		case tunnel.TypeHTTPRequest:
+			var req tunnel.HTTPRequest
+			msg.Unmarshal(&req)
+			tunnel.RestoreRawHeaders(req.Headers, req.RawHeaders)
+			var body io.Reader = bytes.NewReader(req.Body)
+			if req.Streamed {
+				body = c.startBody(req.ID)
+			}
+			go c.handle(c, &req, body)
+
+		case tunnel.TypeBodyChunk:
+			var chunk tunnel.BodyChunk
+			msg.Unmarshal(&chunk)
+			c.mu.Lock()
+			chunks, exists := c.bodies[chunk.ID]
+			if chunk.EOF {
+				delete(c.bodies, chunk.ID)
+			}
+			c.mu.Unlock()
+			if !exists {
+				continue
+			}
+			select {
+			case chunks <- &chunk:
+			default:
+				c.t.Errorf("server sent more of %s's body than the window allows", chunk.ID)
+			}
+			if chunk.EOF {
+				close(chunks)
+			}
+
+		case tunnel.TypeBodyAck:
+			var ack tunnel.BodyAck
+			msg.Unmarshal(&ack)
+			c.windows.Ack(ack)
+
+		default:
+			if c.onMessage != nil {
+				c.onMessage(c, &msg)
+			}
+		}
+	}
+}
+
+// startBody feeds a streamed request body into a pipe, acking each chunk
+// once the handler has read it
+func (c *fakeCLI) startBody(requestID string) io.Reader {
+	chunks := make(chan *tunnel.BodyChunk, tunnel.ChunkQueueSize)
+	c.mu.Lock()
+	c.bodies[requestID] = chunks
+	c.mu.Unlock()
+
+	pr, pw := io.Pipe()
+	go func() {
+		var err error
+		for chunk := range chunks {
+			if err == nil && len(chunk.Data) > 0 {
+				if _, err = pw.Write(chunk.Data); err == nil {
+					c.ack(requestID, 1, false)
+				} else {
+					c.ack(requestID, 0, true)
+				}
+			}
+			if err == nil && chunk.Error != "" {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+func (c *fakeCLI) ack(requestID string, chunks int, stop bool) {
+	if !c.paced {
+		return
+	}
+	msgBytes, _ := tunnel.EncodeBodyAck(c.codec, requestID, chunks, stop)
+	c.conn.Send(msgBytes)
+}
+
+// respond answers a request in a single message
+func (c *fakeCLI) respond(requestID string, status int, headers http.Header, body []byte) {
+	if headers == nil {
+		headers = http.Header{}
+	}
+	msgBytes, err := c.codec.Encode(tunnel.TypeHTTPResponse, tunnel.HTTPResponse{
+		ID:         requestID,
+		StatusCode: status,
+		Headers:    headers,
+		Body:       body,
+		RawHeaders: tunnel.SplitRawHeaders(headers),
+	})
+	if err != nil {
+		c.t.Errorf("encoding response: %v", err)
+		return
+	}
+	c.conn.Send(msgBytes)
+}
+
+// respondStreamed answers a request with a streamed body, paced by the
+// server's acks if flow control was agreed on
+// Returns what tunnel.StreamBody returned.
+func (c *fakeCLI) respondStreamed(requestID string, status int, headers http.Header, body io.Reader) (int64, error) {
+	if headers == nil {
+		headers = http.Header{}
+	}
+	msgBytes, err := c.codec.Encode(tunnel.TypeHTTPResponse, tunnel.HTTPResponse{
+		ID:         requestID,
+		StatusCode: status,
+		Headers:    headers,
+		Streamed:   true,
+		RawHeaders: tunnel.SplitRawHeaders(headers),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := c.conn.Send(msgBytes); err != nil {
+		return 0, err
+	}
+
+	var window *tunnel.SendWindow
+	if c.paced {
+		window = c.windows.Open(requestID, 0)
+		defer c.windows.Close(requestID)
+	}
+	return tunnel.StreamBody(c.conn.Send, requestID, nil, body, c.codec, window)
+}
+
+// newRequest builds a visitor request to path on the tunnel
+func (c *fakeCLI) newRequest(method, path string, body io.Reader) *http.Request {
+	c.t.Helper()
+	req, err := http.NewRequest(method, c.srv.URL+path, body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Host = c.ID + ".localhost"
+	return req
+}
+
+// get sends a visitor GET and returns the status and body
+func (c *fakeCLI) get(path string) (int, []byte) {
+	c.t.Helper()
+	resp, err := http.DefaultClient.Do(c.newRequest(http.MethodGet, path, nil))
+	if err != nil {
+		c.t.Fatalf("GET %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatalf("GET %s: reading body: %v", path, err)
+	}
+	return resp.StatusCode, body
+}
+
+// logBuffer collects log output; goroutines left over from other tests may
+// still be logging, hence the lock
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (b *logBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+}
+
+// captureLog collects everything logged until the test ends
+func captureLog(t testing.TB) *logBuffer {
+	t.Helper()
+	buf := &logBuffer{}
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return buf
+}
+
+// setForTest changes a config variable until the test ends
+func setForTest[T any](t *testing.T, v *T, value T) {
+	t.Helper()
+	old := *v
+	*v = value
+	t.Cleanup(func() { *v = old })
+}
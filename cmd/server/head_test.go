@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestHeadResponsesHaveNoBody(t *testing.T) {
+	srv := startTestServer(t)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{Capabilities: allCapabilities}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		if req.Method == http.MethodGet {
+			cli.respond(req.ID, http.StatusOK, nil, []byte("ok"))
+			return
+		}
+		headers := http.Header{"Content-Length": {"5000"}, "Content-Type": {"text/html"}}
+		switch req.Path {
+		case "/buffered":
+			// Even a CLI that wrongly sends a body mustn't get it written
+			cli.respond(req.ID, http.StatusOK, headers, []byte(strings.Repeat("x", 5000)))
+		case "/streamed":
+			cli.respondStreamed(req.ID, http.StatusOK, headers, strings.NewReader(strings.Repeat("x", 5000)))
+		default:
+			cli.respond(req.ID, http.StatusOK, headers, nil)
+		}
+	})
+
+	for _, path := range []string{"/", "/buffered", "/streamed"} {
+		resp, err := http.DefaultClient.Do(cli.newRequest(http.MethodHead, path, nil))
+		if err != nil {
+			t.Fatalf("HEAD %s: %v", path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || len(body) != 0 {
+			t.Errorf("HEAD %s: got %d with %d body bytes, want 200 and none", path, resp.StatusCode, len(body))
+		}
+		if resp.ContentLength != 5000 || resp.Header.Get("Content-Type") != "text/html" {
+			t.Errorf("HEAD %s: Content-Length %d, Content-Type %q, want the GET's headers", path, resp.ContentLength, resp.Header.Get("Content-Type"))
+		}
+	}
+
+	// The connection is still usable after the HEADs - no stray body bytes
+	// were left on it
+	if status, body := cli.get("/"); status != http.StatusOK || string(body) != "ok" {
+		t.Errorf("GET after the HEADs got %d %q", status, body)
+	}
+}
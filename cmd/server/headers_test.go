@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestSetCookieValuesSurviveTheTunnel(t *testing.T) {
+	srv := startTestServer(t)
+	cookies := http.Header{"Set-Cookie": {
+		"session=abc123; Path=/; HttpOnly",
+		"theme=dark; Path=/; Max-Age=3600",
+	}}
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{Capabilities: allCapabilities},
+		func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+			if req.Path == "/streamed" {
+				cli.respondStreamed(req.ID, http.StatusOK, cookies.Clone(), bytes.NewReader([]byte("ok")))
+				return
+			}
+			cli.respond(req.ID, http.StatusOK, cookies.Clone(), []byte("ok"))
+		})
+
+	for _, path := range []string{"/", "/streamed"} {
+		resp, err := http.DefaultClient.Do(cli.newRequest(http.MethodGet, path, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		got := resp.Header.Values("Set-Cookie")
+		if len(got) != 2 || got[0] != cookies["Set-Cookie"][0] || got[1] != cookies["Set-Cookie"][1] {
+			t.Errorf("%s: Set-Cookie = %q, want both cookies as separate lines", path, got)
+		}
+		parsed := resp.Cookies()
+		if len(parsed) != 2 || parsed[0].Name != "session" || parsed[1].Name != "theme" {
+			t.Errorf("%s: the browser would see cookies %v", path, parsed)
+		}
+	}
+}
+
+func TestRepeatedRequestHeadersReachTheCLI(t *testing.T) {
+	srv := startTestServer(t)
+	got := make(chan http.Header, 1)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+		got <- req.Headers
+		cli.respond(req.ID, http.StatusOK, nil, nil)
+	})
+
+	req := cli.newRequest(http.MethodGet, "/", nil)
+	req.Header.Add("Accept-Language", "en")
+	req.Header.Add("Accept-Language", "de;q=0.5")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if values := (<-got).Values("Accept-Language"); len(values) != 2 || values[0] != "en" || values[1] != "de;q=0.5" {
+		t.Errorf("CLI got Accept-Language %q, want both values", values)
+	}
+}
+
+func TestInvalidUTF8HeadersSurviveTheTunnel(t *testing.T) {
+	srv := startTestServer(t)
+	latin1 := "attachment; filename=\"r\xe9sum\xe9.pdf\""
+	got := make(chan string, 1)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{Capabilities: allCapabilities},
+		func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+			got <- req.Headers.Get("X-File-Name")
+			cli.respond(req.ID, http.StatusOK, http.Header{"Content-Disposition": {latin1}}, []byte("ok"))
+		})
+
+	req := cli.newRequest(http.MethodGet, "/download", nil)
+	req.Header.Set("X-File-Name", "caf\xe9")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// Byte for byte both ways, not with U+FFFD in place of the é
+	if v := <-got; v != "caf\xe9" {
+		t.Errorf("CLI got X-File-Name %q, want %q", v, "caf\xe9")
+	}
+	if v := resp.Header.Get("Content-Disposition"); v != latin1 {
+		t.Errorf("visitor got Content-Disposition %q, want %q", v, latin1)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestTimeoutRateWarningFires(t *testing.T) {
+	logs := captureLog(t)
+	tun := &tunnel.Tunnel{ID: "slowpoke", Timeouts: tunnel.NewTimeoutWindow(4)}
+	before := metrics.timeoutRateWarnings.Load()
+
+	for _, timedOut := range []bool{false, true, true, true} {
+		recordTimeoutOutcome(tun, timedOut)
+	}
+	if !strings.Contains(logs.String(), "WARNING: tunnel slowpoke is timing out on 75% of recent requests") {
+		t.Errorf("no warning logged:\n%s", logs.String())
+	}
+	if got := metrics.timeoutRateWarnings.Load() - before; got != 1 {
+		t.Errorf("timeout_rate_warnings went up by %d, want 1", got)
+	}
+
+	// Staying unhealthy doesn't warn again, recovering is logged once
+	logs.Reset()
+	for _, timedOut := range []bool{true, false, false, false} {
+		recordTimeoutOutcome(tun, timedOut)
+	}
+	if strings.Count(logs.String(), "WARNING") != 0 || strings.Count(logs.String(), "recovered") != 1 {
+		t.Errorf("expected exactly one recovery line:\n%s", logs.String())
+	}
+	if got := metrics.timeoutRateWarnings.Load() - before; got != 1 {
+		t.Errorf("timeout_rate_warnings went up by %d, want 1", got)
+	}
+}
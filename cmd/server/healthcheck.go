@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"tunnelr/internal/tunnel"
+)
+
+// Health-check traffic - load balancers and uptime monitors poll tunnels all
+// day long. Those requests are still forwarded and answered, but they're left
+// out of the access log and the traffic counters so they don't drown out
+// real requests.
+//
+// A request counts as a health check if its path (after the tunnel prefix) is
+// in HEALTHCHECK_PATHS, its User-Agent contains one of HEALTHCHECK_USER_AGENTS,
+// or it carries the HEALTHCHECK_HEADER header. Set a variable to "none" to
+// turn that kind of detection off.
+var (
+	healthCheckPaths      = parseHealthCheckList(getEnv("HEALTHCHECK_PATHS", "/health,/healthz"))
+	healthCheckUserAgents = parseHealthCheckList(getEnv("HEALTHCHECK_USER_AGENTS", "ELB-HealthChecker,kube-probe,GoogleHC,UptimeRobot,Pingdom"))
+	healthCheckHeader     = getEnv("HEALTHCHECK_HEADER", "X-Health-Check")
+)
+
+// parseHealthCheckList splits a comma-separated list, dropping blanks
+// "none" gives an empty list
+func parseHealthCheckList(value string) []string {
+	if strings.EqualFold(strings.TrimSpace(value), "none") {
+		return nil
+	}
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// isHealthCheck reports whether a tunnel request looks like a health check
+func isHealthCheck(r *http.Request, forwardPath string) bool {
+	// Match on the path alone, ignoring any query string
+	path := forwardPath
+	if idx := strings.Index(path, "?"); idx != -1 {
+		path = path[:idx]
+	}
+	for _, p := range healthCheckPaths {
+		if path == p {
+			return true
+		}
+	}
+
+	userAgent := strings.ToLower(r.UserAgent())
+	for _, ua := range healthCheckUserAgents {
+		if strings.Contains(userAgent, strings.ToLower(ua)) {
+			return true
+		}
+	}
+
+	return healthCheckHeader != "none" && r.Header.Get(healthCheckHeader) != ""
+}
+
+// discardStats soaks up the counters of health-check requests
+var discardStats tunnel.TunnelStats
+
+// trafficStats returns the counters a request should update: the tunnel's
+// own, or a throwaway set for health checks
+func trafficStats(tun *tunnel.Tunnel, healthCheck bool) *tunnel.TunnelStats {
+	if healthCheck {
+		return &discardStats
+	}
+	return &tun.Stats
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestHealthChecksAreAnsweredButNotCounted(t *testing.T) {
+	accessLog := captureLog(t)
+	srv := startTestServer(t)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+		cli.respond(req.ID, http.StatusOK, nil, []byte("up"))
+	})
+	tun, _ := registry.Get(cli.ID)
+
+	healthChecksBefore := metrics.healthChecks.Load()
+	forwardedBefore := metrics.requestsForwarded.Load()
+
+	checks := []*http.Request{
+		cli.newRequest(http.MethodGet, "/health", nil),
+		cli.newRequest(http.MethodGet, "/healthz?full=1", nil),
+		cli.newRequest(http.MethodGet, "/", nil),
+		cli.newRequest(http.MethodGet, "/status", nil),
+	}
+	checks[2].Header.Set("User-Agent", "kube-probe/1.29")
+	checks[3].Header.Set("X-Health-Check", "1")
+
+	for _, req := range checks {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "up" {
+			t.Errorf("%s got %d %q, health checks are still answered", req.URL.Path, resp.StatusCode, body)
+		}
+	}
+
+	if got := tun.Stats.Requests.Load(); got != 0 {
+		t.Errorf("tunnel counted %d requests from health checks", got)
+	}
+	if got := tun.Stats.BytesOut.Load(); got != 0 {
+		t.Errorf("tunnel counted %d bytes out from health checks", got)
+	}
+	if got := metrics.healthChecks.Load() - healthChecksBefore; got != int64(len(checks)) {
+		t.Errorf("health_checks went up by %d, want %d", got, len(checks))
+	}
+	if got := metrics.requestsForwarded.Load() - forwardedBefore; got != 0 {
+		t.Errorf("requests_forwarded went up by %d for health checks", got)
+	}
+	if strings.Contains(accessLog.String(), cli.ID+" GET") {
+		t.Errorf("health checks were access-logged:\n%s", accessLog.String())
+	}
+
+	// Real traffic still counts
+	cli.get("/page")
+	if got := tun.Stats.Requests.Load(); got != 1 {
+		t.Errorf("tunnel counted %d requests after a real one, want 1", got)
+	}
+	if !strings.Contains(accessLog.String(), cli.ID+" GET /page") {
+		t.Error("real request wasn't access-logged")
+	}
+}
+
+func TestHealthCheckDetectionIsConfigurable(t *testing.T) {
+	setForTest(t, &healthCheckPaths, parseHealthCheckList(" /ping , ,/ready"))
+	setForTest(t, &healthCheckUserAgents, parseHealthCheckList("none"))
+	setForTest(t, &healthCheckHeader, "X-Probe")
+
+	tests := []struct {
+		path, userAgent, header string
+		want                    bool
+	}{
+		{"/ping", "", "", true},
+		{"/ready?verbose", "", "", true},
+		{"/health", "", "", false}, // Default path, replaced
+		{"/ping/deeper", "", "", false},
+		{"/", "kube-probe/1.29", "", false}, // User agents turned off
+		{"/", "", "X-Probe", true},
+		{"/", "", "X-Health-Check", false},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		r.Header.Set("User-Agent", tc.userAgent)
+		if tc.header != "" {
+			r.Header.Set(tc.header, "1")
+		}
+		if got := isHealthCheck(r, tc.path); got != tc.want {
+			t.Errorf("%s (UA %q, header %q): isHealthCheck = %v, want %v", tc.path, tc.userAgent, tc.header, got, tc.want)
+		}
+	}
+
+	// "none" turns header detection off too
+	setForTest(t, &healthCheckHeader, "none")
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("none", "1")
+	if isHealthCheck(r, "/") {
+		t.Error("HEALTHCHECK_HEADER=none still matched")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"tunnelr/internal/tunnel"
+
+	"github.com/gorilla/websocket"
+)
+
+// Idle tunnels - a CLI left running on a forgotten laptop holds its subdomain
+// and memory forever. With IDLE_TIMEOUT set, a tunnel that hasn't seen a
+// request or a message from its CLI for that long is closed. Keepalive pings
+// don't count as traffic; requests in flight and open WebSockets keep a
+// tunnel alive however quiet they are.
+var idleTimeout = getEnvDuration("IDLE_TIMEOUT", 0) // 0 = never close idle tunnels
+
+// startIdleReaper checks for idle tunnels in the background, if IDLE_TIMEOUT is set
+func startIdleReaper() {
+	if idleTimeout <= 0 {
+		return
+	}
+
+	// Check often enough that a tunnel doesn't overstay by much, but not
+	// more than once a second
+	interval := idleTimeout / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			reapIdleTunnels(now)
+		}
+	}()
+}
+
+// reapIdleTunnels closes every tunnel idle for IDLE_TIMEOUT as of now
+// The CLI gets a close frame saying why. Closing the connection ends the
+// tunnel's read loop, which removes it from the registry as usual.
+func reapIdleTunnels(now time.Time) {
+	for _, tun := range registry.Idle(now, idleTimeout) {
+		idleFor := now.Sub(tun.LastActivity()).Round(time.Second)
+		log.Printf("Closing tunnel %s: no traffic for %s", tun.ID, idleFor)
+		metrics.idleTunnelsClosed.Add(1)
+
+		reason := fmt.Sprintf("no traffic for %s", idleFor)
+		tun.Conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(tunnel.CloseIdle, reason), time.Now().Add(time.Second))
+		tun.Conn.Close()
+	}
+}
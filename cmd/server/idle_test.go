@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestIdleTunnelIsClosedAndActiveOneKept(t *testing.T) {
+	setForTest(t, &idleTimeout, time.Hour)
+	srv := startTestServer(t)
+
+	assigned, staleConn, err := registerFakeCLI(srv, tunnel.TunnelRegister{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer staleConn.Close()
+	stale, _ := registry.Get(assigned.TunnelID)
+
+	time.Sleep(20 * time.Millisecond)
+	active := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		cli.respond(req.ID, http.StatusOK, nil, []byte("still here"))
+	})
+	if status, _ := active.get("/"); status != http.StatusOK {
+		t.Fatalf("request to the active tunnel got %d", status)
+	}
+	closedBefore := metrics.idleTunnelsClosed.Load()
+
+	// Run the reaper with the clock an hour on from the stale tunnel's
+	// registration; the active one had traffic since
+	reapIdleTunnels(stale.LastActivity().Add(idleTimeout + 10*time.Millisecond))
+
+	// The stale CLI is told why, and the tunnel goes
+	staleConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = staleConn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != tunnel.CloseIdle || !strings.HasPrefix(closeErr.Text, "no traffic for") {
+		t.Errorf("stale CLI read %v, want a %d close frame", err, tunnel.CloseIdle)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, ok := registry.Get(stale.ID); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("idle tunnel still registered")
+		}
+	}
+	if got := metrics.idleTunnelsClosed.Load() - closedBefore; got < 1 {
+		t.Errorf("idle_tunnels_closed went up by %d", got)
+	}
+
+	// The active tunnel still works
+	if _, ok := registry.Get(active.ID); !ok {
+		t.Fatal("active tunnel was closed")
+	}
+	if status, body := active.get("/"); status != http.StatusOK || string(body) != "still here" {
+		t.Errorf("active tunnel got %d %q after the sweep", status, body)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestEarlyHintsReachTheVisitor(t *testing.T) {
+	srv := startTestServer(t)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{Capabilities: allCapabilities},
+		func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+			msgBytes, err := cli.codec.Encode(tunnel.TypeHTTPInformational, tunnel.HTTPInformational{
+				ID:         req.ID,
+				StatusCode: http.StatusEarlyHints,
+				Headers:    http.Header{"Link": {"</style.css>; rel=preload; as=style", "</app.js>; rel=preload; as=script"}},
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			cli.conn.Send(msgBytes)
+			cli.respond(req.ID, http.StatusOK, http.Header{"Content-Type": {"text/html"}}, []byte("page"))
+		})
+
+	var hints []textproto.MIMEHeader
+	var codes []int
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			codes = append(codes, code)
+			hints = append(hints, header)
+			return nil
+		},
+	}
+	req := cli.newRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if len(codes) != 1 || codes[0] != http.StatusEarlyHints {
+		t.Fatalf("got 1xx responses %v, want one 103", codes)
+	}
+	if links := hints[0].Values("Link"); len(links) != 2 {
+		t.Errorf("103 Link headers = %q, want both", links)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "page" {
+		t.Errorf("final response %d %q", resp.StatusCode, body)
+	}
+	if links := resp.Header.Values("Link"); len(links) != 0 {
+		t.Errorf("the 103's Link headers leaked into the final response: %q", links)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestResponsesStayWithTheirTunnel(t *testing.T) {
+	srv := startTestServer(t)
+
+	// Tunnel A holds its request until the test lets it answer
+	seen := make(chan string, 1)
+	release := make(chan struct{})
+	a := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+		seen <- req.ID
+		<-release
+		cli.respond(req.ID, http.StatusOK, nil, []byte("from A"))
+	})
+	b := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+		cli.respond(req.ID, http.StatusOK, nil, []byte("from B"))
+	})
+
+	got := make(chan string, 1)
+	go func() {
+		status, body := a.get("/")
+		got <- strings.Join([]string{http.StatusText(status), string(body)}, " ")
+	}()
+
+	var requestID string
+	select {
+	case requestID = <-seen:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request never reached tunnel A")
+	}
+	if !strings.HasPrefix(requestID, a.ID+"-") {
+		t.Errorf("request ID %q isn't namespaced by tunnel %s", requestID, a.ID)
+	}
+
+	// Tunnel B answers A's request ID over its own connection. The server
+	// must not hand that to A's visitor.
+	b.respond(requestID, http.StatusTeapot, nil, []byte("spoofed by B"))
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	select {
+	case answer := <-got:
+		if answer != "OK from A" {
+			t.Errorf("A's visitor got %q, want A's own answer", answer)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("A's visitor never got an answer")
+	}
+
+	// B still works for its own visitors
+	if status, body := b.get("/"); status != http.StatusOK || string(body) != "from B" {
+		t.Errorf("B's visitor got %d %q", status, body)
+	}
+}
+
+func TestSameRequestIDOnTwoTunnels(t *testing.T) {
+	a, b := tunnel.NewPendingRequests(), tunnel.NewPendingRequests()
+
+	pa, ok := a.Add("same-id")
+	if !ok {
+		t.Fatal("first tunnel refused the ID")
+	}
+	pb, ok := b.Add("same-id")
+	if !ok {
+		t.Fatal("second tunnel refused an ID only the first one uses")
+	}
+
+	// Removing it from one leaves the other waiting
+	a.Remove("same-id")
+	select {
+	case <-pa.Done:
+	default:
+		t.Error("removed request isn't done")
+	}
+	select {
+	case <-pb.Done:
+		t.Error("removing A's request finished B's")
+	default:
+	}
+	if _, exists := b.Get("same-id"); !exists {
+		t.Error("B's request is gone")
+	}
+}
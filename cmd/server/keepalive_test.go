@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestSilentTunnelIsReaped(t *testing.T) {
+	setForTest(t, &pingInterval, 200*time.Millisecond)
+	srv := startTestServer(t)
+
+	// Registers, then never reads again - so never answers a ping, like a
+	// CLI whose network went away without closing the connection
+	assigned, conn, err := registerFakeCLI(srv, tunnel.TunnelRegister{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	limit := tunnel.KeepaliveTimeout(pingInterval) + time.Second
+	for {
+		if _, ok := registry.Get(assigned.TunnelID); !ok {
+			break
+		}
+		if time.Since(start) > limit {
+			t.Fatalf("silent tunnel still registered after %s", limit)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Logf("silent tunnel reaped after %s", time.Since(start).Round(time.Millisecond))
+}
+
+func TestAnsweringTunnelIsKept(t *testing.T) {
+	setForTest(t, &pingInterval, 100*time.Millisecond)
+	srv := startTestServer(t)
+
+	// The fake CLI keeps reading, so its WebSocket library answers every ping
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+		cli.respond(req.ID, http.StatusOK, nil, []byte("alive"))
+	})
+
+	time.Sleep(5 * tunnel.KeepaliveTimeout(pingInterval))
+	if status, body := cli.get("/"); status != http.StatusOK || string(body) != "alive" {
+		t.Errorf("answering tunnel got %d %q after several ping rounds", status, body)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import "net"
+
+// Listener tuning for high-throughput deployments
+//
+// LISTEN_REUSEPORT lets several server processes listen on the same port, with
+// the kernel spreading new connections between them. Each process has its own
+// registry, so a request can land on a process that doesn't have its tunnel -
+// the main use is starting a new server before stopping the old one, so no
+// connection is refused during a restart.
+// LISTEN_BACKLOG sets how many connections may wait to be accepted; the
+// default (the kernel's net.core.somaxconn) can overflow when many CLIs
+// reconnect at once.
+//
+// Both are Linux-only (see listen_linux.go). Go already sets SO_REUSEADDR on
+// every listener, so a restarted server can take its port back right away.
+var (
+	listenReusePort = getEnvBool("LISTEN_REUSEPORT", false)
+	listenBacklog   = getEnvInt("LISTEN_BACKLOG", 0) // 0 = the system default
+)
+
+// listen opens the server's TCP listener on addr
+func listen(addr string) (net.Listener, error) {
+	if !listenReusePort && listenBacklog <= 0 {
+		return net.Listen("tcp", addr)
+	}
+	return listenTuned(addr)
+}
@@ -0,0 +1,62 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenTuned opens a listener with LISTEN_REUSEPORT and LISTEN_BACKLOG applied
+// In Go, ListenConfig.Control runs on the raw socket before it's bound, which
+// is the only time SO_REUSEPORT can be set. The backlog is passed to listen(),
+// which Go has already called by the time we get the listener - calling it
+// again on Linux just updates the backlog. The kernel caps it at
+// net.core.somaxconn.
+func listenTuned(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			if !listenReusePort {
+				return nil
+			}
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			if sockErr != nil {
+				return fmt.Errorf("setting SO_REUSEPORT: %v", sockErr)
+			}
+			return nil
+		},
+	}
+
+	listener, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil || listenBacklog <= 0 {
+		return listener, err
+	}
+
+	raw, err := listener.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	var listenErr error
+	err = raw.Control(func(fd uintptr) {
+		listenErr = unix.Listen(int(fd), listenBacklog)
+	})
+	if err == nil {
+		err = listenErr
+	}
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("setting the listen backlog: %v", err)
+	}
+	return listener, nil
+}
@@ -0,0 +1,86 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenerFD runs f on l's socket
+func listenerFD(t *testing.T, l net.Listener, f func(fd int)) {
+	t.Helper()
+	raw, err := l.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := raw.Control(func(fd uintptr) { f(int(fd)) }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListenReusePort(t *testing.T) {
+	setForTest(t, &listenReusePort, true)
+	setForTest(t, &listenBacklog, 0)
+
+	first, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	listenerFD(t, first, func(fd int) {
+		if on, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT); err != nil || on == 0 {
+			t.Errorf("SO_REUSEPORT = %d (%v), want it on", on, err)
+		}
+	})
+
+	// A second process (here: listener) can take the same port
+	second, err := listen(first.Addr().String())
+	if err != nil {
+		t.Fatalf("second listener on %s: %v", first.Addr(), err)
+	}
+	second.Close()
+
+	// Without the setting the port is ours alone
+	listenReusePort = false
+	if l, err := listen(first.Addr().String()); err == nil {
+		l.Close()
+		t.Error("a plain listener shared a port")
+	}
+}
+
+func TestListenBacklog(t *testing.T) {
+	setForTest(t, &listenReusePort, false)
+	setForTest(t, &listenBacklog, 37)
+
+	l, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// For a listening socket Linux reports the backlog limit in tcpi_sacked
+	listenerFD(t, l, func(fd int) {
+		info, err := unix.GetsockoptTCPInfo(fd, unix.IPPROTO_TCP, unix.TCP_INFO)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Sacked != 37 {
+			t.Errorf("backlog %d, want 37", info.Sacked)
+		}
+	})
+
+	// And it still accepts connections
+	go func() {
+		if conn, err := net.Dial("tcp", l.Addr().String()); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
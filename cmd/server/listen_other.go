@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// listenTuned refuses LISTEN_REUSEPORT and LISTEN_BACKLOG outside Linux
+// Other systems either lack SO_REUSEPORT or don't balance connections between
+// the processes sharing a port, so quietly ignoring the settings would mislead.
+func listenTuned(addr string) (net.Listener, error) {
+	return nil, errors.New("LISTEN_REUSEPORT and LISTEN_BACKLOG are only supported on Linux")
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import "testing"
+
+func TestListenTuningNeedsLinux(t *testing.T) {
+	setForTest(t, &listenReusePort, true)
+	if l, err := listen("127.0.0.1:0"); err == nil {
+		l.Close()
+		t.Error("LISTEN_REUSEPORT accepted on a system that doesn't support it")
+	}
+
+	// Untuned listeners work everywhere
+	listenReusePort = false
+	l, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestLocalHostIsKeptForDisplay(t *testing.T) {
+	srv := startTestServer(t)
+	tests := []struct {
+		localHost string
+		want      string
+	}{
+		{"", ""},
+		{"192.168.1.50", "192.168.1.50"},
+		{"api", "api"},
+		{"evil\nhost", ""},
+		{"host/path", ""},
+		{strings.Repeat("a", 254), ""},
+	}
+	for _, tc := range tests {
+		cli := startFakeCLI(t, srv, tunnel.TunnelRegister{LocalHost: tc.localHost, LocalPort: 8080}, nil)
+		tun, ok := registry.Get(cli.ID)
+		if !ok {
+			t.Fatalf("%q: tunnel not registered", tc.localHost)
+		}
+		if tun.LocalHost != tc.want {
+			t.Errorf("LocalHost %q kept as %q, want %q", tc.localHost, tun.LocalHost, tc.want)
+		}
+	}
+}
@@ -8,8 +8,8 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"tunnelr/internal/tunnel"
@@ -20,67 +20,274 @@ import (
 // Global registry of active tunnels
 var registry = tunnel.NewRegistry()
 
-// pendingRequests tracks HTTP requests waiting for responses
-// Maps request ID -> channel that will receive the response
-var pendingRequests = struct {
-	sync.RWMutex
-	m map[string]chan *tunnel.HTTPResponse
-}{m: make(map[string]chan *tunnel.HTTPResponse)}
-
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
+	EnableCompression: wsCompression.Enabled,
+}
+
+// wsCompression configures permessage-deflate on tunnel connections
+// Only used when the CLI enables it too
+var wsCompression = tunnel.CompressionConfig{
+	Enabled:   getEnvBool("WS_COMPRESSION", false),
+	Level:     getEnvInt("WS_COMPRESSION_LEVEL", 1),
+	Threshold: getEnvInt("WS_COMPRESSION_THRESHOLD", 1024),
 }
 
 // Config - in production, these come from environment variables
 var (
-	baseDomain  = getEnv("BASE_DOMAIN", "localhost")  // e.g., "tunnelr.io"
+	baseDomain  = getEnv("BASE_DOMAIN", "localhost") // e.g., "tunnelr.io"
 	serverPort  = getEnv("PORT", "8080")
 	routingMode = getEnv("ROUTING_MODE", "subdomain") // "subdomain" or "path"
+
+	// What a request to the bare base domain gets in subdomain mode:
+	// "landing" (default), "redirect" (to BARE_DOMAIN_REDIRECT) or "status"
+	// (BARE_DOMAIN_STATUS with BARE_DOMAIN_BODY)
+	bareDomainAction   = getEnv("BARE_DOMAIN_ACTION", "landing")
+	bareDomainRedirect = getEnv("BARE_DOMAIN_REDIRECT", "") // e.g., "https://example.com"
+	bareDomainStatus   = getEnvInt("BARE_DOMAIN_STATUS", http.StatusNotFound)
+	bareDomainBody     = getEnv("BARE_DOMAIN_BODY", "")
+
+	// Subdomain mode: a request without a Host header (some HTTP/1.0
+	// clients) doesn't name a tunnel. It gets a 400 saying so, unless this
+	// names a tunnel to send such requests to.
+	missingHostTunnel = strings.ToLower(getEnv("MISSING_HOST_TUNNEL", ""))
+
+	// Bodies up to this many bytes are sent in one message; larger ones are
+	// streamed in chunks (if the CLI supports it)
+	streamThreshold = int64(getEnvInt("STREAM_THRESHOLD", 1024*1024))
+
+	// Longest path (with query string) we forward, after the tunnel ID is
+	// taken off in path mode - longer ones get a 414. 0 = no limit
+	maxPathLength = getEnvInt("MAX_PATH_LENGTH", 8192)
+
+	// How long we wait for the CLI to answer (and, for streamed responses,
+	// the longest gap between chunks) before giving up with a 504
+	forwardTimeout = getEnvDuration("REQUEST_TIMEOUT", 30*time.Second)
+
+	// How often we ping each CLI; a tunnel that misses two pongs is removed
+	// 0 turns keepalives off
+	pingInterval = getEnvDuration("WS_PING_INTERVAL", 30*time.Second)
+
+	// How long a new connection has to finish registering before we drop it
+	registerTimeout = getEnvDuration("REGISTER_TIMEOUT", 10*time.Second)
+
+	// Generated tunnel IDs kept ready for new tunnels, 0 = generate each one
+	// when the tunnel registers
+	idPoolSize = getEnvInt("ID_POOL_SIZE", 0)
+
+	// Warn when this fraction of a tunnel's recent requests time out
+	timeoutWarnRate = getEnvFloat("TIMEOUT_WARN_RATE", 0.5)
+
+	// Optional webhook that receives tunnel lifecycle events
+	webhookURL           = getEnv("WEBHOOK_URL", "")
+	webhookSecret        = getEnv("WEBHOOK_SECRET", "")                // HMAC key for X-Tunnelr-Signature
+	webhookQueueSize     = getEnvInt("WEBHOOK_QUEUE_SIZE", 1000)       // Events buffered before dropping
+	webhookRequestEvents = getEnvBool("WEBHOOK_REQUEST_EVENTS", false) // Also send one event per request
 )
 
-func main() {
-	// Route for CLI to establish tunnel
-	http.HandleFunc("/ws", handleTunnelConnection)
+// webhook is nil when WEBHOOK_URL isn't set (all calls become no-ops)
+var webhook = NewWebhookNotifier(webhookURL, webhookSecret, webhookQueueSize, webhookRequestEvents)
 
-	// Health check
-	http.HandleFunc("/health", handleHealth)
+func main() {
+	// `server --check` only reports whether DNS is ready, see check.go
+	if len(os.Args) > 1 {
+		os.Exit(runCheck(os.Stdout, os.Args[1:]))
+	}
 
-	// Domain status check - shows if domain is properly configured
-	http.HandleFunc("/status", handleStatus)
+	// Names nobody may ask for, on top of tunnel.DefaultReservedSubdomains
+	registry.SetReservedSubdomains(strings.Split(getEnv("RESERVED_SUBDOMAINS", ""), ","))
 
-	// All other requests - check if it's a tunnel subdomain
-	http.HandleFunc("/", handleRequest)
+	// Keep auto-generated subdomains presentable
+	denylist := append([]string(nil), tunnel.DefaultIDDenylist...)
+	if custom := getEnv("ID_DENYLIST", ""); custom != "" {
+		denylist = append(denylist, strings.Split(custom, ",")...)
+	}
+	registry.SetIDGenerator(tunnel.CleanIDGenerator(tunnel.RandomID, denylist))
+	registry.SetIDPool(idPoolSize)
+	registry.SetRateLimit(rateLimit, rateBurst())
+	if adaptiveConcurrency {
+		registry.SetAdaptiveConcurrency(adaptiveTargetLatency, adaptiveMaxConcurrency)
+	}
 
 	addr := ":" + serverPort
-	fmt.Printf("Tunnel server starting on %s\n", addr)
+	fmt.Printf("Tunnel server %s starting on %s\n", versionString(), addr)
 	fmt.Printf("Base domain: %s\n", baseDomain)
 	fmt.Printf("Routing mode: %s\n", routingMode)
 
+	if wsCompression.Enabled && !wsCompression.ValidLevel() {
+		log.Fatalf("WS_COMPRESSION_LEVEL must be between 1 and 9, got %d", wsCompression.Level)
+	}
+
+	if forwardTimeout <= 0 {
+		log.Fatalf("REQUEST_TIMEOUT must be positive, got %s", forwardTimeout)
+	}
+	fmt.Printf("Request timeout: %s\n", forwardTimeout)
+	if rateLimit > 0 {
+		fmt.Printf("Rate limit: %g requests/sec per tunnel (burst %d)\n", rateLimit, rateBurst())
+	}
+	if adaptiveConcurrency {
+		if adaptiveTargetLatency <= 0 || adaptiveMaxConcurrency < 1 {
+			log.Fatalf("ADAPTIVE_TARGET_LATENCY and ADAPTIVE_MAX_CONCURRENCY must be positive")
+		}
+		fmt.Printf("Adaptive concurrency: up to %d requests per tunnel, target p95 %s\n", adaptiveMaxConcurrency, adaptiveTargetLatency)
+	}
+
+	if maxConcurrentRequests > 0 {
+		fmt.Printf("Max concurrent requests: %d (queue up to %d for %s)\n", maxConcurrentRequests, admissionQueueSize, admissionQueueTimeout)
+	}
+
+	if maxBodySize < 0 || defaultBodySize < 0 {
+		log.Fatalf("MAX_BODY_SIZE and DEFAULT_BODY_SIZE can't be negative")
+	}
+	if maxBodySize > 0 && defaultBodySize > maxBodySize {
+		log.Fatalf("DEFAULT_BODY_SIZE (%d) can't be larger than MAX_BODY_SIZE (%d)", defaultBodySize, maxBodySize)
+	}
+
+	if !tunnel.ValidFallback(overloadFallback) {
+		log.Fatalf("OVERLOAD_FALLBACK must be error, page or stale, got %q", overloadFallback)
+	}
+
+	if migrateURL != "" {
+		if !tunnel.ValidServerURL(migrateURL) {
+			log.Fatalf("MIGRATE_URL must be a ws:// or wss:// URL, got %q", migrateURL)
+		}
+		fmt.Printf("On shutdown, tunnels move to: %s\n", migrateURL)
+	}
+
+	if bareDomainAction == "redirect" && bareDomainRedirect == "" {
+		log.Printf("BARE_DOMAIN_ACTION=redirect but BARE_DOMAIN_REDIRECT is empty, showing the landing page instead")
+	}
+
+	if idleTimeout > 0 {
+		fmt.Printf("Idle timeout: %s\n", idleTimeout)
+		startIdleReaper()
+	}
+	startPendingJanitor()
+
 	if routingMode == "path" {
 		fmt.Printf("Tunnel URLs will be: https://%s/t/<tunnel-id>/...\n", baseDomain)
 	} else {
 		fmt.Printf("Tunnel URLs will be: https://<tunnel-id>.%s/...\n", baseDomain)
 	}
 
-	log.Fatal(http.ListenAndServe(addr, nil))
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if tlsConfig != nil {
+		fmt.Printf("TLS: serving HTTPS with %s\n", tlsSource())
+	}
+
+	if grpcAddr != "" {
+		if err := startGRPCServer(tlsConfig); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("gRPC API listening on %s\n", grpcAddr)
+	}
+
+	listener, err := listen(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if listenReusePort {
+		fmt.Printf("Sharing port %s with other processes (LISTEN_REUSEPORT)\n", serverPort)
+	}
+
+	// Runs until SIGTERM/SIGINT, then shuts down gracefully
+	serveUntilSignal(&http.Server{Addr: addr, Handler: newMux(), TLSConfig: tlsConfig}, listener)
+}
+
+// newMux routes the server's own endpoints and sends everything else to
+// the tunnels
+func newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// Route for CLI to establish tunnel
+	mux.HandleFunc("/ws", handleTunnelConnection)
+
+	// The same over long-polling, for CLIs whose proxy blocks WebSockets -
+	// only on the base domain, a tunnel's own /poll/ pages go to the tunnel
+	mux.HandleFunc(tunnel.PollPath+"/", onBaseHost(handlePoll))
+
+	// Health check - a tunnel's own /health goes to the tunnel
+	mux.HandleFunc("/health", onBaseHost(handleHealth))
+
+	// Prometheus metrics
+	if metricsPath != "" && metricsPath != "off" {
+		mux.HandleFunc(metricsPath, handleMetrics(withServerTimeout(handleRequest)))
+	}
+
+	// Domain status check - shows if domain is properly configured
+	mux.HandleFunc("/status", onBaseHost(handleStatus))
+
+	// Operator endpoints (need VIEWER_TOKEN or ADMIN_TOKEN), only on the
+	// base domain so a tunnel can still serve its own /admin pages
+	mux.HandleFunc("/admin/tunnels", onBaseHost(requireRole(roleViewer, handleTunnelList)))
+	mux.HandleFunc("/admin/tunnels/", onBaseHost(requireRole(roleAdmin, handleTunnelDelete)))
+	mux.HandleFunc("/admin/debug/registry", onBaseHost(requireRole(roleViewer, handleRegistryDump)))
+	mux.HandleFunc("/admin/maintenance", onBaseHost(requireRole(roleViewer, handleMaintenance)))
+	mux.HandleFunc("/admin/slow-requests", onBaseHost(requireRole(roleViewer, handleSlowRequests)))
+	mux.HandleFunc("/admin/debug/resources", onBaseHost(requireRole(roleViewer, handleResources)))
+	mux.HandleFunc("/admin/migrate", onBaseHost(requireRole(roleAdmin, handleMigrate)))
+
+	// A CLI's own tunnels, found by its auth token (`tunnelr list`), also
+	// only on the base domain
+	mux.HandleFunc("/api/tunnels", onBaseHost(handleOwnTunnels))
+
+	// All other requests - check if it's a tunnel subdomain
+	mux.HandleFunc("/", withServerTimeout(handleRequest))
+
+	return mux
+}
+
+// onBaseHost serves next only on the base domain
+// In subdomain mode the same path on a tunnel's host goes to the tunnel,
+// which may well have a page there of its own.
+func onBaseHost(next http.HandlerFunc) http.HandlerFunc {
+	tunnelHandler := withServerTimeout(handleRequest)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if routingMode != "path" && extractSubdomain(r.Host) != "" {
+			tunnelHandler(w, r)
+			return
+		}
+		next(w, r)
+	}
 }
 
 // handleTunnelConnection handles WebSocket connections from CLI clients
 func handleTunnelConnection(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	// CLIs will reconnect once we're back (or to another instance)
+	if shuttingDown.Load() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	wsConn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("WebSocket upgrade failed: %v", err)
 		return
 	}
 
+	// Every forwarded request writes to this connection from its own
+	// goroutine, so all writes go through SafeConn's lock
+	conn := tunnel.NewSafeConn(wsConn, wsCompression)
+
 	log.Printf("New CLI client connected from %s", r.RemoteAddr)
 
+	// The whole handshake is bounded, so a client that connects and goes
+	// quiet can't hold this goroutine (and its socket) forever
+	conn.SetReadDeadline(time.Now().Add(registerTimeout))
+	conn.SetWriteDeadline(time.Now().Add(registerTimeout))
+
 	// Wait for the CLI to send a register message
 	_, msgBytes, err := conn.ReadMessage()
 	if err != nil {
-		log.Printf("Failed to read register message: %v", err)
+		// `tunnelr ping` connects and hangs up cleanly - nothing to log
+		if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			log.Printf("Failed to read register message: %v", err)
+		}
 		conn.Close()
 		return
 	}
@@ -105,79 +312,303 @@ func handleTunnelConnection(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Register the tunnel
-	tunnelID := registry.Register(conn, reg.LocalPort)
-	log.Printf("Tunnel registered: %s -> localhost:%d", tunnelID, reg.LocalPort)
+	// A CLI speaking another protocol version would misread our messages -
+	// tell the user which side to upgrade rather than fail in odd ways later
+	if !tunnel.CompatibleVersion(reg.ProtocolVersion) {
+		log.Printf("Rejected tunnel from %s: protocol version %d, we speak %d", r.RemoteAddr, reg.ProtocolVersion, tunnel.ProtocolVersion)
+		advice := "upgrade the CLI (tunnelr update)"
+		if reg.ProtocolVersion > tunnel.ProtocolVersion {
+			advice = "the server needs upgrading, or use an older CLI"
+		}
+		sendTunnelError(conn, tunnel.ErrCodeProtocolVersion,
+			fmt.Sprintf("This CLI speaks protocol version %d but the server speaks version %d: %s", reg.ProtocolVersion, tunnel.ProtocolVersion, advice))
+		conn.Close()
+		return
+	}
 
-	// Send back the assigned tunnel info
-	// URL format depends on routing mode
-	var publicURL string
-	if routingMode == "path" {
-		publicURL = fmt.Sprintf("https://%s/t/%s", baseDomain, tunnelID)
-	} else {
-		publicURL = fmt.Sprintf("https://%s.%s", tunnelID, baseDomain)
+	// Only known tokens may open tunnels (when AUTH_TOKENS is set)
+	if !tunnelTokenAllowed(reg.AuthToken) {
+		reason := "invalid auth token"
+		if reg.AuthToken == "" {
+			reason = "auth token required"
+		}
+		log.Printf("Rejected tunnel from %s: %s", r.RemoteAddr, reason)
+		closeWithReason(conn, websocket.ClosePolicyViolation, reason)
+		return
+	}
+
+	// An unusable password must not quietly leave the tunnel open
+	if reg.BasicAuth != "" && !tunnel.ValidBasicAuth(reg.BasicAuth) {
+		log.Printf("Rejected tunnel from %s: invalid basic auth credentials", r.RemoteAddr)
+		sendTunnelError(conn, tunnel.ErrCodeBasicAuthInvalid, "Invalid basic auth: use user:password with a non-empty user and password")
+		conn.Close()
+		return
+	}
+
+	// Broken rewrite rules would quietly leave the app's links pointing
+	// at localhost - refuse the tunnel instead
+	if _, err := tunnel.NewBodyRewriter(reg.Rewrite); err != nil {
+		log.Printf("Rejected tunnel from %s: %v", r.RemoteAddr, err)
+		sendTunnelError(conn, tunnel.ErrCodeRewriteInvalid, "Invalid --rewrite: "+err.Error())
+		conn.Close()
+		return
 	}
 
+	// Only keep the protocol features we support too
+	reg.Capabilities = tunnel.NegotiateCapabilities(reg.Capabilities)
+	reg.OverloadFallback = validateOverloadFallback(reg.OverloadFallback, r.RemoteAddr)
+	reg.WarmupSeconds = validateWarmup(reg.WarmupSeconds, r.RemoteAddr)
+	reg.MaxBodyBytes = validateMaxBody(reg.MaxBodyBytes, r.RemoteAddr)
+	if !tunnel.ValidGzipLevel(reg.GzipLevel) {
+		log.Printf("Ignoring invalid gzip level %d from %s", reg.GzipLevel, r.RemoteAddr)
+		reg.GzipLevel = 0
+	}
+
+	// The local host is only shown (logs, admin listings) - drop anything
+	// that isn't plausibly a host name rather than print it
+	if len(reg.LocalHost) > 253 || strings.ContainsFunc(reg.LocalHost, func(c rune) bool { return c <= ' ' || c == '/' || c > '~' }) {
+		reg.LocalHost = ""
+	}
+
+	// Register the tunnel
+	tun, err := registry.Register(conn, reg, tunnelLimitFor(reg.AuthToken))
+	switch err {
+	case nil:
+	case tunnel.ErrTunnelLimit:
+		log.Printf("Rejected tunnel from %s: token is at its tunnel limit", r.RemoteAddr)
+		message := fmt.Sprintf("This token already has the maximum of %d tunnels open", tunnelLimitFor(reg.AuthToken))
+		// The tunnel error's code tells our CLI to back off and retry; the
+		// close frame gives any WebSocket client the reason
+		sendTunnelError(conn, tunnel.ErrCodeTunnelLimit, message)
+		closeWithReason(conn, websocket.ClosePolicyViolation, message)
+		return
+	case tunnel.ErrSubdomainInvalid:
+		log.Printf("Rejected tunnel from %s: invalid subdomain %q", r.RemoteAddr, reg.Subdomain)
+		sendTunnelError(conn, tunnel.ErrCodeSubdomainInvalid,
+			fmt.Sprintf("Invalid subdomain %q: use lowercase letters, digits and hyphens (up to 63 characters, not starting or ending with a hyphen)", reg.Subdomain))
+		conn.Close()
+		return
+	case tunnel.ErrSubdomainReserved:
+		log.Printf("Rejected tunnel from %s: subdomain %q is reserved", r.RemoteAddr, reg.Subdomain)
+		sendTunnelError(conn, tunnel.ErrCodeSubdomainReserved,
+			fmt.Sprintf("The subdomain %q is reserved on this server, pick another one", reg.Subdomain))
+		conn.Close()
+		return
+	case tunnel.ErrSubdomainTaken:
+		log.Printf("Rejected tunnel from %s: subdomain %q is in use", r.RemoteAddr, reg.Subdomain)
+		sendTunnelError(conn, tunnel.ErrCodeSubdomainTaken,
+			fmt.Sprintf("The subdomain %q is already in use, pick another one", reg.Subdomain))
+		conn.Close()
+		return
+	case tunnel.ErrNoFreeID:
+		log.Printf("Rejected tunnel from %s: couldn't find a free tunnel ID", r.RemoteAddr)
+		sendTunnelError(conn, tunnel.ErrCodeNoFreeID, "The server couldn't assign a tunnel ID, try again later")
+		conn.Close()
+		return
+	}
+	tunnelID := tun.ID
+	localHost := reg.LocalHost
+	if localHost == "" {
+		localHost = "localhost"
+	}
+	log.Printf("Tunnel registered: %s -> %s", tunnelID, net.JoinHostPort(localHost, strconv.Itoa(reg.LocalPort)))
+	publishEvent(WebhookEvent{
+		Type:       EventTunnelRegistered,
+		TunnelID:   tunnelID,
+		LocalPort:  reg.LocalPort,
+		RemoteAddr: r.RemoteAddr,
+	})
+
+	// Send back the assigned tunnel info
 	assigned := tunnel.TunnelAssigned{
-		TunnelID:  tunnelID,
-		PublicURL: publicURL,
+		TunnelID:     tunnelID,
+		PublicURL:    publicURLFor(tunnelID),
+		Capabilities: reg.Capabilities,
+
+		ProtocolVersion: tunnel.ProtocolVersion,
 	}
 
-	assignedBytes, _ := json.Marshal(assigned)
-	response := tunnel.Message{
-		Type:    tunnel.TypeTunnelAssigned,
-		Payload: assignedBytes,
+	responseBytes, err := tunnel.Encode(tunnel.TypeTunnelAssigned, assigned)
+	if err != nil {
+		log.Printf("Failed to encode tunnel assignment: %v", err)
+		registry.Remove(tunnelID)
+		conn.Close()
+		return
 	}
 
-	responseBytes, _ := json.Marshal(response)
-	if err := conn.WriteMessage(websocket.TextMessage, responseBytes); err != nil {
+	if err := conn.Send(responseBytes); err != nil {
 		log.Printf("Failed to send tunnel assignment: %v", err)
 		registry.Remove(tunnelID)
 		conn.Close()
 		return
 	}
 
+	// Registered - from here on the connection lives as long as the CLI does
+	conn.SetReadDeadline(time.Time{})
+	conn.SetWriteDeadline(time.Time{})
+
 	// Listen for responses from CLI (runs until connection closes)
-	handleCLIResponses(conn, tunnelID)
+	handleCLIResponses(conn, tun)
+}
+
+// publicURLFor returns a tunnel's public URL
+// The format depends on the routing mode
+func publicURLFor(tunnelID string) string {
+	if routingMode == "path" {
+		return fmt.Sprintf("https://%s/t/%s", baseDomain, tunnelID)
+	}
+	return fmt.Sprintf("https://%s.%s", tunnelID, baseDomain)
+}
+
+// sendTunnelError tells the CLI why it didn't get a tunnel
+func sendTunnelError(conn *tunnel.SafeConn, code, message string) {
+	msgBytes, err := tunnel.Encode(tunnel.TypeTunnelError, tunnel.TunnelError{Code: code, Message: message})
+	if err != nil {
+		log.Printf("Failed to encode tunnel error: %v", err)
+		return
+	}
+	conn.Send(msgBytes)
+}
+
+// closeWithReason sends a close frame saying why, then closes the connection
+// The reason must fit in a control frame (123 bytes).
+func closeWithReason(conn *tunnel.SafeConn, code int, reason string) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	conn.Close()
 }
 
 // handleCLIResponses reads responses from CLI and routes them to waiting HTTP requests
-func handleCLIResponses(conn *websocket.Conn, tunnelID string) {
+// Responses are matched against this tunnel's own pending requests only
+func handleCLIResponses(conn *tunnel.SafeConn, tun *tunnel.Tunnel) {
 	defer func() {
-		registry.Remove(tunnelID)
+		registry.RemoveTunnel(tun)
+		tun.Windows.StopAll() // Uploads still streaming have nowhere to go
 		conn.Close()
-		log.Printf("Tunnel disconnected: %s", tunnelID)
+		log.Printf("Tunnel disconnected: %s", tun.ID)
+		publishEvent(WebhookEvent{Type: EventTunnelDisconnected, TunnelID: tun.ID})
 	}()
 
+	// Notice CLIs that vanish without closing the connection
+	stopKeepalive := conn.StartKeepalive(pingInterval)
+	defer stopKeepalive()
+
 	for {
 		_, msgBytes, err := conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				log.Printf("Tunnel %s stopped answering pings, removing it", tun.ID)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
 				log.Printf("WebSocket error: %v", err)
 			}
 			return
 		}
 
-		var msg tunnel.Message
-		if err := json.Unmarshal(msgBytes, &msg); err != nil {
+		tun.Touch()
+
+		msg, err := tunnel.DecodeMessage(msgBytes)
+		if err != nil {
 			log.Printf("Invalid message: %v", err)
 			continue
 		}
+		if err := msg.Decompress(); err != nil {
+			log.Printf("Invalid compressed message from %s: %v", tun.ID, err)
+			continue
+		}
 
-		if msg.Type == tunnel.TypeHTTPResponse {
+		switch msg.Type {
+		case tunnel.TypeHTTPResponse:
 			var resp tunnel.HTTPResponse
-			if err := json.Unmarshal(msg.Payload, &resp); err != nil {
+			if err := msg.Unmarshal(&resp); err != nil {
 				log.Printf("Invalid response payload: %v", err)
 				continue
 			}
+			tunnel.RestoreRawHeaders(resp.Headers, resp.RawHeaders)
 
 			// Find the waiting request and send the response
-			pendingRequests.RLock()
-			ch, exists := pendingRequests.m[resp.ID]
-			pendingRequests.RUnlock()
+			if pending, exists := tun.Pending.Get(resp.ID); exists {
+				select {
+				case pending.Resp <- &resp:
+				default: // Duplicate response - first one wins
+				}
+			}
+
+		case tunnel.TypeHTTPInformational:
+			var info tunnel.HTTPInformational
+			if err := msg.Unmarshal(&info); err != nil {
+				log.Printf("Invalid informational response: %v", err)
+				continue
+			}
+
+			// Early hints are an optimization - drop them rather than block
+			if pending, exists := tun.Pending.Get(info.ID); exists {
+				select {
+				case pending.Info <- &info:
+				default:
+				}
+			}
+
+		case tunnel.TypeBodyChunk:
+			var chunk tunnel.BodyChunk
+			if err := msg.Unmarshal(&chunk); err != nil {
+				log.Printf("Invalid body chunk: %v", err)
+				continue
+			}
 
-			if exists {
-				ch <- &resp
+			// Never waits for the handler - the CLI only sends what the
+			// handler asked for (see flow.go), and a request that fell
+			// further behind than that fails on its own
+			if pending, exists := tun.Pending.Get(chunk.ID); exists && !pending.QueueChunk(&chunk) {
+				log.Printf("Response body for %s overflowed its buffer, failing the request", chunk.ID)
+				tun.Pending.Remove(chunk.ID)
+			}
+
+		case tunnel.TypeBodyAck:
+			var ack tunnel.BodyAck
+			if err := msg.Unmarshal(&ack); err != nil {
+				log.Printf("Invalid body ack: %v", err)
+				continue
+			}
+			tun.Windows.Ack(ack)
+
+		case tunnel.TypeWSOpen:
+			var open tunnel.WSOpen
+			if err := msg.Unmarshal(&open); err != nil {
+				log.Printf("Invalid WebSocket open: %v", err)
+				continue
+			}
+			if stream, exists := tun.WebSockets.Get(open.ID); exists {
+				select {
+				case stream.Open <- &open:
+				default:
+				}
+			}
+
+		case tunnel.TypeWSData:
+			var data tunnel.WSData
+			if err := msg.Unmarshal(&data); err != nil {
+				log.Printf("Invalid WebSocket message: %v", err)
+				continue
+			}
+
+			// Same backpressure as body chunks
+			if stream, exists := tun.WebSockets.Get(data.ID); exists {
+				select {
+				case stream.Data <- &data:
+				case <-stream.Done:
+				}
+			}
+
+		case tunnel.TypeWSClose:
+			var closed tunnel.WSClose
+			if err := msg.Unmarshal(&closed); err != nil {
+				log.Printf("Invalid WebSocket close: %v", err)
+				continue
+			}
+			if stream, exists := tun.WebSockets.Get(closed.ID); exists {
+				select {
+				case stream.Close <- &closed:
+				default:
+				}
 			}
 		}
 	}
@@ -190,15 +621,29 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 
 	if routingMode == "path" {
 		// Path-based routing: /t/<tunnel-id>/...
-		tunnelID, forwardPath = extractFromPath(r.URL.Path)
+		tunnelID, forwardPath = extractFromPath(r.URL.RequestURI())
 	} else {
 		// Subdomain-based routing: <tunnel-id>.domain.com
 		tunnelID = extractSubdomain(r.Host)
 		forwardPath = r.URL.RequestURI()
+
+		// Go's server already refuses HTTP/1.1 requests without a Host, so
+		// this is HTTP/1.0
+		if r.Host == "" {
+			if missingHostTunnel == "" {
+				http.Error(w, fmt.Sprintf("Missing Host header: tunnels are chosen by subdomain, send \"Host: <tunnel-id>.%s\"", baseDomain),
+					http.StatusBadRequest)
+				return
+			}
+			tunnelID = missingHostTunnel
+		}
 	}
 
 	// If no tunnel ID, show landing page or 404
 	if tunnelID == "" {
+		if routingMode != "path" && handleBareDomain(w, r) {
+			return
+		}
 		if r.URL.Path == "/" {
 			showLandingPage(w)
 			return
@@ -207,15 +652,119 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Scanners and broken clients send absurdly long URLs - they'd bloat
+	// the message to the CLI and the logs, and no app wants them
+	if maxPathLength > 0 && len(forwardPath) > maxPathLength {
+		http.Error(w, fmt.Sprintf("URI too long: the path may be at most %d bytes", maxPathLength), http.StatusRequestURITooLong)
+		return
+	}
+
+	// During maintenance, end users get a friendly page instead of the tunnel
+	if inMaintenance, message := maintenance.Get(); inMaintenance && maintenanceBlocksTunnels {
+		showMaintenancePage(w, message)
+		return
+	}
+
 	// Find the tunnel
 	tun, exists := registry.Get(tunnelID)
 	if !exists {
 		http.Error(w, "Tunnel not found: "+tunnelID, http.StatusNotFound)
 		return
 	}
+	tun.Touch()
+
+	// Over the tunnel's RATE_LIMIT - answered with a 429 here
+	if !allowRequest(w, r, tun, forwardPath) {
+		return
+	}
+
+	// Tunnels opened with --basic-auth challenge visitors for credentials
+	if !checkBasicAuth(w, r, tun, forwardPath) {
+		return
+	}
+
+	// Cleartext HTTP/2 with prior knowledge can't be carried by the tunnel -
+	// say so instead of letting the client hang
+	if r.Method == "PRI" || r.ProtoMajor == 2 && r.TLS == nil {
+		http.Error(w, "HTTP/2 cleartext (h2c) is not supported through the tunnel, use HTTP/1.1", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	// An h2c upgrade is optional for the client (RFC 7540 section 3.2), so
+	// drop it and carry on as HTTP/1.1
+	dropH2CUpgrade(r.Header)
+
+	// WebSockets are relayed message by message rather than as one response
+	if websocket.IsWebSocketUpgrade(r) {
+		forwardWebSocket(w, r, tun, forwardPath)
+		return
+	}
 
 	// Forward the request through the tunnel
-	forwardRequest(w, r, tun, forwardPath)
+	forwardCoalesced(w, r, tun, forwardPath)
+}
+
+// dropH2CUpgrade removes an "Upgrade: h2c" offer and its HTTP2-Settings header
+// Returns true if there was one
+func dropH2CUpgrade(header http.Header) bool {
+	if !headerHasToken(header, "Upgrade", "h2c") {
+		return false
+	}
+	header.Del("Upgrade")
+	header.Del("HTTP2-Settings")
+
+	// Connection lists the headers above; drop those tokens too
+	var keep []string
+	for _, v := range header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			token = strings.TrimSpace(token)
+			if token != "" && !strings.EqualFold(token, "Upgrade") && !strings.EqualFold(token, "HTTP2-Settings") {
+				keep = append(keep, token)
+			}
+		}
+	}
+	header.Del("Connection")
+	if len(keep) > 0 {
+		header.Set("Connection", strings.Join(keep, ", "))
+	}
+	return true
+}
+
+// headerHasToken checks a comma-separated header for a token (case-insensitive)
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, v := range header.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleBareDomain applies BARE_DOMAIN_ACTION to a request with no subdomain
+// Returns false for the default "landing" behaviour so the caller carries on
+func handleBareDomain(w http.ResponseWriter, r *http.Request) bool {
+	switch bareDomainAction {
+	case "redirect":
+		if bareDomainRedirect == "" {
+			return false
+		}
+		http.Redirect(w, r, bareDomainRedirect, http.StatusFound)
+		return true
+
+	case "status":
+		body := bareDomainBody
+		if body == "" {
+			body = http.StatusText(bareDomainStatus)
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(bareDomainStatus)
+		fmt.Fprintln(w, body)
+		return true
+	}
+
+	return false
 }
 
 // showLandingPage displays the server info
@@ -223,6 +772,10 @@ func showLandingPage(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "text/plain")
 	fmt.Fprintln(w, "Tunnelr - Localhost to Live")
 	fmt.Fprintln(w, "")
+	if inMaintenance, message := maintenance.Get(); inMaintenance {
+		fmt.Fprintf(w, "MAINTENANCE: %s\n", message)
+		fmt.Fprintln(w, "")
+	}
 	fmt.Fprintf(w, "Routing mode: %s\n", routingMode)
 	fmt.Fprintf(w, "Active tunnels: %d\n", registry.Count())
 	fmt.Fprintln(w, "")
@@ -237,7 +790,13 @@ func showLandingPage(w http.ResponseWriter) {
 // extractFromPath extracts tunnel ID from path-based routing
 // e.g., "/t/abc123/webhook" -> "abc123", "/webhook"
 // e.g., "/t/abc123" -> "abc123", "/"
-func extractFromPath(path string) (tunnelID string, forwardPath string) {
+// e.g., "/t/abc123/search?q=1" -> "abc123", "/search?q=1"
+// requestURI is the path as the client sent it (still escaped) plus the
+// query, like in subdomain mode - so "%2F" in a path or the query string
+// reach the local server unchanged.
+func extractFromPath(requestURI string) (tunnelID string, forwardPath string) {
+	path, query, hasQuery := strings.Cut(requestURI, "?")
+
 	// Must start with /t/
 	if !strings.HasPrefix(path, "/t/") {
 		return "", ""
@@ -258,124 +817,506 @@ func extractFromPath(path string) (tunnelID string, forwardPath string) {
 	} else {
 		forwardPath = "/"
 	}
+	if hasQuery {
+		forwardPath += "?" + query
+	}
 
 	return tunnelID, forwardPath
 }
 
 // forwardRequest sends an HTTP request through the WebSocket tunnel
 func forwardRequest(w http.ResponseWriter, r *http.Request, tun *tunnel.Tunnel, forwardPath string) {
-	// Generate unique request ID
-	requestID := fmt.Sprintf("%d", time.Now().UnixNano())
+	start := time.Now()
+	r = withTrace(r, start) // Breaks down slow requests, see slowtrace.go
+	trace := traceFrom(r)
 
-	// Read request body
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+	// Health checks are answered like anything else but don't count as traffic
+	healthCheck := isHealthCheck(r, forwardPath)
+	stats := trafficStats(tun, healthCheck)
+
+	if !limitRequestBody(w, r, tun) {
+		logAccess(tun, r, forwardPath, http.StatusRequestEntityTooLarge, time.Since(start))
 		return
 	}
 
-	// Convert headers to simple map
-	headers := make(map[string]string)
-	for key, values := range r.Header {
-		headers[key] = strings.Join(values, ", ")
+	// Wait our turn while the whole server is at MAX_CONCURRENT_REQUESTS
+	if !healthCheck {
+		if !admitRequest(w, r, tun, forwardPath, start) {
+			return
+		}
+		defer admission.Release()
 	}
 
+	// Shed load while the local server is struggling (ADAPTIVE_CONCURRENCY)
+	if !healthCheck {
+		if !tun.Concurrency.Acquire() {
+			respondOverloaded(w, r, tun, forwardPath, start)
+			return
+		}
+		defer tun.Concurrency.Release()
+	}
+	trace.mark(stageAdmitted)
+
+	// Generate unique request ID, namespaced by tunnel
+	requestID := tun.ID + "-" + tunnel.NewRequestID()
+
+	// Read the request body, but only up to the streaming threshold
+	// Small bodies go inline in the request message, bigger ones are streamed
+	// Most GETs have none (Content-Length 0 and not chunked) - nothing to read.
+	var body []byte
+	if r.ContentLength != 0 {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, streamThreshold+1))
+		if isBodyTooLarge(err) {
+			respondBodyTooLarge(w, tun.MaxBodyBytes)
+			logAccess(tun, r, forwardPath, http.StatusRequestEntityTooLarge, time.Since(start))
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	streamBody := int64(len(body)) > streamThreshold
+	if streamBody && !tun.Supports(tunnel.CapStreaming) {
+		// Older CLI without streaming support - buffer the whole thing
+		rest, err := io.ReadAll(r.Body)
+		if isBodyTooLarge(err) {
+			respondBodyTooLarge(w, tun.MaxBodyBytes)
+			logAccess(tun, r, forwardPath, http.StatusRequestEntityTooLarge, time.Since(start))
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+			return
+		}
+		body = append(body, rest...)
+		streamBody = false
+	}
+
+	// Copy headers, keeping every value of repeated ones
+	headers := r.Header.Clone()
+	setForwardedHost(headers, r)
+	headers.Set(tunnel.ReceivedAtHeader, start.UTC().Format(time.RFC3339Nano)) // Replaces any the client sent
+
 	// Build the request message
 	httpReq := tunnel.HTTPRequest{
-		ID:      requestID,
-		Method:  r.Method,
-		Path:    forwardPath, // Use the processed path (stripped of /t/<id> if path-based)
-		Headers: headers,
-		Body:    body,
+		ID:       requestID,
+		Method:   r.Method,
+		Path:     forwardPath, // Use the processed path (stripped of /t/<id> if path-based)
+		Headers:  headers,
+		Streamed: streamBody,
+		Attempt:  1,
+
+		RawHeaders: tunnel.SplitRawHeaders(headers),
 	}
-
-	reqBytes, _ := json.Marshal(httpReq)
-	msg := tunnel.Message{
-		Type:    tunnel.TypeHTTPRequest,
-		Payload: reqBytes,
+	if !streamBody {
+		if tun.Rewriter != nil && tun.Rewriter.Requests {
+			body = rewriteBody(tun, headers, body)
+		}
+		httpReq.Body = body
 	}
-	msgBytes, _ := json.Marshal(msg)
 
-	// Create a channel to receive the response
-	respChan := make(chan *tunnel.HTTPResponse, 1)
+	msgBytes, err := tun.Codec().Encode(tunnel.TypeHTTPRequest, httpReq)
+	if err != nil {
+		log.Printf("Failed to encode request for %s: %v", tun.ID, err)
+		http.Error(w, "Failed to encode request for the tunnel", http.StatusInternalServerError)
+		return
+	}
 
-	pendingRequests.Lock()
-	pendingRequests.m[requestID] = respChan
-	pendingRequests.Unlock()
+	// Register where the response should be delivered
+	pending, ok := tun.Pending.Add(requestID)
+	if !ok {
+		http.Error(w, "Duplicate request ID", http.StatusInternalServerError)
+		return
+	}
 
 	// Clean up when done
-	defer func() {
-		pendingRequests.Lock()
-		delete(pendingRequests.m, requestID)
-		pendingRequests.Unlock()
-	}()
+	defer tun.Pending.Remove(requestID)
+
+	stats.Requests.Add(1)
+	if !streamBody {
+		addBytesIn(stats, int64(len(body)))
+	}
 
 	// Send request to CLI
-	if err := tun.Conn.WriteMessage(websocket.TextMessage, msgBytes); err != nil {
-		http.Error(w, "Failed to forward request", http.StatusBadGateway)
+	if err := tun.Conn.Send(msgBytes); err != nil {
+		http.Error(w, fmt.Sprintf("Tunnel %s is disconnecting, failed to forward request", tun.ID), http.StatusBadGateway)
+		logAccess(tun, r, forwardPath, http.StatusBadGateway, time.Since(start))
 		return
 	}
 
+	// Followed by the body, if it's too big to send inline
+	if streamBody {
+		// A long upload is progress too, see pending.go
+		send := func(data []byte) error {
+			pending.Touch()
+			return tun.Conn.Send(data)
+		}
+		// The CLI acks the chunks as the local server reads them
+		var window *tunnel.SendWindow
+		if tun.Supports(tunnel.CapFlowControl) {
+			window = tun.Windows.Open(requestID, forwardTimeout)
+			defer tun.Windows.Close(requestID)
+		}
+		sent, err := tunnel.StreamBody(send, requestID, body, r.Body, tun.Codec(), window)
+		addBytesIn(stats, sent)
+		if err == tunnel.ErrStreamStopped {
+			// The local server answered without reading all of it (or
+			// the tunnel went) - wait for the answer below
+			err = nil
+		}
+		if isBodyTooLarge(err) {
+			// The CLI got an error chunk and abandons the request
+			respondBodyTooLarge(w, tun.MaxBodyBytes)
+			logAccess(tun, r, forwardPath, http.StatusRequestEntityTooLarge, time.Since(start))
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to stream request body for %s: %v", tun.ID, err)
+			http.Error(w, "Failed to forward request body", http.StatusBadGateway)
+			return
+		}
+	}
+	trace.mark(stageSent)
+
 	// Wait for response with timeout
-	select {
-	case resp := <-respChan:
-		// Write response headers
-		for key, value := range resp.Headers {
-			w.Header().Set(key, value)
+	// Informational (1xx) responses may arrive first - pass them straight on
+	timeout := time.After(forwardTimeout)
+	deadline := time.Now().Add(forwardTimeout)
+	warmupRetries := 0
+	for {
+		select {
+		case info := <-pending.Info:
+			writeInformational(w, info)
+			continue
+
+		case resp := <-pending.Resp:
+			// The local server isn't listening yet - give it a moment if the
+			// tunnel is still warming up. If the wait is cut short (timeout,
+			// client gone, tunnel gone), the next round of the loop sees why.
+			if isUnreachable(resp) && !streamBody && tun.InWarmup() {
+				if !waitForWarmup(r, tun, deadline) {
+					continue
+				}
+				if err := resendRequest(tun, &httpReq); err != nil {
+					metrics.warmupRetryFailures.Add(1)
+					log.Printf("Failed to resend %s to tunnel %s during warmup: %v", requestID, tun.ID, err)
+					http.Error(w, fmt.Sprintf("Tunnel %s is disconnecting, failed to forward request", tun.ID), http.StatusBadGateway)
+					logAccess(tun, r, forwardPath, http.StatusBadGateway, time.Since(start))
+					return
+				}
+				metrics.warmupRetries.Add(1)
+				warmupRetries++
+				continue
+			}
+			trace.mark(stageResponded)
+
+			// The CLI sends a streamed body only as fast as we read it, so
+			// if we don't read all of it, it has to be told to stop
+			bodyRead := !resp.Streamed
+			defer func() {
+				if !bodyRead {
+					stopBody(tun, requestID)
+				}
+			}()
+
+			tun.Concurrency.Observe(time.Since(start))
+
+			// Hints that raced the final response still go out first
+			for len(pending.Info) > 0 {
+				writeInformational(w, <-pending.Info)
+			}
+
+			// The CLI is at its concurrency limit - the tunnel may want a
+			// fallback served instead of its 503
+			if isOverloaded(resp) {
+				if status := serveOverloadFallback(w, r, tun); status != 0 {
+					metrics.overloadFallbacks.Add(1)
+					logAccess(tun, r, forwardPath, status, time.Since(start))
+					return
+				}
+			}
+
+			// Operators can hide or normalize some upstream statuses
+			statusCode, remapped := mapStatus(resp.StatusCode)
+
+			if remapped && statusMapPage != "" {
+				// Replace the upstream body entirely (any streamed chunks are
+				// dropped once we return)
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				w.WriteHeader(statusCode)
+				io.WriteString(w, statusMapPage)
+			} else {
+				// Tunnels opened with --rewrite get their rules applied
+				if !resp.Streamed && r.Method != http.MethodHead {
+					resp.Body = rewriteBody(tun, resp.Headers, resp.Body)
+				}
+
+				// Write response headers
+				addTunnelTiming(resp.Headers, start)
+				copyHeaders(w.Header(), resp.Headers)
+				w.WriteHeader(statusCode)
+
+				switch {
+				case r.Method == http.MethodHead:
+					// The headers describe the GET response, Content-Length
+					// included, but a HEAD response never has a body
+					// (RFC 9110 section 9.3.2) - the local server's
+					// Content-Length goes out as it is
+				case resp.Streamed:
+					unbuffered := tun.Unbuffered || tunnel.IsUnbuffered(resp.Headers)
+					written, complete := copyStreamedBody(w, r, tun, requestID, pending, unbuffered)
+					addBytesOut(stats, written)
+					bodyRead = complete
+				default:
+					w.Write(resp.Body)
+					addBytesOut(stats, int64(len(resp.Body)))
+				}
+			}
+
+			if healthCheck {
+				metrics.healthChecks.Add(1)
+			} else {
+				metrics.requestsForwarded.Add(1)
+			}
+			recordTimeoutOutcome(tun, false)
+
+			logAccess(tun, r, forwardPath, statusCode, time.Since(start))
+
+		case <-timeout:
+			if !healthCheck {
+				metrics.requestTimeouts.Add(1)
+				promTimeouts.Inc()
+			}
+			stats.Timeouts.Add(1)
+			recordTimeoutOutcome(tun, true)
+			tun.Concurrency.Observe(forwardTimeout)
+			if warmupRetries > 0 {
+				http.Error(w, fmt.Sprintf("Tunnel %s timed out: the local server still wasn't listening after %d warmup retries in %s", tun.ID, warmupRetries, forwardTimeout),
+					http.StatusGatewayTimeout)
+			} else {
+				http.Error(w, fmt.Sprintf("Tunnel %s timed out: the local server didn't respond within %s", tun.ID, forwardTimeout),
+					http.StatusGatewayTimeout)
+			}
+			logAccess(tun, r, forwardPath, http.StatusGatewayTimeout, time.Since(start))
+
+		case <-r.Context().Done():
+			// Either SERVER_REQUEST_TIMEOUT ran out, or the client went away
+			// (then there's nobody to answer)
+			if serverTimeLimitHit(r) {
+				respondServerTimeLimit(w, r, tun, forwardPath, start)
+			}
+
+		case <-tun.Closed():
+			// A response that arrived just before the disconnect still wins
+			if len(pending.Resp) > 0 {
+				continue
+			}
+			// The CLI disconnected mid-request - no response is coming
+			http.Error(w, fmt.Sprintf("Tunnel %s disconnected before responding", tun.ID), http.StatusBadGateway)
+			logAccess(tun, r, forwardPath, http.StatusBadGateway, time.Since(start))
+		}
+
+		return
+	}
+}
+
+// setForwardedHost tells the local app which host the visitor asked for
+// The CLI sends its own Host (localhost:<port> by default), so this is the
+// only place the public host shows up. Always overwritten - a value the
+// visitor sent can't be trusted.
+func setForwardedHost(headers http.Header, r *http.Request) {
+	headers.Set("X-Forwarded-Host", r.Host)
+}
+
+// writeInformational sends a 1xx response (e.g. 103 Early Hints) to the client
+// ahead of the final response. Its headers are removed again afterwards so
+// they don't leak into the final response.
+func writeInformational(w http.ResponseWriter, info *tunnel.HTTPInformational) {
+	copyHeaders(w.Header(), info.Headers)
+	w.WriteHeader(info.StatusCode)
+	for key := range info.Headers {
+		w.Header().Del(key)
+	}
+}
+
+// copyHeaders replaces dst's values with every value from src
+// Repeated headers like Set-Cookie must stay separate lines - joining them
+// with commas breaks cookies
+func copyHeaders(dst, src http.Header) {
+	for key, values := range src {
+		dst.Del(key)
+		for _, value := range values {
+			dst.Add(key, value)
 		}
-		w.WriteHeader(resp.StatusCode)
-		w.Write(resp.Body)
+	}
+}
 
-	case <-time.After(30 * time.Second):
-		http.Error(w, "Tunnel timeout", http.StatusGatewayTimeout)
+// recordTimeoutOutcome feeds the tunnel's rolling timeout window and logs
+// when the timeout rate crosses TIMEOUT_WARN_RATE (or drops back below it)
+func recordTimeoutOutcome(tun *tunnel.Tunnel, timedOut bool) {
+	rate, changed := tun.Timeouts.Record(timedOut, timeoutWarnRate)
+	if !changed {
+		return
+	}
+
+	if tun.Timeouts.Unhealthy() {
+		metrics.timeoutRateWarnings.Add(1)
+		log.Printf("WARNING: tunnel %s is timing out on %.0f%% of recent requests - local server may be overloaded",
+			tun.ID, rate*100)
+	} else {
+		log.Printf("Tunnel %s recovered: timeout rate down to %.0f%%", tun.ID, rate*100)
 	}
 }
 
-// extractSubdomain gets the subdomain from a host
+// copyStreamedBody writes body chunks to the client as they arrive from the CLI
+// The status line is already sent, so on failure all we can do is abort the
+// connection - the client then sees a truncated response rather than a bogus one
+// Returns how many body bytes were written, and whether that was all of it
+func copyStreamedBody(w http.ResponseWriter, r *http.Request, tun *tunnel.Tunnel, requestID string, pending *tunnel.PendingRequest, unbuffered bool) (int64, bool) {
+	timer := time.NewTimer(forwardTimeout)
+	defer timer.Stop()
+
+	// Push data out as soon as we've caught up with the CLI, so slow
+	// producers (progress output, long downloads) reach the client
+	// incrementally instead of sitting in our write buffer
+	// Unbuffered responses flush every chunk, and the headers right away
+	flusher, _ := w.(http.Flusher)
+	if unbuffered && flusher != nil {
+		flusher.Flush()
+	}
+
+	var written int64
+
+	for {
+		select {
+		case chunk := <-pending.Chunks:
+			if len(chunk.Data) > 0 {
+				n, err := w.Write(chunk.Data)
+				written += int64(n)
+				if err != nil {
+					return written, false // Public client went away
+				}
+				if flusher != nil && (unbuffered || len(pending.Chunks) == 0) {
+					flusher.Flush()
+				}
+			}
+			if chunk.EOF {
+				if chunk.Error != "" {
+					log.Printf("Streamed response ended early: %s", chunk.Error)
+					panic(http.ErrAbortHandler)
+				}
+				return written, true
+			}
+			ackBodyChunk(tun, requestID)
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(forwardTimeout)
+
+		case <-timer.C:
+			log.Printf("Timed out waiting for response body chunk")
+			panic(http.ErrAbortHandler)
+
+		case <-pending.Done:
+			// The body overflowed its buffer (or the request was reaped)
+			panic(http.ErrAbortHandler)
+
+		case <-r.Context().Done():
+			if serverTimeLimitHit(r) {
+				log.Printf("Streamed response hit the server's time limit")
+			}
+			panic(http.ErrAbortHandler)
+
+		case <-tun.Closed():
+			// Chunks that arrived before the disconnect are still written above
+			if len(pending.Chunks) > 0 {
+				continue
+			}
+			log.Printf("Tunnel %s disconnected mid-response", tun.ID)
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// extractSubdomain gets the tunnel ID from a request's host, "" if the host
+// doesn't name one
 // e.g., "abc123.tunnelr.io" -> "abc123"
 // e.g., "tunnelr.io" -> ""
 // e.g., "abc123.localhost:8080" -> "abc123"
 func extractSubdomain(host string) string {
-	// Remove port if present
-	if idx := strings.LastIndex(host, ":"); idx != -1 {
-		host = host[:idx]
-	}
-
-	// Split by dots
-	parts := strings.Split(host, ".")
+	return subdomainOf(host, baseDomain)
+}
 
-	// Need at least subdomain.domain.tld (3 parts) or subdomain.localhost (2 parts)
-	if len(parts) < 2 {
-		return ""
+// subdomainOf returns the single label in front of base in host
+// Anything else gives "": another domain, more than one label
+// ("a.b.tunnelr.io"), an IP address, or a label that can't be a tunnel ID.
+// "<id>.localhost" always works, so tunnels can be tried out locally
+// whatever the base domain.
+func subdomainOf(host, base string) string {
+	// Remove the port, if any ("[::1]:8080" becomes "::1")
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
 	}
 
-	// Check if it's just the base domain
-	if host == baseDomain {
+	// Host names are case-insensitive and may end in a dot
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	base = strings.TrimSuffix(strings.ToLower(base), ".")
+
+	if net.ParseIP(host) != nil {
 		return ""
 	}
 
-	// For localhost: abc123.localhost -> abc123
-	if parts[len(parts)-1] == "localhost" && len(parts) == 2 {
-		return parts[0]
+	label, found := strings.CutSuffix(host, "."+base)
+	if !found {
+		label, found = strings.CutSuffix(host, ".localhost")
 	}
-
-	// For real domains: abc123.tunnelr.io -> abc123
-	if len(parts) >= 3 {
-		return parts[0]
+	// "www.<base domain>" is the base domain, not a tunnel
+	if !found || label == "www" || !tunnel.ValidSubdomain(label) {
+		return ""
 	}
-
-	return ""
+	return label
 }
 
 func handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "ok\nactive_tunnels: %d\n", registry.Count())
+	fmt.Fprintf(w, "ok\nversion: %s\n", versionString())
+	fmt.Fprintf(w, "active_tunnels: %d\n", registry.Count())
+	fmt.Fprintf(w, "requests_forwarded: %d\n", metrics.requestsForwarded.Load())
+	fmt.Fprintf(w, "requests_coalesced: %d\n", metrics.requestsCoalesced.Load())
+	fmt.Fprintf(w, "cache_hits: %d\n", metrics.cacheHits.Load())
+	fmt.Fprintf(w, "health_checks: %d\n", metrics.healthChecks.Load())
+	fmt.Fprintf(w, "overload_fallbacks: %d\n", metrics.overloadFallbacks.Load())
+	fmt.Fprintf(w, "rate_limited: %d\n", metrics.rateLimited.Load())
+	fmt.Fprintf(w, "requests_shed: %d\n", metrics.requestsShed.Load())
+	fmt.Fprintf(w, "warmup_retries: %d\n", metrics.warmupRetries.Load())
+	fmt.Fprintf(w, "warmup_retry_failures: %d\n", metrics.warmupRetryFailures.Load())
+	fmt.Fprintf(w, "auth_challenges: %d\n", metrics.authChallenges.Load())
+	fmt.Fprintf(w, "slow_requests: %d\n", metrics.slowRequests.Load())
+	if idPoolSize > 0 {
+		fmt.Fprintf(w, "id_pool_ready: %d/%d\n", registry.IDPoolLen(), idPoolSize)
+	}
+	fmt.Fprintf(w, "request_timeouts: %d\n", metrics.requestTimeouts.Load())
+	fmt.Fprintf(w, "timeout_rate_warnings: %d\n", metrics.timeoutRateWarnings.Load())
+	fmt.Fprintf(w, "idle_tunnels_closed: %d\n", metrics.idleTunnelsClosed.Load())
+	fmt.Fprintf(w, "pending_requests_reaped: %d\n", metrics.pendingReaped.Load())
+	if maxConcurrentRequests > 0 {
+		fmt.Fprintf(w, "admission_waiting: %d\n", admission.Waiting())
+		fmt.Fprintf(w, "admission_rejected: %d\n", metrics.admissionRejected.Load())
+	}
 }
 
 // handleStatus checks if the domain is properly configured
 func handleStatus(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(domainStatus())
+}
 
+// domainStatus checks DNS for the base domain (and the wildcard in
+// subdomain mode) - shared by /status and `server --check`
+func domainStatus() DomainStatus {
 	status := DomainStatus{
 		BaseDomain:    baseDomain,
 		ServerPort:    serverPort,
@@ -397,8 +1338,15 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 		status.Ready = status.DomainCheck.OK
 	}
 
+	// Maintenance overrides everything else - nobody should connect right now
+	inMaintenance, maintenanceMessage := maintenance.Get()
+	status.Maintenance = inMaintenance
+
 	// Provide helpful message
-	if !status.DomainCheck.OK {
+	if inMaintenance {
+		status.Ready = false
+		status.Message = "Maintenance: " + maintenanceMessage
+	} else if !status.DomainCheck.OK {
 		status.Message = fmt.Sprintf("Domain %s does not resolve. Add an A record pointing to your server's IP.", baseDomain)
 	} else if routingMode == "subdomain" && !status.WildcardCheck.OK {
 		status.Message = fmt.Sprintf("Wildcard subdomain not configured. Add an A record for *.%s pointing to your server's IP.", baseDomain)
@@ -410,7 +1358,7 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	json.NewEncoder(w).Encode(status)
+	return status
 }
 
 // DomainStatus represents the configuration status
@@ -421,6 +1369,7 @@ type DomainStatus struct {
 	RoutingMode   string   `json:"routing_mode"`
 	ServerPort    string   `json:"server_port"`
 	ActiveTunnels int      `json:"active_tunnels"`
+	Maintenance   bool     `json:"maintenance"`
 	DomainCheck   DNSCheck `json:"domain_check"`
 	WildcardCheck DNSCheck `json:"wildcard_check"`
 }
@@ -458,3 +1407,63 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+// getEnvInt reads an integer env var, falling back to the default if unset or invalid
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using default %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+// getEnvDuration reads a duration env var like "30s" or "2m"
+// A bare number is taken as seconds
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using default %s", key, value, defaultValue)
+		return defaultValue
+	}
+	return d
+}
+
+// getEnvFloat reads a decimal env var, falling back to the default if unset or invalid
+func getEnvFloat(key string, defaultValue float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using default %g", key, value, defaultValue)
+		return defaultValue
+	}
+	return f
+}
+
+// getEnvBool reads a boolean env var ("true", "1", "false", "0" etc.)
+func getEnvBool(key string, defaultValue bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using default %t", key, value, defaultValue)
+		return defaultValue
+	}
+	return b
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"sync"
+)
+
+// Maintenance mode shows a notice on the landing page and /status, and (by
+// default) answers tunnel requests with a 503 maintenance page
+// Start in maintenance with MAINTENANCE=true, or toggle at runtime through
+// the /admin/maintenance endpoint
+var maintenance = &maintenanceState{
+	enabled: getEnvBool("MAINTENANCE", false),
+	message: getEnv("MAINTENANCE_MESSAGE", "Tunnelr is down for maintenance. Please try again shortly."),
+}
+
+// maintenanceBlocksTunnels makes tunnel traffic get the maintenance page too
+var maintenanceBlocksTunnels = getEnvBool("MAINTENANCE_BLOCK_TUNNELS", true)
+
+// maintenanceState is the current maintenance flag and message
+type maintenanceState struct {
+	mu      sync.RWMutex
+	enabled bool
+	message string
+}
+
+// MaintenanceStatus is the JSON shape of the maintenance state
+type MaintenanceStatus struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message,omitempty"`
+}
+
+// Get returns whether maintenance is on, and the message to show
+func (m *maintenanceState) Get() (bool, string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.enabled, m.message
+}
+
+// Set turns maintenance on or off; an empty message keeps the current one
+func (m *maintenanceState) Set(enabled bool, message string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.enabled = enabled
+	if message != "" {
+		m.message = message
+	}
+}
+
+// showMaintenancePage answers a tunnel request while in maintenance
+func showMaintenancePage(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Retry-After", "300")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html><head><title>Maintenance</title>
+<style>body{font-family:system-ui,sans-serif;max-width:32rem;margin:5rem auto;padding:0 1rem;color:#333}</style>
+</head><body><h1>Down for maintenance</h1><p>%s</p></body></html>
+`, html.EscapeString(message))
+}
+
+// handleMaintenance shows (GET, viewer) or changes (POST, admin) maintenance mode
+// POST body: {"enabled": true, "message": "Back at 14:00 UTC"}
+func handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		// Viewer access is enough (checked by requireRole)
+
+	case http.MethodPost:
+		if roleFor(r) < roleAdmin {
+			http.Error(w, "Forbidden: this action needs the admin token", http.StatusForbidden)
+			return
+		}
+
+		var req MaintenanceStatus
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		maintenance.Set(req.Enabled, req.Message)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	enabled, message := maintenance.Get()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MaintenanceStatus{Enabled: enabled, Message: message})
+}
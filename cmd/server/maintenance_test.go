@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+// setMaintenance turns maintenance on with message until the test ends
+func setMaintenance(t *testing.T, message string) {
+	t.Helper()
+	enabled, old := maintenance.Get()
+	maintenance.Set(true, message)
+	t.Cleanup(func() { maintenance.Set(enabled, old) })
+}
+
+func TestMaintenanceNoticeOnLandingAndStatus(t *testing.T) {
+	setForTest(t, &baseDomain, "tunnelr.test")
+	setForTest(t, &bareDomainAction, "landing")
+	setMaintenance(t, "Back at 14:00 UTC")
+
+	if w := bareRequest("/"); !strings.Contains(w.Body.String(), "MAINTENANCE: Back at 14:00 UTC") {
+		t.Errorf("landing page has no maintenance notice:\n%s", w.Body.String())
+	}
+
+	w := httptest.NewRecorder()
+	handleStatus(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+	var status DomainStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("status isn't JSON: %v", err)
+	}
+	if !status.Maintenance || status.Ready || status.Message != "Maintenance: Back at 14:00 UTC" {
+		t.Errorf("status during maintenance: %+v", status)
+	}
+
+	// Turning it off takes the notice away again
+	maintenance.Set(false, "")
+	if w := bareRequest("/"); strings.Contains(w.Body.String(), "MAINTENANCE") {
+		t.Errorf("landing page still shows maintenance:\n%s", w.Body.String())
+	}
+}
+
+func TestMaintenancePageForTunnelVisitors(t *testing.T) {
+	srv := startTestServer(t)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+		cli.respond(req.ID, http.StatusOK, nil, []byte("app"))
+	})
+	setMaintenance(t, "Upgrading <db> & cache")
+
+	resp, err := http.DefaultClient.Do(cli.newRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("got %d, Retry-After %q; want a 503 with Retry-After", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	// The message is operator text, but still escaped into the page
+	if !strings.Contains(string(body), "Upgrading &lt;db&gt; &amp; cache") {
+		t.Errorf("maintenance page doesn't show the escaped message:\n%s", body)
+	}
+
+	// MAINTENANCE_BLOCK_TUNNELS=false lets traffic through
+	setForTest(t, &maintenanceBlocksTunnels, false)
+	if status, body := cli.get("/"); status != http.StatusOK || string(body) != "app" {
+		t.Errorf("with tunnels unblocked got %d %q", status, body)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+// hugeBody is what the memory tests send each way
+const hugeBody = 100 << 20
+
+// maxHeapGrowth is how much the live heap may grow while hugeBody goes
+// through: a few windows of chunks at each hop, nowhere near the body itself
+const maxHeapGrowth = 16 << 20
+
+// heapWatcher samples the live heap while a transfer runs and keeps the peak
+// Each sample collects garbage first, so it sees what's really held on to.
+type heapWatcher struct {
+	base uint64
+	peak atomic.Uint64
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+func watchHeap() *heapWatcher {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	w := &heapWatcher{base: m.HeapAlloc, stop: make(chan struct{})}
+	w.done.Add(1)
+	go func() {
+		defer w.done.Done()
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+				runtime.GC()
+				var m runtime.MemStats
+				runtime.ReadMemStats(&m)
+				if m.HeapAlloc > w.peak.Load() {
+					w.peak.Store(m.HeapAlloc)
+				}
+			}
+		}
+	}()
+	return w
+}
+
+// growth stops watching and returns the peak growth over the start
+func (w *heapWatcher) growth() int64 {
+	close(w.stop)
+	w.done.Wait()
+	return int64(w.peak.Load()) - int64(w.base)
+}
+
+func TestHugeBodiesUseConstantMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("moves 200 MB")
+	}
+	srv := startTestServer(t)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{Capabilities: allCapabilities},
+		func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+			if req.Method == http.MethodPost {
+				n, _ := io.Copy(io.Discard, body)
+				cli.respond(req.ID, http.StatusOK, nil, []byte(fmt.Sprint(n)))
+				return
+			}
+			cli.respondStreamed(req.ID, http.StatusOK, nil, io.LimitReader(zeros{}, hugeBody))
+		})
+
+	t.Run("upload", func(t *testing.T) {
+		heap := watchHeap()
+		req := cli.newRequest(http.MethodPost, "/upload", io.LimitReader(zeros{}, hugeBody))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		growth := heap.growth()
+
+		if string(got) != fmt.Sprint(hugeBody) {
+			t.Fatalf("CLI received %s bytes, want %d", got, hugeBody)
+		}
+		t.Logf("heap grew by %d KB", growth>>10)
+		if growth > maxHeapGrowth {
+			t.Errorf("heap grew by %d MB uploading %d MB", growth>>20, hugeBody>>20)
+		}
+	})
+
+	t.Run("download", func(t *testing.T) {
+		heap := watchHeap()
+		resp, err := http.DefaultClient.Do(cli.newRequest(http.MethodGet, "/download", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		growth := heap.growth()
+
+		if err != nil || n != hugeBody {
+			t.Fatalf("visitor received %d bytes (%v), want %d", n, err, hugeBody)
+		}
+		t.Logf("heap grew by %d KB", growth>>10)
+		if growth > maxHeapGrowth {
+			t.Errorf("heap grew by %d MB downloading %d MB", growth>>20, hugeBody>>20)
+		}
+	})
+}
@@ -0,0 +1,26 @@
+package main
+
+import "sync/atomic"
+
+// serverMetrics are process-wide counters
+// atomic.Int64 lets any goroutine bump them without a lock
+type serverMetrics struct {
+	requestsForwarded   atomic.Int64 // Requests that got a response from the CLI
+	requestsCoalesced   atomic.Int64 // Requests answered with a copy of an identical in-flight request
+	cacheHits           atomic.Int64 // Requests answered from the response cache
+	requestTimeouts     atomic.Int64 // Requests that hit the forward timeout
+	healthChecks        atomic.Int64 // Health-check requests forwarded (not counted as traffic)
+	overloadFallbacks   atomic.Int64 // Requests answered with a fallback because the CLI was overloaded
+	rateLimited         atomic.Int64 // Requests refused with a 429 by a tunnel's rate limit
+	requestsShed        atomic.Int64 // Requests turned away by adaptive concurrency
+	warmupRetries       atomic.Int64 // Requests sent again because the local server wasn't up yet
+	warmupRetryFailures atomic.Int64 // Warmup retries that couldn't be sent down the tunnel
+	authChallenges      atomic.Int64 // Requests refused with a 401 by a tunnel's basic auth
+	slowRequests        atomic.Int64 // Requests over SLOW_REQUEST_THRESHOLD
+	timeoutRateWarnings atomic.Int64 // Times a tunnel crossed the timeout-rate threshold
+	idleTunnelsClosed   atomic.Int64 // Tunnels closed after IDLE_TIMEOUT without traffic
+	admissionRejected   atomic.Int64 // Requests refused because the admission queue was full or too slow
+	pendingReaped       atomic.Int64 // Leaked pending requests removed by the janitor
+}
+
+var metrics serverMetrics
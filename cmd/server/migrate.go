@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"tunnelr/internal/tunnel"
+)
+
+// Connection migration - moving CLIs to another server instance without
+// dropping their tunnels, for zero-downtime upgrades
+//
+// We send each CLI a TypeMigrate message naming the new instance. The CLI
+// registers there with the same tunnel ID, switches over, and hangs up on us
+// once the requests it's still answering are done. Public traffic has to
+// reach the new instance by then (DNS, load balancer...) - that part is up
+// to the operator.
+//
+// Trigger it with POST /admin/migrate, or set MIGRATE_URL to move every
+// tunnel when the server shuts down.
+
+// migrateURL is where CLIs are sent on shutdown, empty to just close tunnels
+var migrateURL = getEnv("MIGRATE_URL", "")
+
+// MigrateRequest is the JSON body of POST /admin/migrate
+type MigrateRequest struct {
+	ServerURL string `json:"server_url"`          // e.g. wss://tunnel-2.example.com/ws
+	TunnelID  string `json:"tunnel_id,omitempty"` // Only this tunnel, empty for all
+}
+
+// MigrateResult is the answer to POST /admin/migrate
+type MigrateResult struct {
+	Migrated int `json:"migrated"` // CLIs told to move
+	Skipped  int `json:"skipped"`  // CLIs too old to follow, left where they are
+}
+
+// handleMigrate sends tunnels to another server instance (admin only)
+// POST body: {"server_url": "wss://tunnel-2.example.com/ws"}
+func handleMigrate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req MigrateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if !tunnel.ValidServerURL(req.ServerURL) {
+		http.Error(w, "server_url must be a ws:// or wss:// URL", http.StatusBadRequest)
+		return
+	}
+
+	tunnels := registry.All()
+	if req.TunnelID != "" {
+		tun, ok := registry.Get(req.TunnelID)
+		if !ok {
+			http.Error(w, "Tunnel not found: "+req.TunnelID, http.StatusNotFound)
+			return
+		}
+		tunnels = []*tunnel.Tunnel{tun}
+	}
+
+	var result MigrateResult
+	result.Migrated, result.Skipped = migrateTunnels(tunnels, req.ServerURL, "")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// migrateTunnels tells each tunnel's CLI to move to serverURL
+// Returns how many were told, and how many were skipped because their CLI
+// predates migration.
+func migrateTunnels(tunnels []*tunnel.Tunnel, serverURL, reason string) (migrated, skipped int) {
+	msg, err := tunnel.Encode(tunnel.TypeMigrate, tunnel.Migrate{ServerURL: serverURL, Reason: reason})
+	if err != nil {
+		log.Printf("Failed to encode migrate message: %v", err)
+		return 0, 0
+	}
+
+	for _, tun := range tunnels {
+		if !tun.Supports(tunnel.CapMigrate) {
+			skipped++
+			continue
+		}
+		if err := tun.Conn.Send(msg); err != nil {
+			log.Printf("Failed to send tunnel %s to %s: %v", tun.ID, serverURL, err)
+			continue
+		}
+		migrated++
+	}
+	log.Printf("Sent %d tunnels to %s (%d CLIs too old to follow)", migrated, serverURL, skipped)
+	return migrated, skipped
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+// migrateCall posts body to /admin/migrate as the admin
+func migrateCall(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/admin/migrate", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, req)
+	return rec
+}
+
+// migrateListener starts a fake CLI that reports the migrate messages it gets
+func migrateListener(t *testing.T, srv *httptest.Server, caps []string) (*fakeCLI, <-chan tunnel.Migrate) {
+	t.Helper()
+	moves := make(chan tunnel.Migrate, 4)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{Capabilities: caps}, nil)
+	cli.onMessage = func(cli *fakeCLI, msg *tunnel.Message) {
+		if msg.Type == tunnel.TypeMigrate {
+			var m tunnel.Migrate
+			msg.Unmarshal(&m)
+			moves <- m
+		}
+	}
+	return cli, moves
+}
+
+func TestAdminMigrate(t *testing.T) {
+	setForTest(t, &adminToken, "admin-secret")
+	captureLog(t)
+	srv := startTestServer(t)
+
+	first, firstMoves := migrateListener(t, srv, allCapabilities)
+	_, secondMoves := migrateListener(t, srv, allCapabilities)
+
+	// One tunnel
+	rec := migrateCall(t, `{"server_url": "wss://tunnel-2.example.com/ws", "tunnel_id": "`+first.ID+`"}`)
+	var result MigrateResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); rec.Code != http.StatusOK || err != nil {
+		t.Fatalf("got %d %s", rec.Code, rec.Body)
+	}
+	if result.Migrated != 1 || result.Skipped != 0 {
+		t.Errorf("got %+v, want 1 migrated", result)
+	}
+	select {
+	case m := <-firstMoves:
+		if m.ServerURL != "wss://tunnel-2.example.com/ws" {
+			t.Errorf("told to move to %q", m.ServerURL)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the CLI never got the migrate message")
+	}
+	select {
+	case m := <-secondMoves:
+		t.Errorf("the other tunnel was moved too, to %q", m.ServerURL)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Bad requests
+	tests := []struct {
+		body string
+		want int
+	}{
+		{`{"server_url": "https://tunnel-2.example.com"}`, http.StatusBadRequest},
+		{`{"server_url": ""}`, http.StatusBadRequest},
+		{`not json`, http.StatusBadRequest},
+		{`{"server_url": "wss://tunnel-2.example.com/ws", "tunnel_id": "no-such-tunnel-537"}`, http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		if rec := migrateCall(t, tc.body); rec.Code != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.body, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestMigrateSkipsOldCLIs(t *testing.T) {
+	captureLog(t)
+	srv := startTestServer(t)
+	oldCLI, oldMoves := migrateListener(t, srv, []string{tunnel.CapStreaming})
+	newCLI, newMoves := migrateListener(t, srv, allCapabilities)
+	oldTun, _ := registry.Get(oldCLI.ID)
+	newTun, _ := registry.Get(newCLI.ID)
+
+	migrated, skipped := migrateTunnels([]*tunnel.Tunnel{oldTun, newTun}, "wss://tunnel-2.example.com/ws", "upgrading")
+	if migrated != 1 || skipped != 1 {
+		t.Errorf("migrated %d, skipped %d; want 1 and 1", migrated, skipped)
+	}
+	select {
+	case m := <-newMoves:
+		if m.Reason != "upgrading" {
+			t.Errorf("reason %q, want upgrading", m.Reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the up-to-date CLI never got the migrate message")
+	}
+	select {
+	case <-oldMoves:
+		t.Error("a CLI without the migrate capability was sent a message it can't read")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
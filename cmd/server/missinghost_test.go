@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+// getWithoutHost sends an HTTP/1.0 GET with no Host header, the way some raw
+// clients do, and returns the status and body
+func getWithoutHost(t *testing.T, srv *httptest.Server, path string) (int, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "GET "+path+" HTTP/1.0\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestMissingHostInSubdomainMode(t *testing.T) {
+	setForTest(t, &baseDomain, "tunnelr.test")
+	srv := startTestServer(t)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		cli.respond(req.ID, http.StatusOK, nil, []byte("default tunnel got "+req.Path))
+	})
+
+	// By default it's a 400 that says what's missing
+	setForTest(t, &missingHostTunnel, "")
+	status, body := getWithoutHost(t, srv, "/hook")
+	if status != http.StatusBadRequest || !strings.Contains(body, "Missing Host header") || !strings.Contains(body, "<tunnel-id>.tunnelr.test") {
+		t.Errorf("got %d %q, want a 400 asking for a Host", status, body)
+	}
+
+	// Or it goes to the configured tunnel
+	missingHostTunnel = cli.ID
+	status, body = getWithoutHost(t, srv, "/hook")
+	if status != http.StatusOK || body != "default tunnel got /hook" {
+		t.Errorf("got %d %q, want it forwarded to %s", status, body, cli.ID)
+	}
+
+	// A configured tunnel that isn't connected is just a missing tunnel
+	missingHostTunnel = "not-connected-523"
+	if status, _ := getWithoutHost(t, srv, "/hook"); status != http.StatusNotFound {
+		t.Errorf("unknown default tunnel got %d, want 404", status)
+	}
+}
+
+func TestMissingHostInPathMode(t *testing.T) {
+	setForTest(t, &routingMode, "path")
+	setForTest(t, &missingHostTunnel, "")
+	srv := startTestServer(t)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		cli.respond(req.ID, http.StatusOK, nil, []byte("got "+req.Path))
+	})
+
+	// The path names the tunnel, so no Host is needed
+	status, body := getWithoutHost(t, srv, "/t/"+cli.ID+"/hook")
+	if status != http.StatusOK || body != "got /hook" {
+		t.Errorf("got %d %q, want it forwarded by path", status, body)
+	}
+}
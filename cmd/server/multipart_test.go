@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+// multipartUpload builds a form with a text field and a file of fileSize
+// random bytes, with a boundary full of the characters a header parser
+// might trip on
+func multipartUpload(t *testing.T, fileSize int) (contentType string, body []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	if err := mw.SetBoundary("----tunnelr,543 (x=y) part:1/2?"); err != nil {
+		t.Fatal(err)
+	}
+	mw.WriteField("title", "holiday photos, day 1")
+	fw, err := mw.CreateFormFile("file", "photo.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := make([]byte, fileSize)
+	rand.New(rand.NewSource(543)).Read(file)
+	fw.Write(file)
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return mw.FormDataContentType(), buf.Bytes()
+}
+
+func TestMultipartUploadsRoundTrip(t *testing.T) {
+	setForTest(t, &streamThreshold, 4*1024) // So the large upload is streamed
+	srv := startTestServer(t)
+
+	type received struct {
+		contentTypes []string
+		body         []byte
+		streamed     bool
+	}
+	got := make(chan received, 1)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{Capabilities: allCapabilities}, func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+		data, _ := io.ReadAll(body)
+		got <- received{req.Headers.Values("Content-Type"), data, req.Streamed}
+		cli.respond(req.ID, http.StatusOK, nil, nil)
+	})
+
+	for _, size := range []int{1000, 64 * 1024} {
+		contentType, upload := multipartUpload(t, size)
+		req := cli.newRequest(http.MethodPost, "/upload", bytes.NewReader(upload))
+		req.Header.Set("Content-Type", contentType)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		r := <-got
+		if r.streamed != (size > 4*1024) {
+			t.Errorf("%d-byte file: streamed %v", size, r.streamed)
+		}
+		if len(r.contentTypes) != 1 || r.contentTypes[0] != contentType {
+			t.Errorf("%d-byte file: CLI got Content-Type %q, want %q", size, r.contentTypes, contentType)
+		}
+		if !bytes.Equal(r.body, upload) {
+			t.Errorf("%d-byte file: CLI got %d bytes, want the visitor's %d byte for byte", size, len(r.body), len(upload))
+		}
+	}
+}
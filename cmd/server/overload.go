@@ -0,0 +1,180 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+// Overload fallbacks - a CLI started with --max-concurrent answers 503 (marked
+// with X-Tunnelr-Overloaded) once it has that many requests in flight. Rather
+// than passing the raw 503 on, a tunnel can ask for a friendlier fallback:
+//
+//	error  the 503 as-is (the default)
+//	page   a "busy" page, OVERLOAD_PAGE or a built-in one
+//	stale  the last good response to the same GET, falling back to the page
+//
+// The CLI picks with --overload-fallback; OVERLOAD_FALLBACK is the default
+// for tunnels that don't.
+var (
+	overloadFallback     = getEnv("OVERLOAD_FALLBACK", tunnel.FallbackError)
+	overloadPage         = getEnv("OVERLOAD_PAGE", defaultOverloadPage)
+	overloadStaleMaxAge  = getEnvDuration("OVERLOAD_STALE_MAX_AGE", 10*time.Minute)
+	overloadStaleEntries = getEnvInt("OVERLOAD_STALE_MAX_ENTRIES", 100)
+
+	lastGood = &lastGoodStore{entries: make(map[string]*lastGoodEntry)}
+)
+
+// fallbackHeader tells clients which fallback answered instead of the app
+const fallbackHeader = "X-Tunnel-Fallback"
+
+const defaultOverloadPage = `<!DOCTYPE html>
+<html>
+<head><title>Busy</title></head>
+<body style="font-family: sans-serif; text-align: center; padding-top: 15%">
+<h1>This site is busy right now</h1>
+<p>Please try again in a few seconds.</p>
+</body>
+</html>
+`
+
+// fallbackMode returns the fallback a tunnel uses
+func fallbackMode(tun *tunnel.Tunnel) string {
+	if tun.OverloadFallback != "" {
+		return tun.OverloadFallback
+	}
+	return overloadFallback
+}
+
+// isOverloaded reports whether the CLI turned a request away because it's at
+// its concurrency limit
+func isOverloaded(resp *tunnel.HTTPResponse) bool {
+	return resp.StatusCode == http.StatusServiceUnavailable && resp.Headers.Get(tunnel.OverloadedHeader) != ""
+}
+
+// serveOverloadFallback answers an overloaded request with the tunnel's fallback
+// Returns the status it sent, or 0 if the CLI's 503 should go out as-is
+func serveOverloadFallback(w http.ResponseWriter, r *http.Request, tun *tunnel.Tunnel) int {
+	mode := fallbackMode(tun)
+
+	if mode == tunnel.FallbackStale {
+		if key := coalesceKey(r, tun); key != "" {
+			if resp, age, ok := lastGood.Get(key, tun); ok {
+				// Nobody downstream should keep the stale copy
+				header := resp.header.Clone()
+				header.Set("Cache-Control", "no-store")
+				header.Set("Age", strconv.Itoa(int(age.Seconds())))
+				header.Set(fallbackHeader, "stale")
+				writeSharedResponse(w, &coalescedResponse{status: resp.status, header: header, body: resp.body})
+				return resp.status
+			}
+		}
+		mode = tunnel.FallbackPage
+	}
+
+	if mode != tunnel.FallbackPage {
+		return 0
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", "5")
+	w.Header().Set(fallbackHeader, "page")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	io.WriteString(w, overloadPage)
+	return http.StatusServiceUnavailable
+}
+
+// lastGoodEntry is the most recent successful response to one request
+type lastGoodEntry struct {
+	tun    *tunnel.Tunnel // Only served on the same tunnel, not a later one with the same ID
+	resp   *coalescedResponse
+	stored time.Time
+}
+
+// lastGoodStore keeps recent successful responses for the stale fallback
+type lastGoodStore struct {
+	mu      sync.Mutex
+	entries map[string]*lastGoodEntry
+}
+
+// Get returns the last good response for key if it's recent enough
+func (s *lastGoodStore) Get(key string, tun *tunnel.Tunnel) (*coalescedResponse, time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, exists := s.entries[key]
+	if !exists || entry.tun != tun {
+		return nil, 0, false
+	}
+	age := time.Since(entry.stored)
+	if age > overloadStaleMaxAge {
+		delete(s.entries, key)
+		return nil, 0, false
+	}
+	return entry.resp, age, true
+}
+
+// Put remembers a response
+// When the store is full, entries that are too old (or whose tunnel is gone)
+// are dropped first; if it's still full the response isn't kept
+func (s *lastGoodStore) Put(key string, tun *tunnel.Tunnel, resp *coalescedResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if _, exists := s.entries[key]; !exists && len(s.entries) >= overloadStaleEntries {
+		for k, entry := range s.entries {
+			if now.Sub(entry.stored) > overloadStaleMaxAge || isClosed(entry.tun) {
+				delete(s.entries, k)
+			}
+		}
+		if len(s.entries) >= overloadStaleEntries {
+			return
+		}
+	}
+	s.entries[key] = &lastGoodEntry{tun: tun, resp: resp, stored: now}
+}
+
+// rememberLastGood keeps a recorded response for the stale fallback
+// Only successful responses qualify, and never ones that set cookies or
+// forbid storing
+func rememberLastGood(key string, tun *tunnel.Tunnel, resp *coalescedResponse) {
+	if fallbackMode(tun) != tunnel.FallbackStale || resp == nil {
+		return
+	}
+	if resp.status < 200 || resp.status > 299 || resp.header.Get(fallbackHeader) != "" {
+		return
+	}
+	if len(resp.header.Values("Set-Cookie")) > 0 {
+		return
+	}
+	if _, noStore := parseCacheControl(resp.header.Values("Cache-Control"))["no-store"]; noStore {
+		return
+	}
+	lastGood.Put(key, tun, resp)
+}
+
+// isClosed reports whether a tunnel has been removed
+func isClosed(tun *tunnel.Tunnel) bool {
+	select {
+	case <-tun.Closed():
+		return true
+	default:
+		return false
+	}
+}
+
+// validateOverloadFallback checks a fallback a CLI asked for
+// Unknown names are ignored (with a log line) so the server default applies
+func validateOverloadFallback(name, remoteAddr string) string {
+	if name == "" || tunnel.ValidFallback(name) {
+		return name
+	}
+	log.Printf("Ignoring unknown overload fallback %q from %s", name, remoteAddr)
+	return ""
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+// overloadableCLI answers "<path> v<n>" until overloaded is set, then
+// answers the way a CLI at its --max-concurrent limit does
+func overloadableCLI(t *testing.T, srv *httptest.Server, fallback string, overloaded *atomic.Bool) *fakeCLI {
+	t.Helper()
+	var version atomic.Int32
+	return startFakeCLI(t, srv, tunnel.TunnelRegister{OverloadFallback: fallback}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		switch {
+		case overloaded.Load():
+			cli.respond(req.ID, http.StatusServiceUnavailable, http.Header{tunnel.OverloadedHeader: {"1"}}, []byte("The tunnel is busy"))
+		case req.Path == "/app-503":
+			cli.respond(req.ID, http.StatusServiceUnavailable, nil, []byte("the app's own 503"))
+		case req.Path == "/cookie":
+			cli.respond(req.ID, http.StatusOK, http.Header{"Set-Cookie": {"session=1"}}, []byte("personal"))
+		default:
+			cli.respond(req.ID, http.StatusOK, nil, []byte(fmt.Sprintf("%s v%d", req.Path, version.Add(1))))
+		}
+	})
+}
+
+// visit sends a GET and returns the status, fallback header and body
+func visit(t *testing.T, cli *fakeCLI, path string) (int, string, string) {
+	t.Helper()
+	resp, err := http.DefaultClient.Do(cli.newRequest(http.MethodGet, path, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, resp.Header.Get(fallbackHeader), string(body)
+}
+
+func TestOverloadFallbackError(t *testing.T) {
+	srv := startTestServer(t)
+	var overloaded atomic.Bool
+	cli := overloadableCLI(t, srv, tunnel.FallbackError, &overloaded)
+
+	overloaded.Store(true)
+	if status, fallback, body := visit(t, cli, "/"); status != http.StatusServiceUnavailable || fallback != "" || body != "The tunnel is busy" {
+		t.Errorf("got %d %q %q, want the CLI's 503 as-is", status, fallback, body)
+	}
+}
+
+func TestOverloadFallbackPage(t *testing.T) {
+	setForTest(t, &overloadPage, "<h1>Back soon</h1>")
+	srv := startTestServer(t)
+	var overloaded atomic.Bool
+	cli := overloadableCLI(t, srv, tunnel.FallbackPage, &overloaded)
+
+	// The app's own 503s aren't replaced
+	if status, fallback, body := visit(t, cli, "/app-503"); status != http.StatusServiceUnavailable || fallback != "" || body != "the app's own 503" {
+		t.Errorf("app 503: got %d %q %q", status, fallback, body)
+	}
+
+	overloaded.Store(true)
+	before := metrics.overloadFallbacks.Load()
+	resp, err := http.DefaultClient.Do(cli.newRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || string(body) != "<h1>Back soon</h1>" {
+		t.Errorf("got %d %q, want the busy page", resp.StatusCode, body)
+	}
+	for name, want := range map[string]string{fallbackHeader: "page", "Retry-After": "5", "Cache-Control": "no-store"} {
+		if got := resp.Header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if got := metrics.overloadFallbacks.Load() - before; got != 1 {
+		t.Errorf("overload_fallbacks went up by %d, want 1", got)
+	}
+}
+
+func TestOverloadFallbackStale(t *testing.T) {
+	setForTest(t, &lastGood, &lastGoodStore{entries: make(map[string]*lastGoodEntry)})
+	srv := startTestServer(t)
+	var overloaded atomic.Bool
+	cli := overloadableCLI(t, srv, tunnel.FallbackStale, &overloaded)
+
+	visit(t, cli, "/page")
+	visit(t, cli, "/page") // The latest good answer is the one kept
+	visit(t, cli, "/cookie")
+
+	overloaded.Store(true)
+	if status, fallback, body := visit(t, cli, "/page"); status != http.StatusOK || fallback != "stale" || body != "/page v2" {
+		t.Errorf("/page: got %d %q %q, want the last good response", status, fallback, body)
+	}
+
+	// Nothing good to show: the busy page instead
+	for _, path := range []string{"/never-seen", "/cookie"} {
+		if status, fallback, _ := visit(t, cli, path); status != http.StatusServiceUnavailable || fallback != "page" {
+			t.Errorf("%s: got %d %q, want the busy page", path, status, fallback)
+		}
+	}
+}
+
+func TestServerDefaultOverloadFallback(t *testing.T) {
+	setForTest(t, &overloadFallback, tunnel.FallbackPage)
+	srv := startTestServer(t)
+	var overloaded atomic.Bool
+	overloaded.Store(true)
+
+	// A CLI that doesn't choose (or asks for something unknown) gets the default
+	for _, fallback := range []string{"", "retry-later"} {
+		cli := overloadableCLI(t, srv, fallback, &overloaded)
+		if status, got, _ := visit(t, cli, "/"); status != http.StatusServiceUnavailable || got != "page" {
+			t.Errorf("fallback %q: got %d %q, want the server's page fallback", fallback, status, got)
+		}
+	}
+
+	// A CLI's choice wins over it
+	cli := overloadableCLI(t, srv, tunnel.FallbackError, &overloaded)
+	if _, got, body := visit(t, cli, "/"); got != "" || !strings.Contains(body, "busy") {
+		t.Errorf("error fallback: got %q %q, want the CLI's 503", got, body)
+	}
+}
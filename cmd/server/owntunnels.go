@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"tunnelr/internal/tunnel"
+)
+
+// GET /api/tunnels lists the tunnels opened with the caller's auth token, so
+// `tunnelr list` can show them from any terminal. Unlike /admin/tunnels it
+// needs no operator token - only the same token the CLI connects with, sent
+// as "Authorization: Bearer <token>". Other people's tunnels never show up.
+
+// handleOwnTunnels lists the tunnels owned by the request's bearer token
+func handleOwnTunnels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Tunnels opened without a token all share the "" owner, so there's no
+	// way to tell whose they are
+	token := bearerToken(r)
+	if token == "" || !tunnelTokenAllowed(token) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="tunnelr"`)
+		http.Error(w, "Unauthorized: send the auth token your tunnels were opened with", http.StatusUnauthorized)
+		return
+	}
+
+	list := tunnel.OwnTunnels{Tunnels: []tunnel.OwnTunnel{}}
+	for _, info := range registry.ListByOwner(token) {
+		list.Tunnels = append(list.Tunnels, tunnel.OwnTunnel{
+			ID:          info.ID,
+			LocalPort:   info.LocalPort,
+			PublicURL:   publicURLFor(info.ID),
+			ConnectedAt: info.CreatedAt,
+		})
+	}
+	list.Count = len(list.Tunnels)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(list)
+}
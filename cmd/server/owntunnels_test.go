@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+// listOwnTunnels calls /api/tunnels on the base domain with token
+func listOwnTunnels(t *testing.T, token string) (int, tunnel.OwnTunnels) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/api/tunnels", nil)
+	req.Host = baseDomain
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, req)
+
+	var list tunnel.OwnTunnels
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code, list
+}
+
+func TestOwnTunnelsListsOnlyTheCallersTunnels(t *testing.T) {
+	srv := startTestServer(t)
+	first := startFakeCLI(t, srv, tunnel.TunnelRegister{AuthToken: "alice-519", LocalPort: 3000}, nil)
+	second := startFakeCLI(t, srv, tunnel.TunnelRegister{AuthToken: "alice-519", LocalPort: 8080}, nil)
+	startFakeCLI(t, srv, tunnel.TunnelRegister{AuthToken: "bob-519", LocalPort: 3000}, nil)
+
+	status, list := listOwnTunnels(t, "alice-519")
+	if status != http.StatusOK {
+		t.Fatalf("got %d", status)
+	}
+	if list.Count != 2 || len(list.Tunnels) != 2 {
+		t.Fatalf("got %+v, want alice's 2 tunnels", list)
+	}
+	sort.Slice(list.Tunnels, func(i, j int) bool { return list.Tunnels[i].LocalPort < list.Tunnels[j].LocalPort })
+	for i, want := range []struct {
+		id   string
+		port int
+	}{{first.ID, 3000}, {second.ID, 8080}} {
+		got := list.Tunnels[i]
+		if got.ID != want.id || got.LocalPort != want.port || got.PublicURL != publicURLFor(want.id) || got.ConnectedAt.IsZero() {
+			t.Errorf("tunnel %d: got %+v, want %s on port %d", i, got, want.id, want.port)
+		}
+	}
+
+	// No tunnels with a token is an empty list, not an error
+	if status, list := listOwnTunnels(t, "carol-519"); status != http.StatusOK || list.Count != 0 || list.Tunnels == nil {
+		t.Errorf("token with no tunnels: got %d %+v", status, list)
+	}
+	// Without a token there's no telling whose tunnels are whose
+	if status, _ := listOwnTunnels(t, ""); status != http.StatusUnauthorized {
+		t.Errorf("no token: got %d, want 401", status)
+	}
+}
+
+func TestOwnTunnelsOnlyOnBaseHost(t *testing.T) {
+	srv := startTestServer(t)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{AuthToken: "dave-519"}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		cli.respond(req.ID, http.StatusOK, nil, []byte("the app's own API"))
+	})
+
+	// On the tunnel's host it's the app's endpoint, and the token isn't
+	// looked at (or answered for) by the server
+	req := cli.newRequest(http.MethodGet, "/api/tunnels", nil)
+	req.Header.Set("Authorization", "Bearer dave-519")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "the app's own API" {
+		t.Errorf("on the tunnel's host got %d %q, want it forwarded", resp.StatusCode, body)
+	}
+
+	if status, list := listOwnTunnels(t, "dave-519"); status != http.StatusOK || list.Count != 1 {
+		t.Errorf("on the base domain got %d %+v, want dave's tunnel", status, list)
+	}
+}
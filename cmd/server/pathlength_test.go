@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+// pathOfLength builds a path with a query string, length bytes in all
+func pathOfLength(length int) string {
+	return "/search?q=" + strings.Repeat("a", length-len("/search?q="))
+}
+
+func TestMaxPathLengthBoundary(t *testing.T) {
+	setForTest(t, &maxPathLength, 64)
+	setForTest(t, &routingMode, "subdomain")
+	srv := startTestServer(t)
+	var forwarded atomic.Int32
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		forwarded.Add(1)
+		cli.respond(req.ID, http.StatusOK, nil, nil)
+	})
+
+	// The query string counts, the tunnel ID doesn't
+	tests := []struct {
+		length int
+		want   int
+	}{
+		{63, http.StatusOK},
+		{64, http.StatusOK},
+		{65, http.StatusRequestURITooLong},
+		{4000, http.StatusRequestURITooLong},
+	}
+	for _, mode := range []string{"subdomain", "path"} {
+		routingMode = mode
+		for _, tc := range tests {
+			path := pathOfLength(tc.length)
+			req := cli.newRequest(http.MethodGet, path, nil)
+			if mode == "path" {
+				req = cli.newRequest(http.MethodGet, "/t/"+cli.ID+path, nil)
+				req.Host = baseDomain
+			}
+			before := forwarded.Load()
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tc.want {
+				t.Errorf("%s mode, %d byte path: got %d, want %d", mode, tc.length, resp.StatusCode, tc.want)
+			}
+			if reached := forwarded.Load() > before; reached != (tc.want == http.StatusOK) {
+				t.Errorf("%s mode, %d byte path: forwarded %v", mode, tc.length, reached)
+			}
+			if tc.want == http.StatusRequestURITooLong && !strings.Contains(string(body), "at most 64 bytes") {
+				t.Errorf("%s mode: 414 body %q doesn't give the limit", mode, body)
+			}
+		}
+	}
+	routingMode = "subdomain"
+
+	// 0 turns the limit off
+	maxPathLength = 0
+	if status, _ := cli.get(pathOfLength(4000)); status != http.StatusOK {
+		t.Errorf("with no limit a long path got %d", status)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestExtractFromPath(t *testing.T) {
+	tests := []struct {
+		requestURI  string
+		wantID      string
+		wantForward string
+	}{
+		{"/t/abc123/webhook", "abc123", "/webhook"},
+		{"/t/abc123", "abc123", "/"},
+		{"/t/abc123/", "abc123", "/"},
+		{"/t/abc123/search?q=1", "abc123", "/search?q=1"},
+		{"/t/abc123?q=1", "abc123", "/?q=1"},
+		{"/t/abc123/?q=1&r=2", "abc123", "/?q=1&r=2"},
+		{"/t/abc123/docs/", "abc123", "/docs/"},
+		{"/t/abc123/search?", "abc123", "/search?"},
+		{"/t/abc123/files/a%2Fb%20c", "abc123", "/files/a%2Fb%20c"},
+		{"/t/abc123/search?q=a%26b&next=%2Fhome", "abc123", "/search?q=a%26b&next=%2Fhome"},
+		{"/t/abc123/a?b=/t/other/x", "abc123", "/a?b=/t/other/x"},
+		{"/t/", "", ""},
+		{"/t/?q=1", "", ""},
+		{"/webhook", "", ""},
+		{"/webhook?to=/t/abc123", "", ""},
+	}
+	for _, tc := range tests {
+		id, forward := extractFromPath(tc.requestURI)
+		if id != tc.wantID || forward != tc.wantForward {
+			t.Errorf("extractFromPath(%q) = %q, %q; want %q, %q", tc.requestURI, id, forward, tc.wantID, tc.wantForward)
+		}
+	}
+}
+
+func TestPathRoutingForwardsQueryAndEscapes(t *testing.T) {
+	setForTest(t, &routingMode, "path")
+	srv := startTestServer(t)
+	forwarded := make(chan string, 1)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		forwarded <- req.Path
+		cli.respond(req.ID, http.StatusOK, nil, nil)
+	})
+
+	resp, err := http.Get(srv.URL + "/t/" + cli.ID + "/files/a%2Fb?q=1&next=%2Fhome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d", resp.StatusCode)
+	}
+	if got, want := <-forwarded, "/files/a%2Fb?q=1&next=%2Fhome"; got != want {
+		t.Errorf("forwarded %q, want %q like subdomain mode sends", got, want)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestLargeBodiesThroughGzipAndPlainTunnels(t *testing.T) {
+	srv := startTestServer(t)
+	body := []byte(strings.Repeat("some very compressible tunnel traffic\n", 900<<10/38))
+
+	// Echoes the request body back
+	echo := func(cli *fakeCLI, req *tunnel.HTTPRequest, reqBody io.Reader) {
+		data, _ := io.ReadAll(reqBody)
+		cli.respond(req.ID, http.StatusOK, nil, data)
+	}
+	clis := map[string]tunnel.TunnelRegister{
+		"gzip":  {Capabilities: []string{tunnel.CapStreaming, tunnel.CapGzip}},
+		"plain": {Capabilities: []string{tunnel.CapStreaming}},
+	}
+	for name, reg := range clis {
+		cli := startFakeCLI(t, srv, reg, echo)
+		if cli.codec.Gzip != (name == "gzip") {
+			t.Fatalf("%s: codec gzip = %v", name, cli.codec.Gzip)
+		}
+
+		resp, err := http.DefaultClient.Do(cli.newRequest(http.MethodPost, "/echo", bytes.NewReader(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !bytes.Equal(got, body) {
+			t.Errorf("%s: got %d with %d bytes, want the %d bytes sent", name, resp.StatusCode, len(got), len(body))
+		}
+	}
+}
+
+func TestRegisteredGzipLevel(t *testing.T) {
+	captureLog(t)
+	srv := startTestServer(t)
+	tests := []struct {
+		asked, want int
+	}{
+		{9, 9},
+		{1, 1},
+		{0, 0},
+		{42, 0}, // Out of range: the default, not a refused tunnel
+		{-1, 0},
+	}
+	for _, tc := range tests {
+		cli := startFakeCLI(t, srv, tunnel.TunnelRegister{Capabilities: allCapabilities, GzipLevel: tc.asked}, nil)
+		tun, ok := registry.Get(cli.ID)
+		if !ok {
+			t.Fatalf("level %d: tunnel not registered", tc.asked)
+		}
+		if codec := tun.Codec(); codec.Level != tc.want || !codec.Gzip {
+			t.Errorf("asked for level %d: codec %+v, want gzip at level %d", tc.asked, codec, tc.want)
+		}
+	}
+}
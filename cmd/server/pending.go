@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Pending-request janitor - every forwarded request waits in its tunnel's
+// pending map until the handler that sent it is done. A bug that skips that
+// cleanup would leave entries behind for as long as the tunnel lives, so a
+// background check removes any that are old and have stopped making
+// progress. The tunnelr_pending_requests gauge shows the map sizes.
+
+// pendingMaxAge is how old a pending request has to be before the janitor
+// looks at it, 0 = work it out from the timeouts (see pendingLimits)
+var pendingMaxAge = getEnvDuration("PENDING_MAX_AGE", 0)
+
+var promPendingReaped = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "tunnelr_pending_requests_reaped_total",
+	Help: "Leaked pending requests removed by the janitor.",
+})
+
+func init() {
+	promRegistry.MustRegister(promPendingReaped)
+}
+
+// pendingLimits returns the age past which a pending request may be removed,
+// and how long it must have made no progress
+// A handler waiting for its response gives up after REQUEST_TIMEOUT without
+// progress, and none lasts longer than SERVER_REQUEST_TIMEOUT. Without that
+// cap a long download is legitimate, so the default age is generous.
+func pendingLimits() (maxAge, quiet time.Duration) {
+	quiet = 2 * forwardTimeout
+	switch {
+	case pendingMaxAge > 0:
+		maxAge = pendingMaxAge
+	case serverRequestTimeout > 0:
+		maxAge = serverRequestTimeout + forwardTimeout
+	default:
+		maxAge = time.Hour
+	}
+	return max(maxAge, quiet), quiet
+}
+
+// startPendingJanitor checks the pending maps in the background
+func startPendingJanitor() {
+	maxAge, quiet := pendingLimits()
+	interval := min(maxAge/4, time.Minute)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			reapPendingRequests(now, maxAge, quiet)
+		}
+	}()
+}
+
+// reapPendingRequests removes leaked pending requests as of now
+func reapPendingRequests(now time.Time, maxAge, quiet time.Duration) {
+	if reaped := registry.ReapPending(now, maxAge, quiet); reaped > 0 {
+		log.Printf("Removed %d leaked pending requests (older than %s, no progress for %s)", reaped, maxAge, quiet)
+		metrics.pendingReaped.Add(int64(reaped))
+		promPendingReaped.Add(float64(reaped))
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestPendingLimits(t *testing.T) {
+	tests := []struct {
+		maxAge, serverTimeout, forward time.Duration
+		wantAge, wantQuiet             time.Duration
+	}{
+		{0, 0, 30 * time.Second, time.Hour, time.Minute},
+		{0, 2 * time.Minute, 30 * time.Second, 150 * time.Second, time.Minute},
+		{10 * time.Minute, 2 * time.Minute, 30 * time.Second, 10 * time.Minute, time.Minute},
+		// Never younger than the quiet spell
+		{10 * time.Second, 0, 30 * time.Second, time.Minute, time.Minute},
+	}
+	for _, tc := range tests {
+		setForTest(t, &pendingMaxAge, tc.maxAge)
+		setForTest(t, &serverRequestTimeout, tc.serverTimeout)
+		setForTest(t, &forwardTimeout, tc.forward)
+		age, quiet := pendingLimits()
+		if age != tc.wantAge || quiet != tc.wantQuiet {
+			t.Errorf("PENDING_MAX_AGE=%s SERVER_REQUEST_TIMEOUT=%s REQUEST_TIMEOUT=%s: got %s/%s, want %s/%s",
+				tc.maxAge, tc.serverTimeout, tc.forward, age, quiet, tc.wantAge, tc.wantQuiet)
+		}
+	}
+}
+
+func TestJanitorReapsLeakedPendingRequests(t *testing.T) {
+	srv := startTestServer(t)
+	logs := captureLog(t)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, nil)
+	tun, _ := registry.Get(cli.ID)
+
+	// A request whose handler never cleaned up after itself
+	leaked, _ := tun.Pending.Add("leaked-540")
+	maxAge, quiet := pendingLimits()
+
+	// Too young to touch
+	reapPendingRequests(time.Now(), maxAge, quiet)
+	if _, ok := tun.Pending.Get("leaked-540"); !ok {
+		t.Fatal("reaped a request younger than the max age")
+	}
+
+	metricBefore := metrics.pendingReaped.Load()
+	promBefore := scrapeMetrics(t, srv.URL)["tunnelr_pending_requests_reaped_total"]
+	reapPendingRequests(time.Now().Add(maxAge+quiet), maxAge, quiet)
+
+	if _, ok := tun.Pending.Get("leaked-540"); ok {
+		t.Error("leaked request still pending")
+	}
+	select {
+	case <-leaked.Done:
+	default:
+		t.Error("Done not closed for the reaped request")
+	}
+	if got := metrics.pendingReaped.Load() - metricBefore; got < 1 {
+		t.Errorf("pending_requests_reaped went up by %d, want at least 1", got)
+	}
+	if got := scrapeMetrics(t, srv.URL)["tunnelr_pending_requests_reaped_total"] - promBefore; got < 1 {
+		t.Errorf("tunnelr_pending_requests_reaped_total went up by %v, want at least 1", got)
+	}
+	if !strings.Contains(logs.String(), "leaked pending requests") {
+		t.Errorf("nothing logged about the reaped request: %q", logs.String())
+	}
+
+	// The tunnel itself is fine
+	if _, ok := registry.Get(cli.ID); !ok {
+		t.Error("reaping closed the tunnel")
+	}
+}
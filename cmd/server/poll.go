@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+// Long-polling endpoints for CLIs behind proxies that block WebSocket
+// upgrades (tunnelr connect --transport poll) - see tunnel/poll.go
+//
+// Each session is a tunnel.PollConn. pollListener hands them to an
+// http.Server running handleTunnelConnection, so a polled tunnel goes through
+// the same upgrade, registration and read loop as any other.
+
+// pollLinger is how long a closed session stays around so the CLI can
+// collect what was written last (e.g. the close frame)
+const pollLinger = 2 * tunnel.PollWait
+
+// pollSession is one long-polling connection
+type pollSession struct {
+	conn    *tunnel.PollConn
+	in, out *tunnel.PollBuffer // CLI -> server, server -> CLI
+}
+
+var (
+	pollSessionsMu sync.Mutex
+	pollSessions   = make(map[string]*pollSession)
+
+	pollListener = newPollConnListener()
+	pollOnce     sync.Once
+)
+
+// handlePoll serves /poll/open, /poll/send, /poll/recv and /poll/close
+func handlePoll(w http.ResponseWriter, r *http.Request) {
+	action := strings.TrimPrefix(r.URL.Path, tunnel.PollPath+"/")
+	if action == "open" {
+		openPollSession(w, r)
+		return
+	}
+
+	pollSessionsMu.Lock()
+	id := r.URL.Query().Get("session")
+	sess := pollSessions[id]
+	pollSessionsMu.Unlock()
+	if sess == nil {
+		// Unknown or ended - the CLI treats this like a closed connection
+		http.Error(w, "No such poll session", http.StatusGone)
+		return
+	}
+
+	switch action {
+	case "send":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Use POST to send", http.StatusMethodNotAllowed)
+			return
+		}
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, tunnel.PollMaxBytes))
+		if err != nil {
+			http.Error(w, "Failed to read the body", http.StatusBadRequest)
+			return
+		}
+		if _, err := sess.in.Write(data); err != nil {
+			http.Error(w, "Poll session closed", http.StatusGone)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case "recv":
+		data, err := sess.out.Take(tunnel.PollMaxBytes, tunnel.PollWait)
+		if err == io.EOF {
+			// Everything the server wrote has been collected
+			removePollSession(id)
+			http.Error(w, "Poll session closed", http.StatusGone)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(data)
+
+	case "close":
+		// Like the CLI hanging up a socket: the WebSocket reads EOF
+		sess.in.Close()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// openPollSession starts a session and hands its connection to the
+// WebSocket handler
+func openPollSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Use POST to open a session", http.StatusMethodNotAllowed)
+		return
+	}
+	if shuttingDown.Load() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	pollOnce.Do(func() {
+		// The header timeout drops sessions that never send their upgrade request
+		srv := &http.Server{Handler: http.HandlerFunc(handleTunnelConnection), ReadHeaderTimeout: registerTimeout}
+		go srv.Serve(pollListener)
+	})
+
+	idBytes := make([]byte, 16)
+	rand.Read(idBytes)
+	id := hex.EncodeToString(idBytes)
+
+	sess := &pollSession{in: tunnel.NewPollBuffer(), out: tunnel.NewPollBuffer()}
+	sess.conn = tunnel.NewPollConn(sess.in, sess.out, tunnel.PollAddr(r.Host), tunnel.PollAddr(r.RemoteAddr), func() {
+		time.AfterFunc(pollLinger, func() { removePollSession(id) })
+	})
+
+	pollSessionsMu.Lock()
+	pollSessions[id] = sess
+	pollSessionsMu.Unlock()
+
+	pollListener.conns <- sess.conn
+
+	log.Printf("Long-polling session opened from %s", r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Session string `json:"session"`
+	}{id})
+}
+
+// removePollSession forgets a session, closing it if it's still open
+func removePollSession(id string) {
+	pollSessionsMu.Lock()
+	sess := pollSessions[id]
+	delete(pollSessions, id)
+	pollSessionsMu.Unlock()
+	if sess != nil {
+		sess.conn.Close()
+	}
+}
+
+// closePollSessions ends every session when the server shuts down
+// Shutdown closes the listener the CLIs poll through, so these tunnels can't
+// carry on like WebSocket ones - ending them now fails their requests right
+// away instead of at their timeout. Whatever was written last (a migrate
+// message, say) still goes out with the recvs already waiting.
+func closePollSessions() {
+	pollSessionsMu.Lock()
+	sessions := make([]*pollSession, 0, len(pollSessions))
+	for _, sess := range pollSessions {
+		sessions = append(sessions, sess)
+	}
+	pollSessionsMu.Unlock()
+
+	for _, sess := range sessions {
+		sess.conn.Close()
+	}
+}
+
+// pollConnListener is a net.Listener whose connections are poll sessions
+// It's never closed: it lives as long as the server.
+type pollConnListener struct {
+	conns chan net.Conn
+}
+
+func newPollConnListener() *pollConnListener {
+	return &pollConnListener{conns: make(chan net.Conn)}
+}
+
+func (l *pollConnListener) Accept() (net.Conn, error) {
+	return <-l.conns, nil
+}
+
+func (l *pollConnListener) Close() error {
+	return nil
+}
+
+func (l *pollConnListener) Addr() net.Addr {
+	return tunnel.PollAddr(tunnel.PollPath)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"tunnelr/internal/tunnel"
+)
+
+// pollDialer opens WebSockets to srv over its long-polling endpoints, the
+// way the CLI does with --transport poll
+func pollDialer(t *testing.T, srv *httptest.Server) *websocket.Dialer {
+	t.Helper()
+	base := srv.URL + tunnel.PollPath
+
+	// Closing a session is a request too: let it through before the server
+	// shuts down, or srv.Close waits out the session's pending recv
+	var sending sync.WaitGroup
+	t.Cleanup(sending.Wait)
+
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		resp, err := http.Post(base+"/open", "", nil)
+		if err != nil {
+			return nil, err
+		}
+		var opened struct {
+			Session string `json:"session"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&opened)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		sessionURL := func(action string) string {
+			return base + "/" + action + "?session=" + url.QueryEscape(opened.Session)
+		}
+
+		recvCtx, stopRecv := context.WithCancel(context.Background())
+		in, out := tunnel.NewPollBuffer(), tunnel.NewPollBuffer()
+		conn := tunnel.NewPollConn(in, out, tunnel.PollAddr("test"), tunnel.PollAddr(base), stopRecv)
+
+		// Sends one at a time, in order
+		sending.Add(1)
+		go func() {
+			defer sending.Done()
+			for {
+				data, err := out.Take(tunnel.PollMaxBytes, -1)
+				if err != nil {
+					if resp, err := http.Post(sessionURL("close"), "", nil); err == nil {
+						resp.Body.Close()
+					}
+					return
+				}
+				resp, err := http.Post(sessionURL("send"), "application/octet-stream", bytes.NewReader(data))
+				if err != nil {
+					conn.Close()
+					return
+				}
+				resp.Body.Close()
+			}
+		}()
+
+		// Always a recv waiting
+		go func() {
+			defer in.Close()
+			for {
+				req, _ := http.NewRequestWithContext(recvCtx, http.MethodGet, sessionURL("recv"), nil)
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					return
+				}
+				data, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					return
+				}
+				in.Write(data)
+			}
+		}()
+		return conn, nil
+	}
+	return &websocket.Dialer{NetDialContext: dial}
+}
+
+// pollSessionCount is how many long-polling sessions the server has open
+func pollSessionCount() int {
+	pollSessionsMu.Lock()
+	defer pollSessionsMu.Unlock()
+	return len(pollSessions)
+}
+
+func TestLongPollingRoundTrip(t *testing.T) {
+	srv := startTestServer(t)
+	before := pollSessionCount()
+	cli := startFakeCLIVia(t, srv, pollDialer(t, srv), tunnel.TunnelRegister{Capabilities: allCapabilities},
+		func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+			data, _ := io.ReadAll(body)
+			cli.respond(req.ID, http.StatusOK, http.Header{"X-Path": {req.Path}}, append([]byte("echo: "), data...))
+		})
+	if got := pollSessionCount() - before; got != 1 {
+		t.Errorf("%d new poll sessions, want 1", got)
+	}
+
+	// Requests and bodies both ways, a few in a row on the same session
+	for _, payload := range []string{"first", strings.Repeat("a bigger body ", 10000), ""} {
+		resp, err := http.DefaultClient.Do(cli.newRequest(http.MethodPost, "/hook?n=1", strings.NewReader(payload)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "echo: "+payload || resp.Header.Get("X-Path") != "/hook?n=1" {
+			t.Errorf("got %d %q (X-Path %q) for a %d byte body", resp.StatusCode, body[:min(len(body), 40)], resp.Header.Get("X-Path"), len(payload))
+		}
+	}
+}
+
+func TestPollEndpointsOnlyOnBaseHost(t *testing.T) {
+	srv := startTestServer(t)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		cli.respond(req.ID, http.StatusOK, nil, []byte("the app's own "+req.Path))
+	})
+
+	// On a tunnel's host, /poll/ is the app's
+	before := pollSessionCount()
+	resp, err := http.DefaultClient.Do(cli.newRequest(http.MethodPost, tunnel.PollPath+"/open", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "the app's own /poll/open" {
+		t.Errorf("POST /poll/open on the tunnel's host got %d %q, want it forwarded", resp.StatusCode, body)
+	}
+	if got := pollSessionCount(); got != before {
+		t.Errorf("a request on the tunnel's host opened a poll session")
+	}
+	if status, body := cli.get(tunnel.PollPath + "/recv?session=x"); status != http.StatusOK || string(body) != "the app's own /poll/recv?session=x" {
+		t.Errorf("GET /poll/recv on the tunnel's host got %d %q, want it forwarded", status, body)
+	}
+
+	// On the base domain it's ours
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+tunnel.PollPath+"/recv?session=unknown", nil)
+	req.Host = baseDomain
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGone {
+		t.Errorf("recv for an unknown session on the base domain got %d, want 410", resp.StatusCode)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"tunnelr/internal/tunnel"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics, served at METRICS_PATH (default /metrics)
+// The counters on /health stay as they are - this is the same information
+// (and a bit more) in a format monitoring systems can scrape.
+var (
+	metricsPath = getEnv("METRICS_PATH", "/metrics")
+
+	promRegistry = prometheus.NewRegistry()
+
+	promTunnelsActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tunnelr_tunnels_active",
+		Help: "Tunnels currently connected.",
+	})
+	promTunnelsRegistered = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tunnelr_tunnels_registered_total",
+		Help: "Tunnels registered since the server started.",
+	})
+	promRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tunnelr_requests_total",
+		Help: "Requests to tunnels, by status class (2xx, 4xx...).",
+	}, []string{"code"})
+	promRequestDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tunnelr_request_duration_seconds",
+		Help:    "Time from receiving a tunnel request to finishing the response.",
+		Buckets: prometheus.DefBuckets,
+	})
+	promBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tunnelr_bytes_total",
+		Help: "Body bytes sent through tunnels: in = to the CLI, out = to public clients.",
+	}, []string{"direction"})
+	promTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tunnelr_request_timeouts_total",
+		Help: "Requests that got a 504 because the tunnel didn't answer in time.",
+	})
+)
+
+func init() {
+	promRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		promTunnelsActive,
+		promTunnelsRegistered,
+		promRequests,
+		promRequestDuration,
+		promBytes,
+		promTimeouts,
+	)
+
+	// Keep the tunnel gauge in step with the registry itself, whichever
+	// code path adds or removes a tunnel
+	registry.SetHooks(
+		func(*tunnel.Tunnel) {
+			promTunnelsActive.Inc()
+			promTunnelsRegistered.Inc()
+		},
+		func(*tunnel.Tunnel) {
+			promTunnelsActive.Dec()
+		},
+	)
+}
+
+// handleMetrics serves the Prometheus metrics
+// In subdomain mode, METRICS_PATH on a tunnel's host still goes to the tunnel.
+// With a VIEWER_TOKEN or ADMIN_TOKEN set, scrapes need one of them; without
+// either the metrics are open to anyone.
+func handleMetrics(next http.HandlerFunc) http.HandlerFunc {
+	metricsHandler := promhttp.HandlerFor(promRegistry, promhttp.HandlerOpts{})
+	protected := requireRole(roleViewer, metricsHandler.ServeHTTP)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if routingMode != "path" && extractSubdomain(r.Host) != "" {
+			next(w, r)
+			return
+		}
+		if adminToken == "" && viewerToken == "" {
+			metricsHandler.ServeHTTP(w, r)
+			return
+		}
+		protected(w, r)
+	}
+}
+
+// observeRequest records a finished tunnel request
+func observeRequest(status int, duration time.Duration) {
+	promRequests.WithLabelValues(strconv.Itoa(status/100) + "xx").Inc()
+	promRequestDuration.Observe(duration.Seconds())
+}
+
+// addBytesIn counts request body bytes sent to the CLI, in the request's
+// tunnel counters and (unless they're health-check traffic) in Prometheus
+func addBytesIn(stats *tunnel.TunnelStats, n int64) {
+	stats.BytesIn.Add(n)
+	if stats != &discardStats && n > 0 {
+		promBytes.WithLabelValues("in").Add(float64(n))
+	}
+}
+
+// addBytesOut counts response body bytes sent to the public client
+func addBytesOut(stats *tunnel.TunnelStats, n int64) {
+	stats.BytesOut.Add(n)
+	if stats != &discardStats && n > 0 {
+		promBytes.WithLabelValues("out").Add(float64(n))
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+// scrapeMetrics reads METRICS_PATH on the base domain into series -> value,
+// e.g. `tunnelr_requests_total{code="2xx"}` -> 3
+func scrapeMetrics(t *testing.T, srvURL string) map[string]float64 {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, srvURL+metricsPath, nil)
+	req.Host = baseDomain
+	// Metrics take the viewer token once one is set (any operator token will do)
+	token := viewerToken
+	if token == "" {
+		token = adminToken
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("scraping %s: %d", metricsPath, resp.StatusCode)
+	}
+
+	series := make(map[string]float64)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		idx := strings.LastIndex(line, " ")
+		value, err := strconv.ParseFloat(line[idx+1:], 64)
+		if err != nil {
+			t.Fatalf("bad metrics line %q", line)
+		}
+		series[line[:idx]] = value
+	}
+	return series
+}
+
+func TestMetricsAfterAForwardedRequest(t *testing.T) {
+	srv := startTestServer(t)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+		io.Copy(io.Discard, body)
+		cli.respond(req.ID, http.StatusCreated, nil, []byte("created!"))
+	})
+	before := scrapeMetrics(t, srv.URL)
+
+	resp, err := http.DefaultClient.Do(cli.newRequest(http.MethodPost, "/items", strings.NewReader("new item")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	// The access log (and with it the request metrics) is written just
+	// after the response
+	var after map[string]float64
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		after = scrapeMetrics(t, srv.URL)
+		if after[`tunnelr_requests_total{code="2xx"}`] > before[`tunnelr_requests_total{code="2xx"}`] || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, name := range []string{
+		"tunnelr_tunnels_active",
+		"tunnelr_tunnels_registered_total",
+		`tunnelr_requests_total{code="2xx"}`,
+		"tunnelr_request_duration_seconds_count",
+		`tunnelr_bytes_total{direction="in"}`,
+		`tunnelr_bytes_total{direction="out"}`,
+		"tunnelr_request_timeouts_total",
+		"go_goroutines",
+	} {
+		if _, ok := after[name]; !ok {
+			t.Errorf("%s missing from %s", name, metricsPath)
+		}
+	}
+
+	increases := map[string]float64{
+		`tunnelr_requests_total{code="2xx"}`:     1,
+		"tunnelr_request_duration_seconds_count": 1,
+		`tunnelr_bytes_total{direction="in"}`:    float64(len("new item")),
+		`tunnelr_bytes_total{direction="out"}`:   float64(len("created!")),
+	}
+	for name, want := range increases {
+		if got := after[name] - before[name]; got != want {
+			t.Errorf("%s went up by %g, want %g", name, got, want)
+		}
+	}
+	if after["tunnelr_tunnels_active"] < 1 {
+		t.Errorf("tunnelr_tunnels_active = %g with a tunnel open", after["tunnelr_tunnels_active"])
+	}
+}
+
+func TestTunnelGaugeFollowsTheRegistry(t *testing.T) {
+	srv := startTestServer(t)
+
+	// Tunnels from earlier tests may still be closing, so compare the gauge
+	// with the registry itself once both have settled
+	gaugeMatches := func() bool {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			count := registry.Count()
+			if scrapeMetrics(t, srv.URL)["tunnelr_tunnels_active"] == float64(count) && registry.Count() == count {
+				return true
+			}
+			if time.Now().After(deadline) {
+				return false
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	registeredBefore := scrapeMetrics(t, srv.URL)["tunnelr_tunnels_registered_total"]
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, nil)
+	if !gaugeMatches() {
+		t.Error("tunnelr_tunnels_active doesn't match the registry after a connect")
+	}
+	registered := scrapeMetrics(t, srv.URL)["tunnelr_tunnels_registered_total"]
+	if registered < registeredBefore+1 {
+		t.Errorf("tunnelr_tunnels_registered_total went from %g to %g on connect", registeredBefore, registered)
+	}
+
+	registry.Remove(cli.ID)
+	if !gaugeMatches() {
+		t.Error("tunnelr_tunnels_active doesn't match the registry after a removal")
+	}
+	if got := scrapeMetrics(t, srv.URL)["tunnelr_tunnels_registered_total"]; got < registered {
+		t.Errorf("tunnelr_tunnels_registered_total went down from %g to %g", registered, got)
+	}
+}
+
+func TestMetricsPathOnATunnelHost(t *testing.T) {
+	srv := startTestServer(t)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		cli.respond(req.ID, http.StatusOK, nil, []byte("the app's metrics"))
+	})
+	if status, body := cli.get(metricsPath); status != http.StatusOK || string(body) != "the app's metrics" {
+		t.Errorf("%s on a tunnel's host got %d %q, want it forwarded", metricsPath, status, body)
+	}
+}
+
+func TestMetricsNeedATokenOnceOneIsSet(t *testing.T) {
+	srv := startTestServer(t)
+	scrape := func(token string) int {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+metricsPath, nil)
+		req.Host = baseDomain
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// No operator token: open, as before
+	setForTest(t, &viewerToken, "")
+	setForTest(t, &adminToken, "")
+	if status := scrape(""); status != http.StatusOK {
+		t.Errorf("without tokens: got %d, want 200", status)
+	}
+
+	// With one, anonymous scrapes are turned away and either token works
+	viewerToken, adminToken = "viewer-secret", "admin-secret"
+	tests := []struct {
+		token string
+		want  int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+		{"viewer-secret", http.StatusOK},
+		{"admin-secret", http.StatusOK},
+	}
+	for _, tc := range tests {
+		if status := scrape(tc.token); status != tc.want {
+			t.Errorf("token %q: got %d, want %d", tc.token, status, tc.want)
+		}
+	}
+}
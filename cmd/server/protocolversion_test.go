@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestProtocolVersionHandshake(t *testing.T) {
+	captureLog(t)
+	srv := startTestServer(t)
+
+	// Same version: accepted, and told ours along with the capabilities
+	assigned, conn, err := registerFakeCLI(srv, tunnel.TunnelRegister{ProtocolVersion: tunnel.ProtocolVersion, Capabilities: allCapabilities})
+	if err != nil {
+		t.Fatalf("same version refused: %v", err)
+	}
+	conn.Close()
+	if assigned.ProtocolVersion != tunnel.ProtocolVersion || len(assigned.Capabilities) == 0 {
+		t.Errorf("assigned version %d with capabilities %v, want version %d and the agreed capabilities",
+			assigned.ProtocolVersion, assigned.Capabilities, tunnel.ProtocolVersion)
+	}
+
+	// Other versions are refused, telling the user what to upgrade
+	tests := []struct {
+		version int
+		advice  string
+	}{
+		{tunnel.ProtocolVersion + 1, "the server needs upgrading"},
+		{-1, "upgrade the CLI"},
+	}
+	for _, tc := range tests {
+		_, _, err := registerFakeCLI(srv, tunnel.TunnelRegister{ProtocolVersion: tc.version})
+		var refused *refusedError
+		if !errors.As(err, &refused) {
+			t.Errorf("version %d: got %v, want a refusal", tc.version, err)
+			continue
+		}
+		if refused.Code != tunnel.ErrCodeProtocolVersion || !strings.Contains(refused.Message, tc.advice) {
+			t.Errorf("version %d: got %s %q, want %s saying %q", tc.version, refused.Code, refused.Message, tunnel.ErrCodeProtocolVersion, tc.advice)
+		}
+	}
+}
+
+func TestCLIWithoutProtocolVersionIsRefused(t *testing.T) {
+	// CLIs from before versioning don't send one at all
+	captureLog(t)
+	srv := startTestServer(t)
+	wsConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wsConn.Close()
+	old, _ := tunnel.Encode(tunnel.TypeTunnelRegister, map[string]int{"local_port": 3000})
+	if err := wsConn.WriteMessage(websocket.TextMessage, old); err != nil {
+		t.Fatal(err)
+	}
+	_, reply, err := wsConn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := tunnel.DecodeMessage(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != tunnel.TypeTunnelError {
+		t.Fatalf("old CLI got %s: %s, want a refusal", msg.Type, msg.Payload)
+	}
+	var refused tunnel.TunnelError
+	if err := msg.Unmarshal(&refused); err != nil {
+		t.Fatal(err)
+	}
+	if refused.Code != tunnel.ErrCodeProtocolVersion || !strings.Contains(refused.Message, "upgrade the CLI") {
+		t.Errorf("old CLI got %s %q, want %s telling it to upgrade", refused.Code, refused.Message, tunnel.ErrCodeProtocolVersion)
+	}
+
+	// No tunnel was opened for it
+	if _, _, err := wsConn.ReadMessage(); err == nil {
+		t.Error("connection stayed open after the refusal")
+	}
+}
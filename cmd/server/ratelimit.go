@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"tunnelr/internal/tunnel"
+)
+
+// Per-tunnel rate limiting - RATE_LIMIT caps the requests per second each
+// tunnel accepts, so one flooded public URL can't hammer a developer's
+// machine. Requests over the limit get a 429 and never reach the tunnel.
+// RATE_LIMIT_BURST is how many requests may arrive at once before the limit
+// kicks in (by default RATE_LIMIT rounded up). Health checks aren't limited.
+var (
+	rateLimit      = getEnvFloat("RATE_LIMIT", 0)
+	rateLimitBurst = getEnvInt("RATE_LIMIT_BURST", 0)
+)
+
+// rateBurst returns the configured burst, or the default
+func rateBurst() int {
+	if rateLimitBurst > 0 {
+		return rateLimitBurst
+	}
+	return int(math.Ceil(rateLimit))
+}
+
+// allowRequest applies the tunnel's rate limit
+// Returns false after answering the request with a 429
+func allowRequest(w http.ResponseWriter, r *http.Request, tun *tunnel.Tunnel, forwardPath string) bool {
+	if isHealthCheck(r, forwardPath) {
+		return true
+	}
+	allowed, wait := tun.Limiter.Allow()
+	if allowed {
+		return true
+	}
+
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(w, fmt.Sprintf("Too many requests to tunnel %s, try again in %ds", tun.ID, retryAfter), http.StatusTooManyRequests)
+
+	metrics.rateLimited.Add(1)
+	logAccess(tun, r, forwardPath, http.StatusTooManyRequests, 0)
+	return false
+}
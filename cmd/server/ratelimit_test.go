@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestRateLimitPerTunnel(t *testing.T) {
+	registry.SetRateLimit(1, 3)
+	t.Cleanup(func() { registry.SetRateLimit(0, 0) })
+	srv := startTestServer(t)
+
+	var reached atomic.Int32
+	answer := func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		reached.Add(1)
+		cli.respond(req.ID, http.StatusOK, nil, []byte("ok"))
+	}
+	flooded := startFakeCLI(t, srv, tunnel.TunnelRegister{}, answer)
+	limitedBefore := metrics.rateLimited.Load()
+
+	var statuses []int
+	for i := 0; i < 10; i++ {
+		resp, err := http.DefaultClient.Do(flooded.newRequest(http.MethodGet, "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		statuses = append(statuses, resp.StatusCode)
+
+		if resp.StatusCode == http.StatusTooManyRequests {
+			if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || secs < 1 {
+				t.Errorf("Retry-After = %q, want whole seconds", resp.Header.Get("Retry-After"))
+			}
+		}
+	}
+
+	// The burst goes through, then the bucket is empty
+	for i, status := range statuses {
+		want := http.StatusOK
+		if i >= 3 {
+			want = http.StatusTooManyRequests
+		}
+		if status != want {
+			t.Errorf("request %d: %d, want %d (all: %v)", i+1, status, want, statuses)
+			break
+		}
+	}
+	if got := reached.Load(); got != 3 {
+		t.Errorf("%d requests reached the CLI, want only the 3 allowed", got)
+	}
+	if got := metrics.rateLimited.Load() - limitedBefore; got != 7 {
+		t.Errorf("rate_limited went up by %d, want 7", got)
+	}
+
+	// Health checks don't use up (or get refused by) the limit
+	if status, _ := flooded.get("/healthz"); status != http.StatusOK {
+		t.Errorf("health check on a limited tunnel got %d", status)
+	}
+
+	// Other tunnels have buckets of their own
+	other := startFakeCLI(t, srv, tunnel.TunnelRegister{}, answer)
+	if status, _ := other.get("/"); status != http.StatusOK {
+		t.Errorf("another tunnel got %d while the first was limited", status)
+	}
+}
+
+func TestRateBurstDefault(t *testing.T) {
+	tests := []struct {
+		rate  float64
+		burst int
+		want  int
+	}{
+		{10, 0, 10},
+		{2.5, 0, 3},
+		{0.5, 0, 1},
+		{10, 50, 50},
+	}
+	for _, tc := range tests {
+		setForTest(t, &rateLimit, tc.rate)
+		setForTest(t, &rateLimitBurst, tc.burst)
+		if got := rateBurst(); got != tc.want {
+			t.Errorf("RATE_LIMIT=%g RATE_LIMIT_BURST=%d: burst %d, want %d", tc.rate, tc.burst, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestReceivedAtHeader(t *testing.T) {
+	srv := startTestServer(t)
+	received := make(chan []string, 1)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		received <- req.Headers.Values(tunnel.ReceivedAtHeader)
+		// The local handler runs late: the header still says when the
+		// server got the request
+		time.Sleep(50 * time.Millisecond)
+		cli.respond(req.ID, http.StatusOK, nil, nil)
+	})
+
+	before := time.Now()
+	req := cli.newRequest(http.MethodPost, "/webhook", nil)
+	req.Header.Set(tunnel.ReceivedAtHeader, "2000-01-01T00:00:00Z") // Spoofed by the client
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	after := time.Now()
+
+	values := <-received
+	if len(values) != 1 {
+		t.Fatalf("%s = %q, want exactly one value", tunnel.ReceivedAtHeader, values)
+	}
+	at, err := time.Parse(time.RFC3339Nano, values[0])
+	if err != nil {
+		t.Fatalf("%s = %q: %v", tunnel.ReceivedAtHeader, values[0], err)
+	}
+	if _, offset := at.Zone(); offset != 0 {
+		t.Errorf("%s = %q, want UTC", tunnel.ReceivedAtHeader, values[0])
+	}
+	if at.Before(before) || at.After(after.Add(-50*time.Millisecond)) {
+		t.Errorf("%s = %s, want between %s and %s", tunnel.ReceivedAtHeader, at, before, after.Add(-50*time.Millisecond))
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestSilentConnectionIsDropped(t *testing.T) {
+	srv := startTestServer(t)
+	setForTest(t, &registerTimeout, 200*time.Millisecond)
+
+	// Connect, then never register
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("got a message without registering")
+	} else if netErr, ok := err.(interface{ Timeout() bool }); ok && netErr.Timeout() {
+		t.Fatal("server kept a connection that never registered open")
+	}
+}
+
+func TestRegistrationsDontWaitForSilentConnections(t *testing.T) {
+	srv := startTestServer(t)
+
+	// Connections that never register must not hold up anyone else
+	for i := 0; i < 20; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+
+	start := time.Now()
+	startFakeCLI(t, srv, tunnel.TunnelRegister{}, nil)
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("registering took %s next to silent connections", took)
+	}
+}
+
+// BenchmarkRegistrationHandshake measures full registrations: WebSocket
+// handshake, register message, assignment, hang up
+func BenchmarkRegistrationHandshake(b *testing.B) {
+	srv := startTestServer(b)
+	captureLog(b) // Two lines per tunnel otherwise
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_, conn, err := registerFakeCLI(srv, tunnel.TunnelRegister{Capabilities: allCapabilities})
+			if err != nil {
+				b.Fatal(err)
+			}
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			conn.Close()
+		}
+	})
+}
+
+func TestNoFreeIDIsRefused(t *testing.T) {
+	srv := startTestServer(t)
+	taken := startFakeCLI(t, srv, tunnel.TunnelRegister{}, nil)
+
+	// Every generated ID clashes with the tunnel that's already open
+	registry.SetIDGenerator(func() string { return taken.ID })
+	t.Cleanup(func() { registry.SetIDGenerator(tunnel.RandomID) })
+
+	_, _, err := registerFakeCLI(srv, tunnel.TunnelRegister{})
+	refused, ok := err.(*refusedError)
+	if !ok || refused.Code != tunnel.ErrCodeNoFreeID {
+		t.Fatalf("got %v, want a %s refusal", err, tunnel.ErrCodeNoFreeID)
+	}
+	if tun, ok := registry.Get(taken.ID); !ok || tun.ID != taken.ID {
+		t.Error("the open tunnel lost its ID")
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestRequestBodiesReachTheCLIAsSent(t *testing.T) {
+	srv := startTestServer(t)
+	type seen struct {
+		body          string
+		contentLength string
+	}
+	got := make(chan seen, 1)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+		data, _ := io.ReadAll(body)
+		got <- seen{string(data), req.Headers.Get("Content-Length")}
+		cli.respond(req.ID, http.StatusOK, nil, nil)
+	})
+
+	tests := []struct {
+		name   string
+		method string
+		body   io.Reader
+		want   seen
+	}{
+		{"GET", http.MethodGet, nil, seen{"", ""}},
+		{"POST with a body", http.MethodPost, strings.NewReader("hello"), seen{"hello", "5"}},
+		{"POST, explicitly empty", http.MethodPost, http.NoBody, seen{"", "0"}},
+	}
+	for _, tc := range tests {
+		resp, err := http.DefaultClient.Do(cli.newRequest(tc.method, "/", tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if s := <-got; s != tc.want {
+			t.Errorf("%s: CLI got body %q with Content-Length %q, want %q and %q", tc.name, s.body, s.contentLength, tc.want.body, tc.want.contentLength)
+		}
+	}
+}
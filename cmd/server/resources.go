@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+
+	"tunnelr/internal/tunnel"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Resource usage, for sizing servers
+//
+// /admin/debug/resources shows what the process and the registry are holding
+// right now: memory, goroutines, in-flight requests and the messages queued
+// in channels. The registry numbers are also Prometheus gauges; memory and
+// goroutines are already there from the Go collector (go_memstats_*,
+// go_goroutines).
+
+// ResourceUsage is the JSON body of /admin/debug/resources
+type ResourceUsage struct {
+	Goroutines int         `json:"goroutines"`
+	Memory     MemoryUsage `json:"memory"`
+
+	Registry tunnel.RegistryUsage `json:"registry"`
+
+	WebhookQueue    int `json:"webhook_queue"`     // Events waiting for delivery
+	WebhookQueueCap int `json:"webhook_queue_cap"` // 0 when webhooks are off
+}
+
+// MemoryUsage is the interesting part of runtime.MemStats, in bytes
+type MemoryUsage struct {
+	HeapAlloc   uint64 `json:"heap_alloc"`    // Live heap objects
+	HeapInuse   uint64 `json:"heap_inuse"`    // Heap spans in use, includes fragmentation
+	StackInuse  uint64 `json:"stack_inuse"`   // Goroutine stacks
+	Sys         uint64 `json:"sys"`           // Everything obtained from the OS
+	NumGC       uint32 `json:"num_gc"`        // Completed GC cycles
+	LastPauseNs uint64 `json:"last_pause_ns"` // Most recent GC pause
+}
+
+// currentResourceUsage gathers the numbers
+// In Go, runtime.ReadMemStats briefly stops the world, so this belongs on an
+// admin endpoint rather than in every request.
+func currentResourceUsage() ResourceUsage {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	usage := ResourceUsage{
+		Goroutines: runtime.NumGoroutine(),
+		Memory: MemoryUsage{
+			HeapAlloc:   mem.HeapAlloc,
+			HeapInuse:   mem.HeapInuse,
+			StackInuse:  mem.StackInuse,
+			Sys:         mem.Sys,
+			NumGC:       mem.NumGC,
+			LastPauseNs: mem.PauseNs[(mem.NumGC+255)%256],
+		},
+		Registry: registry.Usage(),
+	}
+	usage.WebhookQueue, usage.WebhookQueueCap = webhook.QueueLen()
+	return usage
+}
+
+// handleResources serves the current resource usage as JSON
+func handleResources(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(currentResourceUsage())
+}
+
+// Registry gauges, read at scrape time
+// A GaugeFunc calls its function whenever /metrics is scraped, so there's
+// nothing to keep in step - at the cost of walking the registry per scrape.
+func init() {
+	usageGauge := func(name, help string, value func(tunnel.RegistryUsage) int) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, func() float64 {
+			return float64(value(registry.Usage()))
+		})
+	}
+
+	promRegistry.MustRegister(
+		usageGauge("tunnelr_pending_requests", "Forwarded requests waiting for the CLI to answer.",
+			func(u tunnel.RegistryUsage) int { return u.PendingRequests }),
+		usageGauge("tunnelr_websockets_active", "WebSockets currently relayed through tunnels.",
+			func(u tunnel.RegistryUsage) int { return u.WebSockets }),
+		usageGauge("tunnelr_response_backlog", "Response messages delivered by CLIs but not yet sent to clients.",
+			func(u tunnel.RegistryUsage) int { return u.ResponseBacklog }),
+		usageGauge("tunnelr_websocket_backlog", "WebSocket messages from local servers not yet sent to clients.",
+			func(u tunnel.RegistryUsage) int { return u.WebSocketBacklog }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "tunnelr_webhook_queue",
+			Help: "Webhook events waiting for delivery.",
+		}, func() float64 {
+			length, _ := webhook.QueueLen()
+			return float64(length)
+		}),
+	)
+}
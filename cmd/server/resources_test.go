@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+// fetchResources reads /admin/debug/resources with the viewer token
+func fetchResources(t *testing.T) ResourceUsage {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/admin/debug/resources", nil)
+	req.Header.Set("Authorization", "Bearer viewer-secret")
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/admin/debug/resources: %d %s", rec.Code, rec.Body)
+	}
+	var usage ResourceUsage
+	if err := json.Unmarshal(rec.Body.Bytes(), &usage); err != nil {
+		t.Fatal(err)
+	}
+	return usage
+}
+
+func TestResourcesCountPendingRequests(t *testing.T) {
+	setForTest(t, &viewerToken, "viewer-secret")
+	srv := startTestServer(t)
+	release := make(chan struct{})
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		<-release
+		cli.respond(req.ID, http.StatusOK, nil, []byte("ok"))
+	})
+	tun, _ := registry.Get(cli.ID)
+	before := fetchResources(t)
+
+	// Three requests held by the CLI
+	done := make(chan struct{})
+	for i := 0; i < 3; i++ {
+		go func() {
+			cli.get("/held")
+			done <- struct{}{}
+		}()
+	}
+	for deadline := time.Now().Add(5 * time.Second); tun.Pending.Len() < 3; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d requests pending", tun.Pending.Len())
+		}
+	}
+
+	during := fetchResources(t)
+	if during.Registry.PendingRequests-before.Registry.PendingRequests < 3 {
+		t.Errorf("pending requests went from %d to %d with 3 held", before.Registry.PendingRequests, during.Registry.PendingRequests)
+	}
+	if during.Registry.Tunnels < 1 || during.Goroutines <= 0 || during.Memory.HeapAlloc == 0 || during.Memory.Sys == 0 {
+		t.Errorf("got %+v", during)
+	}
+	if got := scrapeMetrics(t, srv.URL)["tunnelr_pending_requests"]; got < 3 {
+		t.Errorf("tunnelr_pending_requests = %v with 3 held", got)
+	}
+
+	// Answered requests stop counting
+	close(release)
+	for i := 0; i < 3; i++ {
+		<-done
+	}
+	for deadline := time.Now().Add(5 * time.Second); tun.Pending.Len() > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests still pending on the tunnel", tun.Pending.Len())
+		}
+	}
+	after := fetchResources(t)
+	if after.Registry.PendingRequests > during.Registry.PendingRequests-3 {
+		t.Errorf("pending requests %d after answering, was %d with 3 held", after.Registry.PendingRequests, during.Registry.PendingRequests)
+	}
+}
+
+func TestResourcesNeedsAToken(t *testing.T) {
+	setForTest(t, &viewerToken, "viewer-secret")
+	if got := adminCall(t, newMux(), "", http.MethodGet, "/admin/debug/resources", ""); got != http.StatusUnauthorized {
+		t.Errorf("without a token got %d, want 401", got)
+	}
+	if got := adminCall(t, newMux(), "viewer-secret", http.MethodPost, "/admin/debug/resources", ""); got != http.StatusMethodNotAllowed {
+		t.Errorf("POST got %d, want 405", got)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"tunnelr/internal/tunnel"
+)
+
+// Body rewriting - tunnels opened with --rewrite get regex find/replace on
+// their bodies (see internal/tunnel/rewrite.go). Only bodies that are sent
+// whole are rewritten; streamed ones and anything over REWRITE_MAX_BODY pass
+// through untouched, so rewriting never makes us hold a huge body in memory.
+var rewriteMaxBody = getEnvInt("REWRITE_MAX_BODY", 1024*1024)
+
+// rewriteBody applies the tunnel's rules to a body, if they apply to it
+// headers are the body's own; Content-Length is updated to match
+func rewriteBody(tun *tunnel.Tunnel, headers http.Header, body []byte) []byte {
+	if !tun.Rewriter.Applies(headers) || len(body) > rewriteMaxBody {
+		return body
+	}
+	body = tun.Rewriter.Rewrite(body, publicURLFor(tun.ID))
+	if headers.Get("Content-Length") != "" {
+		headers.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	return body
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+// startRewritingCLI registers a tunnel with rw and answers every request with
+// the response the test sets in reply (keyed by path)
+func startRewritingCLI(t *testing.T, rw *tunnel.BodyRewrite, reply map[string]struct {
+	contentType string
+	body        []byte
+}) *fakeCLI {
+	t.Helper()
+	srv := startTestServer(t)
+	return startFakeCLI(t, srv, tunnel.TunnelRegister{Capabilities: allCapabilities, Rewrite: rw}, func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+		if req.Path == "/echo" {
+			got, _ := io.ReadAll(body)
+			cli.respond(req.ID, http.StatusOK, http.Header{"Content-Type": {"text/plain"}}, got)
+			return
+		}
+		r := reply[req.Path]
+		cli.respond(req.ID, http.StatusOK, http.Header{
+			"Content-Type":   {r.contentType},
+			"Content-Length": {strconv.Itoa(len(r.body))},
+		}, r.body)
+	})
+}
+
+func TestRewriteHTMLResponses(t *testing.T) {
+	png := append([]byte("\x89PNG\r\n\x1a\n"), []byte("http://localhost:3000 inside the pixels")...)
+	cli := startRewritingCLI(t, &tunnel.BodyRewrite{
+		Rules: []tunnel.RewriteRule{{Find: `http://localhost:3000`, Replace: tunnel.PublicURLPlaceholder}},
+	}, map[string]struct {
+		contentType string
+		body        []byte
+	}{
+		"/":         {"text/html; charset=utf-8", []byte(`<a href="http://localhost:3000/about">About</a>`)},
+		"/logo.png": {"image/png", png},
+		"/app.js":   {"application/javascript", []byte(`fetch("http://localhost:3000/api")`)},
+	})
+
+	// HTML links point at the tunnel, with the length to match
+	resp, err := http.DefaultClient.Do(cli.newRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	want := `<a href="` + publicURLFor(cli.ID) + `/about">About</a>`
+	if string(body) != want {
+		t.Errorf("HTML got %q, want %q", body, want)
+	}
+	if resp.ContentLength != int64(len(want)) {
+		t.Errorf("Content-Length %d for a %d byte body", resp.ContentLength, len(want))
+	}
+
+	// Anything that isn't HTML passes through byte for byte
+	if _, body := cli.get("/logo.png"); !bytes.Equal(body, png) {
+		t.Errorf("image changed: %q", body)
+	}
+	if _, body := cli.get("/app.js"); string(body) != `fetch("http://localhost:3000/api")` {
+		t.Errorf("JavaScript rewritten without --rewrite-types: %q", body)
+	}
+}
+
+func TestRewriteSizeCap(t *testing.T) {
+	setForTest(t, &rewriteMaxBody, 100)
+	small := `<a href="http://localhost:3000/">home</a>`
+	large := small + strings.Repeat(" ", 100)
+	cli := startRewritingCLI(t, &tunnel.BodyRewrite{
+		Rules: []tunnel.RewriteRule{{Find: `http://localhost:3000`, Replace: "https://public"}},
+	}, map[string]struct {
+		contentType string
+		body        []byte
+	}{
+		"/small": {"text/html", []byte(small)},
+		"/large": {"text/html", []byte(large)},
+	})
+
+	if _, body := cli.get("/small"); string(body) != `<a href="https://public/">home</a>` {
+		t.Errorf("small page got %q", body)
+	}
+	if _, body := cli.get("/large"); string(body) != large {
+		t.Errorf("page over REWRITE_MAX_BODY was rewritten: %q", body)
+	}
+}
+
+func TestRewriteRequests(t *testing.T) {
+	rules := []tunnel.RewriteRule{{Find: `secret-\d+`, Replace: "[redacted]"}}
+	post := func(cli *fakeCLI) string {
+		req := cli.newRequest(http.MethodPost, "/echo", strings.NewReader("token secret-1234 here"))
+		req.Header.Set("Content-Type", "text/html")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	// Only with --rewrite-requests (the echo's text/plain isn't rewritten)
+	off := startRewritingCLI(t, &tunnel.BodyRewrite{Rules: rules}, nil)
+	if got := post(off); got != "token secret-1234 here" {
+		t.Errorf("request body rewritten without --rewrite-requests: %q", got)
+	}
+	on := startRewritingCLI(t, &tunnel.BodyRewrite{Rules: rules, Requests: true}, nil)
+	if got := post(on); got != "token [redacted] here" {
+		t.Errorf("with --rewrite-requests the local server got %q", got)
+	}
+}
+
+func TestInvalidRewriteRefused(t *testing.T) {
+	srv := startTestServer(t)
+	_, _, err := registerFakeCLI(srv, tunnel.TunnelRegister{
+		Capabilities: allCapabilities,
+		Rewrite:      &tunnel.BodyRewrite{Rules: []tunnel.RewriteRule{{Find: "(unclosed", Replace: "x"}}},
+	})
+	refused, ok := err.(*refusedError)
+	if !ok || refused.Code != tunnel.ErrCodeRewriteInvalid {
+		t.Fatalf("got %v, want a %s refusal", err, tunnel.ErrCodeRewriteInvalid)
+	}
+}
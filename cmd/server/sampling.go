@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+// Access log sampling
+//
+// On busy tunnels logging every request is too much. LOG_SAMPLE_RATE keeps a
+// fraction of them (0.1 = 1 in 10). Counters, metrics and request events
+// always see every request - only the access log line is sampled.
+// Statuses listed in LOG_ALWAYS_STATUS (e.g. "5xx,429") skip sampling, so
+// errors are never lost.
+var (
+	logSampleRate   = getEnvFloat("LOG_SAMPLE_RATE", 1.0)
+	logAlwaysStatus = parseStatusMatchers(getEnv("LOG_ALWAYS_STATUS", "5xx"))
+	accessSampler   = &sampler{rate: logSampleRate}
+)
+
+// sampler picks a fixed fraction of events, evenly spread
+// Counter-based rather than random, so exactly rate*N of N events are kept
+type sampler struct {
+	rate float64
+	seen atomic.Uint64
+}
+
+// Sample reports whether this event should be kept
+func (s *sampler) Sample() bool {
+	if s.rate >= 1 {
+		return true
+	}
+	if s.rate <= 0 {
+		return false
+	}
+	// Keep event n when floor(n*rate) ticks over
+	n := s.seen.Add(1)
+	return math.Floor(float64(n)*s.rate) != math.Floor(float64(n-1)*s.rate)
+}
+
+// statusMatcher matches one status code or a whole class ("5xx")
+type statusMatcher struct {
+	code  int
+	class int
+}
+
+func (m statusMatcher) matches(status int) bool {
+	return status == m.code || m.class != 0 && status/100 == m.class
+}
+
+// parseStatusMatchers parses "5xx,429" style lists
+func parseStatusMatchers(value string) []statusMatcher {
+	var matchers []statusMatcher
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if len(entry) == 3 && strings.HasSuffix(entry, "xx") && entry[0] >= '1' && entry[0] <= '5' {
+			matchers = append(matchers, statusMatcher{class: int(entry[0] - '0')})
+		} else if code, err := strconv.Atoi(entry); err == nil {
+			matchers = append(matchers, statusMatcher{code: code})
+		} else {
+			log.Printf("Ignoring invalid status %q in LOG_ALWAYS_STATUS", entry)
+		}
+	}
+	return matchers
+}
+
+// shouldLogRequest decides if a finished request gets an access log line
+func shouldLogRequest(status int) bool {
+	for _, m := range logAlwaysStatus {
+		if m.matches(status) {
+			return true
+		}
+	}
+	return accessSampler.Sample()
+}
+
+// logAccess records a finished request: metrics and a request event for
+// every one, and a sampled access log line
+// Health checks are never logged
+func logAccess(tun *tunnel.Tunnel, r *http.Request, forwardPath string, status int, duration time.Duration) {
+	if isHealthCheck(r, forwardPath) {
+		return
+	}
+	observeRequest(status, duration)
+	recordSlowRequest(tun, r, forwardPath, status, duration)
+	publishRequestEvent(WebhookEvent{
+		TunnelID:   tun.ID,
+		LocalPort:  tun.LocalPort,
+		Method:     r.Method,
+		Path:       forwardPath,
+		StatusCode: status,
+		DurationMs: duration.Milliseconds(),
+	})
+	if !shouldLogRequest(status) {
+		return
+	}
+
+	log.Printf("%s %s %s -> %d (%s)", tun.ID, r.Method, forwardPath, status, duration.Round(time.Millisecond))
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestSamplerKeepsTheRate(t *testing.T) {
+	tests := []struct {
+		rate float64
+		want int // Of 1000
+	}{
+		{1, 1000},
+		{0.5, 500},
+		{0.25, 250},
+		{0.1, 100},
+		{0.001, 1},
+		{0, 0},
+		{2, 1000}, // Anything over 1 keeps everything
+	}
+	for _, tc := range tests {
+		s := &sampler{rate: tc.rate}
+		kept := 0
+		for i := 0; i < 1000; i++ {
+			if s.Sample() {
+				kept++
+			}
+		}
+		if kept != tc.want {
+			t.Errorf("rate %v kept %d of 1000, want %d", tc.rate, kept, tc.want)
+		}
+	}
+}
+
+func TestSamplerSpreadsEvenly(t *testing.T) {
+	// 1 in 10 means one in every run of 10, not ten in a burst
+	s := &sampler{rate: 0.1}
+	for run := 0; run < 20; run++ {
+		kept := 0
+		for i := 0; i < 10; i++ {
+			if s.Sample() {
+				kept++
+			}
+		}
+		if kept != 1 {
+			t.Fatalf("run %d kept %d of 10", run, kept)
+		}
+	}
+}
+
+func TestParseStatusMatchers(t *testing.T) {
+	log := captureLog(t)
+	matchers := parseStatusMatchers(" 5xx, 429 ,4XX,,bogus,9xx")
+	if len(matchers) != 3 {
+		t.Fatalf("got %d matchers, want 3: %+v", len(matchers), matchers)
+	}
+	if !strings.Contains(log.String(), `"bogus"`) || !strings.Contains(log.String(), `"9xx"`) {
+		t.Errorf("invalid entries weren't reported: %q", log.String())
+	}
+
+	matches := func(status int) bool {
+		for _, m := range matchers {
+			if m.matches(status) {
+				return true
+			}
+		}
+		return false
+	}
+	for status, want := range map[int]bool{500: true, 503: true, 429: true, 404: true, 200: false, 302: false} {
+		if got := matches(status); got != want {
+			t.Errorf("%d matched = %v, want %v", status, got, want)
+		}
+	}
+}
+
+func TestErrorsBypassSampling(t *testing.T) {
+	setForTest(t, &accessSampler, &sampler{rate: 0})
+	setForTest(t, &logAlwaysStatus, parseStatusMatchers("5xx,429"))
+
+	for status, want := range map[int]bool{500: true, 502: true, 429: true, 200: false, 404: false} {
+		if got := shouldLogRequest(status); got != want {
+			t.Errorf("shouldLogRequest(%d) = %v, want %v", status, got, want)
+		}
+	}
+}
+
+func TestSampledOutRequestsStillPublishEvents(t *testing.T) {
+	setForTest(t, &accessSampler, &sampler{rate: 0})
+	setForTest(t, &logAlwaysStatus, parseStatusMatchers("5xx"))
+	accessLog := captureLog(t)
+	requests, unsubscribe := events.Subscribe(true)
+	defer unsubscribe()
+
+	srv := startTestServer(t)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{Capabilities: allCapabilities},
+		func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+			status := http.StatusOK
+			if req.Path == "/fail" {
+				status = http.StatusInternalServerError
+			}
+			cli.respond(req.ID, status, nil, nil)
+		})
+
+	for i := 0; i < 5; i++ {
+		cli.get(fmt.Sprintf("/page/%d", i))
+	}
+	cli.get("/fail")
+
+	// Every request has its event...
+	got := map[string]int{}
+	deadline := time.After(5 * time.Second)
+	for len(got) < 6 {
+		select {
+		case event := <-requests:
+			if event.Type == EventRequestForwarded && event.TunnelID == cli.ID {
+				got[event.Path] = event.StatusCode
+			}
+		case <-deadline:
+			t.Fatalf("got events for %v, want all 6 requests", got)
+		}
+	}
+	if got["/fail"] != http.StatusInternalServerError {
+		t.Errorf("/fail event has status %d", got["/fail"])
+	}
+
+	// ...but only the error got a log line
+	lines := strings.Count(accessLog.String(), cli.ID+" GET ")
+	if lines != 1 || !strings.Contains(accessLog.String(), "/fail -> 500") {
+		t.Errorf("got %d access log lines, want just the 500:\n%s", lines, accessLog.String())
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"tunnelr/internal/tunnel"
+
+	"github.com/gorilla/websocket"
+)
+
+// Graceful shutdown - on SIGTERM (e.g. `docker compose down`) or Ctrl+C the
+// server stops taking new tunnels and requests, lets requests already in
+// flight finish, then tells every CLI it's going away before exiting.
+// A second signal while waiting exits immediately.
+
+// shutdownTimeout is how long in-flight requests get to finish
+var shutdownTimeout = getEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+
+// shuttingDown is set once shutdown starts - new tunnels are refused from then on
+var shuttingDown atomic.Bool
+
+// shutdownReason is the close reason CLIs are sent
+const shutdownReason = "server shutting down"
+
+// serveUntilSignal runs srv on listener (with TLS if srv.TLSConfig is set)
+// until SIGTERM or SIGINT, then shuts down gracefully
+func serveUntilSignal(srv *http.Server, listener net.Listener) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	serveUntil(srv, listener, stop)
+}
+
+// serveUntil runs srv on listener until a signal arrives on stop, then shuts
+// down gracefully
+func serveUntil(srv *http.Server, listener net.Listener, stop chan os.Signal) {
+	errs := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			// The certificate is already in TLSConfig, see loadTLSConfig
+			errs <- srv.ServeTLS(listener, "", "")
+		} else {
+			errs <- srv.Serve(listener)
+		}
+	}()
+
+	select {
+	case err := <-errs:
+		log.Fatal(err)
+	case sig := <-stop:
+		log.Printf("Received %s, shutting down (waiting up to %s for in-flight requests)", sig, shutdownTimeout)
+	}
+
+	// Back to the default behavior, so another signal kills us right away
+	signal.Stop(stop)
+	shuttingDown.Store(true)
+
+	// With somewhere to go, CLIs move their tunnels there while we finish
+	// the requests in flight
+	if migrateURL != "" {
+		migrateTunnels(registry.All(), migrateURL, shutdownReason)
+	}
+	closePollSessions()
+
+	// Shutdown closes the listener and waits for in-flight requests
+	// Tunnel connections were hijacked by the WebSocket upgrade, so they stay
+	// up meanwhile and can still answer
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Gave up waiting for in-flight requests: %v", err)
+	}
+	stopGRPCServer()
+
+	closeAllTunnels(shutdownReason)
+	log.Printf("Shutdown complete")
+}
+
+// closeAllTunnels sends every CLI a close frame with reason, then gives them a
+// moment to hang up before we exit
+func closeAllTunnels(reason string) {
+	tunnels := registry.All()
+	if len(tunnels) == 0 {
+		return
+	}
+	log.Printf("Closing %d tunnels", len(tunnels))
+
+	// In parallel, so one unresponsive CLI doesn't hold up the rest
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, reason)
+	var wg sync.WaitGroup
+	for _, tun := range tunnels {
+		wg.Add(1)
+		go func(conn *tunnel.SafeConn) {
+			defer wg.Done()
+			conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+		}(tun.Conn)
+	}
+	wg.Wait()
+
+	// Each CLI answers with its own close frame, which ends its read loop
+	// and removes the tunnel
+	deadline := time.Now().Add(2 * time.Second)
+	for registry.Count() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestShutdownNotifiesCLIsAndFinishesRequests(t *testing.T) {
+	setForTest(t, &shutdownTimeout, 5*time.Second)
+	setForTest(t, &migrateURL, "")
+	t.Cleanup(func() { shuttingDown.Store(false) })
+
+	// Served the way main serves, stopped by a fake signal
+	srv := httptest.NewUnstartedServer(newMux())
+	srv.URL = "http://" + srv.Listener.Addr().String()
+	stop := make(chan os.Signal, 1)
+	stopped := make(chan struct{})
+	go func() {
+		serveUntil(srv.Config, srv.Listener, stop)
+		close(stopped)
+	}()
+
+	// One CLI with a request in flight, one idle
+	arrived := make(chan struct{})
+	release := make(chan struct{})
+	busy := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		close(arrived)
+		<-release
+		cli.respond(req.ID, http.StatusOK, nil, []byte("finished"))
+	})
+	_, idle, err := registerFakeCLI(srv, tunnel.TunnelRegister{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idleClosed := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := idle.ReadMessage(); err != nil {
+				idleClosed <- err
+				return
+			}
+		}
+	}()
+
+	type result struct {
+		status int
+		body   string
+		err    error
+	}
+	visitor := make(chan result, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(busy.newRequest(http.MethodGet, "/slow", nil))
+		if err != nil {
+			visitor <- result{err: err}
+			return
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		visitor <- result{status: resp.StatusCode, body: string(body)}
+	}()
+	<-arrived
+
+	stop <- syscall.SIGTERM
+
+	// Nobody is told to go away while a request is still being answered
+	select {
+	case err := <-idleClosed:
+		t.Fatalf("CLI closed before in-flight requests finished: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if !shuttingDown.Load() {
+		t.Error("still taking new tunnels after the signal")
+	}
+
+	close(release)
+	if res := <-visitor; res.err != nil || res.status != http.StatusOK || res.body != "finished" {
+		t.Errorf("in-flight request got %d %q %v, want it to finish", res.status, res.body, res.err)
+	}
+
+	// Then every CLI gets a close frame saying why
+	select {
+	case err := <-idleClosed:
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseGoingAway || closeErr.Text != shutdownReason {
+			t.Errorf("CLI got %v, want a %d %q close frame", err, websocket.CloseGoingAway, shutdownReason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("CLI never got a close frame")
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown didn't finish")
+	}
+}
+
+func TestNewTunnelsRefusedWhileShuttingDown(t *testing.T) {
+	srv := startTestServer(t)
+	shuttingDown.Store(true)
+	t.Cleanup(func() { shuttingDown.Store(false) })
+
+	_, _, err := registerFakeCLI(srv, tunnel.TunnelRegister{})
+	if !errors.Is(err, websocket.ErrBadHandshake) {
+		t.Errorf("got %v, want the upgrade refused", err)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+// Slow request traces
+//
+// A request that takes longer than SLOW_REQUEST_THRESHOLD is logged with a
+// breakdown of where the time went, and kept in a small ring buffer served at
+// /admin/slow-requests. The stages are:
+//
+//   - queue:   waiting for a concurrency slot (MAX_CONCURRENT_REQUESTS,
+//     ADAPTIVE_CONCURRENCY)
+//   - forward: reading the request body and sending it down the tunnel
+//   - wait:    waiting for the CLI's response - the local server's time
+//     plus the trip through the tunnel
+//   - write:   writing the response to the client (a streamed body included)
+//
+// A big "wait" points at the local server, a big "forward" or "write" at the
+// tunnel or a slow client.
+var (
+	slowRequestThreshold = getEnvDuration("SLOW_REQUEST_THRESHOLD", 0) // 0 = off
+	slowRequests         = newSlowRequestLog(getEnvInt("SLOW_REQUEST_BUFFER", 100))
+)
+
+// traceStage is a point a forwarded request passes on its way through
+type traceStage int
+
+const (
+	stageStart     traceStage = iota
+	stageAdmitted             // Got a concurrency slot
+	stageSent                 // Request and body handed to the CLI
+	stageResponded            // The CLI's final response arrived
+	numStages
+)
+
+// requestTrace records when a forwarded request reached each stage
+// Stages it never reached stay zero.
+type requestTrace struct {
+	at [numStages]time.Time
+}
+
+// traceKey is the request context key for the *requestTrace
+type traceKey struct{}
+
+// withTrace starts a trace for r, if slow request tracing is on
+func withTrace(r *http.Request, start time.Time) *http.Request {
+	if slowRequestThreshold <= 0 {
+		return r
+	}
+	trace := &requestTrace{}
+	trace.at[stageStart] = start
+	return r.WithContext(context.WithValue(r.Context(), traceKey{}, trace))
+}
+
+// traceFrom returns r's trace, nil if it has none
+func traceFrom(r *http.Request) *requestTrace {
+	trace, _ := r.Context().Value(traceKey{}).(*requestTrace)
+	return trace
+}
+
+// mark stamps a stage with the current time
+// In Go, calling a method on a nil pointer is fine as long as the method
+// checks for it - so callers don't need to know if tracing is on.
+func (t *requestTrace) mark(stage traceStage) {
+	if t != nil {
+		t.at[stage] = time.Now()
+	}
+}
+
+// SlowRequest is one entry in /admin/slow-requests, durations in milliseconds
+type SlowRequest struct {
+	Time      time.Time `json:"time"`
+	TunnelID  string    `json:"tunnel_id"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	TotalMs   float64   `json:"total_ms"`
+	QueueMs   float64   `json:"queue_ms"`
+	ForwardMs float64   `json:"forward_ms"`
+	WaitMs    float64   `json:"wait_ms"`
+	WriteMs   float64   `json:"write_ms"`
+}
+
+// breakdown splits the time from start to end into the four stages
+// The last stage reached runs until end, e.g. a request that timed out has
+// all its remaining time under "wait".
+func (t *requestTrace) breakdown(end time.Time) (queue, forward, wait, write time.Duration) {
+	var spans [numStages]time.Duration
+	for i := range t.at {
+		if t.at[i].IsZero() {
+			break
+		}
+		next := end
+		if i+1 < len(t.at) && !t.at[i+1].IsZero() {
+			next = t.at[i+1]
+		}
+		spans[i] = next.Sub(t.at[i])
+	}
+	return spans[stageStart], spans[stageAdmitted], spans[stageSent], spans[stageResponded]
+}
+
+// recordSlowRequest logs and keeps r's trace if it took longer than
+// SLOW_REQUEST_THRESHOLD
+// Requests without a trace (served from the cache, rejected early) are skipped.
+func recordSlowRequest(tun *tunnel.Tunnel, r *http.Request, forwardPath string, status int, duration time.Duration) {
+	trace := traceFrom(r)
+	if trace == nil || duration < slowRequestThreshold {
+		return
+	}
+
+	queue, forward, wait, write := trace.breakdown(trace.at[stageStart].Add(duration))
+	log.Printf("Slow request %s %s %s -> %d: %s (queue %s, forward %s, wait %s, write %s)",
+		tun.ID, r.Method, forwardPath, status, duration.Round(time.Millisecond),
+		queue.Round(time.Millisecond), forward.Round(time.Millisecond),
+		wait.Round(time.Millisecond), write.Round(time.Millisecond))
+
+	metrics.slowRequests.Add(1)
+	slowRequests.Add(SlowRequest{
+		Time:      trace.at[stageStart],
+		TunnelID:  tun.ID,
+		Method:    r.Method,
+		Path:      forwardPath,
+		Status:    status,
+		TotalMs:   millis(duration),
+		QueueMs:   millis(queue),
+		ForwardMs: millis(forward),
+		WaitMs:    millis(wait),
+		WriteMs:   millis(write),
+	})
+}
+
+// millis converts d to fractional milliseconds
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// slowRequestLog keeps the most recent slow requests, dropping the oldest
+// once it's full
+type slowRequestLog struct {
+	mu      sync.Mutex
+	entries []SlowRequest // Ring buffer, next is where the next entry goes
+	next    int
+	full    bool
+}
+
+func newSlowRequestLog(size int) *slowRequestLog {
+	if size < 1 {
+		size = 1
+	}
+	return &slowRequestLog{entries: make([]SlowRequest, size)}
+}
+
+// Add stores an entry, overwriting the oldest if the buffer is full
+func (l *slowRequestLog) Add(entry SlowRequest) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// Recent returns the stored entries, newest first
+func (l *slowRequestLog) Recent() []SlowRequest {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	count := l.next
+	if l.full {
+		count = len(l.entries)
+	}
+	recent := make([]SlowRequest, 0, count)
+	for i := 1; i <= count; i++ {
+		recent = append(recent, l.entries[(l.next-i+len(l.entries))%len(l.entries)])
+	}
+	return recent
+}
+
+// handleSlowRequests serves the recent slow requests as JSON
+func handleSlowRequests(w http.ResponseWriter, r *http.Request) {
+	recent := slowRequests.Recent()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		ThresholdMs float64       `json:"threshold_ms"`
+		Count       int           `json:"count"`
+		Requests    []SlowRequest `json:"requests"`
+	}{millis(slowRequestThreshold), len(recent), recent})
+}
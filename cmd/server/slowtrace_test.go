@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestSlowRequestsAreTracedAndFastOnesArent(t *testing.T) {
+	setForTest(t, &slowRequestThreshold, 150*time.Millisecond)
+	setForTest(t, &slowRequests, newSlowRequestLog(10))
+	setForTest(t, &viewerToken, "viewer-secret")
+	logs := captureLog(t)
+	srv := startTestServer(t)
+
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		if req.Path == "/slow" {
+			time.Sleep(250 * time.Millisecond) // The local server takes its time
+		}
+		cli.respond(req.ID, http.StatusOK, nil, []byte("done"))
+	})
+	for _, path := range []string{"/fast", "/slow", "/fast"} {
+		if status, _ := cli.get(path); status != http.StatusOK {
+			t.Fatalf("%s got %d", path, status)
+		}
+	}
+
+	// Only the slow one, with its time under "wait" - the local server
+	recent := slowRequests.Recent()
+	if len(recent) != 1 {
+		t.Fatalf("got %d traces, want just /slow: %+v", len(recent), recent)
+	}
+	slow := recent[0]
+	if slow.TunnelID != cli.ID || slow.Method != http.MethodGet || slow.Path != "/slow" || slow.Status != http.StatusOK {
+		t.Errorf("got %+v", slow)
+	}
+	if slow.WaitMs < 200 || slow.TotalMs < slow.WaitMs {
+		t.Errorf("wait %.1fms of %.1fms total, want the local server's 250ms under wait", slow.WaitMs, slow.TotalMs)
+	}
+	if sum := slow.QueueMs + slow.ForwardMs + slow.WaitMs + slow.WriteMs; sum > slow.TotalMs+1 || sum < slow.TotalMs-1 {
+		t.Errorf("stages add up to %.1fms, total is %.1fms", sum, slow.TotalMs)
+	}
+	if !strings.Contains(logs.String(), "Slow request "+cli.ID+" GET /slow") {
+		t.Errorf("slow request not logged:\n%s", logs)
+	}
+
+	// The same, from the admin endpoint
+	req := httptest.NewRequest(http.MethodGet, "/admin/slow-requests", nil)
+	req.Header.Set("Authorization", "Bearer viewer-secret")
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, req)
+	var list struct {
+		ThresholdMs float64       `json:"threshold_ms"`
+		Count       int           `json:"count"`
+		Requests    []SlowRequest `json:"requests"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatalf("%d %s: %v", rec.Code, rec.Body, err)
+	}
+	if list.ThresholdMs != 150 || list.Count != 1 || list.Requests[0].Path != "/slow" {
+		t.Errorf("got %+v", list)
+	}
+}
+
+func TestSlowRequestTracingOff(t *testing.T) {
+	setForTest(t, &slowRequestThreshold, 0)
+	setForTest(t, &slowRequests, newSlowRequestLog(10))
+	srv := startTestServer(t)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		time.Sleep(50 * time.Millisecond)
+		cli.respond(req.ID, http.StatusOK, nil, nil)
+	})
+	cli.get("/")
+	if got := len(slowRequests.Recent()); got != 0 {
+		t.Errorf("%d traces with SLOW_REQUEST_THRESHOLD off", got)
+	}
+}
+
+func TestSlowRequestLogKeepsTheNewest(t *testing.T) {
+	l := newSlowRequestLog(3)
+	if got := l.Recent(); len(got) != 0 {
+		t.Fatalf("new log has %d entries", len(got))
+	}
+	for i := 1; i <= 5; i++ {
+		l.Add(SlowRequest{Path: fmt.Sprintf("/%d", i)})
+	}
+	var paths []string
+	for _, entry := range l.Recent() {
+		paths = append(paths, entry.Path)
+	}
+	if got := strings.Join(paths, " "); got != "/5 /4 /3" {
+		t.Errorf("got %s, want the 3 newest, newest first", got)
+	}
+}
+
+func TestTraceBreakdown(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+
+	full := &requestTrace{}
+	full.at = [numStages]time.Time{at(0), at(10), at(30), at(130)}
+	queue, forward, wait, write := full.breakdown(at(135))
+	if queue != 10*time.Millisecond || forward != 20*time.Millisecond || wait != 100*time.Millisecond || write != 5*time.Millisecond {
+		t.Errorf("got queue %s, forward %s, wait %s, write %s", queue, forward, wait, write)
+	}
+
+	// A request that timed out never responded: the rest is all wait
+	timedOut := &requestTrace{}
+	timedOut.at[stageStart], timedOut.at[stageAdmitted], timedOut.at[stageSent] = at(0), at(0), at(5)
+	if _, _, wait, write := timedOut.breakdown(at(1005)); wait != time.Second || write != 0 {
+		t.Errorf("timed out: wait %s, write %s", wait, write)
+	}
+}
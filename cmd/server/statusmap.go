@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Status mapping lets operators control which upstream status codes reach
+// public clients, e.g. hide the local app's 5xx pages behind a generic 502
+//
+// STATUS_MAP is a comma-separated list of "from=to" rules where from is an
+// exact code ("404") or a class ("5xx"). Exact codes win over classes.
+// STATUS_MAP_PAGE, if set, replaces the body of any remapped response.
+var (
+	statusRules   = parseStatusMap(getEnv("STATUS_MAP", ""))
+	statusMapPage = getEnv("STATUS_MAP_PAGE", "")
+)
+
+// statusRule maps one code or class of codes to a replacement
+type statusRule struct {
+	code  int // Exact status, or 0 for a class rule
+	class int // 1-5 for "1xx".."5xx", 0 for an exact rule
+	to    int
+}
+
+// mapStatus applies the STATUS_MAP rules to an upstream status
+// Returns the status to send and whether it changed
+func mapStatus(status int) (int, bool) {
+	var classMatch *statusRule
+	for i := range statusRules {
+		rule := &statusRules[i]
+		if rule.code == status {
+			return rule.to, rule.to != status
+		}
+		if rule.class != 0 && rule.class == status/100 && classMatch == nil {
+			classMatch = rule
+		}
+	}
+	if classMatch != nil {
+		return classMatch.to, classMatch.to != status
+	}
+	return status, false
+}
+
+// parseStatusMap parses "5xx=502,404=410" into rules
+// Malformed rules are logged and skipped
+func parseStatusMap(value string) []statusRule {
+	var rules []statusRule
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		from, to, found := strings.Cut(entry, "=")
+		toCode, err := strconv.Atoi(strings.TrimSpace(to))
+		if !found || err != nil || toCode < 100 || toCode > 599 {
+			log.Printf("Ignoring invalid STATUS_MAP rule %q", entry)
+			continue
+		}
+
+		from = strings.ToLower(strings.TrimSpace(from))
+		rule := statusRule{to: toCode}
+		if len(from) == 3 && strings.HasSuffix(from, "xx") && from[0] >= '1' && from[0] <= '5' {
+			rule.class = int(from[0] - '0')
+		} else if code, err := strconv.Atoi(from); err == nil && code >= 100 && code <= 599 {
+			rule.code = code
+		} else {
+			log.Printf("Ignoring invalid STATUS_MAP rule %q", entry)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
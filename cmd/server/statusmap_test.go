@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestMapStatus(t *testing.T) {
+	setForTest(t, &statusRules, parseStatusMap("5xx=502, 503=503, 404=410, 9xx=200, 200=abc, =500, 418"))
+
+	tests := []struct {
+		from, to int
+		changed  bool
+	}{
+		{500, 502, true},
+		{504, 502, true},
+		{502, 502, false}, // Mapped to itself
+		{503, 503, false}, // The exact rule wins over 5xx
+		{404, 410, true},
+		{200, 200, false}, // Invalid rules were skipped
+		{301, 301, false},
+	}
+	for _, tc := range tests {
+		to, changed := mapStatus(tc.from)
+		if to != tc.to || changed != tc.changed {
+			t.Errorf("mapStatus(%d) = %d, %v, want %d, %v", tc.from, to, changed, tc.to, tc.changed)
+		}
+	}
+}
+
+func TestParseStatusMapSkipsInvalidRules(t *testing.T) {
+	rules := parseStatusMap("5xx=502,abc=200,404=999,6xx=500,404=,  4XX = 400 ")
+	if len(rules) != 2 {
+		t.Fatalf("got %d rules (%+v), want 5xx and 4XX", len(rules), rules)
+	}
+	if rules[0].class != 5 || rules[0].to != 502 || rules[1].class != 4 || rules[1].to != 400 {
+		t.Errorf("got %+v", rules)
+	}
+}
+
+func TestStatusMapThroughTunnel(t *testing.T) {
+	srv := startTestServer(t)
+	setForTest(t, &statusRules, parseStatusMap("5xx=502"))
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{Capabilities: allCapabilities},
+		func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+			cli.respond(req.ID, http.StatusInternalServerError, nil, []byte("stack trace with secrets"))
+		})
+
+	// Without a page, only the status changes
+	setForTest(t, &statusMapPage, "")
+	status, body := cli.get("/")
+	if status != http.StatusBadGateway || string(body) != "stack trace with secrets" {
+		t.Errorf("got %d %q, want 502 with the upstream body", status, body)
+	}
+
+	// With one, the upstream body is replaced too
+	setForTest(t, &statusMapPage, "<h1>Something went wrong</h1>")
+	status, body = cli.get("/")
+	if status != http.StatusBadGateway || string(body) != "<h1>Something went wrong</h1>" {
+		t.Errorf("got %d %q, want 502 with STATUS_MAP_PAGE", status, body)
+	}
+}
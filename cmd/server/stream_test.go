@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+// echoBody answers every request with its own body, inline or streamed the
+// same way it arrived, and reports whether it was streamed
+// Like most local servers it reads the whole request before answering - the
+// server only starts reading the response once the upload is through.
+func echoBody(streamed chan<- bool) fakeHandler {
+	return func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+		if streamed != nil {
+			streamed <- req.Streamed
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			cli.respond(req.ID, http.StatusBadGateway, nil, nil)
+			return
+		}
+		if !req.Streamed {
+			cli.respond(req.ID, http.StatusOK, nil, data)
+			return
+		}
+		cli.respondStreamed(req.ID, http.StatusOK, nil, bytes.NewReader(data))
+	}
+}
+
+func TestRequestBodiesStreamAboveThreshold(t *testing.T) {
+	srv := startTestServer(t)
+	streamed := make(chan bool, 1)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{Capabilities: allCapabilities}, echoBody(streamed))
+
+	tests := []struct {
+		size     int64
+		streamed bool
+	}{
+		{0, false},
+		{1024, false},
+		{streamThreshold, false}, // Exactly at the threshold still fits one message
+		{streamThreshold + 1, true},
+		{5*streamThreshold + 12345, true},
+	}
+	for _, tc := range tests {
+		data := make([]byte, tc.size)
+		rand.Read(data)
+
+		resp, err := http.DefaultClient.Do(cli.newRequest(http.MethodPost, "/upload", bytes.NewReader(data)))
+		if err != nil {
+			t.Fatalf("%d bytes: %v", tc.size, err)
+		}
+		got, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%d bytes: reading echo: %v", tc.size, err)
+		}
+
+		if s := <-streamed; s != tc.streamed {
+			t.Errorf("%d bytes: streamed = %v, want %v", tc.size, s, tc.streamed)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%d bytes: echo came back as %d different bytes", tc.size, len(got))
+		}
+	}
+}
+
+func TestLegacyCLIGetsInlineBodies(t *testing.T) {
+	srv := startTestServer(t)
+	streamed := make(chan bool, 1)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, echoBody(streamed))
+
+	data := make([]byte, 3*streamThreshold)
+	rand.Read(data)
+	resp, err := http.DefaultClient.Do(cli.newRequest(http.MethodPost, "/upload", bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if <-streamed {
+		t.Error("a CLI without streaming got a streamed body")
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("echo came back as %d different bytes", len(got))
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestRequestedSubdomainIsServed(t *testing.T) {
+	srv := startTestServer(t)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{Subdomain: "myapp-508"}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		cli.respond(req.ID, http.StatusOK, nil, []byte("stable"))
+	})
+	if cli.ID != "myapp-508" {
+		t.Fatalf("assigned %q, want the requested myapp-508", cli.ID)
+	}
+	if status, body := cli.get("/"); status != http.StatusOK || string(body) != "stable" {
+		t.Errorf("GET myapp-508.localhost = %d %q", status, body)
+	}
+}
+
+func TestRequestedSubdomainRefusals(t *testing.T) {
+	srv := startTestServer(t)
+	startFakeCLI(t, srv, tunnel.TunnelRegister{Subdomain: "taken-508"}, nil)
+
+	tests := []struct {
+		subdomain string
+		want      string
+	}{
+		{"taken-508", tunnel.ErrCodeSubdomainTaken},
+		{"my_app", tunnel.ErrCodeSubdomainInvalid},
+		{"my.app", tunnel.ErrCodeSubdomainInvalid},
+		{"-myapp", tunnel.ErrCodeSubdomainInvalid},
+		{"admin", tunnel.ErrCodeSubdomainReserved},
+		{"www", tunnel.ErrCodeSubdomainReserved},
+	}
+	for _, tc := range tests {
+		// An error message, not a random ID in place of the one asked for
+		assigned, _, err := registerFakeCLI(srv, tunnel.TunnelRegister{Subdomain: tc.subdomain})
+		var refused *refusedError
+		if !errors.As(err, &refused) {
+			t.Errorf("%q: got %+v, %v; want a %s error", tc.subdomain, assigned, err, tc.want)
+			continue
+		}
+		if refused.Code != tc.want || refused.Message == "" {
+			t.Errorf("%q: got %s %q, want %s", tc.subdomain, refused.Code, refused.Message, tc.want)
+		}
+	}
+}
+
+func TestSubdomainOf(t *testing.T) {
+	tests := []struct {
+		host, base string
+		want       string
+	}{
+		{"abc123.tunnelr.io", "tunnelr.io", "abc123"},
+		{"ABC123.Tunnelr.IO:443", "tunnelr.io", "abc123"},
+		{"abc123.tunnelr.io.", "tunnelr.io", "abc123"}, // Fully qualified
+		{"tunnelr.io", "tunnelr.io", ""},
+		{"www.tunnelr.io", "tunnelr.io", ""},
+		{"a.b.tunnelr.io", "tunnelr.io", ""},
+		{"abc123.nottunnelr.io", "tunnelr.io", ""},
+		{"abc123.tunnelr.io.evil.com", "tunnelr.io", ""},
+		{"my_app.tunnelr.io", "tunnelr.io", ""},
+
+		// Multi-label base domains: strip the whole base, not a label count
+		{"abc123.tunnel.example.co.uk", "tunnel.example.co.uk", "abc123"},
+		{"tunnel.example.co.uk", "tunnel.example.co.uk", ""},
+		{"example.co.uk", "tunnel.example.co.uk", ""},
+		{"abc123.example.co.uk", "tunnel.example.co.uk", ""},
+		{"www.tunnel.example.co.uk", "tunnel.example.co.uk", ""},
+
+		// localhost works whatever the base; IPs never name a tunnel
+		{"abc123.localhost:8080", "tunnelr.io", "abc123"},
+		{"localhost:8080", "tunnelr.io", ""},
+		{"127.0.0.1:8080", "tunnelr.io", ""},
+		{"[::1]:8080", "tunnelr.io", ""},
+		{"10.0.0.1", "0.1", ""},
+		{"", "tunnelr.io", ""},
+	}
+	for _, tc := range tests {
+		if got := subdomainOf(tc.host, tc.base); got != tc.want {
+			t.Errorf("subdomainOf(%q, %q) = %q, want %q", tc.host, tc.base, got, tc.want)
+		}
+	}
+}
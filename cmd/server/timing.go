@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Timing headers - when the CLI runs with TUNNELR_TIMING_HEADERS it reports
+// how long the local server took. We add our own share so Server-Timing shows
+// the full breakdown: local server vs. tunnel overhead.
+
+// localDurationHeader is set by the CLI, in milliseconds
+const localDurationHeader = "X-Tunnel-Local-Duration"
+
+// addTunnelTiming appends a "tunnel" entry to the response's Server-Timing
+// header: the time since the request arrived minus the local server's time
+// Does nothing if the CLI didn't report a local duration
+func addTunnelTiming(headers http.Header, start time.Time) {
+	if headers == nil {
+		return
+	}
+	localMs, err := strconv.ParseFloat(headers.Get(localDurationHeader), 64)
+	if err != nil || localMs < 0 {
+		return
+	}
+
+	totalMs := float64(time.Since(start).Microseconds()) / 1000
+	tunnelMs := totalMs - localMs
+	if tunnelMs < 0 {
+		tunnelMs = 0
+	}
+
+	// Server-Timing may repeat, so the CLI's "local" entry stays as it is
+	headers.Add("Server-Timing", "tunnel;desc=\"Tunnel overhead\";dur="+strconv.FormatFloat(tunnelMs, 'f', 3, 64))
+}
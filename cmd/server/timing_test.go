@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+// tunnelDuration pulls the tunnel entry's dur out of Server-Timing values
+func tunnelDuration(t *testing.T, values []string) float64 {
+	t.Helper()
+	for _, v := range values {
+		if rest, ok := strings.CutPrefix(v, `tunnel;desc="Tunnel overhead";dur=`); ok {
+			ms, err := strconv.ParseFloat(rest, 64)
+			if err != nil {
+				t.Fatalf("bad tunnel duration in %q", v)
+			}
+			return ms
+		}
+	}
+	t.Fatalf("no tunnel entry in Server-Timing %q", values)
+	return 0
+}
+
+func TestAddTunnelTiming(t *testing.T) {
+	// 100ms in total, 20 of them in the local server
+	headers := http.Header{localDurationHeader: {"20"}}
+	addTunnelTiming(headers, time.Now().Add(-100*time.Millisecond))
+	if ms := tunnelDuration(t, headers.Values("Server-Timing")); ms < 79 || ms > 1000 {
+		t.Errorf("tunnel overhead %.3fms, want about 80", ms)
+	}
+
+	// A local time longer than the total (clock skew) never goes negative
+	headers = http.Header{localDurationHeader: {"5000"}}
+	addTunnelTiming(headers, time.Now())
+	if ms := tunnelDuration(t, headers.Values("Server-Timing")); ms != 0 {
+		t.Errorf("tunnel overhead %.3fms, want 0", ms)
+	}
+
+	// Without a usable local duration nothing is added
+	for _, value := range []string{"", "soon", "-3"} {
+		headers := http.Header{}
+		if value != "" {
+			headers.Set(localDurationHeader, value)
+		}
+		addTunnelTiming(headers, time.Now())
+		if got := headers.Values("Server-Timing"); len(got) != 0 {
+			t.Errorf("local duration %q added Server-Timing %q", value, got)
+		}
+	}
+	addTunnelTiming(nil, time.Now()) // Must not panic
+}
+
+func TestServerTimingThroughTunnel(t *testing.T) {
+	srv := startTestServer(t)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+		headers := http.Header{}
+		headers.Set(localDurationHeader, "12.500")
+		headers.Add("Server-Timing", `local;desc="Local server";dur=12.500`)
+		cli.respond(req.ID, http.StatusOK, headers, []byte("ok"))
+	})
+
+	resp, err := http.DefaultClient.Do(cli.newRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	timing := resp.Header.Values("Server-Timing")
+	if len(timing) != 2 || timing[0] != `local;desc="Local server";dur=12.500` {
+		t.Fatalf("Server-Timing = %q, want the CLI's local entry and the tunnel's", timing)
+	}
+	if ms := tunnelDuration(t, timing); ms < 0 || ms > 5000 {
+		t.Errorf("tunnel overhead %.3fms", ms)
+	}
+}
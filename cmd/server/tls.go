@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Built-in TLS, for simple deployments without Caddy or nginx in front
+// With TLS_CERT and TLS_KEY set, the server speaks HTTPS itself: visitors use
+// https://, CLIs wss://.../ws, and /health works the same as over plain HTTP.
+// With AUTOCERT=true it gets its certificates from Let's Encrypt instead.
+// Without either it serves plain HTTP and expects a proxy to handle HTTPS.
+var (
+	tlsCertFile = getEnv("TLS_CERT", "") // PEM certificate (chain), e.g. fullchain.pem
+	tlsKeyFile  = getEnv("TLS_KEY", "")  // PEM private key, e.g. privkey.pem
+
+	autocertEnabled  = getEnvBool("AUTOCERT", false)
+	autocertCacheDir = getEnv("AUTOCERT_CACHE_DIR", "autocert-cache") // Where certificates and the ACME account key are kept
+	autocertEmail    = getEnv("AUTOCERT_EMAIL", "")                   // Let's Encrypt's contact for expiry warnings, optional
+)
+
+// loadTLSConfig returns the server's TLS config, nil when TLS is off
+// Errors (one of the two files missing, unreadable or not matching) are
+// meant to stop the server at startup, not at the first handshake.
+// The certificate is read once - restart the server after renewing it.
+func loadTLSConfig() (*tls.Config, error) {
+	if autocertEnabled {
+		if tlsCertFile != "" || tlsKeyFile != "" {
+			return nil, fmt.Errorf("set either AUTOCERT or TLS_CERT/TLS_KEY, not both")
+		}
+		return autocertTLSConfig()
+	}
+	if tlsCertFile == "" && tlsKeyFile == "" {
+		return nil, nil
+	}
+	if tlsCertFile == "" || tlsKeyFile == "" {
+		return nil, fmt.Errorf("TLS_CERT and TLS_KEY must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS_CERT/TLS_KEY: %v", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// tlsSource describes where the certificate comes from, for the startup output
+func tlsSource() string {
+	if autocertEnabled {
+		return fmt.Sprintf("Let's Encrypt certificates (cached in %s)", autocertCacheDir)
+	}
+	return tlsCertFile
+}
+
+// autocertTLSConfig gets certificates from Let's Encrypt as they're needed,
+// and renews them before they expire
+// Let's Encrypt checks we control a name with the TLS-ALPN-01 challenge,
+// which happens in the TLS handshake itself - so the server has to be
+// reachable on port 443. Wildcard certificates need a DNS challenge, which
+// this can't do: in subdomain mode every tunnel host gets a certificate of
+// its own on its first visit.
+func autocertTLSConfig() (*tls.Config, error) {
+	if baseDomain == "localhost" || net.ParseIP(baseDomain) != nil {
+		return nil, fmt.Errorf("AUTOCERT needs BASE_DOMAIN to be a public domain, got %q", baseDomain)
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(autocertCacheDir),
+		HostPolicy: autocertHostPolicy,
+		Email:      autocertEmail,
+	}
+	cfg := m.TLSConfig()
+	cfg.MinVersion = tls.VersionTLS12
+	return cfg, nil
+}
+
+// autocertHostPolicy decides which names we ask Let's Encrypt for: the base
+// domain, and in subdomain mode "<id>.<base domain>" for tunnels that are
+// connected
+// Anything else is refused, so scanners trying random names can't use up
+// the domain's Let's Encrypt rate limits. A tunnel's certificate stays in the
+// cache, so it's there right away when the tunnel comes back.
+func autocertHostPolicy(ctx context.Context, host string) error {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	base := strings.TrimSuffix(strings.ToLower(baseDomain), ".")
+	if host == base {
+		return nil
+	}
+	if routingMode == "subdomain" && strings.HasSuffix(host, "."+base) {
+		id := subdomainOf(host, base)
+		if _, ok := registry.Get(id); id != "" && ok {
+			return nil
+		}
+		return fmt.Errorf("autocert: %q isn't a connected tunnel", host)
+	}
+	return fmt.Errorf("autocert: %q isn't under %s", host, base)
+}
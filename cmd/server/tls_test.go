@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunnelr/internal/tunnel"
+)
+
+// writeTestCert writes a self-signed certificate for localhost, its
+// subdomains and 127.0.0.1 to dir, and returns the two paths and a pool
+// trusting it
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost", "*.localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	setForTest(t, &autocertEnabled, false)
+	certFile, keyFile, _ := writeTestCert(t, t.TempDir())
+	otherCert, _, _ := writeTestCert(t, t.TempDir())
+
+	tests := []struct {
+		name      string
+		cert, key string
+		wantTLS   bool
+		wantErr   string
+	}{
+		{"neither set: plain HTTP", "", "", false, ""},
+		{"both set", certFile, keyFile, true, ""},
+		{"only the certificate", certFile, "", false, "must be set together"},
+		{"only the key", "", keyFile, false, "must be set together"},
+		{"missing file", certFile, filepath.Join(t.TempDir(), "nope.pem"), false, "loading TLS_CERT/TLS_KEY"},
+		{"key for another certificate", otherCert, keyFile, false, "loading TLS_CERT/TLS_KEY"},
+	}
+	for _, tc := range tests {
+		tlsCertFile, tlsKeyFile = tc.cert, tc.key
+		cfg, err := loadTLSConfig()
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%s: got error %v, want one mentioning %q", tc.name, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if (cfg != nil) != tc.wantTLS {
+			t.Errorf("%s: got config %v, want TLS %v", tc.name, cfg != nil, tc.wantTLS)
+		}
+		if cfg != nil && (len(cfg.Certificates) != 1 || cfg.MinVersion != tls.VersionTLS12) {
+			t.Errorf("%s: got %d certificates, min version %x", tc.name, len(cfg.Certificates), cfg.MinVersion)
+		}
+	}
+	tlsCertFile, tlsKeyFile = "", ""
+}
+
+func TestServeOverTLS(t *testing.T) {
+	setForTest(t, &autocertEnabled, false)
+	setForTest(t, &migrateURL, "")
+	t.Cleanup(func() { shuttingDown.Store(false) })
+
+	certFile, keyFile, pool := writeTestCert(t, t.TempDir())
+	setForTest(t, &tlsCertFile, certFile)
+	setForTest(t, &tlsKeyFile, keyFile)
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Served the way main serves it, on a listener of our own
+	srv := httptest.NewUnstartedServer(newMux())
+	srv.URL = "https://" + srv.Listener.Addr().String()
+	srv.Config.TLSConfig = tlsConfig
+	stop := make(chan os.Signal, 1)
+	stopped := make(chan struct{})
+	go func() {
+		serveUntil(srv.Config, srv.Listener, stop)
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		stop <- syscall.SIGTERM
+		<-stopped
+	})
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+
+	// /health
+	resp, err := client.Get(srv.URL + "/health")
+	if err != nil {
+		t.Fatalf("/health over HTTPS: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.TLS == nil {
+		t.Errorf("/health got %d (TLS %v), want 200 over TLS", resp.StatusCode, resp.TLS != nil)
+	}
+
+	// A CLI registers over wss://.../ws, and a visitor's request is forwarded
+	dialer := &websocket.Dialer{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	cli := startFakeCLIVia(t, srv, dialer, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, body io.Reader) {
+		data, _ := io.ReadAll(body)
+		cli.respond(req.ID, http.StatusOK, nil, []byte(req.Method+" "+req.Path+" "+string(data)))
+	})
+	resp, err = client.Do(cli.newRequest(http.MethodPost, "/echo?x=1", strings.NewReader("over tls")))
+	if err != nil {
+		t.Fatalf("visitor request over HTTPS: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "POST /echo?x=1 over tls" {
+		t.Errorf("got %d %q, want the request forwarded", resp.StatusCode, body)
+	}
+
+	// Plain HTTP on the same port doesn't get through
+	resp, err = http.Get("http://" + srv.Listener.Addr().String() + "/health")
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Error("plain HTTP served on the TLS port")
+		}
+	}
+}
+
+func TestAutocertHostPolicy(t *testing.T) {
+	setForTest(t, &baseDomain, "tunnels.example.com")
+	setForTest(t, &routingMode, "subdomain")
+	srv := startTestServer(t)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, nil)
+
+	tests := []struct {
+		host  string
+		allow bool
+	}{
+		{"tunnels.example.com", true},
+		{"Tunnels.Example.COM.", true},
+		{cli.ID + ".tunnels.example.com", true},
+		{strings.ToUpper(cli.ID) + ".tunnels.example.com", true},
+		{"notconnected539.tunnels.example.com", false}, // No such tunnel
+		{"www.tunnels.example.com", false},
+		{"a." + cli.ID + ".tunnels.example.com", false},
+		{"example.com", false},
+		{"eviltunnels.example.com", false},
+		{"tunnels.example.com.evil.org", false},
+		{cli.ID + ".localhost", false},
+		{"203.0.113.7", false},
+	}
+	for _, tc := range tests {
+		err := autocertHostPolicy(context.Background(), tc.host)
+		if (err == nil) != tc.allow {
+			t.Errorf("%s: got %v, want allowed %v", tc.host, err, tc.allow)
+		}
+	}
+
+	// A tunnel that's gone doesn't get new certificates
+	disconnectTunnel(cli.ID, "", "test")
+	if err := autocertHostPolicy(context.Background(), cli.ID+".tunnels.example.com"); err == nil {
+		t.Error("allowed a certificate for a disconnected tunnel")
+	}
+
+	// Path routing has no tunnel hosts, only the base domain
+	setForTest(t, &routingMode, "path")
+	cli = startFakeCLI(t, srv, tunnel.TunnelRegister{}, nil)
+	if err := autocertHostPolicy(context.Background(), cli.ID+".tunnels.example.com"); err == nil {
+		t.Error("path mode: allowed a certificate for a tunnel subdomain")
+	}
+	if err := autocertHostPolicy(context.Background(), "tunnels.example.com"); err != nil {
+		t.Errorf("path mode: base domain refused: %v", err)
+	}
+}
+
+func TestAutocertConfig(t *testing.T) {
+	setForTest(t, &autocertEnabled, true)
+	setForTest(t, &autocertCacheDir, t.TempDir())
+	setForTest(t, &tlsCertFile, "")
+	setForTest(t, &tlsKeyFile, "")
+
+	// Needs a public domain for Let's Encrypt to check
+	for _, base := range []string{"localhost", "127.0.0.1", "::1"} {
+		baseDomain = base
+		if _, err := loadTLSConfig(); err == nil || !strings.Contains(err.Error(), "public domain") {
+			t.Errorf("BASE_DOMAIN=%s: got %v, want it refused", base, err)
+		}
+	}
+	setForTest(t, &baseDomain, "tunnels.example.com")
+
+	cfg, err := loadTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.GetCertificate == nil || cfg.MinVersion != tls.VersionTLS12 {
+		t.Errorf("got GetCertificate %v, min version %x", cfg.GetCertificate != nil, cfg.MinVersion)
+	}
+	// The TLS-ALPN-01 challenge is answered in the handshake
+	if !strings.Contains(strings.Join(cfg.NextProtos, ","), "acme-tls/1") {
+		t.Errorf("NextProtos = %v, want acme-tls/1 offered", cfg.NextProtos)
+	}
+
+	// A host the policy refuses fails the handshake without asking Let's Encrypt
+	if _, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "evil.org"}); err == nil {
+		t.Error("got a certificate for a foreign host")
+	}
+
+	// Not together with certificate files
+	tlsCertFile, tlsKeyFile = "cert.pem", "key.pem"
+	if _, err := loadTLSConfig(); err == nil || !strings.Contains(err.Error(), "not both") {
+		t.Errorf("AUTOCERT with TLS_CERT/TLS_KEY: got %v, want an error", err)
+	}
+}
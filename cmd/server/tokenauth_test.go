@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestTunnelTokens(t *testing.T) {
+	setForTest(t, &authTokens, parseAuthTokens(" alpha-509 , ,beta-509"))
+	srv := startTestServer(t)
+
+	// A listed token gets a tunnel
+	for _, token := range []string{"alpha-509", "beta-509"} {
+		assigned, conn, err := registerFakeCLI(srv, tunnel.TunnelRegister{AuthToken: token})
+		if err != nil {
+			t.Errorf("token %q refused: %v", token, err)
+			continue
+		}
+		conn.Close()
+		if assigned.TunnelID == "" {
+			t.Errorf("token %q: no tunnel ID", token)
+		}
+	}
+
+	// Anything else is closed with a policy violation saying why
+	tests := map[string]string{
+		"":           "auth token required",
+		"gamma-509":  "invalid auth token",
+		"alpha-50":   "invalid auth token",
+		"Alpha-509":  "invalid auth token",
+		"alpha-509 ": "invalid auth token",
+	}
+	for token, reason := range tests {
+		_, _, err := registerFakeCLI(srv, tunnel.TunnelRegister{AuthToken: token, Subdomain: "refused-509"})
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) {
+			t.Errorf("token %q: got %v, want the connection closed", token, err)
+			continue
+		}
+		if closeErr.Code != websocket.ClosePolicyViolation || closeErr.Text != reason {
+			t.Errorf("token %q: closed with %d %q, want %d %q", token, closeErr.Code, closeErr.Text, websocket.ClosePolicyViolation, reason)
+		}
+	}
+	if _, ok := registry.Get("refused-509"); ok {
+		t.Error("a refused token got a tunnel registered")
+	}
+}
+
+func TestNoTokensMeansOpenServer(t *testing.T) {
+	setForTest(t, &authTokens, parseAuthTokens(""))
+	srv := startTestServer(t)
+
+	for _, token := range []string{"", "anything"} {
+		_, conn, err := registerFakeCLI(srv, tunnel.TunnelRegister{AuthToken: token})
+		if err != nil {
+			t.Errorf("token %q refused with AUTH_TOKENS empty: %v", token, err)
+			continue
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+func TestUnbufferedResponsesReachTheVisitorAsWritten(t *testing.T) {
+	srv := startTestServer(t)
+
+	// The local server writes a line, then waits until the test is over
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	handle := func(header http.Header) fakeHandler {
+		return func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+			pr, pw := io.Pipe()
+			go cli.respondStreamed(req.ID, http.StatusOK, header, pr)
+			pw.Write([]byte("step 1 done\n"))
+			<-release
+			pw.Write([]byte("step 2 done\n"))
+			pw.Close()
+		}
+	}
+
+	tests := []struct {
+		name   string
+		reg    tunnel.TunnelRegister
+		header http.Header
+	}{
+		{"X-Accel-Buffering", tunnel.TunnelRegister{Capabilities: allCapabilities}, http.Header{"X-Accel-Buffering": {"no"}}},
+		{"--no-buffering", tunnel.TunnelRegister{Capabilities: allCapabilities, Unbuffered: true}, nil},
+	}
+	for _, tc := range tests {
+		cli := startFakeCLI(t, srv, tc.reg, handle(tc.header))
+
+		start := time.Now()
+		resp, err := http.DefaultClient.Do(cli.newRequest(http.MethodGet, "/build-log", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, err := bufio.NewReader(resp.Body).ReadString('\n')
+		resp.Body.Close()
+		if err != nil || line != "step 1 done\n" {
+			t.Errorf("%s: first line %q (%v)", tc.name, line, err)
+		}
+		if took := time.Since(start); took > time.Second {
+			t.Errorf("%s: first line took %s, want it as soon as it was written", tc.name, took)
+		}
+	}
+}
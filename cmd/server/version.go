@@ -0,0 +1,17 @@
+package main
+
+import "tunnelr/internal/tunnel"
+
+// Build info, set at build time so /health shows which build is running:
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%d)" ./cmd/server
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// versionString is the build info in one line, see tunnel.VersionString
+func versionString() string {
+	return tunnel.VersionString(version, commit, buildDate)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHealthShowsVersion(t *testing.T) {
+	setForTest(t, &version, "1.4.0")
+	setForTest(t, &commit, "9f86d08")
+	setForTest(t, &buildDate, "2026-03-01")
+
+	srv := startTestServer(t)
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/health", nil)
+	req.Host = baseDomain
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	lines := strings.Split(string(body), "\n")
+	if len(lines) < 2 || lines[0] != "ok" || lines[1] != "version: 1.4.0 (commit 9f86d08, built 2026-03-01)" {
+		t.Errorf("/health starts %q, want ok then the version", lines[:min(len(lines), 2)])
+	}
+}
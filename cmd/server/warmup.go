@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"tunnelr/internal/tunnel"
+)
+
+// Warmup - a CLI started together with its app (`npm start & tunnelr connect
+// 3000 --warmup 30s`) can get requests before the app is listening. For that
+// long after registering, a request the CLI couldn't deliver because nothing
+// answered on the local port is sent again every WARMUP_RETRY_INTERVAL
+// instead of failing with a 502 right away. Retries still count towards
+// REQUEST_TIMEOUT: once it runs out the visitor gets a 504. Requests with a
+// streamed body can't be sent twice, so they fail as usual.
+var (
+	warmupMax           = getEnvDuration("WARMUP_MAX", 2*time.Minute)
+	warmupRetryInterval = getEnvDuration("WARMUP_RETRY_INTERVAL", 500*time.Millisecond)
+)
+
+// isUnreachable reports whether the CLI's 502 means the local server isn't up
+func isUnreachable(resp *tunnel.HTTPResponse) bool {
+	return resp.StatusCode == http.StatusBadGateway && resp.Headers.Get(tunnel.UnreachableHeader) != ""
+}
+
+// validateWarmup caps the warmup a CLI asked for at WARMUP_MAX
+func validateWarmup(seconds int, remoteAddr string) int {
+	if seconds <= 0 {
+		return 0
+	}
+	if max := int(warmupMax / time.Second); seconds > max {
+		log.Printf("Limiting warmup from %s to %ds (asked for %ds)", remoteAddr, max, seconds)
+		return max
+	}
+	return seconds
+}
+
+// resendRequest sends req down the tunnel again as its next attempt
+func resendRequest(tun *tunnel.Tunnel, req *tunnel.HTTPRequest) error {
+	req.Attempt++
+	msgBytes, err := tun.Codec().Encode(tunnel.TypeHTTPRequest, req)
+	if err != nil {
+		return err
+	}
+	return tun.Conn.Send(msgBytes)
+}
+
+// waitForWarmup pauses before a request is retried
+// Returns false if the client or the tunnel went away meanwhile, or if the
+// request's deadline comes before the next retry would
+func waitForWarmup(r *http.Request, tun *tunnel.Tunnel, deadline time.Time) bool {
+	wait, retry := warmupRetryInterval, true
+	if remaining := time.Until(deadline); remaining < wait {
+		// No time for another attempt - sit out what's left, the caller's
+		// timeout answers the request
+		wait, retry = remaining, false
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return retry
+	case <-r.Context().Done():
+		return false
+	case <-tun.Closed():
+		return false
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunnelr/internal/tunnel"
+)
+
+// unreachable answers a request the way the CLI does while nothing listens
+// on the local port
+func unreachable(cli *fakeCLI, req *tunnel.HTTPRequest) {
+	cli.respond(req.ID, http.StatusBadGateway, http.Header{tunnel.UnreachableHeader: {"1"}}, []byte("Failed to reach localhost"))
+}
+
+// visitTimed sends a visitor GET and returns the status, body and how long
+// the answer took
+func visitTimed(t *testing.T, cli *fakeCLI) (int, string, time.Duration) {
+	t.Helper()
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(cli.newRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body), time.Since(start)
+}
+
+func TestWarmupRetriesUntilTheAppIsUp(t *testing.T) {
+	setForTest(t, &warmupRetryInterval, 20*time.Millisecond)
+	srv := startTestServer(t)
+
+	var mu sync.Mutex
+	var attempts []int
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{WarmupSeconds: 30}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		mu.Lock()
+		attempts = append(attempts, req.Attempt)
+		mu.Unlock()
+		if req.Attempt < 4 {
+			unreachable(cli, req)
+			return
+		}
+		cli.respond(req.ID, http.StatusOK, nil, []byte("up now"))
+	})
+	retriesBefore := metrics.warmupRetries.Load()
+
+	status, body, _ := visitTimed(t, cli)
+	if status != http.StatusOK || body != "up now" {
+		t.Fatalf("got %d %q, want the app's answer once it was up", status, body)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// Each resend is numbered, so the app can tell it's seen the request
+	if got := fmt.Sprint(attempts); got != "[1 2 3 4]" {
+		t.Errorf("attempts %s, want [1 2 3 4]", got)
+	}
+	if got := metrics.warmupRetries.Load() - retriesBefore; got != 3 {
+		t.Errorf("warmup_retries went up by %d, want 3", got)
+	}
+}
+
+func TestNoWarmupFailsRightAway(t *testing.T) {
+	setForTest(t, &warmupRetryInterval, 20*time.Millisecond)
+	srv := startTestServer(t)
+
+	var calls atomic.Int32
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{}, func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) {
+		calls.Add(1)
+		unreachable(cli, req)
+	})
+	if status, _, _ := visitTimed(t, cli); status != http.StatusBadGateway {
+		t.Errorf("got %d, want the CLI's 502", status)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("request sent %d times without a warmup, want once", got)
+	}
+}
+
+func TestWarmupRetriesStopAtTheTimeout(t *testing.T) {
+	setForTest(t, &forwardTimeout, 300*time.Millisecond)
+	srv := startTestServer(t)
+	handle := func(cli *fakeCLI, req *tunnel.HTTPRequest, _ io.Reader) { unreachable(cli, req) }
+
+	// Retrying every 50ms: as many as fit, then a 504
+	setForTest(t, &warmupRetryInterval, 50*time.Millisecond)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{WarmupSeconds: 30}, handle)
+	status, body, took := visitTimed(t, cli)
+	if status != http.StatusGatewayTimeout || !strings.Contains(body, "still wasn't listening") {
+		t.Errorf("got %d %q, want a 504 about the app not being up", status, body)
+	}
+	if took > forwardTimeout+200*time.Millisecond {
+		t.Errorf("answered after %s, want about REQUEST_TIMEOUT (%s)", took, forwardTimeout)
+	}
+
+	// A retry interval longer than the timeout doesn't stretch the request
+	warmupRetryInterval = 5 * time.Second
+	slow := startFakeCLI(t, srv, tunnel.TunnelRegister{WarmupSeconds: 30}, handle)
+	status, _, took = visitTimed(t, slow)
+	if status != http.StatusGatewayTimeout {
+		t.Errorf("got %d, want a 504", status)
+	}
+	if took > forwardTimeout+200*time.Millisecond {
+		t.Errorf("answered after %s, the retry interval kept it past REQUEST_TIMEOUT (%s)", took, forwardTimeout)
+	}
+}
+
+func TestFailedWarmupRetryIsLoggedAndCounted(t *testing.T) {
+	setForTest(t, &warmupRetryInterval, 50*time.Millisecond)
+	logs := captureLog(t)
+	srv := startTestServer(t)
+
+	// A tunnel with no read loop behind it, so closing its connection
+	// doesn't remove it: the resend fails while the tunnel is still listed
+	cliSide := make(chan *websocket.Conn, 1)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		cliSide <- conn
+	}))
+	t.Cleanup(peer.Close)
+	wsConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(peer.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun, err := registry.Register(tunnel.NewSafeConn(wsConn, tunnel.CompressionConfig{}), tunnel.TunnelRegister{LocalPort: 3000, WarmupSeconds: 30}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { registry.RemoveTunnel(tun) })
+
+	// The "CLI" reads the request, then the connection drops just as the
+	// unreachable answer comes in
+	go func() {
+		conn := <-cliSide
+		defer conn.Close()
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		msg, _ := tunnel.DecodeMessage(data)
+		var req tunnel.HTTPRequest
+		msg.Unmarshal(&req)
+		tun.Conn.Close()
+		if pending, ok := tun.Pending.Get(req.ID); ok {
+			pending.Resp <- &tunnel.HTTPResponse{ID: req.ID, StatusCode: http.StatusBadGateway, Headers: http.Header{tunnel.UnreachableHeader: {"1"}}}
+		}
+	}()
+
+	failuresBefore := metrics.warmupRetryFailures.Load()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/", nil)
+	req.Host = tun.ID + ".localhost"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("got %d, want a 502 once the retry couldn't be sent", resp.StatusCode)
+	}
+	if got := metrics.warmupRetryFailures.Load() - failuresBefore; got != 1 {
+		t.Errorf("warmup_retry_failures went up by %d, want 1", got)
+	}
+	if !strings.Contains(logs.String(), "Failed to resend") {
+		t.Errorf("failed resend not logged:\n%s", logs)
+	}
+}
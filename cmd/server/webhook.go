@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Webhook events - the server POSTs these to WEBHOOK_URL so external systems
+// (billing, usage dashboards, alerting) can follow what's happening
+
+// Event types sent to the webhook
+const (
+	EventTunnelRegistered   = "tunnel.registered"
+	EventTunnelDisconnected = "tunnel.disconnected"
+	EventRequestForwarded   = "request.forwarded"
+)
+
+// WebhookEvent is the JSON body POSTed to the webhook URL
+type WebhookEvent struct {
+	Type       string    `json:"type"`
+	TunnelID   string    `json:"tunnel_id"`
+	Timestamp  time.Time `json:"timestamp"`
+	LocalPort  int       `json:"local_port,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+
+	// Only set for request.forwarded events
+	Method     string `json:"method,omitempty"`
+	Path       string `json:"path,omitempty"`
+	StatusCode int    `json:"status_code,omitempty"`
+	DurationMs int64  `json:"duration_ms,omitempty"`
+}
+
+// WebhookNotifier delivers events in the background
+// Events go into a bounded queue so a slow webhook never blocks tunnel traffic
+type WebhookNotifier struct {
+	url           string
+	secret        string
+	requestEvents bool // Also send an event per forwarded request
+	client        *http.Client
+	queue         chan WebhookEvent
+}
+
+// webhookMaxAttempts is how many times we try to deliver one event
+const webhookMaxAttempts = 3
+
+// NewWebhookNotifier creates a notifier and starts its delivery goroutine
+// Returns nil if url is empty - a nil notifier silently drops everything
+func NewWebhookNotifier(url, secret string, queueSize int, requestEvents bool) *WebhookNotifier {
+	if url == "" {
+		return nil
+	}
+	if queueSize <= 0 {
+		queueSize = 1
+	}
+
+	n := &WebhookNotifier{
+		url:           url,
+		secret:        secret,
+		requestEvents: requestEvents,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		queue:         make(chan WebhookEvent, queueSize),
+	}
+	go n.run()
+	return n
+}
+
+// Notify queues an event for delivery
+// If the queue is full the event is dropped (and logged) rather than blocking
+func (n *WebhookNotifier) Notify(event WebhookEvent) {
+	if n == nil {
+		return
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+
+	select {
+	case n.queue <- event:
+	default:
+		log.Printf("Webhook queue full, dropping %s event for tunnel %s", event.Type, event.TunnelID)
+	}
+}
+
+// NotifyRequest queues a request.forwarded event if per-request events are enabled
+func (n *WebhookNotifier) NotifyRequest(event WebhookEvent) {
+	if n == nil || !n.requestEvents {
+		return
+	}
+	event.Type = EventRequestForwarded
+	n.Notify(event)
+}
+
+// QueueLen returns how many events are waiting and how many fit, 0, 0 for a
+// nil notifier
+func (n *WebhookNotifier) QueueLen() (length, capacity int) {
+	if n == nil {
+		return 0, 0
+	}
+	return len(n.queue), cap(n.queue)
+}
+
+// run delivers queued events one at a time
+func (n *WebhookNotifier) run() {
+	for event := range n.queue {
+		body, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("Failed to encode webhook event: %v", err)
+			continue
+		}
+
+		// Retry with exponential backoff: 1s, 2s, ...
+		backoff := time.Second
+		for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+			err = n.deliver(body)
+			if err == nil {
+				break
+			}
+			log.Printf("Webhook delivery failed (attempt %d/%d): %v", attempt, webhookMaxAttempts, err)
+			if attempt < webhookMaxAttempts {
+				time.Sleep(backoff)
+				backoff *= 2
+			}
+		}
+	}
+}
+
+// deliver POSTs one event body to the webhook URL
+func (n *WebhookNotifier) deliver(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "tunnelr-webhook")
+
+	// Receivers verify the payload by computing the same HMAC with the shared secret
+	if n.secret != "" {
+		req.Header.Set("X-Tunnelr-Signature", "sha256="+signPayload(n.secret, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// signPayload returns the hex-encoded HMAC-SHA256 of body
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
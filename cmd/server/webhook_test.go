@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookStub is a local webhook receiver that records what it gets
+// The first failFirst deliveries are answered with a 500.
+type webhookStub struct {
+	mu        sync.Mutex
+	bodies    [][]byte
+	headers   []http.Header
+	calls     int
+	failFirst int
+	received  chan struct{}
+}
+
+func newWebhookStub(t *testing.T, failFirst int) (*webhookStub, *httptest.Server) {
+	stub := &webhookStub{failFirst: failFirst, received: make(chan struct{}, 16)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		stub.mu.Lock()
+		stub.calls++
+		fail := stub.calls <= stub.failFirst
+		if !fail {
+			stub.bodies = append(stub.bodies, body)
+			stub.headers = append(stub.headers, r.Header.Clone())
+		}
+		stub.mu.Unlock()
+
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		stub.received <- struct{}{}
+	}))
+	t.Cleanup(srv.Close)
+	return stub, srv
+}
+
+// wait blocks until n events were accepted, or fails the test
+func (s *webhookStub) wait(t *testing.T, n int, timeout time.Duration) {
+	t.Helper()
+	deadline := time.After(timeout)
+	for i := 0; i < n; i++ {
+		select {
+		case <-s.received:
+		case <-deadline:
+			t.Fatalf("webhook got %d of %d events in %s", i, n, timeout)
+		}
+	}
+}
+
+func TestWebhookDeliversSignedEvents(t *testing.T) {
+	stub, srv := newWebhookStub(t, 0)
+	n := NewWebhookNotifier(srv.URL, "s3cret", 10, false)
+
+	n.Notify(WebhookEvent{Type: EventTunnelRegistered, TunnelID: "abc123", LocalPort: 3000})
+	stub.wait(t, 1, 5*time.Second)
+
+	stub.mu.Lock()
+	body, header := stub.bodies[0], stub.headers[0]
+	stub.mu.Unlock()
+
+	var event WebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		t.Fatalf("webhook body isn't JSON: %v", err)
+	}
+	if event.Type != EventTunnelRegistered || event.TunnelID != "abc123" || event.LocalPort != 3000 {
+		t.Errorf("got event %+v", event)
+	}
+	if event.Timestamp.IsZero() {
+		t.Error("event has no timestamp")
+	}
+
+	// Receivers check the signature by computing the same HMAC
+	if got, want := header.Get("X-Tunnelr-Signature"), "sha256="+signPayload("s3cret", body); got != want {
+		t.Errorf("signature = %q, want %q", got, want)
+	}
+	if got := header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q", got)
+	}
+}
+
+func TestWebhookUnsignedWithoutSecret(t *testing.T) {
+	stub, srv := newWebhookStub(t, 0)
+	n := NewWebhookNotifier(srv.URL, "", 10, false)
+
+	n.Notify(WebhookEvent{Type: EventTunnelDisconnected, TunnelID: "abc123"})
+	stub.wait(t, 1, 5*time.Second)
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	if sig := stub.headers[0].Get("X-Tunnelr-Signature"); sig != "" {
+		t.Errorf("unexpected signature %q without WEBHOOK_SECRET", sig)
+	}
+}
+
+func TestWebhookRetriesFailedDelivery(t *testing.T) {
+	// One 500 first, the retry (after the 1s backoff) succeeds
+	stub, srv := newWebhookStub(t, 1)
+	n := NewWebhookNotifier(srv.URL, "", 10, false)
+
+	n.Notify(WebhookEvent{Type: EventTunnelRegistered, TunnelID: "retry1"})
+	stub.wait(t, 1, 5*time.Second)
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	if stub.calls != 2 {
+		t.Errorf("webhook was called %d times, want 2 (one failure, one retry)", stub.calls)
+	}
+}
+
+func TestWebhookRequestEventsAreOptional(t *testing.T) {
+	stub, srv := newWebhookStub(t, 0)
+	off := NewWebhookNotifier(srv.URL, "", 10, false)
+	on := NewWebhookNotifier(srv.URL, "", 10, true)
+
+	off.NotifyRequest(WebhookEvent{TunnelID: "off", Method: "GET", Path: "/"})
+	on.NotifyRequest(WebhookEvent{TunnelID: "on", Method: "GET", Path: "/", StatusCode: 200})
+	stub.wait(t, 1, 5*time.Second)
+
+	// Give a wrongly sent "off" event time to show up too
+	time.Sleep(100 * time.Millisecond)
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	if len(stub.bodies) != 1 {
+		t.Fatalf("got %d events, want only the one from the notifier with request events on", len(stub.bodies))
+	}
+	var event WebhookEvent
+	json.Unmarshal(stub.bodies[0], &event)
+	if event.Type != EventRequestForwarded || event.TunnelID != "on" || event.StatusCode != 200 {
+		t.Errorf("got event %+v", event)
+	}
+}
+
+func TestWebhookQueueIsBounded(t *testing.T) {
+	// A receiver that never answers keeps the delivery goroutine busy, so
+	// everything after the first event has to wait in the queue
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer srv.Close()
+	defer close(block)
+
+	n := NewWebhookNotifier(srv.URL, "", 2, false)
+	for i := 0; i < 10; i++ {
+		n.Notify(WebhookEvent{Type: EventTunnelRegistered, TunnelID: "flood"}) // Must never block
+	}
+	if length, capacity := n.QueueLen(); capacity != 2 || length > 2 {
+		t.Errorf("queue holds %d of %d, want at most 2", length, capacity)
+	}
+}
+
+func TestNilWebhookIsANoOp(t *testing.T) {
+	n := NewWebhookNotifier("", "secret", 10, true)
+	if n != nil {
+		t.Fatal("expected a nil notifier without a URL")
+	}
+	// None of these may panic
+	n.Notify(WebhookEvent{Type: EventTunnelRegistered})
+	n.NotifyRequest(WebhookEvent{})
+	if length, capacity := n.QueueLen(); length != 0 || capacity != 0 {
+		t.Errorf("QueueLen() = %d, %d", length, capacity)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"tunnelr/internal/tunnel"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket forwarding - "Upgrade: websocket" requests are relayed through
+// the tunnel message by message, so live reload (Vite HMR...) and chat apps
+// work through a tunnel. The CLI opens a matching WebSocket to localhost.
+
+// wsMaxMessageSize is the largest message a public client may send
+var wsMaxMessageSize = int64(getEnvInt("WS_MAX_MESSAGE_SIZE", 16*1024*1024))
+
+// wsWriteWait is how long a write to a public client may take before we give
+// up on it
+const wsWriteWait = 10 * time.Second
+
+// publicUpgrader accepts WebSockets from public clients
+// Origin checks are left to the local app - it gets the client's Origin header
+var publicUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// wsHandshakeHeaders belong to the client's handshake with us - the CLI does
+// its own handshake with the local server
+var wsHandshakeHeaders = []string{"Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version", "Sec-Websocket-Extensions"}
+
+// forwardWebSocket relays a WebSocket between a public client and the local
+// server, until either end closes it or the tunnel goes away
+func forwardWebSocket(w http.ResponseWriter, r *http.Request, tun *tunnel.Tunnel, forwardPath string) {
+	start := time.Now()
+
+	if !tun.Supports(tunnel.CapWebSocket) {
+		http.Error(w, "This tunnel's CLI can't forward WebSockets, it needs to be updated", http.StatusNotImplemented)
+		logAccess(tun, r, forwardPath, http.StatusNotImplemented, time.Since(start))
+		return
+	}
+
+	id := tun.ID + "-" + tunnel.NewRequestID()
+	stream, ok := tun.WebSockets.Add(id)
+	if !ok {
+		http.Error(w, "Duplicate request ID", http.StatusInternalServerError)
+		return
+	}
+	defer tun.WebSockets.Remove(id)
+
+	headers := r.Header.Clone()
+	for _, name := range wsHandshakeHeaders {
+		headers.Del(name)
+	}
+	setForwardedHost(headers, r)
+
+	msgBytes, err := tunnel.Encode(tunnel.TypeWSOpen, tunnel.WSOpen{ID: id, Path: forwardPath, Headers: headers})
+	if err != nil {
+		log.Printf("Failed to encode WebSocket open for %s: %v", tun.ID, err)
+		http.Error(w, "Failed to encode request for the tunnel", http.StatusInternalServerError)
+		return
+	}
+	if err := tun.Conn.Send(msgBytes); err != nil {
+		http.Error(w, fmt.Sprintf("Tunnel %s is disconnecting, failed to forward request", tun.ID), http.StatusBadGateway)
+		logAccess(tun, r, forwardPath, http.StatusBadGateway, time.Since(start))
+		return
+	}
+
+	// Wait for the CLI to open the local WebSocket
+	var opened *tunnel.WSOpen
+	timeout := time.NewTimer(forwardTimeout)
+	defer timeout.Stop()
+	select {
+	case opened = <-stream.Open:
+
+	case closed := <-stream.Close:
+		message := "The local server refused the WebSocket"
+		if closed.Reason != "" {
+			message += ": " + closed.Reason
+		}
+		http.Error(w, message, http.StatusBadGateway)
+		logAccess(tun, r, forwardPath, http.StatusBadGateway, time.Since(start))
+		return
+
+	case <-timeout.C:
+		metrics.requestTimeouts.Add(1)
+		promTimeouts.Inc()
+		http.Error(w, fmt.Sprintf("Tunnel %s timed out: the local server didn't accept the WebSocket within %s", tun.ID, forwardTimeout),
+			http.StatusGatewayTimeout)
+		logAccess(tun, r, forwardPath, http.StatusGatewayTimeout, time.Since(start))
+		sendWSClose(tun, tunnel.WSClose{ID: id, Code: websocket.CloseGoingAway})
+		return
+
+	case <-r.Context().Done():
+		if serverTimeLimitHit(r) {
+			respondServerTimeLimit(w, r, tun, forwardPath, start)
+		}
+		sendWSClose(tun, tunnel.WSClose{ID: id, Code: websocket.CloseGoingAway})
+		return
+
+	case <-tun.Closed():
+		http.Error(w, fmt.Sprintf("Tunnel %s disconnected before responding", tun.ID), http.StatusBadGateway)
+		logAccess(tun, r, forwardPath, http.StatusBadGateway, time.Since(start))
+		return
+	}
+
+	// Accept the client's WebSocket with the subprotocol the local server chose
+	var respHeader http.Header
+	if opened.Subprotocol != "" {
+		respHeader = http.Header{"Sec-Websocket-Protocol": {opened.Subprotocol}}
+	}
+	clientConn, err := publicUpgrader.Upgrade(w, r, respHeader)
+	if err != nil {
+		// Upgrade has already answered the client with an error
+		sendWSClose(tun, tunnel.WSClose{ID: id, Code: websocket.CloseGoingAway})
+		return
+	}
+	defer clientConn.Close()
+	clientConn.SetReadLimit(wsMaxMessageSize)
+
+	stats := &tun.Stats
+	stats.Requests.Add(1)
+	metrics.requestsForwarded.Add(1)
+
+	// Client -> CLI runs in its own goroutine; it reports how the client
+	// side ended
+	clientClosed := make(chan tunnel.WSClose, 1)
+	go func() {
+		for {
+			msgType, data, err := clientConn.ReadMessage()
+			if err != nil {
+				clientClosed <- tunnel.WSCloseFromError(id, err)
+				return
+			}
+			msgBytes, err := tun.Codec().Encode(tunnel.TypeWSData, tunnel.WSData{
+				ID:     id,
+				Binary: msgType == websocket.BinaryMessage,
+				Data:   data,
+			})
+			if err == nil {
+				err = tun.Conn.Send(msgBytes)
+			}
+			if err != nil {
+				clientClosed <- tunnel.WSClose{ID: id, Code: websocket.CloseGoingAway}
+				return
+			}
+			addBytesIn(stats, int64(len(data)))
+		}
+	}()
+
+	// CLI -> client runs here
+	for {
+		select {
+		case data := <-stream.Data:
+			if err := writeClientMessage(clientConn, data); err != nil {
+				sendWSClose(tun, tunnel.WSClose{ID: id, Code: websocket.CloseGoingAway})
+				logAccess(tun, r, forwardPath, http.StatusSwitchingProtocols, time.Since(start))
+				return
+			}
+			addBytesOut(stats, int64(len(data.Data)))
+			continue
+
+		case closed := <-stream.Close:
+			// Messages the local server sent before closing go out first
+			for len(stream.Data) > 0 {
+				data := <-stream.Data
+				if writeClientMessage(clientConn, data) == nil {
+					addBytesOut(stats, int64(len(data.Data)))
+				}
+			}
+			clientConn.WriteControl(websocket.CloseMessage, tunnel.CloseFrame(*closed), time.Now().Add(wsWriteWait))
+
+		case closed := <-clientClosed:
+			sendWSClose(tun, closed)
+
+		case <-tun.Closed():
+			clientConn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "tunnel closed"), time.Now().Add(wsWriteWait))
+		}
+
+		logAccess(tun, r, forwardPath, http.StatusSwitchingProtocols, time.Since(start))
+		return
+	}
+}
+
+// writeClientMessage passes a message from the local server to the client
+func writeClientMessage(conn *websocket.Conn, data *tunnel.WSData) error {
+	msgType := websocket.TextMessage
+	if data.Binary {
+		msgType = websocket.BinaryMessage
+	}
+	conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return conn.WriteMessage(msgType, data.Data)
+}
+
+// sendWSClose tells the CLI to close its side of a WebSocket
+func sendWSClose(tun *tunnel.Tunnel, closed tunnel.WSClose) {
+	msgBytes, err := tunnel.Encode(tunnel.TypeWSClose, closed)
+	if err != nil {
+		return
+	}
+	tun.Conn.Send(msgBytes)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"tunnelr/internal/tunnel"
+)
+
+// echoWebSockets makes cli accept every WebSocket and send each message
+// back, reporting the close it gets from the server on closed
+func echoWebSockets(cli *fakeCLI, closed chan<- tunnel.WSClose) {
+	cli.onMessage = func(cli *fakeCLI, msg *tunnel.Message) {
+		send := func(msgType tunnel.MessageType, payload interface{}) {
+			msgBytes, _ := cli.codec.Encode(msgType, payload)
+			cli.conn.Send(msgBytes)
+		}
+		switch msg.Type {
+		case tunnel.TypeWSOpen:
+			var open tunnel.WSOpen
+			msg.Unmarshal(&open)
+			send(tunnel.TypeWSOpen, tunnel.WSOpen{ID: open.ID, Subprotocol: "echo"})
+		case tunnel.TypeWSData:
+			var data tunnel.WSData
+			msg.Unmarshal(&data)
+			if string(data.Data) == "hang up" {
+				send(tunnel.TypeWSClose, tunnel.WSClose{ID: data.ID, Code: 4000, Reason: "asked to"})
+				return
+			}
+			send(tunnel.TypeWSData, data)
+		case tunnel.TypeWSClose:
+			var c tunnel.WSClose
+			msg.Unmarshal(&c)
+			closed <- c
+		}
+	}
+}
+
+// dialTunnelWS opens a public WebSocket to cli's tunnel
+func dialTunnelWS(t *testing.T, cli *fakeCLI, path string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	dialer := websocket.Dialer{Subprotocols: []string{"echo"}, HandshakeTimeout: 5 * time.Second}
+	conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(cli.srv.URL, "http")+path, http.Header{"Host": {cli.ID + ".localhost"}})
+	if err == nil {
+		t.Cleanup(func() { conn.Close() })
+	}
+	return conn, resp, err
+}
+
+func TestWebSocketEchoThroughTunnel(t *testing.T) {
+	srv := startTestServer(t)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{Capabilities: allCapabilities}, nil)
+	closed := make(chan tunnel.WSClose, 1)
+	echoWebSockets(cli, closed)
+
+	conn, _, err := dialTunnelWS(t, cli, "/socket?room=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.Subprotocol() != "echo" {
+		t.Errorf("subprotocol = %q, want the local server's echo", conn.Subprotocol())
+	}
+
+	messages := []struct {
+		msgType int
+		data    []byte
+	}{
+		{websocket.TextMessage, []byte("hello")},
+		{websocket.BinaryMessage, []byte{0, 1, 2, 0xff}},
+		{websocket.TextMessage, bytes.Repeat([]byte("big "), 100000)},
+	}
+	for _, m := range messages {
+		if err := conn.WriteMessage(m.msgType, m.data); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		gotType, got, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotType != m.msgType || !bytes.Equal(got, m.data) {
+			t.Errorf("echo of a %d-byte message: got type %d, %d bytes", len(m.data), gotType, len(got))
+		}
+	}
+
+	// The client's close reaches the CLI with its code and reason
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "done"), time.Now().Add(time.Second))
+	select {
+	case c := <-closed:
+		if c.Code != websocket.CloseNormalClosure || c.Reason != "done" {
+			t.Errorf("CLI got close %d %q, want 1000 done", c.Code, c.Reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client's close never reached the CLI")
+	}
+}
+
+func TestWebSocketClosedByLocalServer(t *testing.T) {
+	srv := startTestServer(t)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{Capabilities: allCapabilities}, nil)
+	echoWebSockets(cli, make(chan tunnel.WSClose, 1))
+
+	conn, _, err := dialTunnelWS(t, cli, "/socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte("hang up"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok || closeErr.Code != 4000 || closeErr.Text != "asked to" {
+		t.Errorf("got %v, want the local server's close 4000 \"asked to\"", err)
+	}
+}
+
+func TestWebSocketNeedsTheCapability(t *testing.T) {
+	srv := startTestServer(t)
+	cli := startFakeCLI(t, srv, tunnel.TunnelRegister{Capabilities: []string{tunnel.CapStreaming}}, nil)
+
+	_, resp, err := dialTunnelWS(t, cli, "/socket")
+	if err == nil {
+		t.Fatal("WebSocket opened through a CLI that can't forward it")
+	}
+	if resp == nil || resp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("got %v, want a 501", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "needs to be updated") {
+		t.Errorf("body %q doesn't say the CLI needs updating", body)
+	}
+}
@@ -0,0 +1,5 @@
+package adminrpc
+
+// admin.pb.go and admin_grpc.pb.go are generated from admin.proto - rerun
+// this after changing it (needs protoc, protoc-gen-go and protoc-gen-go-grpc)
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative admin.proto
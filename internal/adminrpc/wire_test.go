@@ -0,0 +1,107 @@
+package adminrpc
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestMessagesRoundTrip(t *testing.T) {
+	connected := timestamppb.New(time.Date(2026, 10, 16, 13, 14, 15, 123456789, time.UTC))
+	messages := []proto.Message{
+		&ListTunnelsResponse{Tunnels: []*Tunnel{
+			{Id: "abc123", LocalPort: 3000, PublicUrl: "https://abc123.example.com", ConnectedAt: connected, RemoteAddr: "203.0.113.7:51234"},
+			{Id: "def456", LocalPort: 8080, LocalHost: "192.168.1.20"},
+		}},
+		&Stats{Version: "v1.2.3", ActiveTunnels: 2, RequestsForwarded: 1 << 40, IdleTunnelsClosed: 1},
+		&DisconnectRequest{TunnelId: "abc123", Reason: "maintenance"},
+		&StreamEventsRequest{IncludeRequests: true},
+		&Event{Type: "request.forwarded", TunnelId: "abc123", Timestamp: connected, Method: "GET", Path: "/", StatusCode: 200, DurationMs: 12},
+		// Negative numbers and zero values
+		&Event{LocalPort: -1, DurationMs: -5},
+		&ListTunnelsResponse{},
+	}
+
+	for _, msg := range messages {
+		data, err := proto.Marshal(msg)
+		if err != nil {
+			t.Fatalf("%T: %v", msg, err)
+		}
+		got := msg.ProtoReflect().New().Interface()
+		if err := proto.Unmarshal(data, got); err != nil {
+			t.Fatalf("%T: decoding: %v", msg, err)
+		}
+		if !proto.Equal(got, msg) {
+			t.Errorf("%T: got %v back, want %v", msg, got, msg)
+		}
+	}
+}
+
+func TestZeroValuesAreNotSent(t *testing.T) {
+	data, err := proto.Marshal(&Event{})
+	if err != nil || len(data) != 0 {
+		t.Errorf("empty Event encoded to %x, %v; want nothing", data, err)
+	}
+}
+
+func TestUnknownFieldsAreSkipped(t *testing.T) {
+	// What a client built from a newer admin.proto might send
+	data := protowire.AppendTag(nil, 1, protowire.BytesType)
+	data = protowire.AppendString(data, "abc123")
+	data = protowire.AppendTag(data, 50, protowire.VarintType)
+	data = protowire.AppendVarint(data, 7)
+	data = protowire.AppendTag(data, 51, protowire.BytesType)
+	data = protowire.AppendString(data, "something new")
+	data = protowire.AppendTag(data, 2, protowire.BytesType)
+	data = protowire.AppendString(data, "bye")
+
+	var req DisconnectRequest
+	if err := proto.Unmarshal(data, &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.TunnelId != "abc123" || req.Reason != "bye" {
+		t.Errorf("got %v", &req)
+	}
+}
+
+func TestTruncatedInputIsRejected(t *testing.T) {
+	// Cut off halfway through a field
+	data := protowire.AppendTag(nil, 1, protowire.BytesType)
+	data = protowire.AppendString(data, "abc123")
+	if err := proto.Unmarshal(data[:len(data)-2], &DisconnectRequest{}); err == nil {
+		t.Error("truncated message decoded without an error")
+	}
+}
+
+// The generated method names are what grpcMethodRoles and clients rely on,
+// so check they still match the service in admin.proto
+func TestServiceMatchesProto(t *testing.T) {
+	service := File_admin_proto.Services().ByName("Admin")
+	if service == nil {
+		t.Fatal("admin.proto has no Admin service")
+	}
+	want := map[string]string{
+		"ListTunnels":  Admin_ListTunnels_FullMethodName,
+		"GetStats":     Admin_GetStats_FullMethodName,
+		"Disconnect":   Admin_Disconnect_FullMethodName,
+		"StreamEvents": Admin_StreamEvents_FullMethodName,
+	}
+	methods := service.Methods()
+	if methods.Len() != len(want) {
+		t.Errorf("admin.proto has %d methods, want %d", methods.Len(), len(want))
+	}
+	for name, fullName := range want {
+		method := methods.ByName(protoreflect.Name(name))
+		if method == nil {
+			t.Errorf("admin.proto has no %s method", name)
+			continue
+		}
+		if got := "/" + string(service.FullName()) + "/" + name; got != fullName {
+			t.Errorf("%s: generated name %s, want %s", name, fullName, got)
+		}
+	}
+}
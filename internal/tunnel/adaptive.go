@@ -0,0 +1,129 @@
+package tunnel
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AdaptiveSamples is how many recent latencies the p95 is computed over
+const AdaptiveSamples = 50
+
+// adaptiveMinSamples is how many latencies we need before judging the p95
+const adaptiveMinSamples = 10
+
+// AdaptiveLimiter caps how many requests a tunnel has in flight, and adjusts
+// the cap to how quickly the local server answers. It's AIMD, like TCP
+// congestion control: while the p95 latency stays within the target, every
+// response raises the cap a little (by 1 per "cap" responses); when the p95
+// goes over the target, the cap is halved. A struggling local server gets
+// fewer requests at once, and more again as it recovers.
+type AdaptiveLimiter struct {
+	mu       sync.Mutex
+	limit    float64
+	max      float64
+	target   time.Duration
+	inflight int
+
+	// Recent latencies, as a ring buffer
+	samples []time.Duration
+	next    int
+	filled  int
+
+	lastDecrease time.Time
+}
+
+// NewAdaptiveLimiter creates a limiter aiming for a p95 latency of target,
+// never allowing more than max requests at once (it starts there)
+func NewAdaptiveLimiter(target time.Duration, max int) *AdaptiveLimiter {
+	if max < 1 {
+		max = 1
+	}
+	return &AdaptiveLimiter{
+		limit:   float64(max),
+		max:     float64(max),
+		target:  target,
+		samples: make([]time.Duration, AdaptiveSamples),
+	}
+}
+
+// Acquire reserves room for one more request
+// Returns false if the tunnel is at its current cap
+// A nil limiter always has room
+func (l *AdaptiveLimiter) Acquire() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.inflight >= int(l.limit) {
+		return false
+	}
+	l.inflight++
+	return true
+}
+
+// Release frees the room taken by Acquire
+func (l *AdaptiveLimiter) Release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inflight--
+}
+
+// Observe records how long a request took and adjusts the cap
+func (l *AdaptiveLimiter) Observe(latency time.Duration) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.samples[l.next] = latency
+	l.next = (l.next + 1) % len(l.samples)
+	if l.filled < len(l.samples) {
+		l.filled++
+	}
+	if l.filled < adaptiveMinSamples {
+		return
+	}
+
+	if l.p95() <= l.target {
+		l.limit = math.Min(l.max, l.limit+1/l.limit)
+		return
+	}
+
+	// Too slow: halve the cap, then wait for fresh samples taken under the
+	// new cap before judging again
+	if time.Since(l.lastDecrease) < l.target {
+		return
+	}
+	l.limit = math.Max(1, l.limit/2)
+	l.lastDecrease = time.Now()
+	l.next, l.filled = 0, 0
+}
+
+// p95 returns the 95th percentile of the recorded latencies
+// Caller holds l.mu
+func (l *AdaptiveLimiter) p95() time.Duration {
+	sorted := make([]time.Duration, l.filled)
+	copy(sorted, l.samples[:l.filled])
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(math.Ceil(0.95*float64(len(sorted))))-1]
+}
+
+// Limit returns the current cap, 0 for a nil limiter
+func (l *AdaptiveLimiter) Limit() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return int(l.limit)
+}
@@ -0,0 +1,100 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdaptiveLimiterHalvesAsLatencyRises(t *testing.T) {
+	target := 20 * time.Millisecond
+	l := NewAdaptiveLimiter(target, 16)
+
+	// Fast responses keep the cap where it is
+	for i := 0; i < AdaptiveSamples; i++ {
+		l.Observe(target / 2)
+	}
+	if got := l.Limit(); got != 16 {
+		t.Fatalf("limit %d after fast responses, want 16", got)
+	}
+
+	// Once slow responses push the p95 over the target, the cap halves each
+	// time, but no faster than once per target and never under 1
+	want := 16
+	for round := 0; round < 6; round++ {
+		time.Sleep(target)
+		for i := 0; i < adaptiveMinSamples; i++ {
+			l.Observe(10 * target)
+		}
+		if want > 1 {
+			want /= 2
+		}
+		if got := l.Limit(); got != want {
+			t.Fatalf("round %d: limit %d, want %d", round+1, got, want)
+		}
+	}
+}
+
+func TestAdaptiveLimiterNeedsEnoughSamples(t *testing.T) {
+	l := NewAdaptiveLimiter(10*time.Millisecond, 8)
+	for i := 0; i < adaptiveMinSamples-1; i++ {
+		l.Observe(time.Second)
+	}
+	if got := l.Limit(); got != 8 {
+		t.Errorf("limit %d after %d samples, want no change yet", got, adaptiveMinSamples-1)
+	}
+	l.Observe(time.Second)
+	if got := l.Limit(); got != 4 {
+		t.Errorf("limit %d once there were enough slow samples, want 4", got)
+	}
+}
+
+func TestAdaptiveLimiterRecovers(t *testing.T) {
+	target := 10 * time.Millisecond
+	l := NewAdaptiveLimiter(target, 8)
+	for l.Limit() > 1 {
+		time.Sleep(target)
+		for i := 0; i < adaptiveMinSamples; i++ {
+			l.Observe(time.Second)
+		}
+	}
+
+	// Fast again: the cap climbs back a step at a time, up to the max
+	previous := 1
+	for i := 0; i < 200; i++ {
+		l.Observe(target / 2)
+		got := l.Limit()
+		if got < previous || got > previous+1 {
+			t.Fatalf("limit went from %d to %d on one fast response", previous, got)
+		}
+		previous = got
+	}
+	if previous != 8 {
+		t.Errorf("limit %d after 200 fast responses, want back at the max of 8", previous)
+	}
+}
+
+func TestAdaptiveLimiterCapsInFlight(t *testing.T) {
+	l := NewAdaptiveLimiter(time.Second, 2)
+	if !l.Acquire() || !l.Acquire() {
+		t.Fatal("refused a request under the cap")
+	}
+	if l.Acquire() {
+		t.Fatal("allowed a third request with a cap of 2")
+	}
+	l.Release()
+	if !l.Acquire() {
+		t.Error("refused a request after one was released")
+	}
+
+	var off *AdaptiveLimiter
+	for i := 0; i < 10; i++ {
+		if !off.Acquire() {
+			t.Fatal("nil limiter refused a request")
+		}
+	}
+	off.Release()
+	off.Observe(time.Hour)
+	if got := off.Limit(); got != 0 {
+		t.Errorf("nil limiter's Limit() = %d, want 0", got)
+	}
+}
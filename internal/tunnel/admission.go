@@ -0,0 +1,146 @@
+package tunnel
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrQueueFull is returned by AdmissionQueue.Acquire when too many requests
+// are already waiting
+var ErrQueueFull = errors.New("admission queue is full")
+
+// AdmissionQueue caps how many requests are in flight across the whole
+// server. Once the cap is reached, new requests wait in line - not first come,
+// first served, but highest priority first (and first come, first served
+// among equals). A freed slot goes straight to the front of the line.
+type AdmissionQueue struct {
+	mu         sync.Mutex
+	limit      int
+	maxWaiting int
+	inFlight   int
+	waiting    waiterHeap
+	seq        uint64 // Arrival order, breaks priority ties
+}
+
+// admissionWaiter is one request waiting for a slot
+type admissionWaiter struct {
+	priority int
+	seq      uint64
+	ready    chan struct{} // Closed when the waiter is handed a slot
+	admitted bool
+	index    int // Position in the heap, kept up to date by container/heap
+}
+
+// NewAdmissionQueue allows limit requests at once with up to maxWaiting more
+// in line. A limit below 1 means no limit: it returns nil.
+func NewAdmissionQueue(limit, maxWaiting int) *AdmissionQueue {
+	if limit < 1 {
+		return nil
+	}
+	return &AdmissionQueue{limit: limit, maxWaiting: maxWaiting}
+}
+
+// Acquire takes a slot, waiting in line if there's none free
+// Returns ErrQueueFull if the line is too long, or ctx's error if ctx ends
+// first. A nil queue always has room.
+func (q *AdmissionQueue) Acquire(ctx context.Context, priority int) error {
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	if q.inFlight < q.limit && len(q.waiting) == 0 {
+		q.inFlight++
+		q.mu.Unlock()
+		return nil
+	}
+	if len(q.waiting) >= q.maxWaiting {
+		q.mu.Unlock()
+		return ErrQueueFull
+	}
+	q.seq++
+	w := &admissionWaiter{priority: priority, seq: q.seq, ready: make(chan struct{})}
+	heap.Push(&q.waiting, w)
+	q.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		admitted := w.admitted
+		if !admitted {
+			heap.Remove(&q.waiting, w.index)
+		}
+		q.mu.Unlock()
+
+		// Handed a slot just as we gave up - pass it on
+		if admitted {
+			q.Release()
+		}
+		return ctx.Err()
+	}
+}
+
+// Release frees a slot taken with Acquire, handing it to the most important
+// waiting request if there is one
+func (q *AdmissionQueue) Release() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.waiting) > 0 {
+		w := heap.Pop(&q.waiting).(*admissionWaiter)
+		w.admitted = true
+		close(w.ready)
+		return
+	}
+	q.inFlight--
+}
+
+// Waiting returns how many requests are in line, 0 for a nil queue
+func (q *AdmissionQueue) Waiting() int {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting)
+}
+
+// waiterHeap orders waiters by priority (highest first), then arrival
+// In Go, container/heap works on any type with these five methods.
+type waiterHeap []*admissionWaiter
+
+func (h waiterHeap) Len() int { return len(h) }
+
+func (h waiterHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h waiterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *waiterHeap) Push(x any) {
+	w := x.(*admissionWaiter)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+
+func (h *waiterHeap) Pop() any {
+	old := *h
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return w
+}
@@ -0,0 +1,113 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// waitForWaiting waits until n requests are in line
+func waitForWaiting(t *testing.T, q *AdmissionQueue, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); q.Waiting() != n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests waiting, want %d", q.Waiting(), n)
+		}
+	}
+}
+
+func TestAdmissionHighestPriorityFirst(t *testing.T) {
+	q := NewAdmissionQueue(1, 10)
+	if err := q.Acquire(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server is saturated; these line up, in this order
+	admitted := make(chan string, 4)
+	waiters := []struct {
+		name     string
+		priority int
+	}{
+		{"low", 0},
+		{"header-5-first", 5},
+		{"allowlisted", 100},
+		{"header-5-second", 5},
+	}
+	for i, w := range waiters {
+		w := w
+		go func() {
+			if err := q.Acquire(context.Background(), w.priority); err != nil {
+				t.Error(err)
+				return
+			}
+			admitted <- w.name
+		}()
+		waitForWaiting(t, q, i+1)
+	}
+
+	// Each freed slot goes to the most important waiter, ties in arrival order
+	var order []string
+	for range waiters {
+		q.Release()
+		order = append(order, <-admitted)
+	}
+	want := "[allowlisted header-5-first header-5-second low]"
+	if got := fmt.Sprint(order); got != want {
+		t.Errorf("admitted %s, want %s", got, want)
+	}
+	q.Release()
+
+	// All slots free again: straight in
+	if err := q.Acquire(context.Background(), 0); err != nil {
+		t.Errorf("idle queue: %v", err)
+	}
+}
+
+func TestAdmissionQueueFullAndTimeout(t *testing.T) {
+	q := NewAdmissionQueue(1, 1)
+	q.Acquire(context.Background(), 0)
+
+	// One may wait...
+	ctx, cancel := context.WithCancel(context.Background())
+	gaveUp := make(chan error, 1)
+	go func() { gaveUp <- q.Acquire(ctx, 0) }()
+	waitForWaiting(t, q, 1)
+
+	// ...but not two, whatever their priority
+	if err := q.Acquire(context.Background(), 100); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("with the line full got %v, want ErrQueueFull", err)
+	}
+
+	// Giving up leaves the line
+	cancel()
+	if err := <-gaveUp; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled waiter got %v", err)
+	}
+	if n := q.Waiting(); n != 0 {
+		t.Errorf("%d still waiting after the only waiter gave up", n)
+	}
+
+	// The slot is still ours, and released as normal
+	q.Release()
+	if err := q.Acquire(context.Background(), 0); err != nil {
+		t.Errorf("after release: %v", err)
+	}
+}
+
+func TestNoAdmissionLimit(t *testing.T) {
+	q := NewAdmissionQueue(0, 10)
+	if q != nil {
+		t.Fatal("a limit of 0 made a queue")
+	}
+	for i := 0; i < 100; i++ {
+		if err := q.Acquire(context.Background(), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.Release()
+	if q.Waiting() != 0 {
+		t.Error("nil queue has waiters")
+	}
+}
@@ -0,0 +1,184 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+)
+
+// Binary frames: with CapBinary negotiated, messages that carry a body
+// (HTTPRequest, HTTPResponse, BodyChunk, WSData) go over the WebSocket as
+// binary frames instead of JSON text.
+//
+// In JSON a []byte is base64 - and Message.Payload is itself a []byte, so a
+// body used to be base64-encoded twice, ~78% bigger than the original. A
+// binary frame sends the body as it is:
+//
+//	1 byte   frameMarker (0 - JSON text always starts with '{')
+//	4 bytes  length of the header, big-endian
+//	header   JSON frameHeader: the message type and the payload without its body
+//	rest     the body bytes, gzipped if frameHeader.Gzipped
+//
+// Control messages (register, errors, pings...) stay JSON text.
+
+// frameMarker is the first byte of every binary frame
+const frameMarker = 0
+
+// frameHeaderSize is the marker plus the header length
+const frameHeaderSize = 5
+
+// ErrInvalidFrame is returned by DecodeMessage for a truncated binary frame
+var ErrInvalidFrame = errors.New("invalid binary frame")
+
+// frameHeader is the JSON part of a binary frame
+type frameHeader struct {
+	Type    MessageType     `json:"type"`
+	Payload json.RawMessage `json:"payload"`           // The payload, body field left empty
+	Gzipped bool            `json:"gzipped,omitempty"` // The body after the header is gzipped
+}
+
+// Codec encodes messages the way both sides of a tunnel agreed on
+type Codec struct {
+	Gzip   bool // CapGzip: gzip large payloads
+	Binary bool // CapBinary: send bodies in binary frames
+	Level  int  // gzip level, 0 = gzip.DefaultCompression
+}
+
+// NewCodec picks the encoding for a set of negotiated capabilities
+func NewCodec(capabilities []string) Codec {
+	return Codec{
+		Gzip:   HasCapability(capabilities, CapGzip),
+		Binary: HasCapability(capabilities, CapBinary),
+	}
+}
+
+// Encode serializes a message, as a binary frame if the payload has a body
+// and CapBinary was negotiated, otherwise as JSON text
+// With Gzip set, payloads (or bodies) of at least GzipThreshold bytes are
+// gzipped when that makes them smaller.
+func (c Codec) Encode(msgType MessageType, payload interface{}) ([]byte, error) {
+	if !c.Binary {
+		return c.encodeText(msgType, payload)
+	}
+	framed, body := detachBody(payload)
+	if framed == nil {
+		return c.encodeText(msgType, payload)
+	}
+
+	payloadBytes, err := json.Marshal(framed)
+	if err != nil {
+		return nil, err
+	}
+	header := frameHeader{Type: msgType, Payload: payloadBytes}
+	if c.Gzip {
+		body, header.Gzipped = gzipBytes(body, c.Level)
+	}
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(headerBytes)+len(body))
+	frame[0] = frameMarker
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(headerBytes)))
+	frame = append(frame, headerBytes...)
+	return append(frame, body...), nil
+}
+
+// IsBinaryFrame reports whether data is a binary frame rather than JSON text
+func IsBinaryFrame(data []byte) bool {
+	return len(data) > 0 && data[0] == frameMarker
+}
+
+// DecodeMessage parses a message read from the WebSocket, either form
+// A binary frame's body ends up in Message.Attachment; call Decompress and
+// then Unmarshal to get the payload back with its body.
+func DecodeMessage(data []byte) (Message, error) {
+	var msg Message
+	if !IsBinaryFrame(data) {
+		err := json.Unmarshal(data, &msg)
+		return msg, err
+	}
+
+	if len(data) < frameHeaderSize {
+		return msg, ErrInvalidFrame
+	}
+	headerLen := binary.BigEndian.Uint32(data[1:frameHeaderSize])
+	if uint64(headerLen) > uint64(len(data)-frameHeaderSize) {
+		return msg, ErrInvalidFrame
+	}
+
+	var header frameHeader
+	if err := json.Unmarshal(data[frameHeaderSize:frameHeaderSize+int(headerLen)], &header); err != nil {
+		return msg, err
+	}
+	msg.Type = header.Type
+	msg.Payload = header.Payload
+	msg.Attachment = data[frameHeaderSize+int(headerLen):]
+	msg.attachmentGzipped = header.Gzipped
+	return msg, nil
+}
+
+// Unmarshal decodes the payload into v, putting a binary frame's body back
+// into v's body field
+func (m *Message) Unmarshal(v interface{}) error {
+	if err := json.Unmarshal(m.Payload, v); err != nil {
+		return err
+	}
+	if len(m.Attachment) > 0 {
+		if body := bodyField(v); body != nil {
+			*body = m.Attachment
+		}
+	}
+	return nil
+}
+
+// detachBody returns a copy of payload with its body field emptied, and
+// the body - or nil, nil if the payload has no body field
+func detachBody(payload interface{}) (interface{}, []byte) {
+	// Work on a copy, so the caller's struct keeps its body
+	switch p := payload.(type) {
+	case HTTPRequest:
+		payload = &p
+	case *HTTPRequest:
+		c := *p
+		payload = &c
+	case HTTPResponse:
+		payload = &p
+	case *HTTPResponse:
+		c := *p
+		payload = &c
+	case BodyChunk:
+		payload = &p
+	case *BodyChunk:
+		c := *p
+		payload = &c
+	case WSData:
+		payload = &p
+	case *WSData:
+		c := *p
+		payload = &c
+	default:
+		return nil, nil
+	}
+
+	field := bodyField(payload)
+	body := *field
+	*field = nil
+	return payload, body
+}
+
+// bodyField points at the body of one of the message types that carry one
+func bodyField(v interface{}) *[]byte {
+	switch p := v.(type) {
+	case *HTTPRequest:
+		return &p.Body
+	case *HTTPResponse:
+		return &p.Body
+	case *BodyChunk:
+		return &p.Data
+	case *WSData:
+		return &p.Data
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package tunnel
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// fakeImage returns a PNG-like body: a real signature, then bytes that
+// don't compress, like image data
+func fakeImage(size int) []byte {
+	img := make([]byte, size)
+	rand.New(rand.NewSource(533)).Read(img)
+	copy(img, "\x89PNG\r\n\x1a\n")
+	return img
+}
+
+func TestBinaryFramesCarryBodiesAsIs(t *testing.T) {
+	img := fakeImage(256 << 10)
+	payloads := map[MessageType]interface{}{
+		TypeHTTPRequest:  HTTPRequest{ID: "req1", Method: "POST", Path: "/upload", Body: img},
+		TypeHTTPResponse: HTTPResponse{ID: "req1", StatusCode: 200, Body: img},
+		TypeBodyChunk:    BodyChunk{ID: "req1", Data: img},
+		TypeWSData:       WSData{ID: "ws1", Binary: true, Data: img},
+	}
+
+	for msgType, payload := range payloads {
+		for _, codec := range []Codec{{Binary: true}, {Binary: true, Gzip: true}} {
+			data, err := codec.Encode(msgType, payload)
+			if err != nil {
+				t.Fatalf("%s %+v: %v", msgType, codec, err)
+			}
+			if !IsBinaryFrame(data) {
+				t.Errorf("%s %+v: sent as JSON text", msgType, codec)
+			}
+			// The body plus a small header - no base64
+			if overhead := len(data) - len(img); overhead < 0 || overhead > 512 {
+				t.Errorf("%s %+v: %d bytes for a %d byte body", msgType, codec, len(data), len(img))
+			}
+
+			msg, err := DecodeMessage(data)
+			if err != nil {
+				t.Fatalf("%s %+v: decoding: %v", msgType, codec, err)
+			}
+			if err := msg.Decompress(); err != nil {
+				t.Fatalf("%s %+v: decompressing: %v", msgType, codec, err)
+			}
+			if msg.Type != msgType {
+				t.Errorf("decoded type %s, want %s", msg.Type, msgType)
+			}
+			var got []byte
+			switch msgType {
+			case TypeHTTPRequest:
+				var req HTTPRequest
+				err = msg.Unmarshal(&req)
+				got = req.Body
+			case TypeHTTPResponse:
+				var resp HTTPResponse
+				err = msg.Unmarshal(&resp)
+				got = resp.Body
+			case TypeBodyChunk:
+				var chunk BodyChunk
+				err = msg.Unmarshal(&chunk)
+				got = chunk.Data
+			case TypeWSData:
+				var wsData WSData
+				err = msg.Unmarshal(&wsData)
+				got = wsData.Data
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, img) {
+				t.Errorf("%s %+v: body changed on the way (%d bytes back)", msgType, codec, len(got))
+			}
+		}
+	}
+
+	// The same message as JSON text, for comparison
+	text, err := Codec{}.Encode(TypeHTTPResponse, payloads[TypeHTTPResponse])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(text) < len(img)*4/3 {
+		t.Errorf("JSON text is %d bytes for a %d byte body, expected base64 to grow it", len(text), len(img))
+	}
+}
+
+func TestControlMessagesStayText(t *testing.T) {
+	data, err := Codec{Binary: true}.Encode(TypeTunnelError, TunnelError{Code: "x", Message: "y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsBinaryFrame(data) || data[0] != '{' {
+		t.Errorf("control message encoded as %q, want JSON text", data)
+	}
+}
+
+func TestTruncatedBinaryFrames(t *testing.T) {
+	data, err := Codec{Binary: true}.Encode(TypeHTTPResponse, HTTPResponse{ID: "req1", Body: []byte("hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cut := range []int{1, frameHeaderSize - 1, frameHeaderSize + 3} {
+		if _, err := DecodeMessage(data[:cut]); !errors.Is(err, ErrInvalidFrame) {
+			t.Errorf("frame cut to %d bytes: got %v, want ErrInvalidFrame", cut, err)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package tunnel
+
+import (
+	"compress/flate"
+
+	"github.com/gorilla/websocket"
+)
+
+// CompressionConfig controls WebSocket permessage-deflate
+// Compression is only used if both server and CLI enable it. Small messages
+// (request IDs, acks, tiny bodies) cost more CPU to deflate than they save,
+// so anything under Threshold bytes is sent uncompressed.
+type CompressionConfig struct {
+	Enabled   bool
+	Level     int // flate level: 1 (fastest) .. 9 (smallest)
+	Threshold int // Messages shorter than this many bytes skip compression
+}
+
+// Configure applies the compression level to a newly established connection
+// Returns false if the level is out of range (the default level is kept)
+func (c CompressionConfig) Configure(conn *websocket.Conn) bool {
+	if !c.Enabled {
+		return true
+	}
+	conn.EnableWriteCompression(false) // Decided per message by SafeConn
+	return conn.SetCompressionLevel(c.Level) == nil
+}
+
+// ValidLevel reports whether Level is one gorilla accepts
+func (c CompressionConfig) ValidLevel() bool {
+	return c.Level >= flate.BestSpeed && c.Level <= flate.BestCompression
+}
@@ -0,0 +1,201 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// recordingConn keeps a copy of everything written to the network, or with
+// countOnly set just counts it
+type recordingConn struct {
+	net.Conn
+	mu        sync.Mutex
+	written   bytes.Buffer
+	total     int64
+	countOnly bool
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.total += int64(len(p))
+	if !c.countOnly {
+		c.written.Write(p)
+	}
+	c.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+// compressedFrames parses the client frames written so far and reports, for
+// each, whether it was compressed (the RSV1 bit permessage-deflate sets)
+func (c *recordingConn) compressedFrames(t testing.TB) []bool {
+	t.Helper()
+	c.mu.Lock()
+	data := append([]byte(nil), c.written.Bytes()...)
+	c.mu.Unlock()
+
+	// Skip the HTTP upgrade request
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end < 0 {
+		t.Fatal("no upgrade request written")
+	}
+	data = data[end+4:]
+
+	var frames []bool
+	for len(data) > 0 {
+		if len(data) < 2 {
+			t.Fatal("truncated frame header")
+		}
+		compressed := data[0]&0x40 != 0
+		length := uint64(data[1] & 0x7f)
+		masked := data[1]&0x80 != 0
+		data = data[2:]
+		switch length {
+		case 126:
+			length = uint64(binary.BigEndian.Uint16(data))
+			data = data[2:]
+		case 127:
+			length = binary.BigEndian.Uint64(data)
+			data = data[8:]
+		}
+		if masked {
+			data = data[4:]
+		}
+		if uint64(len(data)) < length {
+			t.Fatal("truncated frame payload")
+		}
+		data = data[length:]
+		frames = append(frames, compressed)
+	}
+	return frames
+}
+
+// dialCompressed connects a SafeConn with the given settings to a server
+// that offers permessage-deflate and reads everything it gets
+func dialCompressed(t testing.TB, cfg CompressionConfig) (*SafeConn, *recordingConn) {
+	t.Helper()
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	var rec *recordingConn
+	dialer := websocket.Dialer{
+		EnableCompression: cfg.Enabled,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			rec = &recordingConn{Conn: conn}
+			return rec, nil
+		},
+	}
+	wsConn, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := NewSafeConn(wsConn, cfg)
+	t.Cleanup(func() { conn.Close() })
+	return conn, rec
+}
+
+func TestSmallMessagesSkipCompression(t *testing.T) {
+	conn, rec := dialCompressed(t, CompressionConfig{Enabled: true, Level: 1, Threshold: 1024})
+
+	small := []byte(`{"type":"body_ack","payload":{"id":"abc","chunks":1}}`)
+	large := bytes.Repeat([]byte(`{"header":"value"},`), 200)
+	for _, msg := range [][]byte{small, large, small, large[:1024], large[:1023]} {
+		if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []bool{false, true, false, true, false}
+	got := rec.compressedFrames(t)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("compressed frames = %v, want %v", got, want)
+	}
+}
+
+func TestNothingCompressedWhenDisabled(t *testing.T) {
+	conn, rec := dialCompressed(t, CompressionConfig{Threshold: 1})
+
+	large := bytes.Repeat([]byte("compressible "), 1000)
+	if err := conn.WriteMessage(websocket.TextMessage, large); err != nil {
+		t.Fatal(err)
+	}
+	for i, compressed := range rec.compressedFrames(t) {
+		if compressed {
+			t.Errorf("frame %d compressed with compression off", i)
+		}
+	}
+}
+
+func TestCompressionLevelRange(t *testing.T) {
+	for level := -1; level <= 10; level++ {
+		valid := level >= 1 && level <= 9
+		if got := (CompressionConfig{Level: level}).ValidLevel(); got != valid {
+			t.Errorf("level %d: ValidLevel() = %v, want %v", level, got, valid)
+		}
+	}
+}
+
+// BenchmarkCompressionLevel sends a typical JSON response message at each
+// level, to weigh CPU against bytes on the wire (see the wire/msg metric)
+func BenchmarkCompressionLevel(b *testing.B) {
+	headers := strings.Repeat(`"Content-Type":["text/html; charset=utf-8"],"Cache-Control":["no-cache"],`, 20)
+	body := strings.Repeat("<li class=\"item\">Some list entry with text</li>\n", 600)
+	msg := []byte(`{"type":"http_response","payload":{"headers":{` + headers + `},"body":"` + body + `"}}`)
+
+	configs := []struct {
+		name string
+		cfg  CompressionConfig
+	}{
+		{"off", CompressionConfig{}},
+		{"level-1", CompressionConfig{Enabled: true, Level: 1}},
+		{"level-5", CompressionConfig{Enabled: true, Level: 5}},
+		{"level-9", CompressionConfig{Enabled: true, Level: 9}},
+	}
+	for _, c := range configs {
+		b.Run(c.name, func(b *testing.B) {
+			conn, rec := dialCompressed(b, c.cfg)
+			rec.mu.Lock()
+			rec.countOnly = true
+			rec.total = 0
+			rec.mu.Unlock()
+
+			b.SetBytes(int64(len(msg)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			rec.mu.Lock()
+			b.ReportMetric(float64(rec.total)/float64(b.N), "wire/msg")
+			rec.mu.Unlock()
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// SafeConn is a WebSocket connection that many goroutines can write to
+// gorilla/websocket allows only one writer at a time - concurrent writes
+// corrupt frames or panic - but the server forwards many requests over one
+// connection and the CLI answers them in parallel. SafeConn puts a mutex
+// around every write.
+//
+// Reads aren't locked: each side has exactly one read loop. Methods of the
+// embedded *websocket.Conn (ReadMessage, Close, RemoteAddr...) pass through.
+type SafeConn struct {
+	*websocket.Conn
+
+	writeMu     sync.Mutex
+	compression CompressionConfig
+}
+
+// NewSafeConn wraps conn, applying the compression settings
+func NewSafeConn(conn *websocket.Conn, compression CompressionConfig) *SafeConn {
+	compression.Configure(conn)
+	return &SafeConn{Conn: conn, compression: compression}
+}
+
+// WriteMessage sends one message, waiting for any write in progress to finish
+// With compression enabled, only messages of at least Threshold bytes are
+// compressed
+func (c *SafeConn) WriteMessage(messageType int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.compression.Enabled {
+		c.Conn.EnableWriteCompression(len(data) >= c.compression.Threshold)
+	}
+	return c.Conn.WriteMessage(messageType, data)
+}
+
+// SetWriteDeadline changes the write deadline without racing a write in progress
+func (c *SafeConn) SetWriteDeadline(t time.Time) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// Send writes an encoded protocol message (see Encode and Codec)
+// Binary frames go out as WebSocket binary messages, JSON as text.
+func (c *SafeConn) Send(data []byte) error {
+	if IsBinaryFrame(data) {
+		return c.WriteMessage(websocket.BinaryMessage, data)
+	}
+	return c.WriteMessage(websocket.TextMessage, data)
+}
@@ -0,0 +1,71 @@
+package tunnel
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSafeConnConcurrentWrites(t *testing.T) {
+	const writers = 100
+
+	received := make(chan string, writers)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- string(data)
+		}
+	}))
+	defer srv.Close()
+
+	wsConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := NewSafeConn(wsConn, CompressionConfig{})
+
+	// Every writer at once, each with a message big enough to take several
+	// network writes - interleaved frames would corrupt them
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg := fmt.Sprintf("%03d:%s", i, strings.Repeat(fmt.Sprint(i%10), 64*1024))
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	conn.Close()
+
+	seen := make(map[string]bool)
+	for msg := range received {
+		var i int
+		fmt.Sscanf(msg[:3], "%d", &i)
+		if want := fmt.Sprintf("%03d:%s", i, strings.Repeat(fmt.Sprint(i%10), 64*1024)); msg != want {
+			t.Fatalf("message %d arrived corrupted", i)
+		}
+		seen[msg[:3]] = true
+	}
+	if len(seen) != writers {
+		t.Errorf("got %d of %d messages", len(seen), writers)
+	}
+}
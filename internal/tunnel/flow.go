@@ -0,0 +1,177 @@
+package tunnel
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Flow control for streamed bodies
+//
+// Each side has a single read loop that delivers the chunks of every body
+// streaming through the tunnel, so it must never wait for one slow reader -
+// every other request on the tunnel, and the keepalive pongs, would wait
+// with it. Instead each body gets a window: the sender may have at most
+// StreamWindow chunks out that the receiver hasn't passed on yet, and the
+// receiver hands credit back with a TypeBodyAck for every chunk its reader
+// takes. The receiver queues a full window (plus the EOF chunk) without
+// blocking; a body that overflows that queue is failed on its own.
+//
+// Peers without CapFlowControl send no acks and don't wait for any, so a
+// body from them fails once its reader falls a whole window behind.
+
+// StreamWindow is how many chunks of one body may be on their way at once
+const StreamWindow = 16
+
+// ChunkQueueSize is how many chunks a receiver queues per body: a whole
+// window, plus the EOF chunk, which is sent without waiting for credit
+const ChunkQueueSize = StreamWindow + 1
+
+var (
+	// ErrStreamStopped means the receiver doesn't want the rest of the body
+	ErrStreamStopped = errors.New("receiver stopped reading the body")
+
+	// ErrStreamStalled means the receiver took nothing for too long
+	ErrStreamStalled = errors.New("receiver stopped taking body chunks")
+)
+
+// SendWindow is the sending side of one body's window
+type SendWindow struct {
+	credits  chan struct{} // One token per chunk we may still send
+	stopped  chan struct{} // Closed when the receiver gives up, or the connection goes
+	stopOnce sync.Once
+	stall    time.Duration // Longest wait for credit, 0 = no limit
+}
+
+func newSendWindow(stall time.Duration) *SendWindow {
+	w := &SendWindow{
+		credits: make(chan struct{}, StreamWindow),
+		stopped: make(chan struct{}),
+		stall:   stall,
+	}
+	for i := 0; i < StreamWindow; i++ {
+		w.credits <- struct{}{}
+	}
+	return w
+}
+
+// Wait takes credit for one chunk, waiting for the receiver to ack one if
+// the window is used up
+// A nil window (the peer doesn't do flow control) never waits.
+func (w *SendWindow) Wait() error {
+	if w == nil {
+		return nil
+	}
+
+	// A receiver that gave up wants nothing more, credit or not
+	select {
+	case <-w.stopped:
+		return ErrStreamStopped
+	default:
+	}
+
+	var timeout <-chan time.Time
+	if w.stall > 0 {
+		timer := time.NewTimer(w.stall)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-w.credits:
+		return nil
+	case <-w.stopped:
+		return ErrStreamStopped
+	case <-timeout:
+		return ErrStreamStalled
+	}
+}
+
+// ack returns credit for n chunks
+// Credit beyond a whole window is dropped, a peer can't make us send faster
+func (w *SendWindow) ack(n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case w.credits <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
+
+// stop makes every Wait fail from now on
+func (w *SendWindow) stop() {
+	w.stopOnce.Do(func() { close(w.stopped) })
+}
+
+// SendWindows tracks the windows of the bodies one connection is sending,
+// by request ID
+type SendWindows struct {
+	mu     sync.Mutex
+	m      map[string]*SendWindow
+	closed bool
+}
+
+// NewSendWindows creates an empty set
+func NewSendWindows() *SendWindows {
+	return &SendWindows{m: make(map[string]*SendWindow)}
+}
+
+// Open starts a body's window, see SendWindow.Wait for stall
+// Once the connection is gone (StopAll) the window comes back stopped
+func (s *SendWindows) Open(id string, stall time.Duration) *SendWindow {
+	w := newSendWindow(stall)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		w.stop()
+		return w
+	}
+	s.m[id] = w
+	return w
+}
+
+// Close forgets a body's window once it's sent
+func (s *SendWindows) Close(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.m, id)
+}
+
+// Ack applies a TypeBodyAck from the receiver
+// Acks for bodies we're no longer sending are ignored.
+func (s *SendWindows) Ack(ack BodyAck) {
+	s.mu.Lock()
+	w, exists := s.m[ack.ID]
+	s.mu.Unlock()
+
+	if !exists {
+		return
+	}
+	if ack.Stop {
+		w.stop()
+		return
+	}
+	w.ack(ack.Chunks)
+}
+
+// StopAll stops every window, for when the connection goes away
+func (s *SendWindows) StopAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for id, w := range s.m {
+		w.stop()
+		delete(s.m, id)
+	}
+}
+
+// EncodeBodyAck builds the message acking n chunks of a body, or asking the
+// sender to stop if stop is set
+func EncodeBodyAck(codec Codec, id string, n int, stop bool) ([]byte, error) {
+	return codec.Encode(TypeBodyAck, BodyAck{ID: id, Chunks: n, Stop: stop})
+}
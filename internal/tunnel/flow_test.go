@@ -0,0 +1,151 @@
+package tunnel
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSendWindowAllowsAWindowThenWaits(t *testing.T) {
+	windows := NewSendWindows()
+	w := windows.Open("req1", 50*time.Millisecond)
+
+	for i := 0; i < StreamWindow; i++ {
+		if err := w.Wait(); err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+	}
+	if err := w.Wait(); err != ErrStreamStalled {
+		t.Fatalf("chunk past the window: got %v, want ErrStreamStalled", err)
+	}
+
+	// Each ack lets exactly one more through
+	windows.Ack(BodyAck{ID: "req1", Chunks: 1})
+	if err := w.Wait(); err != nil {
+		t.Fatalf("after an ack: %v", err)
+	}
+	if err := w.Wait(); err != ErrStreamStalled {
+		t.Fatalf("second chunk after one ack: got %v", err)
+	}
+}
+
+func TestSendWindowIgnoresExtraCredit(t *testing.T) {
+	windows := NewSendWindows()
+	w := windows.Open("req1", 50*time.Millisecond)
+
+	// A peer can't make us keep more than a window in flight
+	windows.Ack(BodyAck{ID: "req1", Chunks: 1000})
+	for i := 0; i < StreamWindow; i++ {
+		if err := w.Wait(); err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+	}
+	if err := w.Wait(); err != ErrStreamStalled {
+		t.Fatalf("got %v, want ErrStreamStalled", err)
+	}
+}
+
+func TestSendWindowStop(t *testing.T) {
+	windows := NewSendWindows()
+	w := windows.Open("req1", 0)
+	other := windows.Open("req2", 0)
+
+	windows.Ack(BodyAck{ID: "req1", Stop: true})
+	if err := w.Wait(); err != ErrStreamStopped {
+		t.Errorf("stopped window: got %v, want ErrStreamStopped", err)
+	}
+	if err := other.Wait(); err != nil {
+		t.Errorf("stopping req1 affected req2: %v", err)
+	}
+
+	// The connection going away stops everything, also windows opened later
+	windows.StopAll()
+	if err := other.Wait(); err != ErrStreamStopped {
+		t.Errorf("after StopAll: got %v", err)
+	}
+	if err := windows.Open("req3", 0).Wait(); err != ErrStreamStopped {
+		t.Errorf("window opened after StopAll: got %v", err)
+	}
+}
+
+func TestSendWindowWakesWaiter(t *testing.T) {
+	windows := NewSendWindows()
+	w := windows.Open("req1", 0)
+	for i := 0; i < StreamWindow; i++ {
+		w.Wait()
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- w.Wait() }()
+	select {
+	case err := <-done:
+		t.Fatalf("Wait returned %v without credit", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	windows.Ack(BodyAck{ID: "req1", Chunks: 1})
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ack didn't wake the sender")
+	}
+}
+
+func TestStreamBodyStopsWhenTold(t *testing.T) {
+	windows := NewSendWindows()
+	w := windows.Open("req1", 0)
+	codec := Codec{}
+
+	var chunks int
+	send := func(data []byte) error {
+		chunks++
+		if chunks == 3 {
+			windows.Ack(BodyAck{ID: "req1", Stop: true})
+		}
+		return nil
+	}
+	_, err := StreamBody(send, "req1", nil, bytes.NewReader(make([]byte, 10*ChunkSize)), codec, w)
+	if err != ErrStreamStopped {
+		t.Fatalf("got %v, want ErrStreamStopped", err)
+	}
+	if chunks != 3 {
+		t.Errorf("sent %d chunks, want 3 (nothing after the stop, not even EOF)", chunks)
+	}
+}
+
+func TestStreamBodyStallSendsErrorEOF(t *testing.T) {
+	w := NewSendWindows().Open("req1", 10*time.Millisecond)
+
+	var last BodyChunk
+	var chunks int
+	send := func(data []byte) error {
+		chunks++
+		msg, _ := DecodeMessage(data)
+		last = BodyChunk{}
+		msg.Unmarshal(&last)
+		return nil
+	}
+	_, err := StreamBody(send, "req1", nil, bytes.NewReader(make([]byte, 100*ChunkSize)), Codec{}, w)
+	if err != ErrStreamStalled {
+		t.Fatalf("got %v, want ErrStreamStalled", err)
+	}
+	if chunks != StreamWindow+1 || !last.EOF || last.Error == "" {
+		t.Errorf("sent %d chunks ending in %+v, want a window and an error EOF", chunks, last)
+	}
+}
+
+func TestQueueChunkNeverBlocks(t *testing.T) {
+	pending, _ := NewPendingRequests().Add("req1")
+
+	for i := 0; i < ChunkQueueSize; i++ {
+		if !pending.QueueChunk(&BodyChunk{ID: "req1"}) {
+			t.Fatalf("chunk %d of a full window plus EOF didn't fit", i)
+		}
+	}
+	if pending.QueueChunk(&BodyChunk{ID: "req1"}) {
+		t.Error("chunk past the queue was accepted")
+	}
+}
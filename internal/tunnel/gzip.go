@@ -0,0 +1,139 @@
+package tunnel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Payload compression: with CapGzip negotiated, large message payloads are
+// gzipped before they go over the WebSocket and Message.Compressed is set.
+// Unlike permessage-deflate (see compression.go) this works through proxies
+// that strip WebSocket extensions, and needs nothing from the WebSocket library.
+
+// GzipThreshold is the smallest payload worth gzipping - below it the gzip
+// header and the CPU time cost more than they save
+const GzipThreshold = 1024
+
+// MaxDecompressedSize caps how big a gzipped payload may inflate to, so a
+// tiny message can't make the other side allocate gigabytes
+const MaxDecompressedSize = 256 << 20
+
+// ValidGzipLevel reports whether level is a gzip level a tunnel may ask for:
+// 1 (gzip.BestSpeed) to 9 (gzip.BestCompression), or 0 for the default
+func ValidGzipLevel(level int) bool {
+	return level == 0 || level >= gzip.BestSpeed && level <= gzip.BestCompression
+}
+
+// ErrPayloadTooLarge is returned by Decompress for payloads over MaxDecompressedSize
+var ErrPayloadTooLarge = errors.New("decompressed payload too large")
+
+// encodeText is Encode, but gzips the payload when c.Gzip is set (both
+// sides agreed on CapGzip) and it's at least GzipThreshold bytes
+// Payloads that don't shrink are sent as they are.
+func (c Codec) encodeText(msgType MessageType, payload interface{}) ([]byte, error) {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := Message{Type: msgType, Payload: payloadBytes}
+	if c.Gzip {
+		msg.Payload, msg.Compressed = gzipBytes(payloadBytes, c.Level)
+	}
+	return json.Marshal(msg)
+}
+
+// gzipWriters keeps gzip writers for reuse, one pool per level
+// (gzip.DefaultCompression to gzip.BestCompression). A new writer allocates
+// about 1 MB, and a streamed body gzips every 32 KB chunk on its own.
+var gzipWriters [gzip.BestCompression - gzip.DefaultCompression + 1]sync.Pool
+
+// gzipBytes compresses data at level (0 = default) if it's at least
+// GzipThreshold bytes and actually shrinks, otherwise it returns data as it is
+func gzipBytes(data []byte, level int) ([]byte, bool) {
+	if len(data) < GzipThreshold {
+		return data, false
+	}
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	if level < gzip.DefaultCompression || level > gzip.BestCompression {
+		return data, false
+	}
+
+	var buf bytes.Buffer
+	pool := &gzipWriters[level-gzip.DefaultCompression]
+	zw, ok := pool.Get().(*gzip.Writer)
+	if ok {
+		zw.Reset(&buf)
+	} else {
+		zw, _ = gzip.NewWriterLevel(&buf, level) // Level checked above
+	}
+	defer pool.Put(zw)
+
+	if _, err := zw.Write(data); err != nil {
+		return data, false
+	}
+	if err := zw.Close(); err != nil {
+		return data, false
+	}
+	if buf.Len() >= len(data) {
+		return data, false
+	}
+	return buf.Bytes(), true
+}
+
+// Decompress replaces a gzipped Payload (or Attachment) with the original bytes
+// Does nothing if the message isn't compressed.
+func (m *Message) Decompress() error {
+	if m.Compressed {
+		payload, err := gunzip(m.Payload)
+		if err != nil {
+			return err
+		}
+		m.Payload = payload
+		m.Compressed = false
+	}
+	if m.attachmentGzipped {
+		attachment, err := gunzip(m.Attachment)
+		if err != nil {
+			return err
+		}
+		m.Attachment = attachment
+		m.attachmentGzipped = false
+	}
+	return nil
+}
+
+// gzipReaders keeps gzip readers for reuse, like gzipWriters
+var gzipReaders sync.Pool
+
+// gunzip inflates data, up to MaxDecompressedSize
+func gunzip(data []byte) ([]byte, error) {
+	zr, ok := gzipReaders.Get().(*gzip.Reader)
+	var err error
+	if ok {
+		err = zr.Reset(bytes.NewReader(data))
+	} else {
+		zr, err = gzip.NewReader(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, err // A reader that failed to Reset isn't reused
+	}
+	defer gzipReaders.Put(zr)
+	defer zr.Close()
+
+	// Read one byte past the cap so we can tell "exactly at" from "over"
+	out, err := io.ReadAll(io.LimitReader(zr, MaxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > MaxDecompressedSize {
+		return nil, ErrPayloadTooLarge
+	}
+	return out, nil
+}
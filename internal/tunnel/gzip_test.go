@@ -0,0 +1,196 @@
+package tunnel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestGzipRoundTripAtEveryLevel(t *testing.T) {
+	data := []byte(strings.Repeat("a body worth compressing, ", 200))
+
+	// Many goroutines at once, so pooled writers and readers get reused
+	// across levels and calls
+	var wg sync.WaitGroup
+	for level := gzip.DefaultCompression; level <= gzip.BestCompression; level++ {
+		for i := 0; i < 4; i++ {
+			level := level
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					zipped, ok := gzipBytes(data, level)
+					if !ok || len(zipped) >= len(data) {
+						t.Errorf("level %d: not compressed", level)
+						return
+					}
+					got, err := gunzip(zipped)
+					if err != nil || !bytes.Equal(got, data) {
+						t.Errorf("level %d: round trip failed: %v", level, err)
+						return
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+func TestGzipBytesLeavesSomeDataAlone(t *testing.T) {
+	small := []byte("tiny")
+	if got, ok := gzipBytes(small, 0); ok || !bytes.Equal(got, small) {
+		t.Error("compressed a payload under GzipThreshold")
+	}
+
+	big := bytes.Repeat([]byte("x"), 4096)
+	if _, ok := gzipBytes(big, 42); ok {
+		t.Error("compressed at an invalid level")
+	}
+}
+
+func TestGunzipRejectsBadInput(t *testing.T) {
+	if _, err := gunzip([]byte("not gzip at all")); err == nil {
+		t.Error("gunzip accepted garbage")
+	}
+
+	// A failed call doesn't break the next one
+	zipped, _ := gzipBytes(bytes.Repeat([]byte("ok "), 1000), 0)
+	if got, err := gunzip(zipped); err != nil || len(got) != 3000 {
+		t.Errorf("gunzip after a failure: %d bytes, %v", len(got), err)
+	}
+}
+
+func BenchmarkGzipChunk(b *testing.B) {
+	chunk := []byte(strings.Repeat("<li>streamed body text</li>\n", 32*1024/28))
+	b.SetBytes(int64(len(chunk)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		zipped, _ := gzipBytes(chunk, 0)
+		if _, err := gunzip(zipped); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestGzipCodecShrinksALargeBody(t *testing.T) {
+	// 1 MB of the kind of text a page or API answer is made of
+	body := []byte(strings.Repeat(`{"id": 12345, "name": "a list entry", "tags": ["one", "two"]},`, 1<<20/62+1))[:1<<20]
+	resp := HTTPResponse{ID: "big", StatusCode: 200, Body: body}
+
+	plain, err := Codec{}.Encode(TypeHTTPResponse, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, codec := range []Codec{{Gzip: true}, {Gzip: true, Binary: true}} {
+		zipped, err := codec.Encode(TypeHTTPResponse, resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(zipped) > len(plain)/5 {
+			t.Errorf("%+v: %d bytes on the wire, want well under the %d uncompressed", codec, len(zipped), len(plain))
+		}
+
+		msg, err := DecodeMessage(zipped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := msg.Decompress(); err != nil {
+			t.Fatal(err)
+		}
+		var got HTTPResponse
+		if err := msg.Unmarshal(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != "big" || !bytes.Equal(got.Body, body) {
+			t.Errorf("%+v: body changed on the way (%d bytes back)", codec, len(got.Body))
+		}
+	}
+}
+
+func TestGzipOnlyWhenNegotiated(t *testing.T) {
+	if NewCodec([]string{CapStreaming}).Gzip {
+		t.Error("gzip used with a peer that didn't ask for it")
+	}
+	if !NewCodec([]string{CapStreaming, CapGzip}).Gzip {
+		t.Error("gzip not used with a peer that agreed to it")
+	}
+
+	// An older peer that doesn't know about Compressed reads plain payloads
+	data, err := NewCodec(nil).Encode(TypeHTTPResponse, HTTPResponse{ID: "old", Body: bytes.Repeat([]byte("x"), 10000)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte(`"compressed"`)) {
+		t.Error("message marked compressed for a peer without gzip")
+	}
+}
+
+func TestGzipLevelChangesOutputSize(t *testing.T) {
+	// Log-like text: compressible, but not so repetitive every level finds
+	// the same matches
+	rng := rand.New(rand.NewSource(534))
+	words := []string{"GET", "POST", "/api/users", "/static/app.js", "200", "304", "404", "ms", "user", "session", "cache", "hit", "miss"}
+	var b strings.Builder
+	for b.Len() < 256<<10 {
+		fmt.Fprintf(&b, "%d %s %s %d\n", rng.Intn(100000), words[rng.Intn(len(words))], words[rng.Intn(len(words))], rng.Intn(1000))
+	}
+	body := []byte(b.String())
+
+	sizes := make(map[int]int)
+	for _, level := range []int{gzip.BestSpeed, gzip.BestCompression} {
+		codec := Codec{Binary: true, Gzip: true, Level: level}
+		data, err := codec.Encode(TypeHTTPResponse, HTTPResponse{ID: "req1", Body: body})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[level] = len(data)
+
+		msg, err := DecodeMessage(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := msg.Decompress(); err != nil {
+			t.Fatal(err)
+		}
+		var got HTTPResponse
+		if err := msg.Unmarshal(&got); err != nil || !bytes.Equal(got.Body, body) {
+			t.Errorf("level %d: body changed on the way (%v)", level, err)
+		}
+	}
+	if sizes[gzip.BestCompression] >= sizes[gzip.BestSpeed] {
+		t.Errorf("level 9 gave %d bytes, level 1 %d; want level 9 smaller", sizes[gzip.BestCompression], sizes[gzip.BestSpeed])
+	}
+
+	// Level 0 is the default, which sits between the two
+	data, err := Codec{Binary: true, Gzip: true}.Encode(TypeHTTPResponse, HTTPResponse{ID: "req1", Body: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) > sizes[gzip.BestSpeed] || len(data) < sizes[gzip.BestCompression] {
+		t.Errorf("default level gave %d bytes, want between %d and %d", len(data), sizes[gzip.BestCompression], sizes[gzip.BestSpeed])
+	}
+}
+
+func TestValidGzipLevel(t *testing.T) {
+	for level := -2; level <= 10; level++ {
+		valid := level >= 0 && level <= 9
+		if got := ValidGzipLevel(level); got != valid {
+			t.Errorf("ValidGzipLevel(%d) = %v, want %v", level, got, valid)
+		}
+	}
+}
+
+func TestTunnelCodecUsesItsGzipLevel(t *testing.T) {
+	r := NewRegistry()
+	tun, err := r.Register(nil, TunnelRegister{Capabilities: []string{CapGzip}, GzipLevel: gzip.BestCompression}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codec := tun.Codec(); !codec.Gzip || codec.Level != gzip.BestCompression {
+		t.Errorf("tunnel codec %+v, want gzip at level 9", codec)
+	}
+}
@@ -0,0 +1,79 @@
+package tunnel
+
+import "sync"
+
+// TimeoutWindowSize is how many recent requests the timeout rate is computed over
+const TimeoutWindowSize = 20
+
+// TimeoutWindow tracks whether a tunnel's recent requests timed out
+// It's a ring buffer of the last N outcomes, so the rate reflects current
+// behaviour rather than the tunnel's whole lifetime
+type TimeoutWindow struct {
+	mu        sync.Mutex
+	outcomes  []bool // true = timed out
+	next      int    // Where the next outcome goes
+	filled    int    // How many slots hold real outcomes
+	timeouts  int    // Timeouts currently in the window
+	unhealthy bool   // Rate is at or above the threshold
+}
+
+// NewTimeoutWindow creates a window over the last size requests
+func NewTimeoutWindow(size int) *TimeoutWindow {
+	if size <= 0 {
+		size = TimeoutWindowSize
+	}
+	return &TimeoutWindow{outcomes: make([]bool, size)}
+}
+
+// Record adds one request outcome and re-evaluates the timeout rate
+// changed is true when the window just crossed the threshold in either
+// direction - check Unhealthy() to see which way
+// No verdict is given until the window has filled up once
+func (w *TimeoutWindow) Record(timedOut bool, threshold float64) (rate float64, changed bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Evict the oldest outcome once the ring is full
+	if w.filled == len(w.outcomes) {
+		if w.outcomes[w.next] {
+			w.timeouts--
+		}
+	} else {
+		w.filled++
+	}
+
+	w.outcomes[w.next] = timedOut
+	if timedOut {
+		w.timeouts++
+	}
+	w.next = (w.next + 1) % len(w.outcomes)
+
+	rate = float64(w.timeouts) / float64(w.filled)
+	if w.filled < len(w.outcomes) {
+		return rate, false
+	}
+
+	unhealthy := rate >= threshold
+	changed = unhealthy != w.unhealthy
+	w.unhealthy = unhealthy
+	return rate, changed
+}
+
+// Unhealthy reports whether the timeout rate is currently over the threshold
+func (w *TimeoutWindow) Unhealthy() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.unhealthy
+}
+
+// Rate returns the fraction of requests in the window that timed out
+func (w *TimeoutWindow) Rate() float64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.filled == 0 {
+		return 0
+	}
+	return float64(w.timeouts) / float64(w.filled)
+}
@@ -0,0 +1,57 @@
+package tunnel
+
+import "testing"
+
+func TestTimeoutWindowCrossesThreshold(t *testing.T) {
+	w := NewTimeoutWindow(4)
+
+	// outcome fed in, whether the threshold (0.5) was just crossed, and
+	// whether the window is unhealthy afterwards
+	steps := []struct {
+		timedOut  bool
+		changed   bool
+		unhealthy bool
+	}{
+		{true, false, false},  // No verdict until the window is full...
+		{true, false, false},  //
+		{true, false, false},  //
+		{false, true, true},   // ...full at 3/4 timed out: warn
+		{false, false, true},  // 2/4, still at the threshold
+		{false, true, false},  // 1/4: recovered
+		{false, false, false}, // 0/4
+		{true, false, false},  // 1/4
+		{true, true, true},    // 2/4: warn again
+	}
+	for i, step := range steps {
+		_, changed := w.Record(step.timedOut, 0.5)
+		if changed != step.changed || w.Unhealthy() != step.unhealthy {
+			t.Fatalf("step %d: changed = %v, unhealthy = %v, want %v, %v",
+				i, changed, w.Unhealthy(), step.changed, step.unhealthy)
+		}
+	}
+}
+
+func TestTimeoutWindowRate(t *testing.T) {
+	w := NewTimeoutWindow(10)
+	if w.Rate() != 0 {
+		t.Errorf("empty window rate = %v", w.Rate())
+	}
+	for i := 0; i < 25; i++ {
+		w.Record(i%5 == 0, 0.9) // Every fifth times out
+	}
+	if got := w.Rate(); got != 0.2 {
+		t.Errorf("rate = %v, want 0.2 over the last 10", got)
+	}
+}
+
+func TestTimeoutWindowDefaultSize(t *testing.T) {
+	w := NewTimeoutWindow(0)
+	for i := 0; i < TimeoutWindowSize-1; i++ {
+		if _, changed := w.Record(true, 0.5); changed {
+			t.Fatalf("verdict after %d of %d outcomes", i+1, TimeoutWindowSize)
+		}
+	}
+	if _, changed := w.Record(true, 0.5); !changed {
+		t.Error("no verdict once the default-sized window filled")
+	}
+}
@@ -0,0 +1,79 @@
+package tunnel
+
+// IDPool keeps a stock of freshly generated tunnel IDs, so a registering
+// tunnel takes one that's ready instead of generating it (random bytes,
+// denylist checks, retries) while the registry is locked. A background
+// goroutine tops the pool back up as IDs are claimed.
+type IDPool struct {
+	ids  chan string
+	stop chan struct{}
+}
+
+// NewIDPool starts a pool holding up to size IDs from gen
+func NewIDPool(gen IDGenerator, size int) *IDPool {
+	if size < 1 {
+		size = 1
+	}
+	p := &IDPool{
+		ids:  make(chan string, size),
+		stop: make(chan struct{}),
+	}
+	go p.refill(gen)
+	return p
+}
+
+// refill keeps the pool full until Stop is called
+// In Go, sending on a full buffered channel blocks, so this sleeps until an
+// ID is claimed and there's room again
+func (p *IDPool) refill(gen IDGenerator) {
+	for {
+		id := gen()
+		select {
+		case p.ids <- id:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// Claim takes an ID from the pool
+// Returns false if the pool is empty (e.g. a burst of registrations drained
+// it) - the caller generates one itself then
+// A nil pool is always empty
+func (p *IDPool) Claim() (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	select {
+	case id := <-p.ids:
+		return id, true
+	default:
+		return "", false
+	}
+}
+
+// Release puts back a claimed ID that was never used, e.g. because the
+// registration failed. IDs that belonged to a tunnel must not come back -
+// someone may still have the old URL.
+func (p *IDPool) Release(id string) {
+	if p == nil {
+		return
+	}
+	select {
+	case p.ids <- id:
+	default: // Already refilled - drop it
+	}
+}
+
+// Len returns how many IDs are ready
+func (p *IDPool) Len() int {
+	if p == nil {
+		return 0
+	}
+	return len(p.ids)
+}
+
+// Stop ends the refill goroutine
+func (p *IDPool) Stop() {
+	close(p.stop)
+}
@@ -0,0 +1,179 @@
+package tunnel
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingIDs generates "id-1", "id-2"... and counts how many it made
+func countingIDs(made *atomic.Int64) IDGenerator {
+	return func() string {
+		return fmt.Sprintf("id-%d", made.Add(1))
+	}
+}
+
+// waitForPool waits until the pool holds at least want IDs
+func waitForPool(t *testing.T, p *IDPool, want int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for p.Len() < want {
+		if time.Now().After(deadline) {
+			t.Fatalf("pool has %d IDs, want %d", p.Len(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestIDPoolClaimAndRefill(t *testing.T) {
+	var made atomic.Int64
+	p := NewIDPool(countingIDs(&made), 5)
+	t.Cleanup(p.Stop)
+	waitForPool(t, p, 5)
+
+	// Claims come out in the order they were generated, each one once
+	seen := make(map[string]bool)
+	for i := 0; i < 12; i++ {
+		id, ok := p.Claim()
+		if !ok {
+			waitForPool(t, p, 1)
+			id, ok = p.Claim()
+		}
+		if !ok || seen[id] {
+			t.Fatalf("claim %d: got %q, %v", i+1, id, ok)
+		}
+		seen[id] = true
+	}
+
+	// The pool tops itself back up, and stops there
+	waitForPool(t, p, 5)
+	time.Sleep(20 * time.Millisecond)
+	if got := made.Load(); got > 12+5+1 {
+		t.Errorf("generated %d IDs for 12 claims and a pool of 5", got)
+	}
+}
+
+func TestIDPoolRelease(t *testing.T) {
+	var made atomic.Int64
+	block := make(chan struct{})
+	t.Cleanup(func() { close(block) })
+	gen := func() string {
+		if made.Load() >= 2 {
+			<-block // Stop refilling after the first two
+		}
+		return fmt.Sprintf("id-%d", made.Add(1))
+	}
+	p := NewIDPool(gen, 2)
+	t.Cleanup(p.Stop)
+	waitForPool(t, p, 2)
+
+	a, _ := p.Claim()
+	b, _ := p.Claim()
+	if _, ok := p.Claim(); ok {
+		t.Fatal("claimed from an empty pool")
+	}
+
+	// An unused ID goes back for the next tunnel
+	p.Release(a)
+	if got, ok := p.Claim(); !ok || got != a {
+		t.Errorf("claimed %q, %v after releasing %q", got, ok, a)
+	}
+
+	// A full pool drops what's released
+	p.Release(a)
+	p.Release(b)
+	p.Release("id-extra")
+	if got := p.Len(); got != 2 {
+		t.Errorf("pool holds %d IDs, want its size of 2", got)
+	}
+}
+
+func TestNilIDPool(t *testing.T) {
+	var p *IDPool
+	if _, ok := p.Claim(); ok {
+		t.Error("nil pool handed out an ID")
+	}
+	p.Release("id")
+	if p.Len() != 0 {
+		t.Error("nil pool isn't empty")
+	}
+}
+
+func TestRegisterUsesPooledIDs(t *testing.T) {
+	var made atomic.Int64
+	r := NewRegistry()
+	r.SetIDGenerator(countingIDs(&made))
+	r.SetIDPool(3)
+	t.Cleanup(r.idPool.Stop)
+	waitForPool(t, r.idPool, 3)
+
+	tun, err := r.Register(nil, TunnelRegister{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tun.ID != "id-1" {
+		t.Errorf("tunnel got %q, want the first pooled ID", tun.ID)
+	}
+
+	// A tunnel that picks its own name leaves the pool alone
+	waitForPool(t, r.idPool, 3)
+	if _, err := r.Register(nil, TunnelRegister{Subdomain: "id-3"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.IDPoolLen(); got != 3 {
+		t.Errorf("pool has %d IDs after a custom subdomain, want 3", got)
+	}
+
+	// ...but a pooled ID it took in the meantime is skipped
+	tun, err = r.Register(nil, TunnelRegister{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tun.ID != "id-2" {
+		t.Errorf("got %q, want id-2", tun.ID)
+	}
+	tun, err = r.Register(nil, TunnelRegister{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tun.ID == "id-3" {
+		t.Error("pooled ID handed out while a tunnel was using it")
+	}
+}
+
+func TestRegisterReleasesIDsItCantUse(t *testing.T) {
+	// Two IDs, then the generator has no more for the pool
+	var made atomic.Int64
+	block := make(chan struct{})
+	t.Cleanup(func() { close(block) })
+	r := NewRegistry()
+	r.SetIDGenerator(func() string {
+		if made.Load() >= 2 {
+			<-block
+		}
+		return fmt.Sprintf("id-%d", made.Add(1))
+	})
+	r.SetIDPool(2)
+	t.Cleanup(r.idPool.Stop)
+	waitForPool(t, r.idPool, 2)
+
+	if _, err := r.Register(nil, TunnelRegister{AuthToken: "alice"}, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Refused over the tunnel limit: the ID it claimed goes back, unused
+	if _, err := r.Register(nil, TunnelRegister{AuthToken: "alice"}, 1); err != ErrTunnelLimit {
+		t.Fatalf("got %v, want ErrTunnelLimit", err)
+	}
+	if got := r.IDPoolLen(); got != 1 {
+		t.Fatalf("pool has %d IDs after a refused registration, want 1", got)
+	}
+	tun, err := r.Register(nil, TunnelRegister{AuthToken: "bob"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tun.ID != "id-2" {
+		t.Errorf("got %q, want id-2 back from the refused registration", tun.ID)
+	}
+}
@@ -0,0 +1,113 @@
+package tunnel
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+)
+
+// IDGenerator produces candidate tunnel IDs
+type IDGenerator func() string
+
+// RandomID is the default generator: 6 random hex characters
+var RandomID IDGenerator = generateID
+
+// DefaultIDDenylist are substrings we never want in a public URL
+// Random hex can only spell a-f words, so this list is short
+var DefaultIDDenylist = []string{"dead", "babe", "b00b", "face", "fec", "dab", "bad", "cafe"}
+
+// maxCleanAttempts bounds how often CleanIDGenerator regenerates
+// With 6 hex chars almost every ID is clean, so this is never hit in practice
+const maxCleanAttempts = 100
+
+// CleanIDGenerator wraps gen so it never returns awkward IDs: ones containing
+// a denylisted substring (case-insensitive), or ones that are easy to misread
+// (see isConfusingID). It regenerates until it gets a clean one.
+func CleanIDGenerator(gen IDGenerator, denylist []string) IDGenerator {
+	lowered := make([]string, 0, len(denylist))
+	for _, word := range denylist {
+		if word = strings.ToLower(strings.TrimSpace(word)); word != "" {
+			lowered = append(lowered, word)
+		}
+	}
+
+	return func() string {
+		var id string
+		for i := 0; i < maxCleanAttempts; i++ {
+			id = gen()
+			if !containsAny(strings.ToLower(id), lowered) && !isConfusingID(id) {
+				return id
+			}
+		}
+		return id // Give up rather than loop forever on a bad generator
+	}
+}
+
+// isConfusingID flags IDs people misread or mistype: all digits (looks like
+// a port or a number) or a run of 3+ identical characters ("aaa1b2")
+func isConfusingID(id string) bool {
+	allDigits := true
+	run := 1
+	for i := 0; i < len(id); i++ {
+		if id[i] < '0' || id[i] > '9' {
+			allDigits = false
+		}
+		if i > 0 && id[i] == id[i-1] {
+			run++
+			if run >= 3 {
+				return true
+			}
+		} else {
+			run = 1
+		}
+	}
+	return allDigits
+}
+
+// containsAny reports whether s contains any of the substrings
+func containsAny(s string, substrings []string) bool {
+	for _, sub := range substrings {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewRequestID returns a unique ID for one forwarded request
+// Unlike tunnel IDs these never appear in URLs, so they can be long: 16
+// random bytes make a collision between concurrent requests practically
+// impossible (a timestamp can repeat under load)
+func NewRequestID() string {
+	bytes := make([]byte, 16) // 16 bytes = 32 hex characters
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+// maxSubdomainLength is the DNS limit for one label
+const maxSubdomainLength = 63
+
+// DefaultReservedSubdomains are refused by every registry on top of the ones
+// it's configured with (see Registry.SetReservedSubdomains): names a visitor
+// would take for the service itself, which makes them good for phishing.
+// "www.<base domain>" is the base domain itself to most visitors.
+var DefaultReservedSubdomains = []string{"admin", "api", "health", "metrics", "status", "ws", "www"}
+
+// ValidSubdomain reports whether name can be used as a requested tunnel ID:
+// lowercase letters, digits and hyphens, not starting or ending with a hyphen
+// Reserved names are the registry's business, see DefaultReservedSubdomains.
+func ValidSubdomain(name string) bool {
+	if name == "" || len(name) > maxSubdomainLength {
+		return false
+	}
+	if name[0] == '-' || name[len(name)-1] == '-' {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+package tunnel
+
+import (
+	"sync"
+	"testing"
+)
+
+// scriptedIDs is a seeded generator: it hands out ids in order, then "zzzzzz"
+func scriptedIDs(ids ...string) (IDGenerator, *int) {
+	calls := 0
+	return func() string {
+		calls++
+		if calls <= len(ids) {
+			return ids[calls-1]
+		}
+		return "zzzzzz"
+	}, &calls
+}
+
+func TestCleanIDGeneratorRegenerates(t *testing.T) {
+	gen, calls := scriptedIDs(
+		"1dead2", // Default denylist
+		"a1CAFE", // Denylisted, any case
+		"x0pest", // Custom denylist entry
+		"123456", // All digits
+		"ab111c", // Run of three
+		"a1b2c3", // Clean
+	)
+	denylist := append([]string{" Pest "}, DefaultIDDenylist...)
+	clean := CleanIDGenerator(gen, denylist)
+
+	if id := clean(); id != "a1b2c3" {
+		t.Errorf("got %q, want the first clean ID a1b2c3", id)
+	}
+	if *calls != 6 {
+		t.Errorf("generator called %d times, want 6", *calls)
+	}
+}
+
+func TestCleanIDGeneratorGivesUp(t *testing.T) {
+	calls := 0
+	dirty := func() string {
+		calls++
+		return "dead00"
+	}
+	if id := CleanIDGenerator(dirty, DefaultIDDenylist)(); id != "dead00" {
+		t.Errorf("got %q", id)
+	}
+	if calls != maxCleanAttempts {
+		t.Errorf("generator called %d times, want %d", calls, maxCleanAttempts)
+	}
+}
+
+func TestIsConfusingID(t *testing.T) {
+	tests := map[string]bool{
+		"123456": true,
+		"000000": true,
+		"aaa1b2": true,
+		"a1bbb2": true,
+		"a1b2cc": false,
+		"a1b2c3": false,
+		"12345a": false,
+	}
+	for id, want := range tests {
+		if got := isConfusingID(id); got != want {
+			t.Errorf("isConfusingID(%q) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestRegistryUsesCleanGenerator(t *testing.T) {
+	gen, _ := scriptedIDs("bad123", "face99", "c0ffee")
+	r := NewRegistry()
+	r.SetIDGenerator(CleanIDGenerator(gen, DefaultIDDenylist))
+
+	tun, err := r.Register(nil, TunnelRegister{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tun.ID != "c0ffee" {
+		t.Errorf("registered as %q, want c0ffee", tun.ID)
+	}
+}
+
+func TestNewRequestIDIsUnique(t *testing.T) {
+	n := 1000000
+	if testing.Short() {
+		n = 10000
+	}
+	seen := make(map[string]struct{}, n)
+	for i := 0; i < n; i++ {
+		id := NewRequestID()
+		if len(id) != 32 {
+			t.Fatalf("ID %q is %d characters, want 32", id, len(id))
+		}
+		if _, dup := seen[id]; dup {
+			t.Fatalf("ID %q repeated after %d IDs", id, i)
+		}
+		seen[id] = struct{}{}
+	}
+}
+
+func TestNewRequestIDIsUniqueAcrossGoroutines(t *testing.T) {
+	const workers, each = 8, 10000
+	ids := make(chan string, workers*each)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				ids <- NewRequestID()
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[string]bool, workers*each)
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("ID %q handed out twice", id)
+		}
+		seen[id] = true
+	}
+}
@@ -0,0 +1,58 @@
+package tunnel
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Keepalives - if the network drops without a clean close, a read on the
+// WebSocket can block forever and the other side never finds out. Each side
+// pings every interval; the peer's WebSocket library answers with a pong
+// automatically. Every pong pushes the read deadline out again, so when pongs
+// stop coming, the next read fails and the connection is torn down.
+
+// keepaliveWriteWait bounds how long sending one ping may take
+const keepaliveWriteWait = 10 * time.Second
+
+// KeepaliveTimeout is how long a connection may stay silent before it's
+// considered dead: two missed pings
+func KeepaliveTimeout(interval time.Duration) time.Duration {
+	return 2 * interval
+}
+
+// StartKeepalive starts pinging the peer every interval and arms the read
+// deadline. Call the returned function to stop pinging.
+// An interval of 0 or less turns keepalives off.
+func (c *SafeConn) StartKeepalive(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	timeout := KeepaliveTimeout(interval)
+	c.SetReadDeadline(time.Now().Add(timeout))
+	c.SetPongHandler(func(string) error {
+		return c.SetReadDeadline(time.Now().Add(timeout))
+	})
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				// In gorilla/websocket, WriteControl is safe to call alongside
+				// other writes, so no need for our write lock
+				if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(keepaliveWriteWait)); err != nil {
+					return // Connection is gone - the read loop will notice
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
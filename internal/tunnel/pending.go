@@ -0,0 +1,150 @@
+package tunnel
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PendingRequest is a forwarded request waiting for the CLI to answer
+// The tunnel's read loop delivers into the channels, the HTTP handler that
+// forwarded the request reads from them
+type PendingRequest struct {
+	Resp   chan *HTTPResponse      // Receives the response (headers + small body)
+	Info   chan *HTTPInformational // Receives 1xx responses sent before it
+	Chunks chan *BodyChunk         // Receives body chunks if the response is streamed
+	Done   chan struct{}           // Closed when the waiting handler gives up
+
+	Created    time.Time    // When the request was forwarded
+	lastActive atomic.Int64 // When the request last made progress (UnixNano), see Touch
+}
+
+// Touch notes that the request made progress - something was delivered to
+// it, or a piece of its body was sent
+func (p *PendingRequest) Touch() {
+	p.lastActive.Store(time.Now().UnixNano())
+}
+
+// LastActive returns when the request last made progress, or when it was
+// created if it hasn't yet
+func (p *PendingRequest) LastActive() time.Time {
+	return time.Unix(0, p.lastActive.Load())
+}
+
+// QueueChunk hands a body chunk to the waiting handler without blocking
+// Returns false if the handler is a whole window behind (see flow.go) - the
+// chunk is dropped and the caller should fail the request. Chunks for a
+// handler that's already finished are dropped quietly.
+func (p *PendingRequest) QueueChunk(chunk *BodyChunk) bool {
+	select {
+	case <-p.Done:
+		return true
+	default:
+	}
+
+	select {
+	case p.Chunks <- chunk:
+		return true
+	default:
+		return false
+	}
+}
+
+// PendingRequests tracks one tunnel's in-flight requests by request ID
+// Each tunnel has its own, so a response arriving on tunnel A can never be
+// delivered to a request that was sent down tunnel B
+type PendingRequests struct {
+	mu sync.RWMutex
+	m  map[string]*PendingRequest
+}
+
+// NewPendingRequests creates an empty set
+func NewPendingRequests() *PendingRequests {
+	return &PendingRequests{m: make(map[string]*PendingRequest)}
+}
+
+// Add starts waiting for a response to requestID
+// Returns false if that ID is already waiting (the caller must not reuse it)
+func (p *PendingRequests) Add(requestID string) (*PendingRequest, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, exists := p.m[requestID]; exists {
+		return nil, false
+	}
+
+	pending := &PendingRequest{
+		Resp:    make(chan *HTTPResponse, 1),
+		Info:    make(chan *HTTPInformational, 4),
+		Chunks:  make(chan *BodyChunk, ChunkQueueSize),
+		Done:    make(chan struct{}),
+		Created: time.Now(),
+	}
+	pending.lastActive.Store(pending.Created.UnixNano())
+	p.m[requestID] = pending
+	return pending, true
+}
+
+// Get looks up a waiting request to deliver something to it
+func (p *PendingRequests) Get(requestID string) (*PendingRequest, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	pending, exists := p.m[requestID]
+	if exists {
+		pending.Touch()
+	}
+	return pending, exists
+}
+
+// Remove stops waiting for requestID and signals anyone delivering to it
+func (p *PendingRequests) Remove(requestID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if pending, exists := p.m[requestID]; exists {
+		delete(p.m, requestID)
+		close(pending.Done)
+	}
+}
+
+// Reap removes requests forwarded more than maxAge ago that made no progress
+// for quiet, and returns how many it removed
+// Every handler removes its own request when it's done, so these are leaks:
+// a handler still waiting would have timed out after a quiet spell that long.
+func (p *PendingRequests) Reap(now time.Time, maxAge, quiet time.Duration) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	reaped := 0
+	for id, pending := range p.m {
+		if now.Sub(pending.Created) >= maxAge && now.Sub(pending.LastActive()) >= quiet {
+			delete(p.m, id)
+			close(pending.Done)
+			reaped++
+		}
+	}
+	return reaped
+}
+
+// Len returns how many requests are waiting
+func (p *PendingRequests) Len() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return len(p.m)
+}
+
+// Backlog returns how many messages are sitting in the waiting requests'
+// channels - delivered by the tunnel but not yet picked up by the handler
+// A growing backlog means clients read responses slower than the CLIs send them.
+func (p *PendingRequests) Backlog() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	backlog := 0
+	for _, pending := range p.m {
+		backlog += len(pending.Resp) + len(pending.Info) + len(pending.Chunks)
+	}
+	return backlog
+}
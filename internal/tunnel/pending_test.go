@@ -0,0 +1,89 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReapRemovesStaleEntries(t *testing.T) {
+	p := NewPendingRequests()
+	leaked, _ := p.Add("leaked")
+	busy, _ := p.Add("busy")
+	p.Add("fresh")
+
+	// As seen from an hour on: leaked and busy are old, but busy just got
+	// a chunk of its response
+	now := time.Now().Add(time.Hour)
+	busy.lastActive.Store(now.Add(-time.Second).UnixNano())
+	fresh, _ := p.Get("fresh")
+	fresh.Created = now.Add(-time.Minute)
+
+	if got := p.Reap(now, 30*time.Minute, time.Minute); got != 1 {
+		t.Errorf("reaped %d, want 1", got)
+	}
+	if _, ok := p.Get("leaked"); ok {
+		t.Error("leaked request still pending")
+	}
+	select {
+	case <-leaked.Done:
+	default:
+		t.Error("reaped request's Done not closed, a late delivery would block")
+	}
+	for _, id := range []string{"busy", "fresh"} {
+		if _, ok := p.Get(id); !ok {
+			t.Errorf("%s request reaped", id)
+		}
+	}
+	if p.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", p.Len())
+	}
+
+	// Removing a reaped request is harmless
+	p.Remove("leaked")
+
+	// Once busy goes quiet too, it goes
+	if got := p.Reap(now.Add(time.Minute), 30*time.Minute, time.Minute); got != 1 {
+		t.Errorf("second pass reaped %d, want 1", got)
+	}
+	if _, ok := p.Get("busy"); ok {
+		t.Error("quiet request still pending")
+	}
+}
+
+func TestGetTouchesRequest(t *testing.T) {
+	p := NewPendingRequests()
+	pending, _ := p.Add("req1")
+	pending.lastActive.Store(time.Now().Add(-time.Hour).UnixNano())
+
+	before := time.Now()
+	p.Get("req1")
+	if pending.LastActive().Before(before) {
+		t.Errorf("LastActive() = %v after a delivery, want at least %v", pending.LastActive(), before)
+	}
+	if !pending.Created.Before(before) {
+		t.Error("Get changed Created")
+	}
+}
+
+func TestRegistryReapPending(t *testing.T) {
+	r := NewRegistry()
+	var tunnels []*Tunnel
+	for i := 0; i < 3; i++ {
+		tun, err := r.Register(nil, TunnelRegister{}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tun.Pending.Add("stale")
+		tunnels = append(tunnels, tun)
+	}
+	tunnels[0].Pending.Add("another")
+
+	if got := r.ReapPending(time.Now().Add(time.Hour), time.Minute, time.Minute); got != 4 {
+		t.Errorf("reaped %d, want 4", got)
+	}
+	for _, tun := range tunnels {
+		if n := tun.Pending.Len(); n != 0 {
+			t.Errorf("tunnel %s still has %d pending", tun.ID, n)
+		}
+	}
+}
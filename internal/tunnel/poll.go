@@ -0,0 +1,236 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Long-polling transport, for networks whose proxies block WebSocket upgrades
+//
+// The CLI and server still speak WebSocket to each other, but the
+// WebSocket's bytes travel over ordinary HTTP requests instead of one
+// upgraded connection:
+//
+//	POST /poll/open                 -> {"session": "<id>"}
+//	POST /poll/send?session=<id>    body: the next bytes from the CLI
+//	GET  /poll/recv?session=<id>    waits up to PollWait for bytes from the server
+//	POST /poll/close?session=<id>   ends the session
+//
+// The bytes are exactly what would have gone over a socket - the HTTP
+// upgrade handshake, then WebSocket frames (RFC 6455) - so messages, pings
+// and close codes work the same on both transports. Sends have to arrive in
+// order, so the CLI keeps at most one in flight. A recv answered with 410
+// Gone means the server ended the session.
+
+// PollPath is where the server serves the long-polling endpoints
+const PollPath = "/poll"
+
+// PollWait is how long a recv waits for data before answering empty - below
+// the 30-60s idle timeouts common in proxies
+const PollWait = 25 * time.Second
+
+// PollMaxBytes caps the body of one send or recv
+const PollMaxBytes = 1 << 20
+
+// pollBufferMax is how much may wait in a PollBuffer before Write blocks
+const pollBufferMax = 4 << 20
+
+// PollBuffer is a byte queue between the HTTP requests of a long-polling
+// session and the WebSocket reading or writing on top of it
+type PollBuffer struct {
+	mu       sync.Mutex
+	data     []byte
+	closed   bool
+	deadline time.Time     // For Read, zero = none
+	changed  chan struct{} // Closed and replaced whenever anything above changes
+}
+
+// NewPollBuffer returns an empty, open buffer
+func NewPollBuffer() *PollBuffer {
+	return &PollBuffer{changed: make(chan struct{})}
+}
+
+// wake tells everyone waiting that something changed, mu must be held
+func (b *PollBuffer) wake() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// Write queues p, waiting while the buffer is full
+func (b *PollBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for !b.closed && len(b.data) >= pollBufferMax {
+		changed := b.changed
+		b.mu.Unlock()
+		<-changed
+		b.mu.Lock()
+	}
+	if b.closed {
+		return 0, net.ErrClosed
+	}
+	b.data = append(b.data, p...)
+	b.wake()
+	return len(p), nil
+}
+
+// Read takes queued bytes into p, waiting for some if there are none
+// Returns io.EOF once the buffer is closed and empty, and an error whose
+// Timeout() is true when the deadline passes.
+func (b *PollBuffer) Read(p []byte) (int, error) {
+	data, err := b.take(len(p), -1)
+	return copy(p, data), err
+}
+
+// Take removes up to max queued bytes, waiting up to wait for some to
+// arrive (a negative wait means until they do)
+// Returns nothing (and no error) if none came in time, io.EOF once the
+// buffer is closed and empty.
+func (b *PollBuffer) Take(max int, wait time.Duration) ([]byte, error) {
+	data, err := b.take(max, wait)
+	if os.IsTimeout(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// take waits up to wait, or until the read deadline if wait is negative
+func (b *PollBuffer) take(max int, wait time.Duration) ([]byte, error) {
+	var until time.Time
+	if wait >= 0 {
+		until = time.Now().Add(wait)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for len(b.data) == 0 {
+		if b.closed {
+			return nil, io.EOF
+		}
+		if wait < 0 {
+			until = b.deadline // May change while we wait, see SetDeadline
+		}
+		if !until.IsZero() && !time.Now().Before(until) {
+			return nil, os.ErrDeadlineExceeded
+		}
+
+		changed := b.changed
+		b.mu.Unlock()
+		if until.IsZero() {
+			<-changed
+		} else {
+			timer := time.NewTimer(time.Until(until))
+			select {
+			case <-changed:
+			case <-timer.C:
+			}
+			timer.Stop()
+		}
+		b.mu.Lock()
+	}
+
+	n := min(max, len(b.data))
+	data := make([]byte, n)
+	copy(data, b.data)
+	b.data = b.data[n:]
+	if len(b.data) == 0 {
+		b.data = nil // Let the old array go
+	}
+	b.wake() // There's room for writers again
+	return data, nil
+}
+
+// SetDeadline sets when a waiting Read gives up, zero for never
+func (b *PollBuffer) SetDeadline(t time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.deadline = t
+	b.wake()
+}
+
+// Close stops further writes - what's queued can still be read
+func (b *PollBuffer) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.closed = true
+		b.wake()
+	}
+}
+
+// PollAddr is the address of one end of a long-polling session
+type PollAddr string
+
+func (a PollAddr) Network() string { return "poll" }
+func (a PollAddr) String() string  { return string(a) }
+
+// PollConn is a net.Conn over a long-polling session: reads come from in,
+// writes go to out. Each side moves the bytes between the buffers and its
+// HTTP requests, and runs a normal WebSocket on top.
+type PollConn struct {
+	in, out       *PollBuffer
+	local, remote net.Addr
+
+	closed    atomic.Bool
+	closeOnce sync.Once
+	onClose   func()
+}
+
+// NewPollConn joins in and out into a connection, onClose (may be nil) runs
+// once when it's closed
+func NewPollConn(in, out *PollBuffer, local, remote net.Addr, onClose func()) *PollConn {
+	return &PollConn{in: in, out: out, local: local, remote: remote, onClose: onClose}
+}
+
+// Read returns io.EOF once the other side closed in, and net.ErrClosed after
+// Close - like a socket
+func (c *PollConn) Read(p []byte) (int, error) {
+	if c.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	n, err := c.in.Read(p)
+	if err != nil && c.closed.Load() {
+		err = net.ErrClosed
+	}
+	return n, err
+}
+
+func (c *PollConn) Write(p []byte) (int, error) { return c.out.Write(p) }
+func (c *PollConn) LocalAddr() net.Addr         { return c.local }
+func (c *PollConn) RemoteAddr() net.Addr        { return c.remote }
+
+// Close ends both directions; bytes already written are still delivered
+func (c *PollConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.closed.Store(true)
+		c.in.Close()
+		c.out.Close()
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return nil
+}
+
+// SetDeadline only affects reads - writes just queue, see SetWriteDeadline
+func (c *PollConn) SetDeadline(t time.Time) error {
+	c.in.SetDeadline(t)
+	return nil
+}
+
+func (c *PollConn) SetReadDeadline(t time.Time) error {
+	c.in.SetDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline does nothing: a write only waits while a lot of data is
+// queued, and a peer that stops polling is noticed by the WebSocket pings
+func (c *PollConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
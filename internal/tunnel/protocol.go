@@ -1,5 +1,13 @@
 package tunnel
 
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
 // This file defines the "language" that server and CLI speak over WebSocket
 // We serialize HTTP requests/responses to JSON and send them through the tunnel
 
@@ -13,44 +21,364 @@ const (
 	// CLI -> Server: "here's the response from localhost"
 	TypeHTTPResponse MessageType = "http_response"
 
+	// CLI -> Server: "localhost sent an informational (1xx) response first"
+	TypeHTTPInformational MessageType = "http_informational"
+
 	// Server -> CLI: "here's your assigned tunnel ID"
 	TypeTunnelAssigned MessageType = "tunnel_assigned"
 
 	// CLI -> Server: "I want to register a tunnel for this port"
 	TypeTunnelRegister MessageType = "tunnel_register"
+
+	// Server -> CLI: "I can't give you a tunnel, here's why"
+	TypeTunnelError MessageType = "tunnel_error"
+
+	// Both directions: "here's the next piece of a streamed body"
+	TypeBodyChunk MessageType = "body_chunk"
+
+	// Both directions: "I passed on some chunks of your body, send more"
+	// (or "stop sending it"), see flow.go
+	TypeBodyAck MessageType = "body_ack"
+
+	// Server -> CLI: "a client wants a WebSocket, please open one to localhost"
+	// CLI -> Server: "done, the local WebSocket is open"
+	TypeWSOpen MessageType = "ws_open"
+
+	// Both directions: "here's a WebSocket message"
+	TypeWSData MessageType = "ws_data"
+
+	// Both directions: "this WebSocket is closed" (or couldn't be opened)
+	TypeWSClose MessageType = "ws_close"
+
+	// Server -> CLI: "move your tunnel to this other server"
+	TypeMigrate MessageType = "migrate"
+)
+
+// ProtocolVersion is the version of this protocol that this build speaks
+// Features old peers can do without are negotiated as capabilities (below),
+// so it only goes up for changes that would break them. Both sides send it
+// when registering, and each side refuses a peer with a different version.
+// Peers from before versioning send none (0); they're refused too, as they
+// can't be told apart from a broken or foreign client.
+const ProtocolVersion = 1
+
+// CompatibleVersion reports whether a peer that sent version v can talk to us
+func CompatibleVersion(v int) bool {
+	return v == ProtocolVersion
+}
+
+// Capabilities are optional protocol features
+// The CLI lists what it supports when registering, the server replies with
+// the subset both sides agree on. Old clients send none and get none.
+const (
+	// Bodies above a size threshold are sent as TypeBodyChunk messages
+	CapStreaming = "streaming"
+
+	// WebSocket connections are relayed with TypeWSOpen/WSData/WSClose
+	CapWebSocket = "websocket"
+
+	// The server enforces TunnelRegister.BasicAuth on public requests
+	CapBasicAuth = "basic_auth"
+
+	// Large message payloads may be gzipped (Message.Compressed)
+	CapGzip = "gzip"
+
+	// The server applies TunnelRegister.Rewrite to bodies
+	CapRewrite = "rewrite"
+
+	// Messages may be sent as binary frames with raw bodies, see binary.go
+	CapBinary = "binary"
+
+	// The CLI follows TypeMigrate to another server
+	CapMigrate = "migrate"
+
+	// Streamed bodies are paced by TypeBodyAck, see flow.go
+	CapFlowControl = "flow_control"
 )
 
+// SupportedCapabilities is everything this build understands
+var SupportedCapabilities = []string{CapStreaming, CapWebSocket, CapBasicAuth, CapGzip, CapRewrite, CapBinary, CapMigrate, CapFlowControl}
+
+// NegotiateCapabilities returns the requested capabilities we also support
+func NegotiateCapabilities(requested []string) []string {
+	var agreed []string
+	for _, c := range requested {
+		if HasCapability(SupportedCapabilities, c) {
+			agreed = append(agreed, c)
+		}
+	}
+	return agreed
+}
+
+// HasCapability reports whether caps contains c
+func HasCapability(caps []string, c string) bool {
+	for _, have := range caps {
+		if have == c {
+			return true
+		}
+	}
+	return false
+}
+
 // Message is the envelope for all WebSocket communication
 // In Go, struct fields with `json:"..."` tags define how they serialize to JSON
 type Message struct {
 	Type    MessageType `json:"type"`
 	Payload []byte      `json:"payload"` // The actual data (varies by type)
+
+	// Compressed means Payload is gzipped - see Codec and Decompress
+	Compressed bool `json:"compressed,omitempty"`
+
+	// Attachment is the raw body of a binary frame, see binary.go
+	// Unmarshal puts it back into the payload's body field.
+	Attachment        []byte `json:"-"`
+	attachmentGzipped bool
+}
+
+// Encode wraps a payload in a Message envelope and serializes the whole thing
+func Encode(msgType MessageType, payload interface{}) ([]byte, error) {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(Message{Type: msgType, Payload: payloadBytes})
 }
 
 // TunnelAssigned is sent from server to CLI after connection
 type TunnelAssigned struct {
-	TunnelID  string `json:"tunnel_id"`  // e.g., "abc123"
-	PublicURL string `json:"public_url"` // e.g., "https://abc123.tunnelr.io"
+	TunnelID     string   `json:"tunnel_id"`              // e.g., "abc123"
+	PublicURL    string   `json:"public_url"`             // e.g., "https://abc123.tunnelr.io"
+	Capabilities []string `json:"capabilities,omitempty"` // Features both sides agreed on
+
+	// The server's ProtocolVersion, 0 from servers that predate it
+	ProtocolVersion int `json:"protocol_version,omitempty"`
 }
 
 // TunnelRegister is sent from CLI to server when connecting
 type TunnelRegister struct {
-	LocalPort int `json:"local_port"` // e.g., 3000
+	LocalPort    int      `json:"local_port"`             // e.g., 3000
+	LocalHost    string   `json:"local_host,omitempty"`   // Where the CLI forwards to, empty = localhost
+	Capabilities []string `json:"capabilities,omitempty"` // Features the CLI supports
+	AuthToken    string   `json:"auth_token,omitempty"`   // Identifies who owns the tunnel
+	Subdomain    string   `json:"subdomain,omitempty"`    // Requested tunnel ID, random if empty
+
+	// What the server answers with while the CLI is overloaded (one of the
+	// Fallback* values), empty for the server's default
+	OverloadFallback string `json:"overload_fallback,omitempty"`
+
+	// How long after registering the server keeps retrying requests the CLI
+	// couldn't deliver because the local server isn't up yet, 0 = no retries
+	WarmupSeconds int `json:"warmup_seconds,omitempty"`
+
+	// "user:pass" public visitors must send with HTTP Basic Auth, empty for
+	// an open tunnel
+	BasicAuth string `json:"basic_auth,omitempty"`
+
+	// Pass every response on as the local server writes it, instead of
+	// letting the server buffer it
+	Unbuffered bool `json:"unbuffered,omitempty"`
+
+	// Find/replace rules for bodies passing through, nil for none
+	Rewrite *BodyRewrite `json:"rewrite,omitempty"`
+
+	// gzip level for payloads sent to this tunnel (CapGzip), 1 = fastest to
+	// 9 = smallest, 0 for the default - see ValidGzipLevel
+	GzipLevel int `json:"gzip_level,omitempty"`
+
+	// Largest request body (bytes) visitors may send, capped by the server's
+	// MAX_BODY_SIZE, 0 for the server's default
+	MaxBodyBytes int64 `json:"max_body_bytes,omitempty"`
+
+	// The CLI's ProtocolVersion, 0 from CLIs that predate it
+	ProtocolVersion int `json:"protocol_version,omitempty"`
+}
+
+// UnreachableHeader marks the CLI's 502 when nothing answered on the local
+// port, so the server can retry it during the tunnel's warmup
+const UnreachableHeader = "X-Tunnelr-Unreachable"
+
+// AttemptHeader tells the local app that a request is a resend, with the
+// attempt number ("2", "3"...), so handlers with side effects can skip
+// requests they've already processed. First attempts don't carry it.
+const AttemptHeader = "X-Tunnel-Attempt"
+
+// CloseIdle is the close code the server uses when it removes a tunnel for
+// having no traffic (IDLE_TIMEOUT). 4000-4999 are free for applications to
+// use (RFC 6455 section 7.4.2). The CLI exits instead of reconnecting.
+const CloseIdle = 4000
+
+// CloseDisconnected is the close code the server uses when an admin
+// disconnects a tunnel. The CLI exits instead of reconnecting, like CloseIdle.
+const CloseDisconnected = 4001
+
+// ReceivedAtHeader carries when the server received a request (RFC 3339, UTC,
+// with fractions of a second), so handlers that check webhook timestamps can
+// tell how much of a delay was the tunnel's
+const ReceivedAtHeader = "X-Tunnel-Received-At"
+
+// OverloadedHeader marks the CLI's 503 when it's at its concurrency limit, so
+// the server can tell it apart from a 503 the local app sent
+const OverloadedHeader = "X-Tunnelr-Overloaded"
+
+// Overload fallbacks - what the public client gets instead of the CLI's 503
+const (
+	FallbackError = "error" // The 503 as-is
+	FallbackPage  = "page"  // A "busy" page
+	FallbackStale = "stale" // The last good response to the same request, else the page
+)
+
+// ValidFallback reports whether name is one of the Fallback* values
+func ValidFallback(name string) bool {
+	return name == FallbackError || name == FallbackPage || name == FallbackStale
+}
+
+// IsUnbuffered reports whether a response asks to be passed on without
+// buffering: "X-Accel-Buffering: no" (the header nginx uses for this), or a
+// server-sent event stream, which is useless if it arrives late
+func IsUnbuffered(header http.Header) bool {
+	if strings.EqualFold(header.Get("X-Accel-Buffering"), "no") {
+		return true
+	}
+	mediaType, _, _ := strings.Cut(header.Get("Content-Type"), ";")
+	return strings.EqualFold(strings.TrimSpace(mediaType), "text/event-stream")
+}
+
+// ValidBasicAuth reports whether s is a usable "user:pass" pair
+// The user can't be empty or contain a colon; the password can be anything
+// but empty
+func ValidBasicAuth(s string) bool {
+	user, pass, found := strings.Cut(s, ":")
+	return found && user != "" && pass != ""
+}
+
+// OwnTunnels is what GET /api/tunnels returns: the tunnels opened with the
+// caller's auth token. `tunnelr list` shows it.
+type OwnTunnels struct {
+	Count   int         `json:"count"`
+	Tunnels []OwnTunnel `json:"tunnels"`
 }
 
+// OwnTunnel is one tunnel in OwnTunnels
+type OwnTunnel struct {
+	ID          string    `json:"id"`
+	LocalPort   int       `json:"local_port"`
+	PublicURL   string    `json:"public_url"`
+	ConnectedAt time.Time `json:"connected_at"`
+}
+
+// TunnelError is sent instead of TunnelAssigned when registration fails
+// The server closes the connection right after sending it
+type TunnelError struct {
+	Code    string `json:"code"`    // Machine-readable, e.g., "tunnel_limit"
+	Message string `json:"message"` // Shown to the user as-is
+}
+
+// Error codes for TunnelError
+const (
+	ErrCodeTunnelLimit       = "tunnel_limit"
+	ErrCodeSubdomainInvalid  = "subdomain_invalid"
+	ErrCodeSubdomainTaken    = "subdomain_taken"
+	ErrCodeSubdomainReserved = "subdomain_reserved"
+	ErrCodeBasicAuthInvalid  = "basic_auth_invalid"
+	ErrCodeRewriteInvalid    = "rewrite_invalid"
+	ErrCodeNoFreeID          = "no_free_id"
+	ErrCodeProtocolVersion   = "protocol_version"
+)
+
 // HTTPRequest represents an incoming HTTP request to forward
 type HTTPRequest struct {
-	ID      string            `json:"id"`      // Unique ID to match response
-	Method  string            `json:"method"`  // GET, POST, etc.
-	Path    string            `json:"path"`    // /api/webhook
-	Headers map[string]string `json:"headers"` // HTTP headers
-	Body    []byte            `json:"body"`    // Request body
+	ID      string      `json:"id"`      // Unique ID to match response
+	Method  string      `json:"method"`  // GET, POST, etc.
+	Path    string      `json:"path"`    // /api/webhook
+	Headers http.Header `json:"headers"` // HTTP headers, all values kept (e.g. several Cookie lines)
+	Body    []byte      `json:"body"`    // Request body
+
+	// Exact bytes of header values that aren't valid UTF-8, see RawHeaders
+	RawHeaders RawHeaders `json:"raw_headers,omitempty"`
+
+	// Streamed means Body is empty and the body follows as TypeBodyChunk messages
+	Streamed bool `json:"streamed,omitempty"`
+
+	// Attempt counts how often the server has sent this request: 1 the first
+	// time, 2 and up for resends (e.g. warmup retries), 0 from older servers
+	Attempt int `json:"attempt,omitempty"`
 }
 
 // HTTPResponse is what the CLI sends back after hitting localhost
 type HTTPResponse struct {
-	ID         string            `json:"id"`          // Matches the request ID
-	StatusCode int               `json:"status_code"` // 200, 404, etc.
-	Headers    map[string]string `json:"headers"`     // Response headers
-	Body       []byte            `json:"body"`        // Response body
+	ID         string      `json:"id"`          // Matches the request ID
+	StatusCode int         `json:"status_code"` // 200, 404, etc.
+	Headers    http.Header `json:"headers"`     // Response headers, all values kept (e.g. several Set-Cookie)
+	Body       []byte      `json:"body"`        // Response body
+
+	// Exact bytes of header values that aren't valid UTF-8, see RawHeaders
+	RawHeaders RawHeaders `json:"raw_headers,omitempty"`
+
+	// Streamed means Body is empty and the body follows as TypeBodyChunk messages
+	Streamed bool `json:"streamed,omitempty"`
+}
+
+// HTTPInformational is a 1xx response (e.g. 103 Early Hints) the local
+// server sent before its final response
+type HTTPInformational struct {
+	ID         string      `json:"id"`          // Matches the request ID
+	StatusCode int         `json:"status_code"` // 103 etc.
+	Headers    http.Header `json:"headers"`     // e.g., Link headers to preload
+}
+
+// BodyChunk carries one piece of a streamed request or response body
+type BodyChunk struct {
+	ID   string `json:"id"`             // Request ID the body belongs to
+	Data []byte `json:"data,omitempty"` // Raw body bytes
+	EOF  bool   `json:"eof,omitempty"`  // Last chunk - nothing follows
+
+	// Set on the EOF chunk if the sender couldn't read the whole body
+	Error string `json:"error,omitempty"`
+}
+
+// BodyAck gives a body's sender credit for more chunks (CapFlowControl)
+type BodyAck struct {
+	ID     string `json:"id"`               // Request ID the body belongs to
+	Chunks int    `json:"chunks,omitempty"` // How many chunks the reader took since the last ack
+	Stop   bool   `json:"stop,omitempty"`   // The reader is gone, don't send the rest
+}
+
+// WSOpen asks the CLI to open a WebSocket to the local server
+// The CLI answers with a WSOpen of its own (just ID and Subprotocol) once the
+// local WebSocket is open, or a WSClose if it couldn't be opened
+type WSOpen struct {
+	ID      string      `json:"id"`                // Unique ID for this WebSocket
+	Path    string      `json:"path,omitempty"`    // /socket?room=1
+	Headers http.Header `json:"headers,omitempty"` // Client's handshake headers (Origin, Cookie...)
+
+	// Set in the CLI's answer: the subprotocol the local server picked
+	Subprotocol string `json:"subprotocol,omitempty"`
+}
+
+// WSData is one WebSocket message
+type WSData struct {
+	ID     string `json:"id"`
+	Binary bool   `json:"binary,omitempty"` // Binary message, otherwise text
+	Data   []byte `json:"data,omitempty"`
+}
+
+// WSClose ends a WebSocket, passing on the close code and reason
+type WSClose struct {
+	ID     string `json:"id"`
+	Code   int    `json:"code,omitempty"` // e.g. 1000 normal closure
+	Reason string `json:"reason,omitempty"`
+}
+
+// Migrate asks the CLI to move its tunnel to another server instance, e.g.
+// before this one is upgraded. The CLI registers there with the same tunnel
+// ID, then closes this connection once its requests in flight are answered.
+type Migrate struct {
+	ServerURL string `json:"server_url"`       // The new server's WebSocket URL, e.g. wss://tunnel-2.example.com/ws
+	Reason    string `json:"reason,omitempty"` // Shown to the user
+}
+
+// ValidServerURL reports whether u is a ws:// or wss:// URL a CLI can dial
+func ValidServerURL(u string) bool {
+	parsed, err := url.Parse(u)
+	return err == nil && (parsed.Scheme == "ws" || parsed.Scheme == "wss") && parsed.Host != ""
 }
@@ -0,0 +1,95 @@
+package tunnel
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"testing"
+)
+
+// unencodable fails to marshal, like a payload carrying a value JSON can't
+// represent would
+type unencodable struct{}
+
+var errUnencodable = errors.New("can't encode this")
+
+func (unencodable) MarshalJSON() ([]byte, error) {
+	return nil, errUnencodable
+}
+
+func TestEncodeReportsMarshalErrors(t *testing.T) {
+	payloads := map[string]interface{}{
+		"marshaler error": unencodable{},
+		"NaN":             math.NaN(),
+		"channel":         make(chan int),
+	}
+	codecs := map[string]Codec{
+		"text":        {},
+		"gzip":        {Gzip: true},
+		"binary":      {Binary: true},
+		"binary+gzip": {Binary: true, Gzip: true},
+	}
+
+	for name, payload := range payloads {
+		data, err := Encode(TypeHTTPResponse, payload)
+		if err == nil || data != nil {
+			t.Errorf("Encode(%s) = %d bytes, %v; want no bytes and an error", name, len(data), err)
+		}
+		for codecName, codec := range codecs {
+			data, err := codec.Encode(TypeHTTPResponse, payload)
+			if err == nil || data != nil {
+				t.Errorf("%s codec, %s: got %d bytes, %v; want no bytes and an error", codecName, name, len(data), err)
+			}
+		}
+	}
+
+	// The cause comes through for the caller to log
+	if _, err := Encode(TypeHTTPResponse, unencodable{}); !errors.Is(err, errUnencodable) {
+		t.Errorf("Encode error = %v, want it to wrap the marshal error", err)
+	}
+}
+
+func TestEncodeBodyFramesRoundTrip(t *testing.T) {
+	// The happy path next to the failures above: what encodes, decodes
+	resp := HTTPResponse{ID: "req1", StatusCode: 200, Body: []byte("hello")}
+	for _, codec := range []Codec{{}, {Binary: true}, {Binary: true, Gzip: true}} {
+		data, err := codec.Encode(TypeHTTPResponse, resp)
+		if err != nil {
+			t.Fatalf("%+v: %v", codec, err)
+		}
+		msg, err := DecodeMessage(data)
+		if err != nil {
+			t.Fatalf("%+v: decoding: %v", codec, err)
+		}
+		if err := msg.Decompress(); err != nil {
+			t.Fatalf("%+v: decompressing: %v", codec, err)
+		}
+		var got HTTPResponse
+		if err := msg.Unmarshal(&got); err != nil {
+			t.Fatalf("%+v: unmarshaling: %v", codec, err)
+		}
+		if got.ID != "req1" || string(got.Body) != "hello" {
+			t.Errorf("%+v: got %+v", codec, got)
+		}
+	}
+}
+
+func TestIsUnbuffered(t *testing.T) {
+	tests := []struct {
+		header http.Header
+		want   bool
+	}{
+		{http.Header{"X-Accel-Buffering": {"no"}}, true},
+		{http.Header{"X-Accel-Buffering": {"No"}}, true},
+		{http.Header{"X-Accel-Buffering": {"yes"}}, false},
+		{http.Header{"Content-Type": {"text/event-stream"}}, true},
+		{http.Header{"Content-Type": {"Text/Event-Stream; charset=utf-8"}}, true},
+		{http.Header{"Content-Type": {"text/html"}}, false},
+		{http.Header{}, false},
+	}
+	for _, tc := range tests {
+		if got := IsUnbuffered(tc.header); got != tc.want {
+			t.Errorf("IsUnbuffered(%v) = %v, want %v", tc.header, got, tc.want)
+		}
+	}
+}
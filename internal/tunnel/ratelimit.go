@@ -0,0 +1,56 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket: it holds up to burst tokens, refilled at
+// rate tokens per second, and every request takes one. Short bursts are
+// fine; a sustained flood is cut down to rate.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time // When tokens was last topped up
+}
+
+// NewRateLimiter creates a full bucket
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow takes a token if one is available
+// If not, it returns how long until the next token arrives
+// A nil limiter allows everything
+func (l *RateLimiter) Allow() (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
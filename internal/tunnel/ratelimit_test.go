@@ -0,0 +1,60 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBurstThenRate(t *testing.T) {
+	l := NewRateLimiter(10, 3)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow(); !ok {
+			t.Fatalf("request %d of the burst refused", i+1)
+		}
+	}
+	ok, wait := l.Allow()
+	if ok {
+		t.Fatal("request past the burst allowed")
+	}
+	if wait <= 0 || wait > 100*time.Millisecond {
+		t.Errorf("wait = %s, want up to 100ms at 10/s", wait)
+	}
+
+	// A token comes back after 1/rate
+	time.Sleep(wait + 10*time.Millisecond)
+	if ok, _ := l.Allow(); !ok {
+		t.Error("refused after waiting the time Allow gave")
+	}
+	if ok, _ := l.Allow(); ok {
+		t.Error("two requests allowed for one refilled token")
+	}
+}
+
+func TestRateLimiterRefillIsCapped(t *testing.T) {
+	l := NewRateLimiter(1000, 2)
+	time.Sleep(20 * time.Millisecond) // 20 tokens' worth, but the bucket holds 2
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if ok, _ := l.Allow(); ok {
+			allowed++
+		}
+	}
+	// The bucket's 2, plus what trickles in while we loop
+	if allowed < 2 || allowed > 3 {
+		t.Errorf("%d requests allowed after a long idle, want the burst of 2", allowed)
+	}
+}
+
+func TestNilRateLimiterAllowsEverything(t *testing.T) {
+	var l *RateLimiter
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.Allow(); !ok {
+			t.Fatal("nil limiter refused a request")
+		}
+	}
+	if ok, _ := NewRateLimiter(1, 0).Allow(); !ok {
+		t.Error("a burst under 1 should still allow one request")
+	}
+}
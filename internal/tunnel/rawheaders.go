@@ -0,0 +1,62 @@
+package tunnel
+
+import (
+	"net/http"
+	"unicode/utf8"
+)
+
+// Header values aren't always UTF-8: HTTP allows any byte from 0x80 up, and
+// older software sends e.g. Latin-1 file names in Content-Disposition. In Go,
+// encoding/json replaces invalid UTF-8 in strings with U+FFFD, so such a
+// value would arrive changed. RawHeaders carries the exact bytes next to the
+// (mangled) Headers; []byte is base64 in JSON, so any byte survives.
+//
+// Peers that don't know the field still get Headers, mangled as before.
+
+// RawHeaders maps a header name to all of its values, as bytes
+type RawHeaders map[string][][]byte
+
+// SplitRawHeaders returns the headers in h with a value that isn't valid
+// UTF-8, nil if there are none (the usual case)
+// All values of such a header are kept, so their order survives.
+func SplitRawHeaders(h http.Header) RawHeaders {
+	var raw RawHeaders
+	for key, values := range h {
+		if allValidUTF8(values) {
+			continue
+		}
+		if raw == nil {
+			raw = make(RawHeaders)
+		}
+		copies := make([][]byte, len(values))
+		for i, value := range values {
+			copies[i] = []byte(value)
+		}
+		raw[key] = copies
+	}
+	return raw
+}
+
+// RestoreRawHeaders puts the exact values from raw back into h
+// Does nothing if h is nil.
+func RestoreRawHeaders(h http.Header, raw RawHeaders) {
+	if h == nil {
+		return
+	}
+	for key, values := range raw {
+		restored := make([]string, len(values))
+		for i, value := range values {
+			restored[i] = string(value)
+		}
+		h[key] = restored
+	}
+}
+
+func allValidUTF8(values []string) bool {
+	for _, value := range values {
+		if !utf8.ValidString(value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+package tunnel
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestInvalidUTF8HeadersRoundTrip(t *testing.T) {
+	latin1 := "attachment; filename=\"r\xe9sum\xe9.pdf\"" // Latin-1, not UTF-8
+	headers := http.Header{
+		"Content-Disposition": {latin1},
+		"X-Binary":            {"ok", "\xff\x00\x80"},
+		"Content-Type":        {"application/pdf"},
+	}
+
+	for _, codec := range []Codec{{}, {Binary: true}, {Binary: true, Gzip: true}} {
+		data, err := codec.Encode(TypeHTTPResponse, HTTPResponse{
+			ID:         "r1",
+			StatusCode: http.StatusOK,
+			Headers:    headers,
+			RawHeaders: SplitRawHeaders(headers),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := DecodeMessage(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := msg.Decompress(); err != nil {
+			t.Fatal(err)
+		}
+		var got HTTPResponse
+		if err := msg.Unmarshal(&got); err != nil {
+			t.Fatal(err)
+		}
+
+		// Without the raw values JSON has replaced the bad bytes
+		if got.Headers.Get("Content-Disposition") == latin1 {
+			t.Fatalf("%+v: Headers survived JSON unchanged, the test proves nothing", codec)
+		}
+		RestoreRawHeaders(got.Headers, got.RawHeaders)
+		if v := got.Headers.Get("Content-Disposition"); v != latin1 {
+			t.Errorf("%+v: Content-Disposition = %q, want %q", codec, v, latin1)
+		}
+		if v := got.Headers["X-Binary"]; len(v) != 2 || v[0] != "ok" || v[1] != "\xff\x00\x80" {
+			t.Errorf("%+v: X-Binary = %q", codec, v)
+		}
+		if v := got.Headers.Get("Content-Type"); v != "application/pdf" {
+			t.Errorf("%+v: Content-Type = %q", codec, v)
+		}
+	}
+}
+
+func TestSplitRawHeadersOnlyWhenNeeded(t *testing.T) {
+	if raw := SplitRawHeaders(http.Header{"Content-Type": {"text/html; charset=utf-8"}, "X-Name": {"Zoë"}}); raw != nil {
+		t.Errorf("valid UTF-8 headers gave %v, want nil", raw)
+	}
+	raw := SplitRawHeaders(http.Header{"X-Ok": {"fine"}, "X-Bad": {"\xe9"}})
+	if len(raw) != 1 || string(raw["X-Bad"][0]) != "\xe9" {
+		t.Errorf("got %q, want just X-Bad", raw)
+	}
+
+	// Nothing to restore into, nothing happens
+	RestoreRawHeaders(nil, raw)
+}
@@ -3,16 +3,112 @@ package tunnel
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 // Tunnel represents an active tunnel connection
 type Tunnel struct {
-	ID        string          // Unique identifier (subdomain)
-	Conn      *websocket.Conn // WebSocket connection to CLI
-	LocalPort int             // Port on the CLI's machine
+	ID           string           // Unique identifier (subdomain)
+	Conn         *SafeConn        // WebSocket connection to CLI
+	LocalPort    int              // Port on the CLI's machine
+	LocalHost    string           // Host the CLI forwards to ("" = localhost)
+	Capabilities []string         // Protocol features negotiated at registration
+	Timeouts     *TimeoutWindow   // Recent request timeouts, for spotting a struggling backend
+	Owner        string           // Auth token the tunnel was registered with ("" = anonymous)
+	CreatedAt    time.Time        // When the tunnel was registered
+	RemoteAddr   string           // Where the CLI connected from
+	Stats        TunnelStats      // Traffic counters
+	Pending      *PendingRequests // Requests waiting for the CLI to answer
+	WebSockets   *WSStreams       // WebSockets relayed through the tunnel
+	Windows      *SendWindows     // Request bodies being streamed to the CLI
+
+	// What to serve while the CLI is overloaded ("" = server default)
+	OverloadFallback string
+
+	// "user:pass" public requests must carry, "" = no auth
+	// Never log or expose this
+	BasicAuth string
+
+	// Responses are flushed to the visitor as soon as each piece arrives
+	Unbuffered bool
+
+	// Find/replace on bodies passing through, nil = none
+	Rewriter *BodyRewriter
+
+	// gzip level for payloads sent to the CLI, 0 = default
+	GzipLevel int
+
+	// Largest request body visitors may send, 0 = no limit
+	MaxBodyBytes int64
+
+	// Until then, requests the local server wasn't up for are retried
+	WarmupUntil time.Time
+
+	// Caps requests per second to this tunnel, nil = no limit
+	Limiter *RateLimiter
+
+	// Caps requests in flight based on local latency, nil = no cap
+	Concurrency *AdaptiveLimiter
+
+	lastActivity atomic.Int64 // Unix nanoseconds of the last request or CLI message, see Touch
+
+	closed    chan struct{} // Closed when the tunnel is removed
+	closeOnce sync.Once
+}
+
+// TunnelStats are counters updated as requests flow through a tunnel
+// atomic types so forwarding goroutines can bump them without a lock
+type TunnelStats struct {
+	Requests atomic.Int64 // Requests forwarded to the CLI
+	Timeouts atomic.Int64 // Requests the CLI didn't answer in time
+	BytesIn  atomic.Int64 // Request body bytes sent to the CLI
+	BytesOut atomic.Int64 // Response body bytes received from the CLI
+}
+
+// Closed returns a channel that's closed once the tunnel has been removed
+// Requests still waiting on the CLI select on it so they fail right away
+// instead of sitting out the full timeout
+func (t *Tunnel) Closed() <-chan struct{} {
+	return t.closed
+}
+
+// markClosed closes the Closed channel (only the first call does anything)
+func (t *Tunnel) markClosed() {
+	t.closeOnce.Do(func() { close(t.closed) })
+}
+
+// Touch records traffic on the tunnel, so it isn't reaped as idle
+func (t *Tunnel) Touch() {
+	t.lastActivity.Store(time.Now().UnixNano())
+}
+
+// LastActivity returns when the tunnel last saw traffic (its creation time if
+// it never has)
+func (t *Tunnel) LastActivity() time.Time {
+	return time.Unix(0, t.lastActivity.Load())
+}
+
+// InWarmup reports whether the tunnel is still in its warmup window
+func (t *Tunnel) InWarmup() bool {
+	return time.Now().Before(t.WarmupUntil)
+}
+
+// Supports reports whether the tunnel's CLI negotiated a capability
+func (t *Tunnel) Supports(capability string) bool {
+	return HasCapability(t.Capabilities, capability)
+}
+
+// Codec is how messages to this tunnel's CLI are encoded
+func (t *Tunnel) Codec() Codec {
+	codec := NewCodec(t.Capabilities)
+	codec.Level = t.GzipLevel
+	return codec
 }
 
 // Registry keeps track of all active tunnels
@@ -22,33 +118,220 @@ type Registry struct {
 	// In Go, you embed sync.Mutex directly in the struct
 	mu      sync.RWMutex
 	tunnels map[string]*Tunnel
+	owners  map[string]int // Active tunnel count per owner token
+	newID   IDGenerator    // Produces IDs for new tunnels
+	idPool  *IDPool        // Pre-generated IDs, nil = generate on demand
+
+	reserved map[string]bool // Names no tunnel may use, only written before use
+
+	// Optional hooks, e.g. for metrics (see SetHooks)
+	onRegister func(*Tunnel)
+	onRemove   func(*Tunnel)
+
+	// Per-tunnel rate limit for new tunnels (see SetRateLimit)
+	rateLimit float64
+	rateBurst int
+
+	// Adaptive concurrency for new tunnels (see SetAdaptiveConcurrency)
+	adaptiveTarget time.Duration
+	adaptiveMax    int
 }
 
+// ErrTunnelLimit is returned by Register when the owner already has their
+// maximum number of tunnels open
+var ErrTunnelLimit = errors.New("tunnel limit reached for this token")
+
+// ErrNoFreeID is returned by Register when maxIDAttempts random IDs in a row
+// were already taken - the ID space is (nearly) full, or the generator is
+// broken
+var ErrNoFreeID = errors.New("no free tunnel ID")
+
+// maxIDAttempts bounds how often Register generates a new ID after a
+// collision. With 16.7 million IDs, even a million tunnels collide only 6% of
+// the time per attempt, so hitting this means something is wrong.
+const maxIDAttempts = 100
+
+// ErrSubdomainInvalid, ErrSubdomainReserved and ErrSubdomainTaken are
+// returned by Register when the requested subdomain can't be used
+var (
+	ErrSubdomainInvalid  = errors.New("invalid subdomain")
+	ErrSubdomainReserved = errors.New("subdomain is reserved")
+	ErrSubdomainTaken    = errors.New("subdomain is already in use")
+)
+
 // NewRegistry creates an empty registry
 // In Go, functions starting with "New" are constructors by convention
 func NewRegistry() *Registry {
-	return &Registry{
-		tunnels: make(map[string]*Tunnel),
+	r := &Registry{
+		tunnels:  make(map[string]*Tunnel),
+		owners:   make(map[string]int),
+		reserved: make(map[string]bool),
+		newID:    generateID,
 	}
+	r.SetReservedSubdomains(DefaultReservedSubdomains)
+	return r
+}
+
+// SetReservedSubdomains adds names no tunnel may use, on top of
+// DefaultReservedSubdomains. Random IDs avoid them too.
+// Call it before the registry is in use
+func (r *Registry) SetReservedSubdomains(names []string) {
+	for _, name := range names {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			r.reserved[name] = true
+		}
+	}
+}
+
+// IsReserved reports whether name is reserved, see SetReservedSubdomains
+func (r *Registry) IsReserved(name string) bool {
+	return r.reserved[name]
+}
+
+// SetIDGenerator replaces how tunnel IDs are generated
+// Call it before the registry is in use
+func (r *Registry) SetIDGenerator(gen IDGenerator) {
+	r.newID = gen
+}
+
+// SetIDPool keeps size IDs from the registry's generator ready for new
+// tunnels. size <= 0 turns the pool off. Call it after SetIDGenerator and
+// before the registry is in use.
+func (r *Registry) SetIDPool(size int) {
+	if size > 0 {
+		r.idPool = NewIDPool(r.newID, size)
+	}
+}
+
+// IDPoolLen returns how many pre-generated IDs are ready (0 without a pool)
+func (r *Registry) IDPoolLen() int {
+	return r.idPool.Len()
+}
+
+// SetHooks sets functions called whenever a tunnel is registered or removed
+// Either may be nil. Call it before the registry is in use.
+// Hooks run with the registry locked, so they must be quick and must not call
+// back into the registry.
+func (r *Registry) SetHooks(onRegister, onRemove func(*Tunnel)) {
+	r.onRegister = onRegister
+	r.onRemove = onRemove
 }
 
-// Register adds a new tunnel and returns its ID
-func (r *Registry) Register(conn *websocket.Conn, localPort int) string {
-	// Generate a random ID for the subdomain
-	id := generateID()
+// SetRateLimit gives every new tunnel a limit of rate requests per second,
+// allowing bursts of up to burst requests. rate <= 0 means no limit.
+// Call it before the registry is in use.
+func (r *Registry) SetRateLimit(rate float64, burst int) {
+	r.rateLimit = rate
+	r.rateBurst = burst
+}
+
+// SetAdaptiveConcurrency gives every new tunnel an AdaptiveLimiter aiming
+// for a p95 latency of target, with at most max requests in flight.
+// target <= 0 turns it off. Call it before the registry is in use.
+func (r *Registry) SetAdaptiveConcurrency(target time.Duration, max int) {
+	r.adaptiveTarget = target
+	r.adaptiveMax = max
+}
+
+// Register adds a new tunnel and returns it
+// reg is the CLI's registration, with Capabilities already negotiated
+// ownerLimit caps how many tunnels reg.AuthToken may hold at once (0 = no cap,
+// anonymous tunnels are never capped)
+// reg.Subdomain, if set, is used as the ID instead of a random one
+func (r *Registry) Register(conn *SafeConn, reg TunnelRegister, ownerLimit int) (*Tunnel, error) {
+	if reg.Subdomain != "" && !ValidSubdomain(reg.Subdomain) {
+		return nil, ErrSubdomainInvalid
+	}
+	if r.reserved[reg.Subdomain] {
+		return nil, ErrSubdomainReserved
+	}
+	owner := reg.AuthToken
+
+	// Build the tunnel before locking - the lock only covers the map updates
+	tunnel := &Tunnel{
+		Conn:             conn,
+		LocalPort:        reg.LocalPort,
+		LocalHost:        reg.LocalHost,
+		Capabilities:     reg.Capabilities,
+		Timeouts:         NewTimeoutWindow(TimeoutWindowSize),
+		Owner:            owner,
+		CreatedAt:        time.Now(),
+		Pending:          NewPendingRequests(),
+		WebSockets:       NewWSStreams(),
+		Windows:          NewSendWindows(),
+		OverloadFallback: reg.OverloadFallback,
+		BasicAuth:        reg.BasicAuth,
+		Unbuffered:       reg.Unbuffered,
+		GzipLevel:        reg.GzipLevel,
+		MaxBodyBytes:     reg.MaxBodyBytes,
+		closed:           make(chan struct{}),
+	}
+	tunnel.lastActivity.Store(tunnel.CreatedAt.UnixNano())
+	tunnel.WarmupUntil = tunnel.CreatedAt.Add(time.Duration(reg.WarmupSeconds) * time.Second)
+	tunnel.Rewriter, _ = NewBodyRewriter(reg.Rewrite) // The server rejects invalid rules before this
+	if r.rateLimit > 0 {
+		tunnel.Limiter = NewRateLimiter(r.rateLimit, r.rateBurst)
+	}
+	if r.adaptiveTarget > 0 {
+		tunnel.Concurrency = NewAdaptiveLimiter(r.adaptiveTarget, r.adaptiveMax)
+	}
+	if conn != nil {
+		tunnel.RemoteAddr = conn.RemoteAddr().String()
+	}
+
+	// A ready-made ID, if there's a pool
+	var pooledID string
+	var pooled bool
+	if reg.Subdomain == "" {
+		pooledID, pooled = r.idPool.Claim()
+	}
 
 	// Lock for writing (exclusive access)
 	r.mu.Lock()
 	// defer unlocks when function exits - prevents forgetting to unlock
 	defer r.mu.Unlock()
 
-	r.tunnels[id] = &Tunnel{
-		ID:        id,
-		Conn:      conn,
-		LocalPort: localPort,
+	if owner != "" && ownerLimit > 0 && r.owners[owner] >= ownerLimit {
+		if pooled {
+			r.idPool.Release(pooledID) // Never handed out, still fresh
+		}
+		return nil, ErrTunnelLimit
 	}
 
-	return id
+	if reg.Subdomain != "" {
+		if _, taken := r.tunnels[reg.Subdomain]; taken {
+			return nil, ErrSubdomainTaken
+		}
+		tunnel.ID = reg.Subdomain
+	} else if _, taken := r.tunnels[pooledID]; pooled && !taken && !r.reserved[pooledID] {
+		tunnel.ID = pooledID
+	} else {
+		// Generate a random ID, making sure it doesn't clash with an existing
+		// tunnel - overwriting the map entry would hijack that tunnel's
+		// traffic. A pooled ID can clash too, if a tunnel asked for it as its
+		// subdomain after it was generated.
+		tunnel.ID = ""
+		for i := 0; i < maxIDAttempts; i++ {
+			id := r.newID()
+			if _, taken := r.tunnels[id]; !taken && !r.reserved[id] {
+				tunnel.ID = id
+				break
+			}
+		}
+		if tunnel.ID == "" {
+			return nil, ErrNoFreeID
+		}
+	}
+
+	r.tunnels[tunnel.ID] = tunnel
+	if owner != "" {
+		r.owners[owner]++
+	}
+	if r.onRegister != nil {
+		r.onRegister(tunnel)
+	}
+
+	return tunnel, nil
 }
 
 // Get retrieves a tunnel by ID
@@ -67,7 +350,97 @@ func (r *Registry) Remove(id string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	delete(r.tunnels, id)
+	if tunnel, exists := r.tunnels[id]; exists {
+		r.removeLocked(tunnel)
+	}
+}
+
+// RemoveTunnel deletes t, unless its ID already belongs to a newer tunnel -
+// e.g. after CloseAndRemove, the CLI may be back before t's read loop ends
+func (r *Registry) RemoveTunnel(t *Tunnel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.tunnels[t.ID] == t {
+		r.removeLocked(t)
+	}
+}
+
+// CloseAndRemove sends a tunnel's CLI a close frame with code and reason,
+// closes the connection and removes the tunnel right away, so no more
+// requests go to it
+// Returns false if there's no tunnel with that ID.
+func (r *Registry) CloseAndRemove(id string, code int, reason string) bool {
+	tunnel, exists := r.Get(id)
+	if !exists {
+		return false
+	}
+	r.RemoveTunnel(tunnel)
+	tunnel.Conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	tunnel.Conn.Close()
+	return true
+}
+
+// removeLocked deletes tunnel, r.mu must be held
+func (r *Registry) removeLocked(tunnel *Tunnel) {
+	delete(r.tunnels, tunnel.ID)
+	tunnel.markClosed()
+	if r.onRemove != nil {
+		r.onRemove(tunnel)
+	}
+
+	if tunnel.Owner != "" {
+		r.owners[tunnel.Owner]--
+		if r.owners[tunnel.Owner] <= 0 {
+			delete(r.owners, tunnel.Owner)
+		}
+	}
+}
+
+// All returns every active tunnel
+// The slice is a copy, so callers can take their time with each tunnel (e.g.
+// write to its connection) without holding up the registry
+func (r *Registry) All() []*Tunnel {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	tunnels := make([]*Tunnel, 0, len(r.tunnels))
+	for _, t := range r.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	return tunnels
+}
+
+// Idle returns the tunnels with no traffic for at least timeout as of now
+// Tunnels with requests in flight or open WebSockets are never idle, however
+// long a request or a quiet WebSocket lasts.
+func (r *Registry) Idle(now time.Time, timeout time.Duration) []*Tunnel {
+	var idle []*Tunnel
+	for _, t := range r.All() {
+		if now.Sub(t.LastActivity()) >= timeout && t.Pending.Len() == 0 && t.WebSockets.Len() == 0 {
+			idle = append(idle, t)
+		}
+	}
+	return idle
+}
+
+// ReapPending removes leaked pending requests from every tunnel (see
+// PendingRequests.Reap) and returns how many it removed
+func (r *Registry) ReapPending(now time.Time, maxAge, quiet time.Duration) int {
+	reaped := 0
+	for _, t := range r.All() {
+		reaped += t.Pending.Reap(now, maxAge, quiet)
+	}
+	return reaped
+}
+
+// CountByOwner returns how many tunnels an owner token currently holds
+func (r *Registry) CountByOwner(owner string) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.owners[owner]
 }
 
 // Count returns how many active tunnels exist
@@ -0,0 +1,247 @@
+package tunnel
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegisterCapsTunnelsPerOwner(t *testing.T) {
+	r := NewRegistry()
+	const limit = 3
+
+	var first *Tunnel
+	for i := 0; i < limit; i++ {
+		tun, err := r.Register(nil, TunnelRegister{AuthToken: "alice"}, limit)
+		if err != nil {
+			t.Fatalf("tunnel %d of %d: %v", i+1, limit, err)
+		}
+		if first == nil {
+			first = tun
+		}
+	}
+	if _, err := r.Register(nil, TunnelRegister{AuthToken: "alice"}, limit); err != ErrTunnelLimit {
+		t.Fatalf("tunnel past the limit: got %v, want ErrTunnelLimit", err)
+	}
+	if got := r.CountByOwner("alice"); got != limit {
+		t.Errorf("CountByOwner = %d, want %d", got, limit)
+	}
+
+	// Other tokens, and anonymous tunnels, have their own (or no) count
+	if _, err := r.Register(nil, TunnelRegister{AuthToken: "bob"}, limit); err != nil {
+		t.Errorf("another token was refused: %v", err)
+	}
+	for i := 0; i < limit+1; i++ {
+		if _, err := r.Register(nil, TunnelRegister{}, limit); err != nil {
+			t.Fatalf("anonymous tunnel %d refused: %v", i+1, err)
+		}
+	}
+
+	// Closing one makes room again
+	r.RemoveTunnel(first)
+	if _, err := r.Register(nil, TunnelRegister{AuthToken: "alice"}, limit); err != nil {
+		t.Errorf("after closing one: %v", err)
+	}
+}
+
+func TestRegisterWithoutLimit(t *testing.T) {
+	r := NewRegistry()
+	for i := 0; i < 50; i++ {
+		if _, err := r.Register(nil, TunnelRegister{AuthToken: "alice"}, 0); err != nil {
+			t.Fatalf("tunnel %d refused without a limit: %v", i+1, err)
+		}
+	}
+}
+
+func BenchmarkRegister(b *testing.B) {
+	r := NewRegistry()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			tun, err := r.Register(nil, TunnelRegister{AuthToken: "bench"}, 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			r.RemoveTunnel(tun)
+		}
+	})
+}
+
+func TestRegisterRequestedSubdomain(t *testing.T) {
+	r := NewRegistry()
+
+	tun, err := r.Register(nil, TunnelRegister{Subdomain: "myapp"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tun.ID != "myapp" {
+		t.Errorf("ID = %q, want the requested myapp", tun.ID)
+	}
+
+	// Taken until the first tunnel closes, even for the same owner
+	if _, err := r.Register(nil, TunnelRegister{Subdomain: "myapp"}, 0); err != ErrSubdomainTaken {
+		t.Errorf("second myapp: got %v, want ErrSubdomainTaken", err)
+	}
+	r.RemoveTunnel(tun)
+	if _, err := r.Register(nil, TunnelRegister{Subdomain: "myapp"}, 0); err != nil {
+		t.Errorf("myapp after the first closed: %v", err)
+	}
+}
+
+func TestRegisterRefusesBadSubdomains(t *testing.T) {
+	r := NewRegistry()
+	r.SetReservedSubdomains([]string{"billing"})
+
+	tests := map[string]error{
+		"MyApp":                 ErrSubdomainInvalid,
+		"my_app":                ErrSubdomainInvalid,
+		"my.app":                ErrSubdomainInvalid,
+		"-myapp":                ErrSubdomainInvalid,
+		"myapp-":                ErrSubdomainInvalid,
+		"my app":                ErrSubdomainInvalid,
+		"über":                  ErrSubdomainInvalid,
+		strings.Repeat("a", 64): ErrSubdomainInvalid,
+		"admin":                 ErrSubdomainReserved,
+		"www":                   ErrSubdomainReserved,
+		"billing":               ErrSubdomainReserved,
+	}
+	for name, want := range tests {
+		if _, err := r.Register(nil, TunnelRegister{Subdomain: name}, 0); err != want {
+			t.Errorf("%q: got %v, want %v", name, err, want)
+		}
+	}
+	if r.Count() != 0 {
+		t.Errorf("%d tunnels registered from refused names", r.Count())
+	}
+
+	// The longest allowed label is fine
+	if _, err := r.Register(nil, TunnelRegister{Subdomain: strings.Repeat("a", 63)}, 0); err != nil {
+		t.Errorf("63-character name: %v", err)
+	}
+}
+
+func TestReservedSubdomains(t *testing.T) {
+	r := NewRegistry()
+	r.SetReservedSubdomains([]string{" Billing ", "", "docs"})
+
+	// The defaults are always there, whatever the server adds
+	for _, name := range append([]string{"billing", "docs"}, DefaultReservedSubdomains...) {
+		if !r.IsReserved(name) {
+			t.Errorf("%q isn't reserved", name)
+		}
+		if _, err := r.Register(nil, TunnelRegister{Subdomain: name}, 0); err != ErrSubdomainReserved {
+			t.Errorf("%q: got %v, want ErrSubdomainReserved", name, err)
+		}
+	}
+
+	if _, err := r.Register(nil, TunnelRegister{Subdomain: "myapp"}, 0); err != nil {
+		t.Errorf("myapp: %v", err)
+	}
+
+	// A random ID that happens to be reserved is thrown away
+	gen, _ := scriptedIDs("www", "status", "abc123")
+	r.SetIDGenerator(gen)
+	tun, err := r.Register(nil, TunnelRegister{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tun.ID != "abc123" {
+		t.Errorf("got ID %q, want reserved IDs skipped", tun.ID)
+	}
+}
+
+func TestRegisterRegeneratesCollidingIDs(t *testing.T) {
+	gen, calls := scriptedIDs("aaa111", "aaa111", "bbb222")
+	r := NewRegistry()
+	r.SetIDGenerator(gen)
+
+	first, err := r.Register(nil, TunnelRegister{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The generator hands out aaa111 again: a fresh ID, not a hijack
+	second, err := r.Register(nil, TunnelRegister{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID != "aaa111" || second.ID != "bbb222" || *calls != 3 {
+		t.Errorf("registered %q and %q with %d IDs generated, want aaa111 and bbb222 with 3", first.ID, second.ID, *calls)
+	}
+	if got, _ := r.Get("aaa111"); got != first {
+		t.Error("the first tunnel lost its ID to the second")
+	}
+}
+
+func TestRegisterGivesUpWhenNoIDIsFree(t *testing.T) {
+	calls := 0
+	r := NewRegistry()
+	r.SetIDGenerator(func() string {
+		calls++
+		return "same01"
+	})
+	if _, err := r.Register(nil, TunnelRegister{}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	calls = 0
+	if tun, err := r.Register(nil, TunnelRegister{}, 0); !errors.Is(err, ErrNoFreeID) {
+		t.Fatalf("got %v, %v; want ErrNoFreeID", tun, err)
+	}
+	if calls != maxIDAttempts {
+		t.Errorf("tried %d IDs, want %d", calls, maxIDAttempts)
+	}
+	if r.Count() != 1 {
+		t.Errorf("%d tunnels registered, want just the first", r.Count())
+	}
+}
+
+func TestIdleTunnels(t *testing.T) {
+	r := NewRegistry()
+	stale, _ := r.Register(nil, TunnelRegister{}, 0)
+	time.Sleep(20 * time.Millisecond)
+	active, _ := r.Register(nil, TunnelRegister{}, 0)
+	busy, _ := r.Register(nil, TunnelRegister{}, 0)
+	streaming, _ := r.Register(nil, TunnelRegister{}, 0)
+	active.Touch()
+
+	// A clock an hour on from the stale tunnel's last traffic: the others
+	// were touched later, so they're just short of it
+	const timeout = time.Hour
+	now := stale.LastActivity().Add(timeout + 10*time.Millisecond)
+	if idle := r.Idle(now, timeout); len(idle) != 1 || idle[0] != stale {
+		t.Errorf("idle = %v, want just the stale tunnel %s", tunnelIDs(idle), stale.ID)
+	}
+
+	// Much later everything is idle - unless it has a request in flight or
+	// an open WebSocket, however quiet
+	busy.Pending.Add("slow-request")
+	streaming.WebSockets.Add("quiet-socket")
+	later := now.Add(24 * time.Hour)
+	idle := r.Idle(later, timeout)
+	if len(idle) != 2 || (idle[0] != stale && idle[1] != stale) || (idle[0] != active && idle[1] != active) {
+		t.Errorf("a day later idle = %v, want %s and %s", tunnelIDs(idle), stale.ID, active.ID)
+	}
+
+	// Traffic resets the clock
+	stale.Touch()
+	if idle := r.Idle(now, timeout); len(idle) != 0 {
+		t.Errorf("after new traffic idle = %v, want none", tunnelIDs(idle))
+	}
+}
+
+// tunnelIDs lists the tunnels' IDs, for error messages
+func tunnelIDs(tunnels []*Tunnel) []string {
+	var ids []string
+	for _, t := range tunnels {
+		ids = append(ids, t.ID)
+	}
+	return ids
+}
+
+func TestCloseAndRemoveUnknownTunnel(t *testing.T) {
+	r := NewRegistry()
+	if r.CloseAndRemove("nosuchtunnel", CloseDisconnected, "bye") {
+		t.Error("CloseAndRemove reported closing a tunnel that doesn't exist")
+	}
+}
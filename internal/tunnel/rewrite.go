@@ -0,0 +1,119 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Body rewriting - regex find/replace on the bodies passing through a tunnel
+// The usual use is fixing links: an app that writes "http://localhost:3000"
+// into its HTML sends visitors back to their own machine.
+
+// MaxRewriteRules caps how many rules a tunnel may register
+const MaxRewriteRules = 20
+
+// PublicURLPlaceholder in a replacement is swapped for the tunnel's public URL
+const PublicURLPlaceholder = "{public_url}"
+
+// DefaultRewriteTypes are the media types rewritten when none are given
+var DefaultRewriteTypes = []string{"text/html"}
+
+// ErrRewriteInvalid is returned by NewBodyRewriter for unusable rules
+var ErrRewriteInvalid = errors.New("invalid rewrite rule")
+
+// RewriteRule is one find/replace
+// Find is a Go regular expression, Replace may use $1-style references and
+// PublicURLPlaceholder
+type RewriteRule struct {
+	Find    string `json:"find"`
+	Replace string `json:"replace"`
+}
+
+// BodyRewrite is a tunnel's rewriting setup, sent in TunnelRegister
+type BodyRewrite struct {
+	Rules        []RewriteRule `json:"rules"`
+	ContentTypes []string      `json:"content_types,omitempty"` // Media types to rewrite, empty = DefaultRewriteTypes
+	Requests     bool          `json:"requests,omitempty"`      // Rewrite request bodies too, not just responses
+}
+
+// BodyRewriter is a BodyRewrite with its patterns compiled
+type BodyRewriter struct {
+	rules        []compiledRewrite
+	contentTypes []string
+	Requests     bool
+}
+
+type compiledRewrite struct {
+	find    *regexp.Regexp
+	replace string
+}
+
+// NewBodyRewriter compiles cfg, returning nil (no rewriting) if it has no rules
+// In Go, regexp uses RE2, which runs in linear time - a visitor can't make a
+// pattern take forever, whatever the body.
+func NewBodyRewriter(cfg *BodyRewrite) (*BodyRewriter, error) {
+	if cfg == nil || len(cfg.Rules) == 0 {
+		return nil, nil
+	}
+	if len(cfg.Rules) > MaxRewriteRules {
+		return nil, fmt.Errorf("%w: at most %d rules", ErrRewriteInvalid, MaxRewriteRules)
+	}
+
+	rw := &BodyRewriter{Requests: cfg.Requests}
+	for _, rule := range cfg.Rules {
+		if rule.Find == "" {
+			return nil, fmt.Errorf("%w: empty pattern", ErrRewriteInvalid)
+		}
+		re, err := regexp.Compile(rule.Find)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrRewriteInvalid, err)
+		}
+		rw.rules = append(rw.rules, compiledRewrite{find: re, replace: rule.Replace})
+	}
+
+	for _, t := range cfg.ContentTypes {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			rw.contentTypes = append(rw.contentTypes, t)
+		}
+	}
+	if len(rw.contentTypes) == 0 {
+		rw.contentTypes = DefaultRewriteTypes
+	}
+	return rw, nil
+}
+
+// Applies reports whether a body with these headers should be rewritten:
+// its media type is one of ours and it isn't compressed (the rules would
+// never match gzip bytes)
+// A type ending in "/*" matches the whole family, e.g. "text/*".
+func (rw *BodyRewriter) Applies(header http.Header) bool {
+	if rw == nil {
+		return false
+	}
+	if enc := header.Get("Content-Encoding"); enc != "" && !strings.EqualFold(enc, "identity") {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, t := range rw.contentTypes {
+		if t == mediaType || strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rewrite applies every rule to body, in order
+func (rw *BodyRewriter) Rewrite(body []byte, publicURL string) []byte {
+	for _, rule := range rw.rules {
+		replace := strings.ReplaceAll(rule.replace, PublicURLPlaceholder, publicURL)
+		body = rule.find.ReplaceAll(body, []byte(replace))
+	}
+	return body
+}
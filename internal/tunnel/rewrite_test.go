@@ -0,0 +1,89 @@
+package tunnel
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRewriteHTML(t *testing.T) {
+	rw, err := NewBodyRewriter(&BodyRewrite{Rules: []RewriteRule{
+		{Find: `http://localhost:3000`, Replace: PublicURLPlaceholder},
+		{Find: `data-port="(\d+)"`, Replace: `data-port="$1" data-proxied`},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	page := `<a href="http://localhost:3000/login">Log in</a><div data-port="3000"></div><img src="http://localhost:3000/logo.png">`
+	want := `<a href="https://abc.tunnelr.test/login">Log in</a><div data-port="3000" data-proxied></div><img src="https://abc.tunnelr.test/logo.png">`
+	if got := string(rw.Rewrite([]byte(page), "https://abc.tunnelr.test")); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestRewriteAppliesTo(t *testing.T) {
+	defaults, _ := NewBodyRewriter(&BodyRewrite{Rules: []RewriteRule{{Find: "a", Replace: "b"}}})
+	custom, _ := NewBodyRewriter(&BodyRewrite{
+		Rules:        []RewriteRule{{Find: "a", Replace: "b"}},
+		ContentTypes: []string{" Application/JavaScript ", "text/*"},
+	})
+
+	tests := []struct {
+		rw     *BodyRewriter
+		header http.Header
+		want   bool
+	}{
+		{defaults, http.Header{"Content-Type": {"text/html; charset=utf-8"}}, true},
+		{defaults, http.Header{"Content-Type": {"TEXT/HTML"}}, true},
+		{defaults, http.Header{"Content-Type": {"text/css"}}, false},
+		{defaults, http.Header{"Content-Type": {"image/png"}}, false},
+		{defaults, http.Header{}, false},
+		{defaults, http.Header{"Content-Type": {"text/html"}, "Content-Encoding": {"gzip"}}, false},
+		{defaults, http.Header{"Content-Type": {"text/html"}, "Content-Encoding": {"identity"}}, true},
+		{custom, http.Header{"Content-Type": {"application/javascript"}}, true},
+		{custom, http.Header{"Content-Type": {"text/css"}}, true},
+		{custom, http.Header{"Content-Type": {"application/json"}}, false},
+		{nil, http.Header{"Content-Type": {"text/html"}}, false},
+	}
+	for i, tc := range tests {
+		if got := tc.rw.Applies(tc.header); got != tc.want {
+			t.Errorf("%d: Applies(%v) = %v, want %v", i, tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestNewBodyRewriterRejectsBadRules(t *testing.T) {
+	if rw, err := NewBodyRewriter(nil); rw != nil || err != nil {
+		t.Errorf("no setup: %v, %v", rw, err)
+	}
+	if rw, err := NewBodyRewriter(&BodyRewrite{}); rw != nil || err != nil {
+		t.Errorf("no rules: %v, %v", rw, err)
+	}
+
+	tooMany := make([]RewriteRule, MaxRewriteRules+1)
+	for i := range tooMany {
+		tooMany[i] = RewriteRule{Find: "x", Replace: "y"}
+	}
+	for name, cfg := range map[string]*BodyRewrite{
+		"empty pattern":  {Rules: []RewriteRule{{Find: "", Replace: "x"}}},
+		"invalid regexp": {Rules: []RewriteRule{{Find: "(unclosed", Replace: "x"}}},
+		"too many rules": {Rules: tooMany},
+	} {
+		if _, err := NewBodyRewriter(cfg); !errors.Is(err, ErrRewriteInvalid) {
+			t.Errorf("%s: got %v, want ErrRewriteInvalid", name, err)
+		}
+	}
+	if _, err := NewBodyRewriter(&BodyRewrite{Rules: tooMany[:MaxRewriteRules]}); err != nil {
+		t.Errorf("%d rules: %v", MaxRewriteRules, err)
+	}
+}
+
+func TestRewriteLeavesNonMatchingBodiesAlone(t *testing.T) {
+	rw, _ := NewBodyRewriter(&BodyRewrite{Rules: []RewriteRule{{Find: "localhost", Replace: "example"}}})
+	body := []byte(strings.Repeat("nothing to see ", 10))
+	if got := rw.Rewrite(body, "https://x"); string(got) != string(body) {
+		t.Errorf("changed a body with no matches: %q", got)
+	}
+}
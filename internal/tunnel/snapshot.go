@@ -0,0 +1,134 @@
+package tunnel
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"time"
+)
+
+// RegistrySnapshot is a point-in-time copy of the whole registry
+// Everything in it is plain data, safe to serialize or hold onto while the
+// live registry keeps changing
+type RegistrySnapshot struct {
+	TakenAt     time.Time        `json:"taken_at"`
+	TunnelCount int              `json:"tunnel_count"`
+	OwnerCount  int              `json:"owner_count"`
+	Tunnels     []TunnelSnapshot `json:"tunnels"`
+}
+
+// TunnelSnapshot is a copy of one tunnel's state
+type TunnelSnapshot struct {
+	ID           string    `json:"id"`
+	LocalPort    int       `json:"local_port"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastActivity time.Time `json:"last_activity"`
+	RemoteAddr   string    `json:"remote_addr"`
+	Capabilities []string  `json:"capabilities"`
+
+	// First 8 hex chars of sha256(token) - enough to tell owners apart
+	// without exposing the token itself
+	OwnerFingerprint string `json:"owner_fingerprint,omitempty"`
+
+	Requests int64 `json:"requests"`
+	Timeouts int64 `json:"timeouts"`
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+
+	// Connection health
+	TimeoutRate float64 `json:"timeout_rate"` // Over the recent request window
+	Unhealthy   bool    `json:"unhealthy"`    // Timeout rate is over the warning threshold
+
+	// Current adaptive concurrency cap, 0 when adaptive concurrency is off
+	ConcurrencyLimit int `json:"concurrency_limit,omitempty"`
+}
+
+// Snapshot returns a deep copy of the registry's current state
+// The read lock is held while copying, so the snapshot is consistent: every
+// tunnel in it was registered at the same instant
+func (r *Registry) Snapshot() RegistrySnapshot {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	snap := RegistrySnapshot{
+		TakenAt:     time.Now(),
+		TunnelCount: len(r.tunnels),
+		OwnerCount:  len(r.owners),
+		Tunnels:     make([]TunnelSnapshot, 0, len(r.tunnels)),
+	}
+
+	for _, t := range r.tunnels {
+		snap.Tunnels = append(snap.Tunnels, t.snapshot())
+	}
+	return snap
+}
+
+// snapshot copies a single tunnel
+func (t *Tunnel) snapshot() TunnelSnapshot {
+	ts := TunnelSnapshot{
+		ID:           t.ID,
+		LocalPort:    t.LocalPort,
+		CreatedAt:    t.CreatedAt,
+		LastActivity: t.LastActivity(),
+		RemoteAddr:   t.RemoteAddr,
+		Capabilities: append([]string(nil), t.Capabilities...),
+		Requests:     t.Stats.Requests.Load(),
+		Timeouts:     t.Stats.Timeouts.Load(),
+		BytesIn:      t.Stats.BytesIn.Load(),
+		BytesOut:     t.Stats.BytesOut.Load(),
+		TimeoutRate:  t.Timeouts.Rate(),
+		Unhealthy:    t.Timeouts.Unhealthy(),
+
+		ConcurrencyLimit: t.Concurrency.Limit(),
+	}
+	if t.Owner != "" {
+		sum := sha256.Sum256([]byte(t.Owner))
+		ts.OwnerFingerprint = hex.EncodeToString(sum[:4])
+	}
+	return ts
+}
+
+// TunnelInfo is the short description of a tunnel used for listings
+type TunnelInfo struct {
+	ID         string    `json:"id"`
+	LocalPort  int       `json:"local_port"`
+	LocalHost  string    `json:"local_host,omitempty"` // Empty = localhost
+	CreatedAt  time.Time `json:"connected_at"`
+	RemoteAddr string    `json:"remote_addr"`
+}
+
+// List returns every active tunnel, oldest first
+// Like Snapshot, it only copies plain data - never the live connection
+func (r *Registry) List() []TunnelInfo {
+	return r.list(func(*Tunnel) bool { return true })
+}
+
+// ListByOwner returns the active tunnels opened with the owner token, oldest
+// first
+func (r *Registry) ListByOwner(owner string) []TunnelInfo {
+	return r.list(func(t *Tunnel) bool { return t.Owner == owner })
+}
+
+// list copies the tunnels match accepts, oldest first
+func (r *Registry) list(match func(*Tunnel) bool) []TunnelInfo {
+	r.mu.RLock()
+	list := make([]TunnelInfo, 0, len(r.tunnels))
+	for _, t := range r.tunnels {
+		if !match(t) {
+			continue
+		}
+		list = append(list, TunnelInfo{
+			ID:         t.ID,
+			LocalPort:  t.LocalPort,
+			LocalHost:  t.LocalHost,
+			CreatedAt:  t.CreatedAt,
+			RemoteAddr: t.RemoteAddr,
+		})
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
@@ -0,0 +1,93 @@
+package tunnel
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestSnapshotIsConsistentUnderConcurrentChanges(t *testing.T) {
+	r := NewRegistry()
+
+	// Writers register, use and remove tunnels, each under its own token, so
+	// every consistent snapshot has exactly one owner per tunnel
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				tun, err := r.Register(nil, TunnelRegister{
+					AuthToken:    fmt.Sprintf("token-%d-%d", w, i),
+					Capabilities: []string{CapStreaming},
+				}, 0)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				tun.Stats.Requests.Add(1)
+				tun.Stats.BytesIn.Add(100)
+				r.RemoveTunnel(tun)
+			}
+		}()
+	}
+
+	for i := 0; i < 2000; i++ {
+		snap := r.Snapshot()
+		if snap.TunnelCount != len(snap.Tunnels) {
+			t.Fatalf("TunnelCount = %d but %d tunnels listed", snap.TunnelCount, len(snap.Tunnels))
+		}
+		if snap.OwnerCount != snap.TunnelCount {
+			t.Fatalf("%d owners for %d single-owner tunnels", snap.OwnerCount, snap.TunnelCount)
+		}
+		ids := make(map[string]bool)
+		for _, ts := range snap.Tunnels {
+			if ids[ts.ID] {
+				t.Fatalf("tunnel %s listed twice", ts.ID)
+			}
+			ids[ts.ID] = true
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestSnapshotIsADeepCopy(t *testing.T) {
+	r := NewRegistry()
+	tun, err := r.Register(nil, TunnelRegister{AuthToken: "alice", LocalPort: 8080, Capabilities: []string{CapStreaming}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun.Stats.Requests.Add(3)
+
+	snap := r.Snapshot()
+	if len(snap.Tunnels) != 1 {
+		t.Fatalf("got %d tunnels, want 1", len(snap.Tunnels))
+	}
+	ts := snap.Tunnels[0]
+	if ts.ID != tun.ID || ts.LocalPort != 8080 || ts.Requests != 3 {
+		t.Errorf("got %+v", ts)
+	}
+	if ts.OwnerFingerprint == "" || ts.OwnerFingerprint == "alice" {
+		t.Errorf("OwnerFingerprint = %q, want a hash of the token", ts.OwnerFingerprint)
+	}
+
+	// Changing the snapshot leaves the tunnel alone, and the other way round
+	ts.Capabilities[0] = "changed"
+	tun.Stats.Requests.Add(1)
+	r.RemoveTunnel(tun)
+
+	if tun.Capabilities[0] != CapStreaming {
+		t.Errorf("editing the snapshot changed the tunnel's capabilities to %v", tun.Capabilities)
+	}
+	if snap.TunnelCount != 1 || snap.Tunnels[0].Requests != 3 {
+		t.Errorf("snapshot changed after it was taken: %+v", snap)
+	}
+}
@@ -0,0 +1,58 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+)
+
+// ChunkSize is the most body data sent in a single TypeBodyChunk message
+const ChunkSize = 32 * 1024
+
+// StreamBody sends prefix followed by everything read from r as body chunks
+// It finishes with an EOF chunk so the other side never waits forever
+// (if r fails part way, the EOF chunk carries the error)
+// send writes one encoded message to the connection, codec is how the two
+// sides agreed to encode it
+// window paces the data chunks when the peer does flow control, nil
+// otherwise (the EOF chunk needs no credit). If the receiver stops reading
+// (ErrStreamStopped) nothing more is sent, if it stalls the EOF chunk
+// carries the error.
+// Returns how many body bytes were sent
+func StreamBody(send func([]byte) error, id string, prefix []byte, r io.Reader, codec Codec, window *SendWindow) (int64, error) {
+	body := io.MultiReader(bytes.NewReader(prefix), r)
+	buf := make([]byte, ChunkSize)
+	var sent int64
+
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			if err := window.Wait(); err != nil {
+				if err == ErrStreamStalled {
+					sendChunk(send, BodyChunk{ID: id, EOF: true, Error: err.Error()}, codec)
+				}
+				return sent, err
+			}
+			if err := sendChunk(send, BodyChunk{ID: id, Data: buf[:n]}, codec); err != nil {
+				return sent, err
+			}
+			sent += int64(n)
+		}
+
+		if readErr == io.EOF {
+			return sent, sendChunk(send, BodyChunk{ID: id, EOF: true}, codec)
+		}
+		if readErr != nil {
+			sendChunk(send, BodyChunk{ID: id, EOF: true, Error: readErr.Error()}, codec)
+			return sent, readErr
+		}
+	}
+}
+
+// sendChunk writes a single body chunk message
+func sendChunk(send func([]byte) error, chunk BodyChunk, codec Codec) error {
+	msgBytes, err := codec.Encode(TypeBodyChunk, chunk)
+	if err != nil {
+		return err
+	}
+	return send(msgBytes)
+}
@@ -0,0 +1,34 @@
+package tunnel
+
+// RegistryUsage counts what the registry is holding on to right now, for
+// capacity planning
+type RegistryUsage struct {
+	Tunnels         int `json:"tunnels"`
+	PendingRequests int `json:"pending_requests"` // Forwarded requests waiting for the CLI
+	WebSockets      int `json:"websockets"`       // Open relayed WebSockets
+	IDPoolReady     int `json:"id_pool_ready"`    // Pre-generated IDs, see SetIDPool
+
+	// Messages queued in channels, delivered but not yet consumed
+	ResponseBacklog  int `json:"response_backlog"`
+	WebSocketBacklog int `json:"websocket_backlog"`
+}
+
+// Usage adds up the pending requests, WebSockets and channel backlogs of
+// every tunnel
+// Each tunnel is counted under its own locks, so the totals are close to,
+// but not exactly, one instant - fine for monitoring.
+func (r *Registry) Usage() RegistryUsage {
+	tunnels := r.All()
+
+	usage := RegistryUsage{
+		Tunnels:     len(tunnels),
+		IDPoolReady: r.IDPoolLen(),
+	}
+	for _, t := range tunnels {
+		usage.PendingRequests += t.Pending.Len()
+		usage.ResponseBacklog += t.Pending.Backlog()
+		usage.WebSockets += t.WebSockets.Len()
+		usage.WebSocketBacklog += t.WebSockets.Backlog()
+	}
+	return usage
+}
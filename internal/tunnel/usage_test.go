@@ -0,0 +1,51 @@
+package tunnel
+
+import "testing"
+
+func TestUsageMatchesTheRegistry(t *testing.T) {
+	r := NewRegistry()
+	if got := r.Usage(); got != (RegistryUsage{}) {
+		t.Errorf("empty registry reports %+v", got)
+	}
+
+	a, err := r.Register(nil, TunnelRegister{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := r.Register(nil, TunnelRegister{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Three requests waiting, one of them with a response and a chunk queued
+	first, _ := a.Pending.Add("a1")
+	a.Pending.Add("a2")
+	b.Pending.Add("b1")
+	first.Resp <- &HTTPResponse{ID: "a1"}
+	first.Chunks <- &BodyChunk{ID: "a1"}
+
+	// Two WebSockets, one with two messages from the local server queued
+	ws, _ := b.WebSockets.Add("ws1")
+	b.WebSockets.Add("ws2")
+	ws.Data <- &WSData{ID: "ws1"}
+	ws.Data <- &WSData{ID: "ws1"}
+
+	want := RegistryUsage{
+		Tunnels:          2,
+		PendingRequests:  3,
+		WebSockets:       2,
+		ResponseBacklog:  2,
+		WebSocketBacklog: 2,
+	}
+	if got := r.Usage(); got != want {
+		t.Errorf("got  %+v\nwant %+v", got, want)
+	}
+
+	// Finished requests and closed tunnels stop counting
+	a.Pending.Remove("a1")
+	r.RemoveTunnel(b)
+	want = RegistryUsage{Tunnels: 1, PendingRequests: 1}
+	if got := r.Usage(); got != want {
+		t.Errorf("after cleaning up got %+v, want %+v", got, want)
+	}
+}
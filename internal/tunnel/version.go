@@ -0,0 +1,21 @@
+package tunnel
+
+import "strings"
+
+// VersionString describes a build for `tunnelr version` and the server's
+// /health, e.g. "1.4.0 (commit 9f86d08, built 2026-03-01)"
+// commit and date are set at build time and may be empty - a plain
+// `go build` gives just "dev".
+func VersionString(version, commit, date string) string {
+	var details []string
+	if commit != "" {
+		details = append(details, "commit "+commit)
+	}
+	if date != "" {
+		details = append(details, "built "+date)
+	}
+	if len(details) == 0 {
+		return version
+	}
+	return version + " (" + strings.Join(details, ", ") + ")"
+}
@@ -0,0 +1,20 @@
+package tunnel
+
+import "testing"
+
+func TestVersionString(t *testing.T) {
+	tests := []struct {
+		version, commit, date string
+		want                  string
+	}{
+		{"1.4.0", "9f86d08", "2026-03-01", "1.4.0 (commit 9f86d08, built 2026-03-01)"},
+		{"1.4.0", "9f86d08", "", "1.4.0 (commit 9f86d08)"},
+		{"1.4.0", "", "2026-03-01", "1.4.0 (built 2026-03-01)"},
+		{"dev", "", "", "dev"},
+	}
+	for _, tc := range tests {
+		if got := VersionString(tc.version, tc.commit, tc.date); got != tc.want {
+			t.Errorf("VersionString(%q, %q, %q) = %q, want %q", tc.version, tc.commit, tc.date, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package tunnel
+
+import (
+	"sync"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket relaying - a public client's WebSocket is carried through the
+// tunnel as WSOpen/WSData/WSClose messages, and the CLI opens a matching
+// WebSocket to the local server
+
+// WSStream is a relayed WebSocket on the server side
+// Like PendingRequest, the tunnel's read loop delivers into the channels and
+// the handler relaying the WebSocket reads from them
+type WSStream struct {
+	Open  chan *WSOpen  // Receives the CLI's answer once the local WebSocket is open
+	Data  chan *WSData  // Receives messages from the local server
+	Close chan *WSClose // Receives the local side closing (or failing to open)
+	Done  chan struct{} // Closed when the handler is finished with the stream
+}
+
+// WSStreams tracks one tunnel's WebSockets by ID
+type WSStreams struct {
+	mu sync.RWMutex
+	m  map[string]*WSStream
+}
+
+// NewWSStreams creates an empty set
+func NewWSStreams() *WSStreams {
+	return &WSStreams{m: make(map[string]*WSStream)}
+}
+
+// Add starts tracking a WebSocket
+// Returns false if the ID is already in use
+func (w *WSStreams) Add(id string) (*WSStream, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, exists := w.m[id]; exists {
+		return nil, false
+	}
+
+	stream := &WSStream{
+		Open:  make(chan *WSOpen, 1),
+		Data:  make(chan *WSData, 16),
+		Close: make(chan *WSClose, 1),
+		Done:  make(chan struct{}),
+	}
+	w.m[id] = stream
+	return stream, true
+}
+
+// Get looks up a WebSocket
+func (w *WSStreams) Get(id string) (*WSStream, bool) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	stream, exists := w.m[id]
+	return stream, exists
+}
+
+// Remove stops tracking a WebSocket and signals anyone delivering to it
+func (w *WSStreams) Remove(id string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if stream, exists := w.m[id]; exists {
+		delete(w.m, id)
+		close(stream.Done)
+	}
+}
+
+// Len returns how many WebSockets are open
+func (w *WSStreams) Len() int {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return len(w.m)
+}
+
+// WSCloseFromError describes why reading from a WebSocket stopped
+// A close frame keeps its code and reason; anything else (a dropped
+// connection) becomes 1006 "abnormal closure"
+func WSCloseFromError(id string, err error) WSClose {
+	if closeErr, ok := err.(*websocket.CloseError); ok {
+		return WSClose{ID: id, Code: closeErr.Code, Reason: closeErr.Text}
+	}
+	return WSClose{ID: id, Code: websocket.CloseAbnormalClosure}
+}
+
+// CloseFrame builds the close frame that passes a WSClose on to the other end
+// Some codes only describe what happened and may not be sent (RFC 6455
+// section 7.4.1) - a dropped connection is passed on as "going away"
+func CloseFrame(c WSClose) []byte {
+	code := c.Code
+	switch code {
+	case 0, websocket.CloseNoStatusReceived:
+		return websocket.FormatCloseMessage(websocket.CloseNoStatusReceived, "")
+	case websocket.CloseAbnormalClosure, websocket.CloseTLSHandshake:
+		code = websocket.CloseGoingAway
+	}
+
+	// Control frames carry at most 125 bytes, 2 of which are the code
+	reason := c.Reason
+	for len(reason) > 123 {
+		_, size := utf8.DecodeLastRuneInString(reason)
+		reason = reason[:len(reason)-size]
+	}
+	return websocket.FormatCloseMessage(code, reason)
+}
+
+// Backlog returns how many messages from local servers are waiting to be
+// written to the public WebSockets
+func (w *WSStreams) Backlog() int {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	backlog := 0
+	for _, stream := range w.m {
+		backlog += len(stream.Open) + len(stream.Data) + len(stream.Close)
+	}
+	return backlog
+}